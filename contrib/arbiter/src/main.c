@@ -253,7 +253,7 @@ static void onhello(client_t client, int argc, xid_t *argv) {
 	CHECK(argc == 1, client, "HELLO: wrong number of arguments");
 
 	debug("[%d] HELLO\n", CLIENT_ID(client));
-	if (raft.role == ROLE_LEADER) {
+	if (!use_raft || (raft.role == ROLE_LEADER)) {
 		client_message_shortcut(client, RES_OK);
 	} else {
 		client_message_shortcut(client, RES_FAILED);
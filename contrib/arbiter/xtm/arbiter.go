@@ -0,0 +1,747 @@
+package xtm
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Arbiter is the arbiter daemon (src/main.c without raft) written in Go.
+// It answers the same commands the same way, keeps the clog in the files
+// of the C arbiter and can replace it on the same datadir, see xtmd. Unlike
+// Server, which forgets everything with the process, everything the
+// backends rely on survives a restart:
+//
+//   - the status of every finished transaction is in the clog;
+//   - the xid counter is marked in the clog before xids are given out, as
+//     set_next_gxid() does, so xids are never reused;
+//   - transactions in progress and their snapshots are checkpointed to
+//     DATADIR/arbiter.state every CheckpointInterval and on Close.
+//
+// Participants of the transactions in progress lose their connections
+// when the arbiter goes down, which counts as a vote against, so these
+// transactions are aborted on the next start. The checkpoint tells where
+// to look for them in the clog: every xid below its global xmin has been
+// finished by the time it was written.
+type Arbiter struct {
+	// How often to checkpoint, 0 only checkpoints on Close
+	CheckpointInterval time.Duration
+	// Where to report what goes on, nil to keep quiet
+	Log *log.Logger
+
+	mu         sync.Mutex
+	ckptMu     sync.Mutex
+	datadir    string
+	clog       *Clog
+	ln         net.Listener
+	addr       string
+	conns      map[*arbiterConn]bool
+	nextXid    uint32
+	prevXid    uint32
+	globalXmin uint32
+	active     map[uint32]*xact
+	recovered  []uint32
+	deadlocks  *deadlockGraph
+	stop       chan struct{}
+	wg         sync.WaitGroup
+}
+
+// Snapshots kept for every transaction, the same as MAX_SNAPSHOTS_PER_TRANS
+const maxSnapshots = 8
+
+// Replies a connection may have queued: a backend waits for the reply to
+// its command before sending another one and sockhub multiplexes at most
+// MAX_STREAMS of them, so the queue never fills up
+const maxStreams = 4096
+
+const stateFile = "arbiter.state"
+
+// Mirrors Transaction of include/transaction.h
+type xact struct {
+	xid          uint32
+	xmin         uint32
+	size         uint32
+	fixedSize    bool
+	votesFor     uint32
+	votesAgainst uint32
+	snapshots    [maxSnapshots]Snapshot
+	nsnapshots   int // wraps around maxSnapshots
+	listeners    []*session
+}
+
+type arbiterConn struct {
+	conn     net.Conn
+	out      chan Message
+	sessions map[uint32]*session
+}
+
+// Mirrors client_userdata_t: a backend identified by connection and channel
+type session struct {
+	ac            *arbiterConn
+	chan_         uint32
+	snapshotsSent int
+	xpart         *xact // the transaction it participates in
+	xwait         *xact // the transaction it waits for
+}
+
+// Checkpoint as it is written to DATADIR/arbiter.state
+type arbiterState struct {
+	NextXid      uint32      `json:"next_xid"`
+	PrevXid      uint32      `json:"prev_xid"`
+	GlobalXmin   uint32      `json:"global_xmin"`
+	Transactions []xactState `json:"transactions"`
+	Time         time.Time   `json:"time"`
+}
+
+type xactState struct {
+	Xid       uint32     `json:"xid"`
+	Xmin      uint32     `json:"xmin"`
+	Size      uint32     `json:"size"`
+	FixedSize bool       `json:"fixed_size"`
+	VotesFor  uint32     `json:"votes_for"`
+	Snapshots []Snapshot `json:"snapshots"`
+}
+
+// OpenArbiter opens the clog in datadir, with sync every clog write is
+// followed by fsync. The transactions which were in progress when the
+// previous arbiter stopped are aborted by Start.
+func OpenArbiter(datadir string, sync bool) (*Arbiter, error) {
+	clog, err := OpenClog(datadir, sync)
+	if err != nil {
+		return nil, err
+	}
+	a := &Arbiter{
+		CheckpointInterval: time.Second,
+		datadir:            datadir,
+		clog:               clog,
+		conns:              make(map[*arbiterConn]bool),
+		active:             make(map[uint32]*xact),
+		deadlocks:          newDeadlockGraph(),
+	}
+	return a, nil
+}
+
+func (a *Arbiter) logf(format string, args ...interface{}) {
+	if a.Log != nil {
+		a.Log.Printf(format, args...)
+	}
+}
+
+func (a *Arbiter) recover() error {
+	last, err := a.clog.LastUsed()
+	if err != nil {
+		return err
+	}
+	next := last + 1
+
+	// Without a checkpoint, as in a datadir of the C arbiter, the
+	// transactions in doubt are looked for in the last file
+	from := last - last%commitsPerFile
+	state, err := a.readState()
+	if err != nil {
+		return err
+	}
+	if state != nil {
+		from = state.GlobalXmin
+		if state.NextXid > next {
+			next = state.NextXid
+		}
+		for _, t := range state.Transactions {
+			a.logf("xid %d was in progress with %d of %d votes for commit", t.Xid, t.VotesFor, t.Size)
+		}
+	}
+	if from < MinXid {
+		from = MinXid
+	}
+
+	err = a.clog.Scan(from, next, ClogDoubt, func(xid uint32) error {
+		a.recovered = append(a.recovered, xid)
+		return a.clog.Write(xid, ClogNegative)
+	})
+	if err != nil {
+		return err
+	}
+	if len(a.recovered) > 0 {
+		a.logf("aborted %d transactions left in progress", len(a.recovered))
+	}
+
+	if err := a.clog.Write(next, ClogNegative); err != nil {
+		return err
+	}
+	a.nextXid = next
+	a.prevXid = next - 1
+	a.logf("will use %d", next)
+	return a.Checkpoint()
+}
+
+// Recovered returns the xids aborted when the arbiter was started
+func (a *Arbiter) Recovered() []uint32 {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return append([]uint32(nil), a.recovered...)
+}
+
+func (a *Arbiter) readState() (*arbiterState, error) {
+	data, err := ioutil.ReadFile(filepath.Join(a.datadir, stateFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var state arbiterState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("xtm: %s is corrupted: %v", stateFile, err)
+	}
+	return &state, nil
+}
+
+// Called with a.mu held or before the arbiter is started
+func (a *Arbiter) state() ([]byte, error) {
+	state := arbiterState{
+		NextXid:    a.nextXid,
+		PrevXid:    a.prevXid,
+		GlobalXmin: a.oldestXmin(),
+		Time:       time.Now(),
+	}
+	for _, t := range a.sorted() {
+		ts := xactState{Xid: t.xid, Xmin: t.xmin, Size: t.size, FixedSize: t.fixedSize, VotesFor: t.votesFor}
+		for i := 0; i < t.nsnapshots && i < maxSnapshots; i++ {
+			ts.Snapshots = append(ts.Snapshots, t.snapshots[i])
+		}
+		state.Transactions = append(state.Transactions, ts)
+	}
+	return json.MarshalIndent(state, "", "  ")
+}
+
+// The old checkpoint stays until the new one is complete
+func (a *Arbiter) writeState(data []byte) error {
+	a.ckptMu.Lock()
+	defer a.ckptMu.Unlock()
+	path := filepath.Join(a.datadir, stateFile)
+	f, err := os.Create(path + ".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// Checkpoint writes the transactions in progress and their snapshots, the
+// arbiter goes on serving while the file is written
+func (a *Arbiter) Checkpoint() error {
+	a.mu.Lock()
+	data, err := a.state()
+	a.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return a.writeState(data)
+}
+
+func (a *Arbiter) checkpointer(stop chan struct{}) {
+	defer a.wg.Done()
+	if a.CheckpointInterval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(a.CheckpointInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if err := a.Checkpoint(); err != nil {
+				a.logf("checkpoint failed: %v", err)
+			}
+		}
+	}
+}
+
+// Listen on addr ("127.0.0.1:0" picks a free port) and serve in background.
+// The first start recovers what the previous arbiter has left.
+func (a *Arbiter) Start(addr string) error {
+	if a.nextXid == 0 {
+		if err := a.recover(); err != nil {
+			return err
+		}
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	a.mu.Lock()
+	a.ln = ln
+	a.addr = ln.Addr().String()
+	a.stop = make(chan struct{})
+	stop := a.stop
+	a.mu.Unlock()
+	a.logf("listening on %s", a.addr)
+
+	a.wg.Add(2)
+	go a.accept(ln)
+	go a.checkpointer(stop)
+	return nil
+}
+
+func (a *Arbiter) Addr() string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.addr
+}
+
+// Close stops serving, which aborts the transactions in progress as their
+// participants disconnect, checkpoints and closes the clog
+func (a *Arbiter) Close() error {
+	a.mu.Lock()
+	ln := a.ln
+	a.ln = nil
+	if a.stop != nil {
+		close(a.stop)
+		a.stop = nil
+	}
+	conns := make([]*arbiterConn, 0, len(a.conns))
+	for ac := range a.conns {
+		conns = append(conns, ac)
+	}
+	a.mu.Unlock()
+
+	if ln != nil {
+		ln.Close()
+	}
+	for _, ac := range conns {
+		ac.conn.Close()
+	}
+	a.wg.Wait()
+
+	var err error
+	if a.nextXid != 0 {
+		err = a.Checkpoint()
+	}
+	if cerr := a.clog.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func (a *Arbiter) accept(ln net.Listener) {
+	defer a.wg.Done()
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		ac := &arbiterConn{
+			conn:     conn,
+			out:      make(chan Message, maxStreams),
+			sessions: make(map[uint32]*session),
+		}
+		a.mu.Lock()
+		a.conns[ac] = true
+		a.mu.Unlock()
+
+		a.wg.Add(2)
+		go a.serve(ac)
+		go a.write(ac)
+	}
+}
+
+func (a *Arbiter) write(ac *arbiterConn) {
+	defer a.wg.Done()
+	for m := range ac.out {
+		if err := WriteMessage(ac.conn, m); err != nil {
+			// the reader notices the connection is gone
+			ac.conn.Close()
+		}
+	}
+}
+
+func (a *Arbiter) serve(ac *arbiterConn) {
+	defer a.wg.Done()
+	defer func() {
+		ac.conn.Close()
+		a.mu.Lock()
+		for _, s := range ac.sessions {
+			a.ondisconnect(s)
+		}
+		delete(a.conns, ac)
+		// replies are only queued with a.mu held
+		close(ac.out)
+		a.mu.Unlock()
+	}()
+
+	for {
+		msg, err := ReadMessage(ac.conn)
+		if err != nil {
+			return
+		}
+
+		a.mu.Lock()
+		s := ac.sessions[msg.Chan]
+		if s == nil {
+			s = &session{ac: ac, chan_: msg.Chan}
+			ac.sessions[msg.Chan] = s
+		}
+		if msg.Code == MsgDisconnect {
+			a.ondisconnect(s)
+			delete(ac.sessions, msg.Chan)
+		} else if reply := a.oncmd(s, msg.Body); reply != nil {
+			s.reply(reply...)
+		}
+		a.mu.Unlock()
+	}
+}
+
+// Called with a.mu held
+func (s *session) reply(body ...uint32) {
+	s.ac.out <- Message{Code: MsgReply, Chan: s.chan_, Body: body}
+}
+
+// A disconnected participant votes against, the same as in ondisconnect()
+func (a *Arbiter) ondisconnect(s *session) {
+	if t := s.xwait; t != nil {
+		t.removeListener(s)
+		s.xwait = nil
+	}
+	if t := s.xpart; t != nil {
+		s.xpart = nil
+		if a.active[t.xid] == t {
+			a.finish(t, ClogNegative)
+		}
+	}
+}
+
+func (t *xact) removeListener(s *session) {
+	for i, l := range t.listeners {
+		if l == s {
+			t.listeners = append(t.listeners[:i], t.listeners[i+1:]...)
+			return
+		}
+	}
+}
+
+func failed(format string, args ...interface{}) error {
+	return fmt.Errorf(format, args...)
+}
+
+// Returns the reply to send now, nil if the reply is postponed.
+// Called with a.mu held.
+func (a *Arbiter) oncmd(s *session, argv []uint32) []uint32 {
+	if len(argv) == 0 {
+		a.logf("[%d] EMPTY: empty command?", s.chan_)
+		return []uint32{ResFailed}
+	}
+	var reply []uint32
+	var err error
+	switch argv[0] {
+	case CmdHello:
+		if len(argv) != 1 {
+			err = failed("HELLO: wrong number of arguments")
+		}
+		reply = []uint32{ResOk}
+	case CmdReserve:
+		reply, err = a.onreserve(argv)
+	case CmdBegin:
+		reply, err = a.onbegin(s, argv)
+	case CmdFor:
+		reply, err = a.onvote(s, argv, true)
+	case CmdAgainst:
+		reply, err = a.onvote(s, argv, false)
+	case CmdSnapshot:
+		reply, err = a.onsnapshot(s, argv)
+	case CmdStatus:
+		reply, err = a.onstatus(s, argv)
+	case CmdDeadlock:
+		reply, err = a.ondeadlock(s, argv)
+	default:
+		err = failed("NOISE: unknown command '%c' (%d)", rune(argv[0]), argv[0])
+	}
+	if err != nil {
+		a.logf("[%d] %v, returning RES_FAILED", s.chan_, err)
+		return []uint32{ResFailed}
+	}
+	return reply
+}
+
+// Move the xid counter marking the new position in the clog first, so
+// that a restart continues after it
+func (a *Arbiter) useXid(xid uint32) error {
+	if err := a.clog.Write(xid+1, ClogNegative); err != nil {
+		return err
+	}
+	if err := a.clog.Write(a.nextXid, ClogBlank); err != nil {
+		return err
+	}
+	a.nextXid = xid + 1
+	return nil
+}
+
+func (a *Arbiter) onreserve(argv []uint32) ([]uint32, error) {
+	if len(argv) != 3 {
+		return nil, failed("RESERVE: wrong number of arguments")
+	}
+	minxid, minsize := argv[1], argv[2]
+	maxxid := minxid + minsize - 1
+	if a.prevXid >= minxid || maxxid >= a.nextXid {
+		minxid = maxXid(minxid, a.nextXid)
+		maxxid = maxXid(maxxid, minxid+minsize-1)
+		if err := a.useXid(maxxid); err != nil {
+			return nil, failed("RESERVE: %v", err)
+		}
+	}
+	return []uint32{ResOk, minxid, maxxid}, nil
+}
+
+// A transaction finished by the votes of others leaves its participants
+// free, unlike CLIENT_XPART() of the C arbiter which keeps pointing at it
+func (a *Arbiter) participating(s *session) bool {
+	return s.xpart != nil && a.active[s.xpart.xid] == s.xpart
+}
+
+func (a *Arbiter) onbegin(s *session, argv []uint32) ([]uint32, error) {
+	if len(argv) != 1 && len(argv) != 2 {
+		return nil, failed("BEGIN: wrong number of arguments")
+	}
+	if a.participating(s) {
+		return nil, failed("BEGIN: already participating in another transaction")
+	}
+
+	t := &xact{xid: a.nextXid, size: 1}
+	if len(argv) == 2 {
+		t.size = argv[1]
+		t.fixedSize = true
+	}
+	if err := a.useXid(t.xid); err != nil {
+		return nil, failed("BEGIN: %v", err)
+	}
+	if err := a.clog.Write(t.xid, ClogDoubt); err != nil {
+		return nil, failed("BEGIN: transaction %d failed to initialize clog bits: %v", t.xid, err)
+	}
+	a.prevXid = t.xid
+	a.active[t.xid] = t
+	s.snapshotsSent = 0
+	s.xpart = t
+
+	snap := t.nextSnapshot()
+	*snap = a.snapshot()
+	t.xmin = snap.Xmin
+	if a.globalXmin == 0 {
+		a.globalXmin = snap.Xmin
+	}
+	snap.Gxmin = a.globalXmin
+	return append([]uint32{ResOk, t.xid}, snap.encode()...), nil
+}
+
+func (t *xact) nextSnapshot() *Snapshot {
+	snap := &t.snapshots[t.nsnapshots%maxSnapshots]
+	t.nsnapshots++
+	return snap
+}
+
+// Active transactions in the order of xids
+func (a *Arbiter) sorted() []*xact {
+	xacts := make([]*xact, 0, len(a.active))
+	for _, t := range a.active {
+		xacts = append(xacts, t)
+	}
+	sort.Slice(xacts, func(i, j int) bool { return xacts[i].xid < xacts[j].xid })
+	return xacts
+}
+
+// The same as gen_snapshot(): xmin is the oldest active xid and xmax the
+// first of the run of consecutive xids at the end, the active ones between
+// them are listed
+func (a *Arbiter) snapshot() Snapshot {
+	var active []uint32
+	for _, t := range a.sorted() {
+		active = append(active, t.xid)
+	}
+	n := len(active)
+	for n > 1 && active[n-2]+1 == active[n-1] {
+		n--
+	}
+	if n == 0 {
+		return Snapshot{}
+	}
+	return Snapshot{Xmin: active[0], Xmax: active[n-1], Xip: active[:n-1]}
+}
+
+// The smallest xmin of the snapshots in use, the same as get_global_xmin()
+func (a *Arbiter) oldestXmin() uint32 {
+	xmin := a.nextXid
+	for _, t := range a.active {
+		if t.xmin < xmin {
+			xmin = t.xmin
+		}
+	}
+	return xmin
+}
+
+func (a *Arbiter) onsnapshot(s *session, argv []uint32) ([]uint32, error) {
+	if len(argv) != 2 {
+		return nil, failed("SNAPSHOT: wrong number of arguments")
+	}
+	var snap Snapshot
+	t := a.active[argv[1]]
+	if t == nil {
+		a.logf("[%d] SNAPSHOT: xid=%d not found: use current snapshot", s.chan_, argv[1])
+		snap = a.snapshot()
+	} else {
+		if !a.participating(s) {
+			s.snapshotsSent = 0
+			s.xpart = t
+			if !t.fixedSize {
+				t.size++
+			}
+		}
+		if s.xpart != t {
+			return nil, failed("SNAPSHOT: getting snapshot for a transaction not participated in")
+		}
+		if s.snapshotsSent == t.nsnapshots {
+			// a fresh snapshot is needed
+			*t.nextSnapshot() = a.snapshot()
+		}
+		snap = t.snapshots[s.snapshotsSent%maxSnapshots]
+		s.snapshotsSent++
+	}
+	snap.Gxmin = a.globalXmin
+	return append([]uint32{ResOk}, snap.encode()...), nil
+}
+
+func (a *Arbiter) onvote(s *session, argv []uint32, commit bool) ([]uint32, error) {
+	if len(argv) != 3 {
+		return nil, failed("VOTE: wrong number of arguments")
+	}
+	xid, wait := argv[1], argv[2] != 0
+	if s.xpart == nil || s.xpart.xid != xid {
+		return nil, failed("VOTE: voting for a transaction not participated in")
+	}
+	t := a.active[xid]
+	if t == nil {
+		return nil, failed("VOTE: xid=%d not found", xid)
+	}
+	if commit {
+		t.votesFor++
+	} else {
+		t.votesAgainst++
+	}
+	// not participating any more
+	s.xpart = nil
+
+	// aborted at once, without waiting for the rest of votes
+	switch {
+	case t.votesAgainst > 0:
+		a.finish(t, ClogNegative)
+		return []uint32{ResTransactionAborted}, nil
+	case t.votesFor >= t.size:
+		a.finish(t, ClogPositive)
+		return []uint32{ResTransactionCommitted}, nil
+	case wait:
+		a.listen(s, t)
+		return nil, nil
+	}
+	return []uint32{ResTransactionInProgress}, nil
+}
+
+func (a *Arbiter) onstatus(s *session, argv []uint32) ([]uint32, error) {
+	if len(argv) != 3 {
+		return nil, failed("STATUS: wrong number of arguments %d, expected 3", len(argv))
+	}
+	xid, wait := argv[1], argv[2] != 0
+	status, err := a.clog.Read(xid)
+	if err != nil {
+		return nil, failed("STATUS: %v", err)
+	}
+	switch status {
+	case ClogBlank:
+		return []uint32{ResTransactionUnknown}, nil
+	case ClogPositive:
+		return []uint32{ResTransactionCommitted}, nil
+	case ClogNegative:
+		return []uint32{ResTransactionAborted}, nil
+	}
+	if !wait {
+		return []uint32{ResTransactionInProgress}, nil
+	}
+	t := a.active[xid]
+	if t == nil {
+		return nil, failed("STATUS: xid=%d not found", xid)
+	}
+	a.listen(s, t)
+	return nil, nil
+}
+
+func (a *Arbiter) listen(s *session, t *xact) {
+	s.xwait = t
+	t.listeners = append(t.listeners, s)
+}
+
+// Write the outcome to the clog and answer everybody who waits for it,
+// the same as apply_clog_update()
+func (a *Arbiter) finish(t *xact, status int) {
+	if err := a.clog.Write(t.xid, status); err != nil {
+		a.logf("APPLY: failed to write to clog, xid=%d: %v", t.xid, err)
+	}
+	reply := uint32(ResTransactionAborted)
+	if status == ClogPositive {
+		reply = ResTransactionCommitted
+	}
+	for _, l := range t.listeners {
+		l.xwait = nil
+		l.reply(reply)
+	}
+	t.listeners = nil
+	delete(a.active, t.xid)
+	if t.xmin == a.globalXmin {
+		a.globalXmin = a.oldestXmin()
+	}
+}
+
+// [port, root, src, dst, dst..., 0, src, ...]: the backend listening on
+// port replaces its part of the graph of locks and asks whether root is
+// in a cycle
+func (a *Arbiter) ondeadlock(s *session, argv []uint32) ([]uint32, error) {
+	if len(argv) < 4 {
+		return nil, failed("DEADLOCK: wrong number of arguments %d, expected > 4", len(argv))
+	}
+	host, _, _ := net.SplitHostPort(s.ac.conn.RemoteAddr().String())
+	node := fmt.Sprintf("%s:%d", host, argv[1])
+	a.deadlocks.replace(node, argv[3:])
+	if a.deadlocks.cycle(argv[2]) {
+		return []uint32{ResDeadlock}, nil
+	}
+	return []uint32{ResOk}, nil
+}
+
+// Status of the transaction as it is known to the arbiter
+func (a *Arbiter) TransactionStatus(xid uint32) uint32 {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.active[xid] != nil {
+		return ResTransactionInProgress
+	}
+	switch status, _ := a.clog.Read(xid); status {
+	case ClogPositive:
+		return ResTransactionCommitted
+	case ClogNegative:
+		return ResTransactionAborted
+	}
+	return ResTransactionUnknown
+}
@@ -0,0 +1,181 @@
+package xtm
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func startArbiter(t *testing.T, datadir string) *Arbiter {
+	a, err := OpenArbiter(datadir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// checkpoints are only taken on start and close, so that a copy of
+	// the datadir in between is consistent
+	a.CheckpointInterval = 0
+	if err := a.Start("127.0.0.1:0"); err != nil {
+		a.Close()
+		t.Fatal(err)
+	}
+	return a
+}
+
+func dialArbiter(t *testing.T, a *Arbiter) *Client {
+	c, err := Dial(a.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// The files of a running arbiter, as a crash would leave them
+func copyDatadir(t *testing.T, from string) string {
+	to := tempDir(t)
+	files, err := ioutil.ReadDir(from)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, info := range files {
+		src, err := os.Open(filepath.Join(from, info.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		dst, err := os.Create(filepath.Join(to, info.Name()))
+		if err == nil {
+			_, err = io.Copy(dst, src)
+			if cerr := dst.Close(); err == nil {
+				err = cerr
+			}
+		}
+		src.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return to
+}
+
+func expectStatuses(t *testing.T, c *Client, statuses map[uint32]uint32) {
+	for xid, expected := range statuses {
+		status, err := c.Status(xid, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status != expected {
+			t.Errorf("transaction %d is %d after restart instead of %d", xid, status, expected)
+		}
+	}
+}
+
+func expectNewXid(t *testing.T, c *Client, last uint32) {
+	next, _, err := c.Begin(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next <= last {
+		t.Errorf("xid %d given out again after restart, the last one was %d", next, last)
+	}
+}
+
+func TestArbiterRestart(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	a := startArbiter(t, dir)
+
+	c := dialArbiter(t, a)
+	committed, _, err := c.Begin(1)
+	if err == nil {
+		_, err = c.Vote(committed, true, false)
+	}
+	if err != nil {
+		a.Close()
+		t.Fatal(err)
+	}
+	// one vote of two is in, the other one never comes
+	c1, c2 := dialArbiter(t, a), dialArbiter(t, a)
+	xid, _, err := c1.Begin(2)
+	if err == nil {
+		_, err = c2.Snapshot(xid)
+	}
+	if err == nil {
+		_, err = c1.Vote(xid, true, false)
+	}
+	var last uint32
+	if err == nil {
+		last, _, err = c.Begin(1)
+	}
+	if err != nil {
+		a.Close()
+		t.Fatal(err)
+	}
+	crash := copyDatadir(t, dir)
+	defer os.RemoveAll(crash)
+
+	c.Close()
+	c1.Close()
+	c2.Close()
+	if err := a.Close(); err != nil {
+		t.Fatal(err)
+	}
+	expected := map[uint32]uint32{
+		committed: ResTransactionCommitted,
+		xid:       ResTransactionAborted,
+		last:      ResTransactionAborted,
+	}
+
+	t.Run("close", func(t *testing.T) {
+		a := startArbiter(t, dir)
+		defer a.Close()
+		c := dialArbiter(t, a)
+		defer c.Close()
+		expectStatuses(t, c, expected)
+		expectNewXid(t, c, last)
+	})
+
+	t.Run("crash", func(t *testing.T) {
+		a := startArbiter(t, crash)
+		defer a.Close()
+		if recovered := a.Recovered(); !reflect.DeepEqual(recovered, []uint32{xid, last}) {
+			t.Errorf("recovered %v instead of %v", recovered, []uint32{xid, last})
+		}
+		c := dialArbiter(t, a)
+		defer c.Close()
+		expectStatuses(t, c, expected)
+		expectNewXid(t, c, last)
+	})
+}
+
+// A datadir of the C arbiter has the clog files and no arbiter.state
+func TestArbiterOpensCDatadir(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	page := make([]byte, 4096)
+	for xid, status := range map[uint32]int{
+		100: ClogPositive,
+		101: ClogDoubt,
+		102: ClogNegative, // next xid marked by the C arbiter before giving out 101
+	} {
+		page[xid/commitsPerByte] |= byte(status) << (bitsPerCommit * (xid % commitsPerByte))
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, clogFileName(0)), page, 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	a := startArbiter(t, dir)
+	defer a.Close()
+	if recovered := a.Recovered(); !reflect.DeepEqual(recovered, []uint32{101}) {
+		t.Errorf("recovered %v instead of [101]", recovered)
+	}
+	c := dialArbiter(t, a)
+	defer c.Close()
+	expectStatuses(t, c, map[uint32]uint32{
+		100: ResTransactionCommitted,
+		101: ResTransactionAborted,
+		102: ResTransactionAborted,
+	})
+	expectNewXid(t, c, 102)
+}
@@ -0,0 +1,154 @@
+package xtm
+
+import (
+	"fmt"
+	"net"
+	"sync"
+)
+
+// Client talks to the arbiter the same way libarbiter does: one command at
+// a time, waiting for the reply. Several clients may share a connection
+// using different channels, see NewClient.
+type Client struct {
+	mu   sync.Mutex
+	conn net.Conn
+	Chan uint32
+}
+
+func Dial(addr string) (*Client, error) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return NewClient(conn, 0), nil
+}
+
+func NewClient(conn net.Conn, channel uint32) *Client {
+	return &Client{conn: conn, Chan: channel}
+}
+
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
+
+// Call sends raw command and returns raw reply, it is up to the caller to
+// make sense of it
+func (c *Client) Call(cmd uint32, argv ...uint32) ([]uint32, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	body := append([]uint32{cmd}, argv...)
+	if err := WriteMessage(c.conn, Message{Code: MsgCommand, Chan: c.Chan, Body: body}); err != nil {
+		return nil, err
+	}
+	reply, err := ReadMessage(c.conn)
+	if err != nil {
+		return nil, err
+	}
+	if reply.Chan != c.Chan {
+		return nil, fmt.Errorf("xtm: reply for channel %d received on channel %d", reply.Chan, c.Chan)
+	}
+	if len(reply.Body) == 0 {
+		return nil, fmt.Errorf("xtm: empty reply to '%c'", rune(cmd))
+	}
+	return reply.Body, nil
+}
+
+func expectOk(cmd byte, reply []uint32, minLen int) error {
+	if reply[0] != ResOk {
+		return fmt.Errorf("xtm: '%c' failed: %#x", cmd, reply[0])
+	}
+	if len(reply) < minLen {
+		return fmt.Errorf("xtm: reply to '%c' is too short: %v", cmd, reply)
+	}
+	return nil
+}
+
+func (c *Client) Hello() error {
+	reply, err := c.Call(CmdHello)
+	if err != nil {
+		return err
+	}
+	return expectOk(CmdHello, reply, 1)
+}
+
+// Reserve claims at least size xids starting from minxid for local usage
+func (c *Client) Reserve(minxid uint32, size uint32) (first, last uint32, err error) {
+	reply, err := c.Call(CmdReserve, minxid, size)
+	if err != nil {
+		return 0, 0, err
+	}
+	if err = expectOk(CmdReserve, reply, 3); err != nil {
+		return 0, 0, err
+	}
+	return reply[1], reply[2], nil
+}
+
+// Begin starts a global transaction. With size 0 the number of
+// participants is counted as they ask for snapshots.
+func (c *Client) Begin(size uint32) (uint32, Snapshot, error) {
+	var reply []uint32
+	var err error
+	if size > 0 {
+		reply, err = c.Call(CmdBegin, size)
+	} else {
+		reply, err = c.Call(CmdBegin)
+	}
+	if err != nil {
+		return 0, Snapshot{}, err
+	}
+	if err = expectOk(CmdBegin, reply, 5); err != nil {
+		return 0, Snapshot{}, err
+	}
+	snapshot, err := decodeSnapshot(reply[2:])
+	return reply[1], snapshot, err
+}
+
+// Snapshot joins the transaction if not joined yet and returns its snapshot
+func (c *Client) Snapshot(xid uint32) (Snapshot, error) {
+	reply, err := c.Call(CmdSnapshot, xid)
+	if err != nil {
+		return Snapshot{}, err
+	}
+	if err = expectOk(CmdSnapshot, reply, 4); err != nil {
+		return Snapshot{}, err
+	}
+	return decodeSnapshot(reply[1:])
+}
+
+func bool2xid(b bool) uint32 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func status(cmd byte, reply []uint32) (uint32, error) {
+	if len(reply) != 1 || reply[0] == ResFailed {
+		return 0, fmt.Errorf("xtm: '%c' failed: %v", cmd, reply)
+	}
+	return reply[0], nil
+}
+
+// Vote for or against commit of the transaction, returns one of
+// ResTransaction* statuses
+func (c *Client) Vote(xid uint32, commit bool, wait bool) (uint32, error) {
+	cmd := byte(CmdAgainst)
+	if commit {
+		cmd = CmdFor
+	}
+	reply, err := c.Call(uint32(cmd), xid, bool2xid(wait))
+	if err != nil {
+		return 0, err
+	}
+	return status(cmd, reply)
+}
+
+// Status returns one of ResTransaction* statuses
+func (c *Client) Status(xid uint32, wait bool) (uint32, error) {
+	reply, err := c.Call(CmdStatus, xid, bool2xid(wait))
+	if err != nil {
+		return 0, err
+	}
+	return status(CmdStatus, reply)
+}
@@ -0,0 +1,260 @@
+package xtm
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// Statuses kept in the clog, keep in sync with include/clog.h
+const (
+	ClogBlank    = 0
+	ClogPositive = 1
+	ClogNegative = 2
+	ClogDoubt    = 3
+)
+
+// The smallest xid which the arbiter uses, the same as MIN_XID
+const MinXid = 42
+
+// Layout of clog files, keep in sync with include/clogfile.h
+const (
+	bitsPerCommit  = 2
+	commitMask     = 1<<bitsPerCommit - 1
+	commitsPerByte = 4
+	commitsPerFile = 0x10000000
+	bytesPerFile   = commitsPerFile / commitsPerByte
+)
+
+// Clog is the commit log of the arbiter stored in the same files as
+// src/clog.c stores it: DATADIR/%016x.dat, each holding two bits for
+// every one of 2^28 xids. A datadir of the C arbiter can be opened by the
+// Go one and the other way round.
+type Clog struct {
+	mu      sync.Mutex
+	datadir string
+	files   map[uint32]*os.File
+	// fsync after every write, the same as building the C arbiter with SYNC
+	sync bool
+}
+
+func clogFileName(fileid uint32) string {
+	return fmt.Sprintf("%016x.dat", fileid)
+}
+
+// OpenClog opens the clog in datadir, creating the directory and the first
+// file on the first launch
+func OpenClog(datadir string, sync bool) (*Clog, error) {
+	if err := os.MkdirAll(datadir, 0700); err != nil {
+		return nil, err
+	}
+	c := &Clog{datadir: datadir, files: make(map[uint32]*os.File), sync: sync}
+	ids, err := c.fileids()
+	if err != nil {
+		return nil, err
+	}
+	if len(ids) == 0 {
+		ids = []uint32{0}
+	}
+	for _, id := range ids {
+		if _, err := c.file(id, true); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// Ids of the files in datadir in ascending order
+func (c *Clog) fileids() ([]uint32, error) {
+	entries, err := ioutil.ReadDir(c.datadir)
+	if err != nil {
+		return nil, err
+	}
+	var ids []uint32
+	for _, e := range entries {
+		var id uint32
+		if len(e.Name()) != 20 {
+			continue
+		}
+		if _, err := fmt.Sscanf(e.Name(), "%016x.dat", &id); err != nil {
+			continue
+		}
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids, nil
+}
+
+// The file with the given id, nil if there is none and create is false.
+// Called with c.mu held or before the clog is shared.
+func (c *Clog) file(fileid uint32, create bool) (*os.File, error) {
+	if f := c.files[fileid]; f != nil {
+		return f, nil
+	}
+	path := filepath.Join(c.datadir, clogFileName(fileid))
+	flags := os.O_RDWR
+	if create {
+		flags |= os.O_CREATE
+	}
+	f, err := os.OpenFile(path, flags, 0660)
+	if os.IsNotExist(err) && !create {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	// sparse, as falloc() leaves it
+	if err := f.Truncate(bytesPerFile); err != nil {
+		f.Close()
+		return nil, err
+	}
+	c.files[fileid] = f
+	return f, nil
+}
+
+// Read returns the status of xid, ClogBlank for xids never written.
+// A failure to read leaves the caller without an answer, so it is returned.
+func (c *Clog) Read(xid uint32) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	f, err := c.file(xid/commitsPerFile, false)
+	if f == nil || err != nil {
+		return ClogBlank, err
+	}
+	var b [1]byte
+	if _, err := f.ReadAt(b[:], int64(xid%commitsPerFile/commitsPerByte)); err != nil {
+		return ClogBlank, err
+	}
+	return int(b[0]>>(bitsPerCommit*(xid%commitsPerByte))) & commitMask, nil
+}
+
+// Write sets the status of xid, creating the file it belongs to if needed
+func (c *Clog) Write(xid uint32, status int) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	f, err := c.file(xid/commitsPerFile, true)
+	if err != nil {
+		return err
+	}
+	offset := int64(xid % commitsPerFile / commitsPerByte)
+	shift := bitsPerCommit * (xid % commitsPerByte)
+	var b [1]byte
+	if _, err := f.ReadAt(b[:], offset); err != nil {
+		return err
+	}
+	b[0] = b[0]&^(commitMask<<shift) | byte(status)<<shift
+	if _, err := f.WriteAt(b[:], offset); err != nil {
+		return err
+	}
+	if c.sync {
+		return f.Sync()
+	}
+	return nil
+}
+
+// LastUsed returns the greatest xid of the last file whose status is not
+// blank, MinXid if there is none, the same as clog_find_last_used()
+func (c *Clog) LastUsed() (uint32, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var last uint32
+	for id := range c.files {
+		if id >= last {
+			last = id
+		}
+	}
+	f := c.files[last]
+
+	buf := make([]byte, 1<<20)
+	for end := int64(bytesPerFile); end > 0; end -= int64(len(buf)) {
+		start := end - int64(len(buf))
+		if _, err := f.ReadAt(buf, start); err != nil && err != io.EOF {
+			return 0, err
+		}
+		for i := len(buf) - 1; i >= 0; i-- {
+			if buf[i] == 0 {
+				continue
+			}
+			sub := uint32(commitsPerByte - 1)
+			for buf[i]>>(bitsPerCommit*sub)&commitMask == 0 {
+				sub--
+			}
+			xid := last*commitsPerFile + uint32(start+int64(i))*commitsPerByte + sub
+			if xid < MinXid {
+				return MinXid, nil
+			}
+			return xid, nil
+		}
+	}
+	return MinXid, nil
+}
+
+// Scan calls fn for every xid in [from, till) which has the given status,
+// reading the files in chunks rather than an xid at a time
+func (c *Clog) Scan(from, till uint32, status int, fn func(xid uint32) error) error {
+	buf := make([]byte, 1<<20)
+	for xid := from; xid < till; {
+		c.mu.Lock()
+		f, err := c.file(xid/commitsPerFile, false)
+		c.mu.Unlock()
+		if err != nil {
+			return err
+		}
+		// the rest of the file or of the range, whichever ends first
+		end := (xid/commitsPerFile + 1) * commitsPerFile
+		if end == 0 || end > till {
+			end = till
+		}
+		if f == nil {
+			xid = end
+			continue
+		}
+		offset := int64(xid % commitsPerFile / commitsPerByte)
+		n := int((end-1)%commitsPerFile/commitsPerByte - uint32(offset) + 1)
+		if n > len(buf) {
+			n = len(buf)
+		}
+		if _, err := f.ReadAt(buf[:n], offset); err != nil && err != io.EOF {
+			return err
+		}
+		first := xid - xid%commitsPerByte
+		for i := 0; i < n; i++ {
+			for sub := uint32(0); sub < commitsPerByte; sub++ {
+				x := first + uint32(i)*commitsPerByte + sub
+				if x < xid || x >= end {
+					continue
+				}
+				if int(buf[i]>>(bitsPerCommit*sub))&commitMask == status {
+					if err := fn(x); err != nil {
+						return err
+					}
+				}
+			}
+		}
+		next := first + uint32(n)*commitsPerByte
+		if next <= xid || next > end {
+			next = end
+		}
+		xid = next
+	}
+	return nil
+}
+
+// Close closes all files, the clog should not be used after that
+func (c *Clog) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var first error
+	for id, f := range c.files {
+		if err := f.Close(); err != nil && first == nil {
+			first = err
+		}
+		delete(c.files, id)
+	}
+	return first
+}
@@ -0,0 +1,128 @@
+package xtm
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "clog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func openClog(t *testing.T, dir string) *Clog {
+	c, err := OpenClog(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func writeClog(t *testing.T, c *Clog, statuses map[uint32]int) {
+	for xid, status := range statuses {
+		if err := c.Write(xid, status); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestClogReadWrite(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	// the xids of one byte, and of the second file
+	written := map[uint32]int{
+		MinXid:               ClogPositive,
+		MinXid + 1:           ClogNegative,
+		MinXid + 2:           ClogDoubt,
+		MinXid + 3:           ClogPositive,
+		commitsPerFile + 5:   ClogDoubt,
+		2*commitsPerFile - 1: ClogNegative,
+	}
+	c := openClog(t, dir)
+	writeClog(t, c, written)
+	// overwriting one leaves its neighbours alone
+	written[MinXid+1] = ClogPositive
+	writeClog(t, c, map[uint32]int{MinXid + 1: ClogPositive})
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, clogFileName(1))); err != nil {
+		t.Fatal(err)
+	}
+
+	c = openClog(t, dir)
+	defer c.Close()
+	for _, xid := range []uint32{MinXid - 1, MinXid, MinXid + 1, MinXid + 2, MinXid + 3, MinXid + 4,
+		commitsPerFile, commitsPerFile + 5, 2*commitsPerFile - 1, 5 * commitsPerFile} {
+		status, err := c.Read(xid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status != written[xid] {
+			t.Errorf("xid %d is %d instead of %d", xid, status, written[xid])
+		}
+	}
+}
+
+func TestClogLastUsed(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	c := openClog(t, dir)
+	defer c.Close()
+
+	for _, step := range []struct {
+		write map[uint32]int
+		last  uint32
+	}{
+		{nil, MinXid},
+		{map[uint32]int{1000: ClogPositive, 999: ClogNegative}, 1000},
+		{map[uint32]int{commitsPerFile + 7: ClogDoubt}, commitsPerFile + 7},
+		// the last file wins even if an earlier one has greater offsets
+		{map[uint32]int{commitsPerFile - 1: ClogPositive}, commitsPerFile + 7},
+	} {
+		writeClog(t, c, step.write)
+		last, err := c.LastUsed()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if last != step.last {
+			t.Errorf("last used xid %d instead of %d after %v", last, step.last, step.write)
+		}
+	}
+}
+
+func TestClogScan(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	c := openClog(t, dir)
+	defer c.Close()
+
+	writeClog(t, c, map[uint32]int{
+		commitsPerFile - 20: ClogDoubt, // before the range
+		commitsPerFile - 10: ClogDoubt,
+		commitsPerFile - 1:  ClogDoubt,
+		commitsPerFile:      ClogPositive,
+		commitsPerFile + 1:  ClogDoubt,
+		commitsPerFile + 9:  ClogDoubt,
+		commitsPerFile + 10: ClogDoubt, // the end is not in the range
+	})
+	var found []uint32
+	err := c.Scan(commitsPerFile-10, commitsPerFile+10, ClogDoubt, func(xid uint32) error {
+		found = append(found, xid)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []uint32{commitsPerFile - 10, commitsPerFile - 1, commitsPerFile + 1, commitsPerFile + 9}
+	if !reflect.DeepEqual(found, expected) {
+		t.Errorf("scan found %v instead of %v", found, expected)
+	}
+}
@@ -0,0 +1,769 @@
+// Package conformance checks that an arbiter, the C one of src/main.c or
+// the Go one of package xtm, answers the commands of the protocol as the
+// README and the C arbiter specify: every command with good and wrong
+// arguments, votes and snapshots of transactions not participated in,
+// duplicate votes, xids which must never be given out twice, replies
+// postponed until the outcome is known and messages of several channels
+// interleaved on one connection.
+//
+// Cases talk to the arbiter at addr with their own connections, they do
+// not depend on each other nor on the state the arbiter starts with, so
+// they may be run against any arbiter which has no other clients.
+package conformance
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/digoal/postgres_cluster/contrib/arbiter/xtm"
+)
+
+// How long to wait for a reply, and to make sure there is none
+var (
+	ReplyTimeout = 5 * time.Second
+	QuietPeriod  = 200 * time.Millisecond
+)
+
+type Case struct {
+	Name string
+	Run  func(addr string) error
+}
+
+var Cases = []Case{
+	{"hello", testHello},
+	{"malformed", testMalformed},
+	{"reserve", testReserve},
+	{"begin", testBegin},
+	{"unique-xids", testUniqueXids},
+	{"snapshot", testSnapshot},
+	{"commit", testCommit},
+	{"fixed-size", testFixedSize},
+	{"abort", testAbort},
+	{"duplicate-votes", testDuplicateVotes},
+	{"out-of-order", testOutOfOrder},
+	{"status", testStatus},
+	{"wait", testWait},
+	{"disconnect", testDisconnect},
+	{"channels", testChannels},
+	{"deadlock", testDeadlock},
+}
+
+// Run all cases, returning the failures by the name of the case
+func Run(addr string) map[string]error {
+	failures := make(map[string]error)
+	for _, c := range Cases {
+		if err := c.Run(addr); err != nil {
+			failures[c.Name] = err
+		}
+	}
+	return failures
+}
+
+// A connection speaking raw messages, several channels may share it
+type conn struct {
+	net.Conn
+}
+
+func dial(addr string) (*conn, error) {
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return &conn{c}, nil
+}
+
+func (c *conn) send(channel uint32, body ...uint32) error {
+	return xtm.WriteMessage(c, xtm.Message{Code: xtm.MsgCommand, Chan: channel, Body: body})
+}
+
+func (c *conn) disconnect(channel uint32) error {
+	return xtm.WriteMessage(c, xtm.Message{Code: xtm.MsgDisconnect, Chan: channel})
+}
+
+func (c *conn) recv(timeout time.Duration) (xtm.Message, error) {
+	c.SetReadDeadline(time.Now().Add(timeout))
+	defer c.SetReadDeadline(time.Time{})
+	return xtm.ReadMessage(c)
+}
+
+// Reply to the command sent on channel 0
+func (c *conn) call(body ...uint32) ([]uint32, error) {
+	return c.callOn(0, body...)
+}
+
+func (c *conn) callOn(channel uint32, body ...uint32) ([]uint32, error) {
+	if err := c.send(channel, body...); err != nil {
+		return nil, err
+	}
+	return c.reply(channel)
+}
+
+func (c *conn) reply(channel uint32) ([]uint32, error) {
+	m, err := c.recv(ReplyTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("no reply: %v", err)
+	}
+	if m.Chan != channel {
+		return nil, fmt.Errorf("reply on channel %d, expected %d", m.Chan, channel)
+	}
+	if len(m.Body) == 0 {
+		return nil, fmt.Errorf("empty reply")
+	}
+	return m.Body, nil
+}
+
+// The reply is postponed: nothing comes within QuietPeriod
+func (c *conn) quiet() error {
+	m, err := c.recv(QuietPeriod)
+	if err == nil {
+		return fmt.Errorf("unexpected reply %v", m)
+	}
+	if e, ok := err.(net.Error); ok && e.Timeout() {
+		return nil
+	}
+	return err
+}
+
+func name(code uint32) string {
+	switch code {
+	case xtm.ResOk:
+		return "RES_OK"
+	case xtm.ResFailed:
+		return "RES_FAILED"
+	case xtm.ResDeadlock:
+		return "RES_DEADLOCK"
+	case xtm.ResTransactionCommitted:
+		return "COMMITTED"
+	case xtm.ResTransactionAborted:
+		return "ABORTED"
+	case xtm.ResTransactionInProgress:
+		return "INPROGRESS"
+	case xtm.ResTransactionUnknown:
+		return "UNKNOWN"
+	}
+	return fmt.Sprintf("%#x", code)
+}
+
+// The reply to what is a one-word answer
+func expect(what string, reply []uint32, err error, code uint32) error {
+	if err != nil {
+		return fmt.Errorf("%s: %v", what, err)
+	}
+	if len(reply) != 1 || reply[0] != code {
+		return fmt.Errorf("%s: replied %v, expected [%s]", what, reply, name(code))
+	}
+	return nil
+}
+
+// The reply starting with RES_OK of at least n words
+func expectOk(what string, reply []uint32, err error, n int) error {
+	if err != nil {
+		return fmt.Errorf("%s: %v", what, err)
+	}
+	if reply[0] != xtm.ResOk {
+		return fmt.Errorf("%s: replied %s", what, name(reply[0]))
+	}
+	if len(reply) < n {
+		return fmt.Errorf("%s: reply %v is too short", what, reply)
+	}
+	return nil
+}
+
+func begin(c *conn, size ...uint32) (uint32, xtm.Snapshot, error) {
+	reply, err := c.call(append([]uint32{xtm.CmdBegin}, size...)...)
+	if err := expectOk("BEGIN", reply, err, 5); err != nil {
+		return 0, xtm.Snapshot{}, err
+	}
+	snap, err := snapshotOf(reply[2:])
+	return reply[1], snap, err
+}
+
+func snapshotOf(body []uint32) (xtm.Snapshot, error) {
+	snap := xtm.Snapshot{Gxmin: body[0], Xmin: body[1], Xmax: body[2], Xip: body[3:]}
+	if snap.Xmin > snap.Xmax {
+		return snap, fmt.Errorf("snapshot %v has xmin above xmax", snap)
+	}
+	for _, xid := range snap.Xip {
+		if xid < snap.Xmin || xid >= snap.Xmax {
+			return snap, fmt.Errorf("snapshot %v lists %d out of [xmin, xmax)", snap, xid)
+		}
+	}
+	return snap, nil
+}
+
+func joinSnapshot(c *conn, xid uint32) (xtm.Snapshot, error) {
+	reply, err := c.call(xtm.CmdSnapshot, xid)
+	if err := expectOk("SNAPSHOT", reply, err, 4); err != nil {
+		return xtm.Snapshot{}, err
+	}
+	return snapshotOf(reply[1:])
+}
+
+func vote(c *conn, xid uint32, commit bool, wait bool) ([]uint32, error) {
+	cmd := uint32(xtm.CmdAgainst)
+	if commit {
+		cmd = xtm.CmdFor
+	}
+	w := uint32(0)
+	if wait {
+		w = 1
+	}
+	return c.call(cmd, xid, w)
+}
+
+func status(c *conn, xid uint32) ([]uint32, error) {
+	return c.call(xtm.CmdStatus, xid, 0)
+}
+
+// Run fn with n fresh connections, closing them after
+func with(addr string, n int, fn func(cs ...*conn) error) error {
+	cs := make([]*conn, n)
+	for i := range cs {
+		c, err := dial(addr)
+		if err != nil {
+			return err
+		}
+		defer c.Close()
+		cs[i] = c
+	}
+	return fn(cs...)
+}
+
+func testHello(addr string) error {
+	return with(addr, 1, func(cs ...*conn) error {
+		reply, err := cs[0].call(xtm.CmdHello)
+		return expect("HELLO", reply, err, xtm.ResOk)
+	})
+}
+
+// Every command with a wrong number of arguments, unknown and empty ones
+func testMalformed(addr string) error {
+	return with(addr, 1, func(cs ...*conn) error {
+		c := cs[0]
+		for _, cmd := range [][]uint32{
+			{},
+			{'q'},
+			{0},
+			{xtm.CmdHello, 1},
+			{xtm.CmdReserve},
+			{xtm.CmdReserve, xtm.MinXid},
+			{xtm.CmdReserve, xtm.MinXid, 1, 1},
+			{xtm.CmdBegin, 1, 2},
+			{xtm.CmdSnapshot},
+			{xtm.CmdSnapshot, 1, 2},
+			{xtm.CmdStatus},
+			{xtm.CmdStatus, 1},
+			{xtm.CmdStatus, 1, 0, 0},
+			{xtm.CmdDeadlock, 5432, 1},
+		} {
+			reply, err := c.call(cmd...)
+			if err := expect(fmt.Sprintf("%v", cmd), reply, err, xtm.ResFailed); err != nil {
+				return err
+			}
+		}
+		// the connection is still served
+		reply, err := c.call(xtm.CmdHello)
+		return expect("HELLO after malformed commands", reply, err, xtm.ResOk)
+	})
+}
+
+// The range reserved is never given to global transactions
+func testReserve(addr string) error {
+	return with(addr, 1, func(cs ...*conn) error {
+		c := cs[0]
+		reply, err := c.call(xtm.CmdReserve, xtm.MinXid, 100)
+		if err := expectOk("RESERVE", reply, err, 3); err != nil {
+			return err
+		}
+		first, last := reply[1], reply[2]
+		if first < xtm.MinXid || last < first || last-first+1 < 100 {
+			return fmt.Errorf("RESERVE of 100 xids from %d: got %d-%d", xtm.MinXid, first, last)
+		}
+		xid, _, err := begin(c)
+		if err != nil {
+			return err
+		}
+		if xid >= first && xid <= last {
+			return fmt.Errorf("BEGIN gave %d out of the reserved range %d-%d", xid, first, last)
+		}
+		reply, err = vote(c, xid, false, false)
+		return expect("AGAINST", reply, err, xtm.ResTransactionAborted)
+	})
+}
+
+func testBegin(addr string) error {
+	return with(addr, 2, func(cs ...*conn) error {
+		x1, s1, err := begin(cs[0])
+		if err != nil {
+			return err
+		}
+		if s1.Xmin > x1 || s1.Gxmin > s1.Xmin {
+			return fmt.Errorf("BEGIN of %d: snapshot %v", x1, s1)
+		}
+		// one transaction at a time
+		reply, err := cs[0].call(xtm.CmdBegin)
+		if err := expect("second BEGIN", reply, err, xtm.ResFailed); err != nil {
+			return err
+		}
+
+		x2, s2, err := begin(cs[1])
+		if err != nil {
+			return err
+		}
+		if x2 <= x1 {
+			return fmt.Errorf("BEGIN gave %d after %d", x2, x1)
+		}
+		// x1 is in progress, so it is not visible to x2
+		if s2.Xmin > x1 || (x1 < s2.Xmax && !contains(s2.Xip, x1)) {
+			return fmt.Errorf("snapshot %v of %d sees %d in progress", s2, x2, x1)
+		}
+		for i, x := range []uint32{x1, x2} {
+			reply, err := vote(cs[i], x, false, false)
+			if err := expect("AGAINST", reply, err, xtm.ResTransactionAborted); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func contains(xids []uint32, xid uint32) bool {
+	for _, x := range xids {
+		if x == xid {
+			return true
+		}
+	}
+	return false
+}
+
+// Concurrent begins and reserves never get the same xid
+func testUniqueXids(addr string) error {
+	const clients = 8
+	const rounds = 50
+	var mu sync.Mutex
+	var xids []uint32
+	var ranges [][2]uint32
+	errs := make(chan error, clients)
+	for i := 0; i < clients; i++ {
+		go func(i int) {
+			errs <- with(addr, 1, func(cs ...*conn) error {
+				for r := 0; r < rounds; r++ {
+					if i%2 == 0 {
+						reply, err := cs[0].call(xtm.CmdReserve, xtm.MinXid, 10)
+						if err := expectOk("RESERVE", reply, err, 3); err != nil {
+							return err
+						}
+						mu.Lock()
+						ranges = append(ranges, [2]uint32{reply[1], reply[2]})
+						mu.Unlock()
+						continue
+					}
+					xid, _, err := begin(cs[0])
+					if err != nil {
+						return err
+					}
+					mu.Lock()
+					xids = append(xids, xid)
+					mu.Unlock()
+					reply, err := vote(cs[0], xid, true, false)
+					if err := expect("FOR", reply, err, xtm.ResTransactionCommitted); err != nil {
+						return err
+					}
+				}
+				return nil
+			})
+		}(i)
+	}
+	for i := 0; i < clients; i++ {
+		if err := <-errs; err != nil {
+			return err
+		}
+	}
+
+	sort.Slice(xids, func(i, j int) bool { return xids[i] < xids[j] })
+	for i := 1; i < len(xids); i++ {
+		if xids[i] == xids[i-1] {
+			return fmt.Errorf("xid %d given out twice", xids[i])
+		}
+	}
+	for _, r := range ranges {
+		for _, xid := range xids {
+			if xid >= r[0] && xid <= r[1] {
+				return fmt.Errorf("xid %d given out in the reserved range %d-%d", xid, r[0], r[1])
+			}
+		}
+	}
+	return nil
+}
+
+// Joining by snapshot, snapshots of another transaction
+func testSnapshot(addr string) error {
+	return with(addr, 3, func(cs ...*conn) error {
+		xid, _, err := begin(cs[0])
+		if err != nil {
+			return err
+		}
+		if _, err := joinSnapshot(cs[1], xid); err != nil {
+			return err
+		}
+		// asking again is fine, it stays a participant of the same
+		if _, err := joinSnapshot(cs[1], xid); err != nil {
+			return err
+		}
+
+		other, _, err := begin(cs[2])
+		if err != nil {
+			return err
+		}
+		reply, err := cs[1].call(xtm.CmdSnapshot, other)
+		if err := expect("SNAPSHOT of a transaction not participated in", reply, err, xtm.ResFailed); err != nil {
+			return err
+		}
+
+		// two participants, both vote
+		for i := 0; i < 2; i++ {
+			if _, err := vote(cs[i], xid, false, false); err != nil {
+				return err
+			}
+		}
+		reply, err = vote(cs[2], other, false, false)
+		return expect("AGAINST", reply, err, xtm.ResTransactionAborted)
+	})
+}
+
+// Not committed until every participant has voted for
+func testCommit(addr string) error {
+	return with(addr, 3, func(cs ...*conn) error {
+		xid, _, err := begin(cs[0])
+		if err != nil {
+			return err
+		}
+		for _, c := range cs[1:] {
+			if _, err := joinSnapshot(c, xid); err != nil {
+				return err
+			}
+		}
+		for i, c := range cs {
+			reply, err := vote(c, xid, true, false)
+			want := uint32(xtm.ResTransactionInProgress)
+			if i == len(cs)-1 {
+				want = xtm.ResTransactionCommitted
+			}
+			if err := expect(fmt.Sprintf("FOR %d of %d", i+1, len(cs)), reply, err, want); err != nil {
+				return err
+			}
+		}
+		reply, err := status(cs[0], xid)
+		return expect("STATUS", reply, err, xtm.ResTransactionCommitted)
+	})
+}
+
+// With begin(size) those who ask for snapshots do not add to the votes
+func testFixedSize(addr string) error {
+	return with(addr, 3, func(cs ...*conn) error {
+		xid, _, err := begin(cs[0], 2)
+		if err != nil {
+			return err
+		}
+		for _, c := range cs[1:] {
+			if _, err := joinSnapshot(c, xid); err != nil {
+				return err
+			}
+		}
+		reply, err := vote(cs[0], xid, true, false)
+		if err := expect("FOR 1 of 2", reply, err, xtm.ResTransactionInProgress); err != nil {
+			return err
+		}
+		reply, err = vote(cs[1], xid, true, false)
+		if err := expect("FOR 2 of 2", reply, err, xtm.ResTransactionCommitted); err != nil {
+			return err
+		}
+		reply, err = vote(cs[2], xid, true, false)
+		return expect("FOR after the commit", reply, err, xtm.ResFailed)
+	})
+}
+
+// One vote against aborts at once, without waiting for the rest
+func testAbort(addr string) error {
+	return with(addr, 3, func(cs ...*conn) error {
+		xid, _, err := begin(cs[0])
+		if err != nil {
+			return err
+		}
+		for _, c := range cs[1:] {
+			if _, err := joinSnapshot(c, xid); err != nil {
+				return err
+			}
+		}
+		reply, err := vote(cs[0], xid, true, false)
+		if err := expect("FOR", reply, err, xtm.ResTransactionInProgress); err != nil {
+			return err
+		}
+		reply, err = vote(cs[1], xid, false, true)
+		if err := expect("AGAINST", reply, err, xtm.ResTransactionAborted); err != nil {
+			return err
+		}
+		reply, err = status(cs[2], xid)
+		if err := expect("STATUS", reply, err, xtm.ResTransactionAborted); err != nil {
+			return err
+		}
+		reply, err = vote(cs[2], xid, true, false)
+		return expect("FOR after the abort", reply, err, xtm.ResFailed)
+	})
+}
+
+// A participant votes once
+func testDuplicateVotes(addr string) error {
+	return with(addr, 2, func(cs ...*conn) error {
+		xid, _, err := begin(cs[0])
+		if err != nil {
+			return err
+		}
+		if _, err := joinSnapshot(cs[1], xid); err != nil {
+			return err
+		}
+		reply, err := vote(cs[0], xid, true, false)
+		if err := expect("FOR", reply, err, xtm.ResTransactionInProgress); err != nil {
+			return err
+		}
+		reply, err = vote(cs[0], xid, true, false)
+		if err := expect("second FOR", reply, err, xtm.ResFailed); err != nil {
+			return err
+		}
+		reply, err = vote(cs[0], xid, false, false)
+		if err := expect("AGAINST after FOR", reply, err, xtm.ResFailed); err != nil {
+			return err
+		}
+		// the duplicates have not counted
+		reply, err = status(cs[1], xid)
+		if err := expect("STATUS", reply, err, xtm.ResTransactionInProgress); err != nil {
+			return err
+		}
+		reply, err = vote(cs[1], xid, true, false)
+		return expect("FOR of the other participant", reply, err, xtm.ResTransactionCommitted)
+	})
+}
+
+// Votes before begin, for xids not given out and for the wrong transaction
+func testOutOfOrder(addr string) error {
+	return with(addr, 2, func(cs ...*conn) error {
+		reply, err := vote(cs[0], xtm.MinXid, true, false)
+		if err := expect("FOR before BEGIN", reply, err, xtm.ResFailed); err != nil {
+			return err
+		}
+		xid, _, err := begin(cs[0])
+		if err != nil {
+			return err
+		}
+		reply, err = vote(cs[0], xid+1000, true, false)
+		if err := expect("FOR of another xid", reply, err, xtm.ResFailed); err != nil {
+			return err
+		}
+		reply, err = vote(cs[1], xid, true, false)
+		if err := expect("FOR without joining", reply, err, xtm.ResFailed); err != nil {
+			return err
+		}
+		reply, err = vote(cs[0], xid, true, false)
+		if err := expect("FOR", reply, err, xtm.ResTransactionCommitted); err != nil {
+			return err
+		}
+		// the snapshot of a finished transaction is the current one
+		if _, err := joinSnapshot(cs[1], xid); err != nil {
+			return fmt.Errorf("SNAPSHOT of a finished transaction: %v", err)
+		}
+		// and does not make it a participant
+		reply, err = vote(cs[1], xid, true, false)
+		return expect("FOR after the commit", reply, err, xtm.ResFailed)
+	})
+}
+
+func testStatus(addr string) error {
+	return with(addr, 1, func(cs ...*conn) error {
+		xid, _, err := begin(cs[0])
+		if err != nil {
+			return err
+		}
+		reply, err := status(cs[0], xid)
+		if err := expect("STATUS of the transaction in progress", reply, err, xtm.ResTransactionInProgress); err != nil {
+			return err
+		}
+		reply, err = status(cs[0], xid+1000000)
+		if err := expect("STATUS of an xid not given out", reply, err, xtm.ResTransactionUnknown); err != nil {
+			return err
+		}
+		reply, err = vote(cs[0], xid, false, false)
+		if err := expect("AGAINST", reply, err, xtm.ResTransactionAborted); err != nil {
+			return err
+		}
+		reply, err = cs[0].call(xtm.CmdStatus, xid, 1)
+		return expect("STATUS with wait of a finished transaction", reply, err, xtm.ResTransactionAborted)
+	})
+}
+
+// Replies to FOR and STATUS with wait come when the last vote is in
+func testWait(addr string) error {
+	return with(addr, 3, func(cs ...*conn) error {
+		xid, _, err := begin(cs[0])
+		if err != nil {
+			return err
+		}
+		if _, err := joinSnapshot(cs[1], xid); err != nil {
+			return err
+		}
+		if err := cs[0].send(0, xtm.CmdFor, xid, 1); err != nil {
+			return err
+		}
+		if err := cs[2].send(0, xtm.CmdStatus, xid, 1); err != nil {
+			return err
+		}
+		for _, c := range []*conn{cs[0], cs[2]} {
+			if err := c.quiet(); err != nil {
+				return fmt.Errorf("waiting for %d: %v", xid, err)
+			}
+		}
+		reply, err := vote(cs[1], xid, true, false)
+		if err := expect("the last FOR", reply, err, xtm.ResTransactionCommitted); err != nil {
+			return err
+		}
+		for i, c := range []*conn{cs[0], cs[2]} {
+			reply, err := c.reply(0)
+			if err := expect(fmt.Sprintf("postponed reply %d", i+1), reply, err, xtm.ResTransactionCommitted); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// A participant which goes away votes against, by closing the connection
+// or by the disconnect message of sockhub for its channel
+func testDisconnect(addr string) error {
+	return with(addr, 3, func(cs ...*conn) error {
+		gone, err := dial(addr)
+		if err != nil {
+			return err
+		}
+		defer gone.Close()
+
+		x1, _, err := begin(cs[0])
+		if err != nil {
+			return err
+		}
+		if _, err := joinSnapshot(gone, x1); err != nil {
+			return err
+		}
+		if err := cs[1].send(0, xtm.CmdStatus, x1, 1); err != nil {
+			return err
+		}
+		gone.Close()
+		reply, err := cs[1].reply(0)
+		if err := expect("STATUS with wait when a participant is gone", reply, err, xtm.ResTransactionAborted); err != nil {
+			return err
+		}
+		reply, err = vote(cs[0], x1, true, false)
+		if err := expect("FOR", reply, err, xtm.ResFailed); err != nil {
+			return err
+		}
+
+		// a new backend, the C arbiter keeps the first one participating
+		// in the transaction aborted without its vote
+		x2, _, err := begin(cs[2])
+		if err != nil {
+			return err
+		}
+		reply, err = cs[1].callOn(7, xtm.CmdSnapshot, x2)
+		if err := expectOk("SNAPSHOT", reply, err, 4); err != nil {
+			return err
+		}
+		if err := cs[1].disconnect(7); err != nil {
+			return err
+		}
+		reply, err = cs[0].call(xtm.CmdStatus, x2, 1)
+		return expect("STATUS after the channel has disconnected", reply, err, xtm.ResTransactionAborted)
+	})
+}
+
+// Channels of one connection are separate backends
+func testChannels(addr string) error {
+	return with(addr, 1, func(cs ...*conn) error {
+		c := cs[0]
+		xid, _, err := begin(c)
+		if err != nil {
+			return err
+		}
+		reply, err := c.callOn(1, xtm.CmdSnapshot, xid)
+		if err := expectOk("SNAPSHOT on channel 1", reply, err, 4); err != nil {
+			return err
+		}
+		// the reply to channel 2 comes first though it was asked last
+		if err := c.send(1, xtm.CmdFor, xid, 1); err != nil {
+			return err
+		}
+		reply, err = c.callOn(2, xtm.CmdHello)
+		if err := expect("HELLO on channel 2", reply, err, xtm.ResOk); err != nil {
+			return err
+		}
+		// the waiting channel may be answered before the voting one
+		if err := c.send(0, xtm.CmdFor, xid, 0); err != nil {
+			return err
+		}
+		replies := make(map[uint32][]uint32)
+		for len(replies) < 2 {
+			m, err := c.recv(ReplyTimeout)
+			if err != nil {
+				return fmt.Errorf("no reply: %v", err)
+			}
+			if _, dup := replies[m.Chan]; dup || (m.Chan != 0 && m.Chan != 1) {
+				return fmt.Errorf("unexpected reply %v", m)
+			}
+			replies[m.Chan] = m.Body
+		}
+		if err := expect("FOR on channel 0", replies[0], nil, xtm.ResTransactionCommitted); err != nil {
+			return err
+		}
+		return expect("postponed FOR on channel 1", replies[1], nil, xtm.ResTransactionCommitted)
+	})
+}
+
+// Two nodes each sending their half of a cycle
+func testDeadlock(addr string) error {
+	return with(addr, 2, func(cs ...*conn) error {
+		// xids of transactions of this case only
+		base, _, err := begin(cs[0])
+		if err != nil {
+			return err
+		}
+		if _, err := vote(cs[0], base, false, false); err != nil {
+			return err
+		}
+		a, b, c := base+1000000, base+1000001, base+1000002
+
+		reply, err := cs[0].call(xtm.CmdDeadlock, 1, a, a, b, 0)
+		if err := expect("DEADLOCK of the first half", reply, err, xtm.ResOk); err != nil {
+			return err
+		}
+		reply, err = cs[1].call(xtm.CmdDeadlock, 2, b, b, c, 0)
+		if err := expect("DEADLOCK without a cycle", reply, err, xtm.ResOk); err != nil {
+			return err
+		}
+		reply, err = cs[1].call(xtm.CmdDeadlock, 2, b, b, c, a, 0)
+		if err := expect("DEADLOCK of the second half", reply, err, xtm.ResDeadlock); err != nil {
+			return err
+		}
+		// replaced by a subgraph of the node without the edge
+		reply, err = cs[1].call(xtm.CmdDeadlock, 2, b, b, c, 0)
+		if err := expect("DEADLOCK after the edge is gone", reply, err, xtm.ResOk); err != nil {
+			return err
+		}
+		// leave the graph as it was
+		for i, c := range cs {
+			if _, err := c.call(xtm.CmdDeadlock, uint32(i+1), a, a, 0); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
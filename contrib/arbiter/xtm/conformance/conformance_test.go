@@ -0,0 +1,51 @@
+//go:build arbiter_conformance
+// +build arbiter_conformance
+
+package conformance
+
+// The cases against the arbiter given by -arbiter, e.g. bin/arbiter
+// started with -r 127.0.0.1:5431,
+//
+//	go test -tags arbiter_conformance -args -arbiter 127.0.0.1:5431
+//
+// or against xtm.Arbiter embedded in the test without it.
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/digoal/postgres_cluster/contrib/arbiter/xtm"
+)
+
+var arbiter = flag.String("arbiter", "", "HOST:PORT of the arbiter to check, the Go one is embedded if not set")
+
+func TestConformance(t *testing.T) {
+	addr := *arbiter
+	if addr == "" {
+		dir, err := ioutil.TempDir("", "clog")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		a, err := xtm.OpenArbiter(dir, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := a.Start("127.0.0.1:0"); err != nil {
+			t.Fatal(err)
+		}
+		defer a.Close()
+		addr = a.Addr()
+	}
+
+	for _, c := range Cases {
+		c := c
+		t.Run(c.Name, func(t *testing.T) {
+			if err := c.Run(addr); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
@@ -0,0 +1,52 @@
+package xtm
+
+// Graph of locks for the detection of distributed deadlocks, see ddd.c.
+// Every backend sends the edges "transaction waits for transaction" of its
+// node, replacing those it has sent before; a deadlock is a cycle through
+// the transaction it asks about.
+type deadlockGraph struct {
+	// edges of every node, by the source
+	nodes map[string]map[uint32][]uint32
+}
+
+func newDeadlockGraph() *deadlockGraph {
+	return &deadlockGraph{nodes: make(map[string]map[uint32][]uint32)}
+}
+
+// subgraph is [src, dst, dst..., 0, src, dst..., 0, ...]
+func (g *deadlockGraph) replace(node string, subgraph []uint32) {
+	edges := make(map[uint32][]uint32)
+	for i := 0; i < len(subgraph); {
+		src := subgraph[i]
+		for i++; i < len(subgraph) && subgraph[i] != 0; i++ {
+			edges[src] = append(edges[src], subgraph[i])
+		}
+		// skip the terminating zero
+		i++
+	}
+	if len(edges) == 0 {
+		delete(g.nodes, node)
+		return
+	}
+	g.nodes[node] = edges
+}
+
+func (g *deadlockGraph) cycle(root uint32) bool {
+	visited := make(map[uint32]bool)
+	var reaches func(xid uint32) bool
+	reaches = func(xid uint32) bool {
+		visited[xid] = true
+		for _, edges := range g.nodes {
+			for _, dst := range edges[xid] {
+				if dst == root {
+					return true
+				}
+				if !visited[dst] && reaches(dst) {
+					return true
+				}
+			}
+		}
+		return false
+	}
+	return reaches(root)
+}
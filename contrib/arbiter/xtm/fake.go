@@ -0,0 +1,425 @@
+package xtm
+
+import (
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Server is an in-process stand-in for the arbiter (src/main.c without
+// raft) which lets protocol level tests run without the C daemon. It keeps
+// the same bookkeeping as the real thing: xid allocation, participation,
+// votes, the clog and replies postponed until the transaction is over.
+//
+// Snapshots are simplified: every participant of a transaction receives
+// the snapshot taken when the transaction began.
+//
+// The exported fields inject faults, set them before Start.
+type Server struct {
+	// Delay replies to FOR and AGAINST by this amount, both the immediate
+	// ones and those to voters waiting for the outcome. The vote is counted
+	// at once and the rest of the connection is not held up.
+	VoteDelay time.Duration
+	// Send every reply twice
+	DuplicateReplies bool
+
+	mu           sync.Mutex
+	ln           net.Listener
+	addr         string
+	conns        map[*serverConn]bool
+	nextXid      uint32
+	prevXid      uint32
+	transactions map[uint32]*transaction
+	clog         map[uint32]uint32
+	wg           sync.WaitGroup
+}
+
+type transaction struct {
+	xid       uint32
+	size      uint32
+	fixedSize bool
+	votesFor  uint32
+	snapshot  Snapshot
+	listeners []*fakeClient
+}
+
+type serverConn struct {
+	conn    net.Conn
+	wmu     sync.Mutex
+	clients map[uint32]*fakeClient
+}
+
+// Mirrors client_userdata_t: a backend identified by connection and channel
+type fakeClient struct {
+	sc    *serverConn
+	chan_ uint32
+	xpart *transaction
+	xwait *transaction
+	voter bool // waits for the outcome after its vote
+}
+
+// The first xid given out, the same as in a fresh clog
+const FirstXid = 3
+
+func NewServer() *Server {
+	return &Server{
+		conns:        make(map[*serverConn]bool),
+		nextXid:      FirstXid,
+		transactions: make(map[uint32]*transaction),
+		clog:         make(map[uint32]uint32),
+	}
+}
+
+// Listen on addr ("127.0.0.1:0" picks a free port) and serve in background
+func (s *Server) Start(addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.ln = ln
+	s.addr = ln.Addr().String()
+	s.mu.Unlock()
+
+	s.wg.Add(1)
+	go s.accept(ln)
+	return nil
+}
+
+func (s *Server) Addr() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.addr
+}
+
+// Close stops listening and drops all connections
+func (s *Server) Close() {
+	s.mu.Lock()
+	ln := s.ln
+	s.ln = nil
+	s.mu.Unlock()
+	if ln != nil {
+		ln.Close()
+	}
+	s.dropConnections()
+	s.wg.Wait()
+}
+
+// Restart emulates a crash and restart of the arbiter on the same address:
+// connections are dropped and the transactions in progress are aborted,
+// while the clog and the xid counter survive as they do on disk.
+func (s *Server) Restart() error {
+	s.Close()
+
+	s.mu.Lock()
+	for xid, t := range s.transactions {
+		s.clog[xid] = ResTransactionAborted
+		delete(s.transactions, t.xid)
+	}
+	addr := s.addr
+	s.mu.Unlock()
+
+	return s.Start(addr)
+}
+
+func (s *Server) dropConnections() {
+	s.mu.Lock()
+	conns := make([]*serverConn, 0, len(s.conns))
+	for sc := range s.conns {
+		conns = append(conns, sc)
+	}
+	s.mu.Unlock()
+	for _, sc := range conns {
+		sc.conn.Close()
+	}
+}
+
+func (s *Server) accept(ln net.Listener) {
+	defer s.wg.Done()
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		sc := &serverConn{conn: conn, clients: make(map[uint32]*fakeClient)}
+		s.mu.Lock()
+		s.conns[sc] = true
+		s.mu.Unlock()
+
+		s.wg.Add(1)
+		go s.serve(sc)
+	}
+}
+
+func (s *Server) serve(sc *serverConn) {
+	defer s.wg.Done()
+	defer func() {
+		sc.conn.Close()
+		s.mu.Lock()
+		for _, c := range sc.clients {
+			s.ondisconnect(c)
+		}
+		delete(s.conns, sc)
+		s.mu.Unlock()
+	}()
+
+	for {
+		msg, err := ReadMessage(sc.conn)
+		if err != nil {
+			return
+		}
+
+		s.mu.Lock()
+		c := sc.clients[msg.Chan]
+		if c == nil {
+			c = &fakeClient{sc: sc, chan_: msg.Chan}
+			sc.clients[msg.Chan] = c
+		}
+		if msg.Code == MsgDisconnect {
+			s.ondisconnect(c)
+			delete(sc.clients, msg.Chan)
+			s.mu.Unlock()
+			continue
+		}
+		reply := s.oncmd(c, msg.Body)
+		s.mu.Unlock()
+
+		if reply != nil {
+			if len(msg.Body) > 0 && (msg.Body[0] == CmdFor || msg.Body[0] == CmdAgainst) && s.VoteDelay > 0 {
+				go c.delayedReply(s, s.VoteDelay, reply...)
+			} else {
+				c.reply(s, reply...)
+			}
+		}
+	}
+}
+
+func (c *fakeClient) reply(s *Server, body ...uint32) {
+	c.sc.wmu.Lock()
+	defer c.sc.wmu.Unlock()
+	m := Message{Code: MsgReply, Chan: c.chan_, Body: body}
+	WriteMessage(c.sc.conn, m)
+	if s.DuplicateReplies {
+		WriteMessage(c.sc.conn, m)
+	}
+}
+
+func (c *fakeClient) delayedReply(s *Server, delay time.Duration, body ...uint32) {
+	time.Sleep(delay)
+	c.reply(s, body...)
+}
+
+// A disconnected participant votes against, the same as in ondisconnect()
+func (s *Server) ondisconnect(c *fakeClient) {
+	if t := c.xwait; t != nil {
+		t.removeListener(c)
+		c.xwait = nil
+	}
+	if t := c.xpart; t != nil {
+		c.xpart = nil
+		if s.transactions[t.xid] == t {
+			s.finish(t, ResTransactionAborted)
+		}
+	}
+}
+
+func (t *transaction) removeListener(c *fakeClient) {
+	for i, l := range t.listeners {
+		if l == c {
+			t.listeners = append(t.listeners[:i], t.listeners[i+1:]...)
+			return
+		}
+	}
+}
+
+// Returns reply to send now, nil if the reply is postponed.
+// Called with s.mu held.
+func (s *Server) oncmd(c *fakeClient, argv []uint32) []uint32 {
+	if len(argv) == 0 {
+		return []uint32{ResFailed}
+	}
+	switch argv[0] {
+	case CmdHello:
+		return []uint32{ResOk}
+	case CmdReserve:
+		return s.onreserve(argv)
+	case CmdBegin:
+		return s.onbegin(c, argv)
+	case CmdFor:
+		return s.onvote(c, argv, true)
+	case CmdAgainst:
+		return s.onvote(c, argv, false)
+	case CmdSnapshot:
+		return s.onsnapshot(c, argv)
+	case CmdStatus:
+		return s.onstatus(c, argv)
+	}
+	return []uint32{ResFailed}
+}
+
+func maxXid(a, b uint32) uint32 {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+func (s *Server) onreserve(argv []uint32) []uint32 {
+	if len(argv) != 3 {
+		return []uint32{ResFailed}
+	}
+	minxid, minsize := argv[1], argv[2]
+	maxxid := minxid + minsize - 1
+	if s.prevXid >= minxid || maxxid >= s.nextXid {
+		minxid = maxXid(minxid, s.nextXid)
+		maxxid = maxXid(maxxid, minxid+minsize-1)
+		s.nextXid = maxxid + 1
+	}
+	return []uint32{ResOk, minxid, maxxid}
+}
+
+func (s *Server) participating(c *fakeClient) bool {
+	return c.xpart != nil && s.transactions[c.xpart.xid] == c.xpart
+}
+
+func (s *Server) onbegin(c *fakeClient, argv []uint32) []uint32 {
+	if len(argv) != 1 && len(argv) != 2 {
+		return []uint32{ResFailed}
+	}
+	if s.participating(c) {
+		return []uint32{ResFailed}
+	}
+
+	t := &transaction{xid: s.nextXid, size: 1}
+	if len(argv) == 2 {
+		t.size = argv[1]
+		t.fixedSize = true
+	}
+	t.snapshot = s.snapshot()
+	s.nextXid++
+	s.prevXid = t.xid
+	s.transactions[t.xid] = t
+	c.xpart = t
+
+	return append([]uint32{ResOk, t.xid}, t.snapshot.encode()...)
+}
+
+// Snapshot of the active transactions, called before the xid is taken
+func (s *Server) snapshot() Snapshot {
+	snap := Snapshot{Xmin: s.nextXid, Xmax: s.nextXid}
+	for xid := range s.transactions {
+		snap.Xip = append(snap.Xip, xid)
+		if xid < snap.Xmin {
+			snap.Xmin = xid
+		}
+	}
+	sort.Slice(snap.Xip, func(i, j int) bool { return snap.Xip[i] < snap.Xip[j] })
+
+	snap.Gxmin = snap.Xmin
+	for _, t := range s.transactions {
+		if t.snapshot.Xmin < snap.Gxmin {
+			snap.Gxmin = t.snapshot.Xmin
+		}
+	}
+	return snap
+}
+
+func (s *Server) onsnapshot(c *fakeClient, argv []uint32) []uint32 {
+	if len(argv) != 2 {
+		return []uint32{ResFailed}
+	}
+	t := s.transactions[argv[1]]
+	if t == nil {
+		return []uint32{ResFailed}
+	}
+	if c.xpart != t {
+		if s.participating(c) {
+			return []uint32{ResFailed}
+		}
+		if !t.fixedSize {
+			t.size++
+		}
+		c.xpart = t
+	}
+	return append([]uint32{ResOk}, t.snapshot.encode()...)
+}
+
+func (s *Server) onvote(c *fakeClient, argv []uint32, commit bool) []uint32 {
+	if len(argv) != 3 {
+		return []uint32{ResFailed}
+	}
+	t := s.transactions[argv[1]]
+	if t == nil || c.xpart != t {
+		return []uint32{ResFailed}
+	}
+	wait := argv[2] != 0
+
+	if !commit {
+		s.finish(t, ResTransactionAborted)
+		return []uint32{ResTransactionAborted}
+	}
+	t.votesFor++
+	if t.votesFor >= t.size {
+		s.finish(t, ResTransactionCommitted)
+		return []uint32{ResTransactionCommitted}
+	}
+	if wait {
+		s.listen(c, t, true)
+		return nil
+	}
+	return []uint32{ResTransactionInProgress}
+}
+
+func (s *Server) onstatus(c *fakeClient, argv []uint32) []uint32 {
+	if len(argv) != 3 {
+		return []uint32{ResFailed}
+	}
+	xid, wait := argv[1], argv[2] != 0
+	if status, ok := s.clog[xid]; ok {
+		return []uint32{status}
+	}
+	t := s.transactions[xid]
+	if t == nil {
+		return []uint32{ResTransactionUnknown}
+	}
+	if wait {
+		s.listen(c, t, false)
+		return nil
+	}
+	return []uint32{ResTransactionInProgress}
+}
+
+func (s *Server) listen(c *fakeClient, t *transaction, voter bool) {
+	c.xwait = t
+	c.voter = voter
+	t.listeners = append(t.listeners, c)
+}
+
+// Write the outcome to the clog and answer everybody who waits for it
+func (s *Server) finish(t *transaction, status uint32) {
+	s.clog[t.xid] = status
+	delete(s.transactions, t.xid)
+	for _, l := range t.listeners {
+		var delay time.Duration
+		if l.voter {
+			delay = s.VoteDelay
+		}
+		l.xwait = nil
+		go l.delayedReply(s, delay, status)
+	}
+	t.listeners = nil
+}
+
+// Status of the transaction as it is known to the fake arbiter
+func (s *Server) TransactionStatus(xid uint32) uint32 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if status, ok := s.clog[xid]; ok {
+		return status
+	}
+	if s.transactions[xid] != nil {
+		return ResTransactionInProgress
+	}
+	return ResTransactionUnknown
+}
@@ -0,0 +1,145 @@
+package xtm
+
+import (
+	"testing"
+	"time"
+)
+
+func startServer(t *testing.T, setup func(s *Server)) *Server {
+	s := NewServer()
+	if setup != nil {
+		setup(s)
+	}
+	if err := s.Start("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func dial(t *testing.T, s *Server) *Client {
+	c, err := Dial(s.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// Begin a transaction of two participants, the second one joins it
+func beginPair(t *testing.T, s *Server) (*Client, *Client, uint32) {
+	c1, c2 := dial(t, s), dial(t, s)
+	xid, _, err := c1.Begin(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c2.Snapshot(xid); err != nil {
+		t.Fatal(err)
+	}
+	return c1, c2, xid
+}
+
+func TestVoteDelay(t *testing.T) {
+	const delay = 50 * time.Millisecond
+	s := startServer(t, func(s *Server) { s.VoteDelay = delay })
+	defer s.Close()
+	c1, c2, xid := beginPair(t, s)
+	defer c1.Close()
+	defer c2.Close()
+
+	waited := make(chan uint32, 1)
+	var answered time.Time
+	go func() {
+		status, err := c1.Vote(xid, true, true)
+		if err != nil {
+			t.Error(err)
+		}
+		answered = time.Now()
+		waited <- status
+	}()
+	time.Sleep(2 * delay)
+	start := time.Now()
+	status, err := c2.Vote(xid, true, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != ResTransactionCommitted {
+		t.Errorf("last vote got %d instead of committed", status)
+	}
+	if elapsed := time.Since(start); elapsed < delay {
+		t.Errorf("vote answered in %v, before the delay of %v", elapsed, delay)
+	}
+	if status := <-waited; status != ResTransactionCommitted {
+		t.Errorf("waiting vote got %d instead of committed", status)
+	}
+	if elapsed := answered.Sub(start); elapsed < delay {
+		t.Errorf("waiting vote answered %v after the last one, before the delay of %v", elapsed, delay)
+	}
+	if status := s.TransactionStatus(xid); status != ResTransactionCommitted {
+		t.Errorf("clog has %d instead of committed", status)
+	}
+}
+
+// A duplicate is taken for the reply to the next command, which should be
+// rejected rather than misread
+func TestDuplicateReplies(t *testing.T) {
+	s := startServer(t, func(s *Server) { s.DuplicateReplies = true })
+	defer s.Close()
+	c := dial(t, s)
+	defer c.Close()
+
+	xid, _, err := c.Begin(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status, err := c.Status(xid, false); err == nil {
+		t.Errorf("the duplicate of the reply to begin is taken for status %d", status)
+	}
+	if status := s.TransactionStatus(xid); status != ResTransactionInProgress {
+		t.Errorf("transaction is %d instead of in progress", status)
+	}
+}
+
+func TestRestart(t *testing.T) {
+	s := startServer(t, nil)
+	defer s.Close()
+	c1, c2, xid := beginPair(t, s)
+	defer c1.Close()
+	defer c2.Close()
+	c := dial(t, s)
+	committed, _, err := c.Begin(1)
+	if err == nil {
+		_, err = c.Vote(committed, true, false)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+
+	if err := s.Restart(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c1.Vote(xid, true, false); err == nil {
+		t.Errorf("vote on the connection of the crashed arbiter succeeded")
+	}
+
+	c = dial(t, s)
+	defer c.Close()
+	for _, expected := range []struct {
+		xid    uint32
+		status uint32
+	}{{xid, ResTransactionAborted}, {committed, ResTransactionCommitted}} {
+		status, err := c.Status(expected.xid, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status != expected.status {
+			t.Errorf("transaction %d is %d after restart instead of %d", expected.xid, status, expected.status)
+		}
+	}
+	next, _, err := c.Begin(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next <= committed {
+		t.Errorf("xid %d given out again after restart, the last one was %d", next, committed)
+	}
+}
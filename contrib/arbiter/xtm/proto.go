@@ -0,0 +1,132 @@
+// Package xtm speaks the backend-arbiter protocol described in
+// contrib/arbiter/README.
+//
+// Every message is a sockhub header followed by a series of 32-bit
+// numbers: [cmd, argv[0], argv[1], ...] for commands and
+// [result, ...] for replies. The header carries the size of the body
+// (24 bits), a user defined code (8 bits) and the channel number which
+// lets sockhub multiplex several backends over one connection.
+package xtm
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// Commands, keep in sync with include/proto.h
+const (
+	CmdHello    = 'h'
+	CmdReserve  = 'r'
+	CmdBegin    = 'b'
+	CmdFor      = 'y'
+	CmdAgainst  = 'n'
+	CmdSnapshot = 't'
+	CmdStatus   = 's'
+	CmdDeadlock = 'd'
+)
+
+// Results, keep in sync with include/proto.h
+const (
+	ResFailed                = 0xDEADBEEF
+	ResOk                    = 0xC0FFEE
+	ResRedirect              = 404
+	ResDeadlock              = 0xDEADDEED
+	ResTransactionCommitted  = 1
+	ResTransactionAborted    = 2
+	ResTransactionInProgress = 3
+	ResTransactionUnknown    = 4
+)
+
+// Message codes of the sockhub header
+const (
+	MsgDisconnect = 0
+	MsgCommand    = 1   // MSG_FIRST_USER_CODE, used by libarbiter for commands
+	MsgReply      = 'r' // used by the arbiter for replies
+)
+
+// Maximal size of a message body, the header has 24 bits for it
+const MaxBodySize = 1<<24 - 1
+
+const headerSize = 8
+
+type Message struct {
+	Code byte
+	Chan uint32
+	Body []uint32
+}
+
+func (m Message) String() string {
+	if len(m.Body) == 0 {
+		return fmt.Sprintf("[chan %d, code %d] empty", m.Chan, m.Code)
+	}
+	return fmt.Sprintf("[chan %d, code %d] %q %v", m.Chan, m.Code, rune(m.Body[0]), m.Body[1:])
+}
+
+// The header is a C bit field {size: 24, code: 8} followed by 'chan',
+// both in the byte order of the host, which is little endian everywhere
+// the arbiter runs.
+func ReadMessage(r io.Reader) (Message, error) {
+	var hdr [headerSize]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return Message{}, err
+	}
+	word := binary.LittleEndian.Uint32(hdr[0:4])
+	size := word & MaxBodySize
+	m := Message{
+		Code: byte(word >> 24),
+		Chan: binary.LittleEndian.Uint32(hdr[4:8]),
+	}
+	if size%4 != 0 {
+		return m, fmt.Errorf("xtm: message size %d is not a multiple of 4", size)
+	}
+
+	data := make([]byte, size)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return m, err
+	}
+	m.Body = make([]uint32, size/4)
+	for i := range m.Body {
+		m.Body[i] = binary.LittleEndian.Uint32(data[4*i:])
+	}
+	return m, nil
+}
+
+func WriteMessage(w io.Writer, m Message) error {
+	size := 4 * len(m.Body)
+	if size > MaxBodySize {
+		return fmt.Errorf("xtm: message of %d bytes is too long", size)
+	}
+	buf := make([]byte, headerSize+size)
+	binary.LittleEndian.PutUint32(buf[0:4], uint32(size)|uint32(m.Code)<<24)
+	binary.LittleEndian.PutUint32(buf[4:8], m.Chan)
+	for i, x := range m.Body {
+		binary.LittleEndian.PutUint32(buf[headerSize+4*i:], x)
+	}
+	_, err := w.Write(buf)
+	return err
+}
+
+// Snapshot as the arbiter sends it: global xmin followed by the snapshot
+type Snapshot struct {
+	Gxmin uint32
+	Xmin  uint32
+	Xmax  uint32
+	Xip   []uint32
+}
+
+func (s Snapshot) encode() []uint32 {
+	return append([]uint32{s.Gxmin, s.Xmin, s.Xmax}, s.Xip...)
+}
+
+func decodeSnapshot(body []uint32) (Snapshot, error) {
+	if len(body) < 3 {
+		return Snapshot{}, fmt.Errorf("xtm: snapshot is too short: %v", body)
+	}
+	return Snapshot{
+		Gxmin: body[0],
+		Xmin:  body[1],
+		Xmax:  body[2],
+		Xip:   append([]uint32(nil), body[3:]...),
+	}, nil
+}
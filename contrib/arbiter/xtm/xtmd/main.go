@@ -0,0 +1,137 @@
+// Command xtmd is the arbiter written in Go, see xtm.Arbiter. It takes the
+// options of bin/arbiter and keeps its files, so either may be started on
+// a datadir the other has used:
+//
+//	xtmd -r HOST:PORT [-d DATADIR] [-l LOGFILE] [-k] [-sync] [-checkpoint 1s]
+//
+// Raft is not supported: give -r once.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/digoal/postgres_cluster/contrib/arbiter/xtm"
+)
+
+const (
+	defaultDatadir    = "/tmp/clog"
+	defaultListenHost = "0.0.0.0"
+	defaultListenPort = 5431
+)
+
+type listenAddrs []string
+
+func (l *listenAddrs) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *listenAddrs) Set(value string) error {
+	if !strings.Contains(value, ":") {
+		value = fmt.Sprintf("%s:%d", value, defaultListenPort)
+	}
+	*l = append(*l, value)
+	return nil
+}
+
+var (
+	listen     listenAddrs
+	datadir    = flag.String("d", defaultDatadir, "Keep the clog and the checkpoint in DATADIR.")
+	logfile    = flag.String("l", "", "Write output to LOGFILE.")
+	assassin   = flag.Bool("k", false, "Just kill the other arbiter running at the same DATADIR and exit.")
+	syncWrites = flag.Bool("sync", false, "Fsync the clog after every write.")
+	checkpoint = flag.Duration("checkpoint", time.Second, "Checkpoint the transactions in progress this often.")
+)
+
+func init() {
+	flag.Var(&listen, "r", "Listen on the HOST and PORT.")
+}
+
+func readPid(path string) int {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		log.Printf("failed to read pid from pidfile: %v", err)
+		return 0
+	}
+	return pid
+}
+
+// If there is a pidfile in datadir, stop the arbiter it names and wait
+// for it to exit, the same as kill_the_elder()
+func killTheElder(pidpath string) {
+	pid := readPid(pidpath)
+	if pid <= 1 {
+		return
+	}
+	if err := syscall.Kill(pid, syscall.SIGTERM); err != nil {
+		log.Printf("pid=%d not killed: %v", pid, err)
+		return
+	}
+	for syscall.Kill(pid, 0) == nil {
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func main() {
+	flag.Parse()
+	if len(listen) == 0 {
+		listen = listenAddrs{fmt.Sprintf("%s:%d", defaultListenHost, defaultListenPort)}
+	}
+	if len(listen) > 1 {
+		fmt.Fprintln(os.Stderr, "raft is not supported, specify -r HOST:PORT once or use bin/arbiter")
+		os.Exit(2)
+	}
+
+	pidpath := filepath.Join(*datadir, "arbiter.pid")
+	killTheElder(pidpath)
+	if *assassin {
+		return
+	}
+
+	if *logfile != "" {
+		f, err := os.OpenFile(*logfile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			log.Fatalf("could not open log file: %v", err)
+		}
+		log.SetOutput(f)
+	}
+
+	a, err := xtm.OpenArbiter(*datadir, *syncWrites)
+	if err != nil {
+		log.Fatalf("could not open clog at '%s': %v", *datadir, err)
+	}
+	a.Log = log.New(log.Writer(), "", log.LstdFlags)
+	a.CheckpointInterval = *checkpoint
+
+	if err := ioutil.WriteFile(pidpath, []byte(fmt.Sprintf("%d\n", os.Getpid())), 0644); err != nil {
+		log.Printf("failed to write pidfile: %v", err)
+	}
+	if err := a.Start(listen[0]); err != nil {
+		os.Remove(pidpath)
+		log.Fatalf("could not start on %s: %v", listen[0], err)
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	<-signals
+	log.Printf("terminated")
+	if err := a.Close(); err != nil {
+		log.Printf("failed to close: %v", err)
+	}
+	if err := os.Remove(pidpath); err != nil {
+		log.Printf("could not remove pidfile: %v", err)
+	}
+}
@@ -0,0 +1,98 @@
+package dtmclient
+
+import (
+    "time"
+)
+
+// Concurrent runs the given protocol with the steps of the beginning that
+// do not wait for each other sent to all participants at once: the local
+// transactions begin together and, once the coordinator has the snapshot,
+// the rest of participants access or join it together. The commit is that
+// of the protocol. For two participants nothing changes but the begins,
+// the wider the transaction the more round trips overlap.
+func Concurrent(p Protocol) Protocol {
+    return concurrentProtocol{p}
+}
+
+type concurrentProtocol struct {
+    Protocol
+}
+
+func (c concurrentProtocol) Begin(tx *GlobalTx, isolation string) error {
+    stmt := "begin transaction"
+    if isolation != Default {
+        stmt += " isolation level " + isolation
+    }
+    begin := func() error {
+        err := tx.each(0, "begin", func(i int) error {
+            _, err := tx.conns[i].Exec(stmt)
+            return err
+        })
+        if err != nil {
+            tx.rollbackFrom(0)
+        }
+        return err
+    }
+
+    switch c.Protocol {
+    case CSN:
+        if err := begin(); err != nil {
+            return err
+        }
+        err := tx.join(func(i int) error {
+            switch {
+            case i == 0 && tx.Gid == "":
+                return tx.conns[0].QueryRow("select dtm_extend()").Scan(&tx.Snapshot)
+            case i == 0:
+                return tx.conns[0].QueryRow("select dtm_extend($1)", tx.Gid).Scan(&tx.Snapshot)
+            case tx.Gid == "":
+                return tx.conns[i].QueryRow("select dtm_access($1)", tx.Snapshot).Scan(&tx.Snapshots[i])
+            default:
+                return tx.conns[i].QueryRow("select dtm_access($1, $2)", tx.Snapshot, tx.Gid).Scan(&tx.Snapshots[i])
+            }
+        })
+        if err != nil {
+            tx.rollbackFrom(0)
+        }
+        return err
+    case XID:
+        err := tx.join(func(i int) error {
+            if i == 0 {
+                return tx.conns[0].QueryRow("select dtm_begin_transaction()::bigint").Scan(&tx.Snapshot)
+            }
+            _, err := tx.conns[i].Exec("select dtm_join_transaction($1)", int32(tx.Snapshot))
+            tx.Snapshots[i] = tx.Snapshot
+            return err
+        })
+        if err != nil {
+            return err
+        }
+        return begin()
+    }
+    if err := begin(); err != nil {
+        return err
+    }
+    if err := c.Protocol.Join(tx); err != nil {
+        tx.Rollback()
+        return err
+    }
+    return nil
+}
+
+// The coordinator takes the snapshot by step(0), then the rest adopt it
+// at once, sets SnapshotTime
+func (tx *GlobalTx) join(step func(i int) error) error {
+    snapshotStart := time.Now()
+    start := time.Now()
+    err := step(0)
+    tx.span("extend", 0, start)
+    if err != nil {
+        return err
+    }
+    tx.Snapshots[0] = tx.Snapshot
+    if err = tx.each(1, "access", step); err != nil {
+        return err
+    }
+    tx.SnapshotTime = time.Since(snapshotStart)
+    return nil
+}
@@ -0,0 +1,352 @@
+// Package dtmclient drives global transactions over several PostgreSQL
+// nodes running pg_tsdtm.
+//
+// The coordinator (the first participant) extends the transaction and the
+// rest of participants access its snapshot. Commit is done with 2PC:
+// every participant prepares the transaction, votes for the commit CSN
+// and then commits the prepared transaction.
+//
+//  tx, err := dtmclient.Begin(conns, "42")
+//  ...
+//  _, err = tx.Exec(0, "update t set v = v - 1 where u = $1", 1)
+//  _, err = tx.Exec(1, "update t set v = v + 1 where u = $1", 2)
+//  ...
+//  err = tx.Commit()
+//
+// Read-only transactions may use empty gid, they are committed locally
+// on every participant. CommitLocal does the same for writing transactions,
+// which is not atomic and exists only to compare with the 2PC path.
+// BeginLocal goes further and skips DTM altogether, to measure its cost.
+// BeginAt reads on a single connection, e.g. a hot standby, under the
+// snapshot of another global transaction.
+//
+// BeginWith selects the protocol: CSN of pg_tsdtm described above, or XID
+// of pg_dtm with the arbiter, where participants join the xid given by the
+// arbiter and just commit. See Protocol. Concurrent and PipelinedCSN
+// drive the participants at once instead of one after another.
+//
+// Every step on every participant is recorded in Spans, so that slow
+// phases of the protocol can be found.
+package dtmclient
+
+import (
+    "fmt"
+    "sync"
+    "time"
+    "github.com/jackc/pgx"
+)
+
+// The state of the global transaction
+const (
+    Active = iota
+    Prepared
+    Committed
+    Aborted
+)
+
+type GlobalTx struct {
+    Gid string
+    Snapshot int64
+    Csn int64
+    State int
+    SnapshotTime time.Duration  // time spent to obtain the global snapshot
+    Failed int                  // participant on which commit failed, -1 if none
+    Snapshots []int64           // snapshot adopted by every participant
+    Spans []Span
+    // Called after every step on every participant with the step phase,
+    // e.g. to inject faults at a given point of the protocol. Pipelined
+    // protocols call it concurrently for different participants.
+    Hook func(phase string, participant int)
+    // Called after every statement run by Exec, Query and QueryRow with
+    // its arguments, how long it took and its error, e.g. to log them.
+    // Statements of QueryRow end with Scan of the row.
+    Log func(participant int, sql string, arguments []interface{}, elapsed time.Duration, err error)
+
+    conns []*pgx.Conn
+    prepared []bool
+    mu sync.Mutex       // of Spans, participants may be driven concurrently
+    local bool
+    protocol Protocol
+}
+
+// One step of the transaction on one participant
+type Span struct {
+    Phase string          // begin, extend, access, statement, prepare, begin_prepare,
+                          // vote, end_prepare, commit_prepared, commit or rollback
+    Participant int
+    Start time.Time
+    Duration time.Duration
+}
+
+func (tx *GlobalTx) span(phase string, participant int, start time.Time) {
+    tx.mu.Lock()
+    tx.Spans = append(tx.Spans, Span{phase, participant, start, time.Since(start)})
+    tx.mu.Unlock()
+    if tx.Hook != nil {
+        tx.Hook(phase, participant)
+    }
+}
+
+// Isolation levels for BeginIsolated and BeginLocalIsolated, the empty one
+// leaves the default of the session
+const (
+    Default = ""
+    ReadCommitted = "read committed"
+    RepeatableRead = "repeatable read"
+    Serializable = "serializable"
+)
+
+// Begin starts a global transaction over the given connections. The first
+// connection acts as the coordinator.
+func Begin(conns []*pgx.Conn, gid string) (*GlobalTx, error) {
+    return BeginIsolated(conns, gid, Default)
+}
+
+// BeginIsolated is Begin with the given isolation level on every participant
+func BeginIsolated(conns []*pgx.Conn, gid string, isolation string) (*GlobalTx, error) {
+    return BeginWith(CSN, conns, gid, isolation)
+}
+
+// BeginWith starts a global transaction coordinated with the given protocol
+func BeginWith(p Protocol, conns []*pgx.Conn, gid string, isolation string) (*GlobalTx, error) {
+    if len(conns) == 0 {
+        return nil, fmt.Errorf("dtmclient: no participants")
+    }
+    tx := new_tx(conns, gid, false)
+    tx.protocol = p
+    if b, ok := p.(beginner); ok {
+        if err := b.Begin(tx, isolation); err != nil {
+            return nil, err
+        }
+        return tx, nil
+    }
+    if p.JoinsBeforeBegin() {
+        if err := p.Join(tx); err != nil {
+            return nil, err
+        }
+        if err := tx.begin(isolation); err != nil {
+            return nil, err
+        }
+        return tx, nil
+    }
+    if err := tx.begin(isolation); err != nil {
+        return nil, err
+    }
+    if err := p.Join(tx); err != nil {
+        tx.Rollback()
+        return nil, err
+    }
+    return tx, nil
+}
+
+// BeginAt starts a read-only transaction on a single connection with the
+// snapshot of another global transaction, e.g. on a hot standby of one of
+// its participants. It has no gid and is committed locally.
+func BeginAt(conn *pgx.Conn, snapshot int64, isolation string) (*GlobalTx, error) {
+    tx, err := begin([]*pgx.Conn{conn}, "", isolation, false)
+    if err != nil {
+        return nil, err
+    }
+    start := time.Now()
+    err = conn.QueryRow("select dtm_access($1)", snapshot).Scan(&tx.Snapshot)
+    tx.span("access", 0, start)
+    if err != nil {
+        tx.Rollback()
+        return nil, err
+    }
+    tx.Snapshots[0] = tx.Snapshot
+    tx.SnapshotTime = time.Since(start)
+    return tx, nil
+}
+
+// BeginLocal starts plain local transactions on the given connections
+// without DTM: there is neither a global snapshot nor CSN voting, Commit
+// commits the participants one by one
+func BeginLocal(conns []*pgx.Conn, gid string) (*GlobalTx, error) {
+    return begin(conns, gid, Default, true)
+}
+
+// BeginLocalIsolated is BeginLocal with the given isolation level
+func BeginLocalIsolated(conns []*pgx.Conn, gid string, isolation string) (*GlobalTx, error) {
+    return begin(conns, gid, isolation, true)
+}
+
+func new_tx(conns []*pgx.Conn, gid string, local bool) *GlobalTx {
+    return &GlobalTx{Gid: gid, conns: conns, Failed: -1, Snapshots: make([]int64, len(conns)),
+        prepared: make([]bool, len(conns)), local: local, protocol: CSN}
+}
+
+// Start local transactions on all participants
+func begin(conns []*pgx.Conn, gid string, isolation string, local bool) (*GlobalTx, error) {
+    if len(conns) == 0 {
+        return nil, fmt.Errorf("dtmclient: no participants")
+    }
+    tx := new_tx(conns, gid, local)
+    if err := tx.begin(isolation); err != nil {
+        return nil, err
+    }
+    return tx, nil
+}
+
+func (tx *GlobalTx) begin(isolation string) error {
+    stmt := "begin transaction"
+    if isolation != Default {
+        stmt += " isolation level " + isolation
+    }
+    for i, conn := range tx.conns {
+        start := time.Now()
+        _, err := conn.Exec(stmt)
+        tx.span("begin", i, start)
+        if err != nil {
+            tx.rollbackFirst(i)
+            return err
+        }
+    }
+    return nil
+}
+
+// Participants returns connections of the transaction in the same order
+// they were passed to Begin
+func (tx *GlobalTx) Participants() []*pgx.Conn {
+    return tx.conns
+}
+
+func (tx *GlobalTx) log(node int, sql string, arguments []interface{}, start time.Time, err error) {
+    if tx.Log != nil {
+        tx.Log(node, sql, arguments, time.Since(start), err)
+    }
+}
+
+func (tx *GlobalTx) Exec(node int, sql string, arguments ...interface{}) (pgx.CommandTag, error) {
+    start := time.Now()
+    defer tx.span("statement", node, start)
+    tag, err := tx.conns[node].Exec(sql, arguments...)
+    tx.log(node, sql, arguments, start, err)
+    return tag, err
+}
+
+// The span of Query and QueryRow lasts until the first response, reading of
+// rows is not counted
+func (tx *GlobalTx) Query(node int, sql string, arguments ...interface{}) (*pgx.Rows, error) {
+    start := time.Now()
+    defer tx.span("statement", node, start)
+    rows, err := tx.conns[node].Query(sql, arguments...)
+    tx.log(node, sql, arguments, start, err)
+    return rows, err
+}
+
+// Row of QueryRow, the error of the statement comes with Scan
+type Row struct {
+    row *pgx.Row
+    tx *GlobalTx
+    node int
+    sql string
+    arguments []interface{}
+    start time.Time
+}
+
+func (r *Row) Scan(dest ...interface{}) error {
+    err := r.row.Scan(dest...)
+    r.tx.log(r.node, r.sql, r.arguments, r.start, err)
+    return err
+}
+
+func (tx *GlobalTx) QueryRow(node int, sql string, arguments ...interface{}) *Row {
+    start := time.Now()
+    defer tx.span("statement", node, start)
+    return &Row{tx.conns[node].QueryRow(sql, arguments...), tx, node, sql, arguments, start}
+}
+
+// Commit finishes the transaction on all participants as its protocol
+// prescribes, see Protocol.
+func (tx *GlobalTx) Commit() error {
+    if tx.State != Active {
+        return fmt.Errorf("dtmclient: transaction '%s' is not active", tx.Gid)
+    }
+
+    if tx.Gid == "" || tx.local {
+        return tx.CommitLocal()
+    }
+
+    return tx.protocol.Commit(tx)
+}
+
+// CommitLocal commits every participant with plain COMMIT, one after
+// another. A failure in the middle leaves the transaction committed on
+// some of the participants only.
+func (tx *GlobalTx) CommitLocal() error {
+    if tx.State != Active {
+        return fmt.Errorf("dtmclient: transaction '%s' is not active", tx.Gid)
+    }
+    for i, conn := range tx.conns {
+        start := time.Now()
+        _, err := conn.Exec("commit")
+        tx.span("commit", i, start)
+        if err != nil {
+            tx.Failed = i
+            tx.rollbackFrom(i + 1)
+            tx.State = Aborted
+            return err
+        }
+    }
+    tx.State = Committed
+    return nil
+}
+
+// Rollback aborts the transaction on all participants, prepared or not.
+// The first error is returned but all participants are tried anyway.
+func (tx *GlobalTx) Rollback() error {
+    var firstErr error
+
+    if tx.State == Committed || tx.State == Aborted {
+        return nil
+    }
+    for i, conn := range tx.conns {
+        var err error
+        start := time.Now()
+        if tx.prepared[i] {
+            _, err = conn.Exec("rollback prepared '" + tx.Gid + "'")
+        } else {
+            _, err = conn.Exec("rollback")
+        }
+        tx.span("rollback", i, start)
+        if err != nil && firstErr == nil {
+            firstErr = err
+        }
+    }
+    tx.State = Aborted
+    return firstErr
+}
+
+// RollbackAfterPrepare prepares the transaction on the first n participants
+// and then rolls it back everywhere, as coordinator would do if one of the
+// participants failed to prepare
+func (tx *GlobalTx) RollbackAfterPrepare(n int) error {
+    if tx.State != Active {
+        return fmt.Errorf("dtmclient: transaction '%s' is not active", tx.Gid)
+    }
+    for i, conn := range tx.conns[:n] {
+        start := time.Now()
+        _, err := conn.Exec("prepare transaction '" + tx.Gid + "'")
+        tx.span("prepare", i, start)
+        if err != nil {
+            tx.Rollback()
+            return err
+        }
+        tx.prepared[i] = true
+        tx.State = Prepared
+    }
+    return tx.Rollback()
+}
+
+func (tx *GlobalTx) rollbackFrom(n int) {
+    for _, conn := range tx.conns[n:] {
+        conn.Exec("rollback")
+    }
+}
+
+func (tx *GlobalTx) rollbackFirst(n int) {
+    for _, conn := range tx.conns[:n] {
+        conn.Exec("rollback")
+    }
+}
@@ -0,0 +1,159 @@
+package dtmclient
+
+import (
+    "fmt"
+    "sync"
+    "time"
+)
+
+// PipelinedCSN is the CSN protocol in fewer round trips. Steps whose
+// result the client does not need are sent together as one simple query,
+// and participants which do not wait for each other are driven at once:
+//
+//  coordinator:   begin, dtm_extend
+//  others:        begin + dtm_access                 all at once
+//  all:           prepare + dtm_begin_prepare        all at once
+//  all:           dtm_prepare                        one after another
+//  all:           dtm_end_prepare                    all at once
+//  all:           commit prepared                    all at once
+//
+// COMMIT PREPARED can not run in a multi-command string, so it takes its
+// own round trip. The snapshot dtm_access returns is not read back, the
+// participants are taken to have the snapshot of the coordinator.
+var PipelinedCSN Protocol = pipelinedProtocol{}
+
+// Protocols which begin the local transactions themselves, see BeginWith
+type beginner interface {
+    Begin(tx *GlobalTx, isolation string) error
+}
+
+type pipelinedProtocol struct{}
+
+func (pipelinedProtocol) JoinsBeforeBegin() bool {
+    return false
+}
+
+// Only of a transaction begun by Begin
+func (pipelinedProtocol) Join(tx *GlobalTx) error {
+    return fmt.Errorf("dtmclient: pipelined transactions join as they begin")
+}
+
+func (pipelinedProtocol) Begin(tx *GlobalTx, isolation string) error {
+    begin := "begin transaction"
+    if isolation != Default {
+        begin += " isolation level " + isolation
+    }
+    gid := "'" + tx.Gid + "'"
+    if tx.Gid == "" {
+        gid = "null"
+    }
+
+    snapshotStart := time.Now()
+    start := time.Now()
+    _, err := tx.conns[0].Exec(begin)
+    tx.span("begin", 0, start)
+    if err != nil {
+        return err
+    }
+    start = time.Now()
+    err = tx.conns[0].QueryRow("select dtm_extend(" + gid + ")").Scan(&tx.Snapshot)
+    tx.span("extend", 0, start)
+    if err != nil {
+        tx.rollbackFrom(0)
+        return err
+    }
+    tx.Snapshots[0] = tx.Snapshot
+
+    access := fmt.Sprintf("%s; select dtm_access(%d, %s)", begin, tx.Snapshot, gid)
+    err = tx.each(1, "access", func(i int) error {
+        _, err := tx.conns[i].Exec(access)
+        tx.Snapshots[i] = tx.Snapshot
+        return err
+    })
+    if err != nil {
+        tx.rollbackFrom(0)
+        return err
+    }
+    tx.SnapshotTime = time.Since(snapshotStart)
+    return nil
+}
+
+func (pipelinedProtocol) Commit(tx *GlobalTx) error {
+    gid := "'" + tx.Gid + "'"
+    err := tx.each(0, "prepare", func(i int) error {
+        _, err := tx.conns[i].Exec("prepare transaction " + gid + "; select dtm_begin_prepare(" + gid + ")")
+        if err != nil {
+            // either of the two may have failed
+            var n int64
+            if tx.conns[i].QueryRow("select count(*) from pg_prepared_xacts where gid = $1", tx.Gid).Scan(&n) != nil || n > 0 {
+                tx.prepared[i] = true
+            }
+            return err
+        }
+        tx.prepared[i] = true
+        return nil
+    })
+    tx.State = Prepared
+    if err != nil {
+        tx.Rollback()
+        return err
+    }
+
+    var csn int64
+    for i, conn := range tx.conns {
+        start := time.Now()
+        err := conn.QueryRow("select dtm_prepare($1, $2)", tx.Gid, csn).Scan(&csn)
+        tx.span("vote", i, start)
+        if err != nil {
+            tx.Failed = i
+            tx.Rollback()
+            return err
+        }
+    }
+    tx.Csn = csn
+
+    err = tx.each(0, "end_prepare", func(i int) error {
+        _, err := tx.conns[i].Exec(fmt.Sprintf("select dtm_end_prepare(%s, %d)", gid, csn))
+        return err
+    })
+    if err == nil {
+        err = tx.each(0, "commit_prepared", func(i int) error {
+            _, err := tx.conns[i].Exec("commit prepared " + gid)
+            return err
+        })
+    }
+    if err != nil {
+        return err
+    }
+    tx.State = Committed
+    return nil
+}
+
+func (pipelinedProtocol) Functions() map[string]int {
+    return CSN.Functions()
+}
+
+// Run the step on participants from the first one on at once, records
+// the span of every one. Returns the error of the first participant
+// failed, which becomes tx.Failed.
+func (tx *GlobalTx) each(first int, phase string, step func(i int) error) error {
+    errs := make([]error, len(tx.conns))
+    var wg sync.WaitGroup
+    for i := first; i < len(tx.conns); i++ {
+        wg.Add(1)
+        go func(i int) {
+            defer wg.Done()
+            start := time.Now()
+            errs[i] = step(i)
+            tx.span(phase, i, start)
+        }(i)
+    }
+    wg.Wait()
+    for i, err := range errs {
+        if err != nil {
+            tx.Failed = i
+            return err
+        }
+    }
+    return nil
+}
@@ -0,0 +1,232 @@
+package dtmclient
+
+import (
+    "time"
+)
+
+// Protocol is the way participants of a global transaction share one
+// snapshot and agree on its commit. pg_dtm comes in two flavors:
+//
+// CSN (pg_tsdtm) keeps no central state: the coordinator extends its
+// snapshot to the global transaction by gid and the rest of participants
+// access it, then after every participant is prepared they vote for the
+// commit sequence number and commit the prepared transactions.
+//
+// XID (pg_dtm with the arbiter) gets the xid of the global transaction
+// from the arbiter on the coordinator with dtm_begin_transaction() and
+// joins the rest of participants to it with dtm_join_transaction() before
+// their local transactions begin. The arbiter collects the votes itself,
+// so every participant just commits.
+//
+// TwoPhase is no DTM at all but the baseline to compare them with: every
+// participant keeps its local snapshot, the client prepares all of them
+// and then commits them prepared.
+type Protocol interface {
+    // Whether Join should be called before local transactions begin
+    JoinsBeforeBegin() bool
+    // Share the snapshot among tx.Participants(), sets tx.Snapshot
+    Join(tx *GlobalTx) error
+    // Commit the active transaction on all participants
+    Commit(tx *GlobalTx) error
+    // Functions of pg_dtm the protocol calls, by the number of arguments
+    Functions() map[string]int
+}
+
+var (
+    CSN Protocol = csnProtocol{}
+    XID Protocol = xidProtocol{}
+    TwoPhase Protocol = twoPhaseProtocol{}
+)
+
+// Protocols of pg_dtm by name
+var Protocols = map[string]Protocol{"csn": CSN, "xid": XID}
+
+type csnProtocol struct{}
+
+func (csnProtocol) JoinsBeforeBegin() bool {
+    return false
+}
+
+func (csnProtocol) Join(tx *GlobalTx) error {
+    snapshotStart := time.Now()
+    for i, conn := range tx.conns {
+        var err error
+        start := time.Now()
+        switch {
+        case i == 0 && tx.Gid == "":
+            err = conn.QueryRow("select dtm_extend()").Scan(&tx.Snapshot)
+        case i == 0:
+            err = conn.QueryRow("select dtm_extend($1)", tx.Gid).Scan(&tx.Snapshot)
+        case tx.Gid == "":
+            err = conn.QueryRow("select dtm_access($1)", tx.Snapshot).Scan(&tx.Snapshot)
+        default:
+            err = conn.QueryRow("select dtm_access($1, $2)", tx.Snapshot, tx.Gid).Scan(&tx.Snapshot)
+        }
+        if i == 0 {
+            tx.span("extend", i, start)
+        } else {
+            tx.span("access", i, start)
+        }
+        if err != nil {
+            return err
+        }
+        tx.Snapshots[i] = tx.Snapshot
+    }
+    tx.SnapshotTime = time.Since(snapshotStart)
+    return nil
+}
+
+// If any step before the commit CSN is agreed fails, the transaction is
+// rolled back everywhere and the error is returned
+func (csnProtocol) Commit(tx *GlobalTx) error {
+    for i, conn := range tx.conns {
+        start := time.Now()
+        _, err := conn.Exec("prepare transaction '" + tx.Gid + "'")
+        tx.span("prepare", i, start)
+        if err != nil {
+            tx.Failed = i
+            tx.Rollback()
+            return err
+        }
+        tx.prepared[i] = true
+    }
+    tx.State = Prepared
+
+    for i, conn := range tx.conns {
+        start := time.Now()
+        _, err := conn.Exec("select dtm_begin_prepare($1)", tx.Gid)
+        tx.span("begin_prepare", i, start)
+        if err != nil {
+            tx.Failed = i
+            tx.Rollback()
+            return err
+        }
+    }
+    var csn int64
+    for i, conn := range tx.conns {
+        start := time.Now()
+        err := conn.QueryRow("select dtm_prepare($1, $2)", tx.Gid, csn).Scan(&csn)
+        tx.span("vote", i, start)
+        if err != nil {
+            tx.Failed = i
+            tx.Rollback()
+            return err
+        }
+    }
+    tx.Csn = csn
+    for i, conn := range tx.conns {
+        start := time.Now()
+        _, err := conn.Exec("select dtm_end_prepare($1, $2)", tx.Gid, csn)
+        tx.span("end_prepare", i, start)
+        if err != nil {
+            tx.Failed = i
+            return err
+        }
+    }
+    for i, conn := range tx.conns {
+        start := time.Now()
+        _, err := conn.Exec("commit prepared '" + tx.Gid + "'")
+        tx.span("commit_prepared", i, start)
+        if err != nil {
+            tx.Failed = i
+            return err
+        }
+    }
+    tx.State = Committed
+    return nil
+}
+
+func (csnProtocol) Functions() map[string]int {
+    return map[string]int{
+        "dtm_extend": 1,
+        "dtm_access": 2,
+        "dtm_begin_prepare": 1,
+        "dtm_prepare": 2,
+        "dtm_end_prepare": 2,
+    }
+}
+
+type xidProtocol struct{}
+
+func (xidProtocol) JoinsBeforeBegin() bool {
+    return true
+}
+
+// Snapshot of the transaction is its global xid
+func (xidProtocol) Join(tx *GlobalTx) error {
+    snapshotStart := time.Now()
+    for i, conn := range tx.conns {
+        var err error
+        start := time.Now()
+        if i == 0 {
+            err = conn.QueryRow("select dtm_begin_transaction()::bigint").Scan(&tx.Snapshot)
+            tx.span("extend", i, start)
+        } else {
+            _, err = conn.Exec("select dtm_join_transaction($1)", int32(tx.Snapshot))
+            tx.span("access", i, start)
+        }
+        if err != nil {
+            return err
+        }
+        tx.Snapshots[i] = tx.Snapshot
+    }
+    tx.SnapshotTime = time.Since(snapshotStart)
+    return nil
+}
+
+// The arbiter makes plain commits atomic
+func (xidProtocol) Commit(tx *GlobalTx) error {
+    return tx.CommitLocal()
+}
+
+func (xidProtocol) Functions() map[string]int {
+    return map[string]int{
+        "dtm_begin_transaction": 0,
+        "dtm_join_transaction": 1,
+    }
+}
+
+type twoPhaseProtocol struct{}
+
+func (twoPhaseProtocol) JoinsBeforeBegin() bool {
+    return false
+}
+
+// Nothing is shared
+func (twoPhaseProtocol) Join(tx *GlobalTx) error {
+    return nil
+}
+
+// If any participant fails to prepare, the transaction is rolled back
+// everywhere. Once all are prepared the transaction is committed, a
+// failure then leaves it prepared on the rest of participants.
+func (twoPhaseProtocol) Commit(tx *GlobalTx) error {
+    for i, conn := range tx.conns {
+        start := time.Now()
+        _, err := conn.Exec("prepare transaction '" + tx.Gid + "'")
+        tx.span("prepare", i, start)
+        if err != nil {
+            tx.Failed = i
+            tx.Rollback()
+            return err
+        }
+        tx.prepared[i] = true
+    }
+    tx.State = Prepared
+
+    for i, conn := range tx.conns {
+        start := time.Now()
+        _, err := conn.Exec("commit prepared '" + tx.Gid + "'")
+        tx.span("commit_prepared", i, start)
+        if err != nil {
+            tx.Failed = i
+            return err
+        }
+    }
+    tx.State = Committed
+    return nil
+}
+
+func (twoPhaseProtocol) Functions() map[string]int {
+    return map[string]int{}
+}
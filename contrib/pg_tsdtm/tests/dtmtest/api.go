@@ -0,0 +1,119 @@
+// Package dtmtest runs distributed transactions against a cluster of
+// PostgreSQL nodes with DTM and checks that they stay atomic and isolated.
+// It is what the transfers command is made of, so that other programs and
+// CI pipelines can embed the same tests:
+//
+//  cluster, err := dtmtest.LoadCluster("nodes.json")
+//  ...
+//  config := dtmtest.DefaultConfig()
+//  config.Workers = 4
+//  config.Duration = time.Minute
+//  runner := dtmtest.Runner{Cluster: cluster, Config: config}
+//  report, err := runner.Run()
+//  ...
+//  if failures := report.Failures(); len(failures) > 0 {
+//      ...
+//  }
+//
+// Workloads other than the built-in ones implement Workload and are either
+// registered with RegisterWorkload under a name for Config.Workload or
+// given to the Runner directly.
+//
+// The harness keeps the state of the run in package variables: only one
+// run may be in progress at a time.
+package dtmtest
+
+import (
+    "flag"
+    "fmt"
+    "github.com/jackc/pgx"
+)
+
+// Nodes of the cluster taking part in global transactions, and hot
+// standbys of every node if any, see Config.StandbyReads
+type Cluster struct {
+    Nodes []pgx.ConnConfig
+    Standbys [][]pgx.ConnConfig
+}
+
+// LoadCluster reads the cluster config file described at ClusterConfig
+func LoadCluster(path string) (cluster Cluster, err error) {
+    defer func() {
+        if e := recover(); e != nil {
+            err = fmt.Errorf("%s: %v", path, e)
+        }
+    }()
+
+    config, err := load_config(path)
+    if err != nil {
+        return Cluster{}, err
+    }
+    for _, node := range config.Nodes {
+        cluster.Nodes = append(cluster.Nodes, node.connConfig())
+        var replicas []pgx.ConnConfig
+        for _, standby := range node.Standbys {
+            replicas = append(replicas, standby.connConfig())
+        }
+        cluster.Standbys = append(cluster.Standbys, replicas)
+    }
+    return cluster, nil
+}
+
+// DefaultConfig returns the settings the transfers command runs with when
+// no flags are given
+func DefaultConfig() Config {
+    saved := cfg
+    cfg = Config{}
+    RegisterFlags(flag.NewFlagSet("dtmtest", flag.ContinueOnError))
+    defaults := cfg
+    cfg = saved
+    return defaults
+}
+
+// RegisterWorkload makes the workload available as Config.Workload. The
+// built-in workloads are registered the same way.
+func RegisterWorkload(name string, create func() Workload) {
+    register_workload(name, create)
+}
+
+// Workload of the Runner given instead of Config.Workload
+var customWorkload Workload
+
+// Runner runs one workload against the cluster with the checks and faults
+// the config asks for. The paths to the cluster config and to the
+// bootstrap and compose files of Config are ignored, the nodes are those
+// of the Cluster.
+type Runner struct {
+    Cluster Cluster
+    Config Config
+    // Runs instead of the one named by Config.Workload if set
+    Workload Workload
+}
+
+// Run returns the report of the run, or an error if the config is wrong
+// or the cluster has failed to set up the workload. Checks failed by the
+// cluster are not errors, see Report.Failures.
+func (r *Runner) Run() (report Report, err error) {
+    cfg = r.Config
+    nodes = r.Cluster.Nodes
+    standbys = r.Cluster.Standbys
+    if standbys == nil {
+        standbys = make([][]pgx.ConnConfig, len(nodes))
+    }
+    orchestrator = nil
+    if err := check_config(); err != nil {
+        return Report{}, err
+    }
+    if _, ok := workloads[cfg.Workload]; !ok && r.Workload == nil {
+        return Report{}, fmt.Errorf("unknown workload '%s', available: %v", cfg.Workload, workload_names())
+    }
+
+    customWorkload = r.Workload
+    defer func() {
+        customWorkload = nil
+        if e := recover(); e != nil {
+            err = fmt.Errorf("%v", e)
+        }
+    }()
+    return run(), nil
+}
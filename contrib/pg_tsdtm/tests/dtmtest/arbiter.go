@@ -0,0 +1,297 @@
+package dtmtest
+
+import (
+    "fmt"
+    osexec "os/exec"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+    "github.com/digoal/postgres_cluster/contrib/arbiter/xtm"
+    "github.com/digoal/postgres_cluster/contrib/pg_tsdtm/tests/dtmclient"
+)
+
+// Arbiter failover scenario, see -arbiter-stop-cmd: the arbiter is killed
+// once in the middle of the run and started again. Transactions failing
+// meanwhile are counted, and the history (enabled automatically) verifies
+// afterwards that no committed transfer was lost and no aborted one
+// became visible.
+//
+// With -arbiters, replicas of the arbiter by raft or standbys taking over
+// its datadir, the one answering HELLO is the leader: it is stopped
+// -arbiter-failovers times, the run goes on as soon as another endpoint
+// answers and the stopped one is started again after -arbiter-outage. The
+// xids given by the arbiter with -protocol xid are remembered with the
+// outcome the workers have seen, and after every leader change as well as
+// at the end of the run the leader is asked for their status: a commit
+// the new leader does not know is a lost decision, a rolled back
+// transaction it says is committed is a flipped one.
+type Outage struct {
+    sync.Mutex
+    down bool
+    restarted time.Time
+    recovered time.Duration
+    errors int64
+    leaderChanges int
+    failover time.Duration  // the longest time without a leader
+    committed []uint32
+    rolledBack []uint32
+    checked int64
+    lost int64
+    flipped int64
+}
+
+var outage Outage
+
+// Called by workers for every failed transaction
+func (o *Outage) Error() {
+    o.Lock()
+    if o.down {
+        o.errors++
+    }
+    o.Unlock()
+}
+
+// Called by workers for every committed transaction: the first commit
+// after restart ends the outage
+func (o *Outage) Commit() {
+    o.Lock()
+    if o.down && !o.restarted.IsZero() {
+        o.down = false
+        o.recovered = time.Since(o.restarted)
+    }
+    o.Unlock()
+}
+
+func (o *Outage) Errors() int64 {
+    o.Lock()
+    defer o.Unlock()
+    return o.errors
+}
+
+// Time from restart of the arbiter till the first commit
+func (o *Outage) Recovery() time.Duration {
+    o.Lock()
+    defer o.Unlock()
+    return o.recovered
+}
+
+// Remember the outcome of the attempt of the transaction of the arbiter
+func (o *Outage) Decided(tx *dtmclient.GlobalTx, err error) {
+    if tx == nil || tx.Snapshot == 0 {
+        return
+    }
+    o.Lock()
+    defer o.Unlock()
+    if err == nil && tx.State == dtmclient.Committed {
+        o.committed = append(o.committed, uint32(tx.Snapshot))
+    } else if err == errRolledBack {
+        o.rolledBack = append(o.rolledBack, uint32(tx.Snapshot))
+    }
+}
+
+func (o *Outage) Decisions() (checked, lost, flipped int64) {
+    o.Lock()
+    defer o.Unlock()
+    return o.checked, o.lost, o.flipped
+}
+
+func (o *Outage) LeaderChanges() (int, time.Duration) {
+    o.Lock()
+    defer o.Unlock()
+    return o.leaderChanges, o.failover
+}
+
+func arbiter_endpoints() []string {
+    var endpoints []string
+    for _, e := range strings.Split(cfg.Arbiters, ",") {
+        if e = strings.TrimSpace(e); e != "" {
+            endpoints = append(endpoints, e)
+        }
+    }
+    return endpoints
+}
+
+// Commands may refer to the arbiter as %a (HOST:PORT) and %i (its number
+// in -arbiters)
+func arbiter_cmd(template string, endpoint int) string {
+    if endpoint < 0 {
+        return template
+    }
+    cmd := strings.Replace(template, "%a", arbiter_endpoints()[endpoint], -1)
+    return strings.Replace(cmd, "%i", strconv.Itoa(endpoint), -1)
+}
+
+func arbiter_hello(addr string) bool {
+    conn, err := xtm.Dial(addr)
+    if err != nil {
+        return false
+    }
+    defer conn.Close()
+    return conn.Hello() == nil
+}
+
+// The endpoint answering HELLO other than except, -1 if none does
+func arbiter_leader(except int) int {
+    for i, addr := range arbiter_endpoints() {
+        if i != except && arbiter_hello(addr) {
+            return i
+        }
+    }
+    return -1
+}
+
+// Ask the leader about every transaction decided so far
+func verify_decisions(leader int) {
+    conn, err := xtm.Dial(arbiter_endpoints()[leader])
+    if err != nil {
+        fmt.Printf("[arbiter] decisions not verified: %v\n", err)
+        return
+    }
+    defer conn.Close()
+
+    outage.Lock()
+    committed := append([]uint32(nil), outage.committed...)
+    rolledBack := append([]uint32(nil), outage.rolledBack...)
+    outage.Unlock()
+
+    var lost, flipped int64
+    for _, xid := range committed {
+        status, err := conn.Status(xid, false)
+        if err != nil {
+            fmt.Printf("[arbiter] decisions not verified: %v\n", err)
+            return
+        }
+        if status != xtm.ResTransactionCommitted {
+            fmt.Printf("[arbiter] committed xid %d is %d at %s\n", xid, status, arbiter_endpoints()[leader])
+            lost++
+        }
+    }
+    for _, xid := range rolledBack {
+        status, err := conn.Status(xid, false)
+        if err != nil {
+            fmt.Printf("[arbiter] decisions not verified: %v\n", err)
+            return
+        }
+        if status == xtm.ResTransactionCommitted {
+            fmt.Printf("[arbiter] rolled back xid %d is committed at %s\n", xid, arbiter_endpoints()[leader])
+            flipped++
+        }
+    }
+    fmt.Printf("[arbiter] %d decisions verified at %s, %d lost, %d flipped\n",
+        len(committed) + len(rolledBack), arbiter_endpoints()[leader], lost, flipped)
+
+    outage.Lock()
+    outage.checked += int64(len(committed) + len(rolledBack))
+    outage.lost += lost
+    outage.flipped += flipped
+    outage.Unlock()
+}
+
+// At the end of the run, once the leader is there
+func verify_final_decisions() {
+    deadline := time.Now().Add(reconnectTimeout)
+    for time.Now().Before(deadline) {
+        if leader := arbiter_leader(-1); leader >= 0 {
+            verify_decisions(leader)
+            return
+        }
+        time.Sleep(100 * time.Millisecond)
+    }
+    fmt.Println("[arbiter] no leader, decisions not verified")
+}
+
+func run_arbiter_cmd(cmd string) {
+    out, err := osexec.Command("sh", "-c", cmd).CombinedOutput()
+    if err != nil {
+        fmt.Printf("[arbiter] '%s' failed: %v\n%s", cmd, err, out)
+    }
+}
+
+func arbiter_failover(stop chan struct{}, wg *sync.WaitGroup) {
+    defer wg.Done()
+
+    wait := cfg.ArbiterOutageAfter
+    failovers := cfg.ArbiterFailovers
+    if cfg.Arbiters == "" {
+        failovers = 1
+    }
+    for n := 0; n < failovers; n++ {
+        select {
+        case <-stop:
+            if n == 0 {
+                fmt.Println("[arbiter] workers finished before the outage")
+            }
+            return
+        case <-time.After(wait):
+        }
+        wait = cfg.ArbiterOutageAfter
+        if !arbiter_outage(stop) {
+            return
+        }
+    }
+}
+
+// Returns false if the run has ended meanwhile
+func arbiter_outage(stop chan struct{}) bool {
+    leader := -1
+    if cfg.Arbiters != "" {
+        if leader = arbiter_leader(-1); leader < 0 {
+            fmt.Println("[arbiter] no leader to stop")
+            return true
+        }
+        fmt.Printf("[arbiter] stopping leader %s\n", arbiter_endpoints()[leader])
+    } else {
+        fmt.Println("[arbiter] stopping")
+    }
+    outage.Lock()
+    outage.down = true
+    outage.Unlock()
+    stopped := time.Now()
+    run_arbiter_cmd(arbiter_cmd(cfg.ArbiterStopCmd, leader))
+
+    restart := time.After(cfg.ArbiterOutage)
+    if cfg.Arbiters != "" {
+    elect:
+        for {
+            if next := arbiter_leader(leader); next >= 0 {
+                took := time.Since(stopped)
+                fmt.Printf("[arbiter] %s took over in %v\n", arbiter_endpoints()[next], took)
+                outage.Lock()
+                outage.leaderChanges++
+                if took > outage.failover {
+                    outage.failover = took
+                }
+                outage.Unlock()
+                verify_decisions(next)
+                break
+            }
+            select {
+            case <-stop:
+                break elect
+            case <-restart:
+                fmt.Println("[arbiter] no endpoint took over")
+                break elect
+            case <-time.After(100 * time.Millisecond):
+            }
+        }
+    }
+
+    ended := false
+    select {
+    case <-stop:
+        ended = true
+    case <-restart:
+    }
+
+    if leader >= 0 {
+        fmt.Printf("[arbiter] starting %s\n", arbiter_endpoints()[leader])
+    } else {
+        fmt.Println("[arbiter] starting")
+    }
+    run_arbiter_cmd(arbiter_cmd(cfg.ArbiterStartCmd, leader))
+    outage.Lock()
+    outage.restarted = time.Now()
+    outage.Unlock()
+    return !ended
+}
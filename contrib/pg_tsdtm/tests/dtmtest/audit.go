@@ -0,0 +1,93 @@
+package dtmtest
+
+import (
+    "fmt"
+    "sort"
+    "strconv"
+    "strings"
+    "github.com/jackc/pgx"
+    "github.com/digoal/postgres_cluster/contrib/pg_tsdtm/tests/dtmclient"
+)
+
+// Server-side history of accounts, see -audit: every update of a transfer
+// also appends a row to t_audit on the same node in the same transaction,
+// with all the participants of the global transaction. Once the run is
+// over the tables of all nodes are joined: every global transaction should
+// be either on all of its participants or on none of them, and the changes
+// of every account should add up to its balance.
+func create_audit(conns []*pgx.Conn) {
+    for _, conn := range conns {
+        exec(conn, "drop table if exists t_audit")
+        exec(conn, "create table t_audit(account int, old bigint, new bigint, gid text, participants text)")
+    }
+}
+
+func drop_audit(conns []*pgx.Conn) {
+    for _, conn := range conns {
+        exec(conn, "drop table if exists t_audit")
+    }
+}
+
+// Nodes of the transaction as stored in t_audit, e.g. "0,2"
+func participants_list(order []int) string {
+    nodes := append([]int(nil), order...)
+    sort.Ints(nodes)
+    var list []string
+    for _, node := range nodes {
+        list = append(list, strconv.Itoa(node))
+    }
+    return strings.Join(list, ",")
+}
+
+func audit_update(tx *dtmclient.GlobalTx, participant int, conn *pgx.Conn, u *Update, participants string) error {
+    stmt, err := prepared(conn, "audit", "insert into t_audit values ($1, $2, $3, $4, $5)")
+    if err != nil {
+        return err
+    }
+    _, err = tx.Exec(participant, stmt, u.Account, u.Balance - int64(u.Delta), u.Balance, tx.Gid, participants)
+    return err
+}
+
+func check_audit(conns []*pgx.Conn) int {
+    anomalies := 0
+
+    // nodes the transaction was found on and those it should be on
+    found := make(map[string][]int)
+    expected := make(map[string]string)
+    for i, conn := range conns {
+        rows, err := conn.Query("select gid, min(participants), count(distinct participants) from t_audit group by gid")
+        checkErr(err)
+        for rows.Next() {
+            var gid, participants string
+            var variants int
+            checkErr(rows.Scan(&gid, &participants, &variants))
+            if variants != 1 {
+                fmt.Printf("[audit] transaction '%s' has different participants on node %d\n", gid, i)
+                anomalies++
+            }
+            found[gid] = append(found[gid], i)
+            expected[gid] = participants
+        }
+        checkErr(rows.Err())
+    }
+    for gid, nodes := range found {
+        if participants_list(nodes) != expected[gid] {
+            fmt.Printf("[audit] transaction '%s' of nodes %s is only on nodes %v\n", gid, expected[gid], nodes)
+            anomalies++
+        }
+    }
+
+    for i, conn := range conns {
+        var broken int64
+        checkErr(conn.QueryRow(
+            "select count(*) from t left join " +
+            "(select account, sum(new - old) as delta from t_audit group by account) a on a.account = t.u " +
+            "where t.v <> $1 + coalesce(a.delta, 0)", cfg.InitAmount).Scan(&broken))
+        if broken != 0 {
+            fmt.Printf("[audit] %d accounts on node %d do not match their history\n", broken, i)
+            anomalies += int(broken)
+        }
+    }
+    fmt.Printf("[audit] %d global transactions checked\n", len(found))
+    return anomalies
+}
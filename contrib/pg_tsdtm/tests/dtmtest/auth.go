@@ -0,0 +1,221 @@
+package dtmtest
+
+import (
+    "bufio"
+    "fmt"
+    "net/url"
+    "os"
+    "path/filepath"
+    "regexp"
+    "strconv"
+    "strings"
+    "github.com/jackc/pgx"
+)
+
+// Credentials of the nodes not given in the config or connection strings
+// are looked up the way libpq does it: the user and password from PGUSER
+// and PGPASSWORD, then the password from the password file, PGPASSFILE or
+// ~/.pgpass. Nodes may also name a service of the connection service file,
+// PGSERVICEFILE or ~/.pg_service.conf and then pg_service.conf of
+// PGSYSCONFDIR, with "service" in the config or service=name in -conn.
+func authenticate(conf *pgx.ConnConfig) {
+    if conf.User == "" {
+        conf.User = os.Getenv("PGUSER")
+    }
+    if conf.Password == "" {
+        conf.Password = os.Getenv("PGPASSWORD")
+    }
+    if conf.Password == "" {
+        conf.Password = pgpass_password(*conf)
+    }
+}
+
+func home_file(name string) string {
+    home := os.Getenv("HOME")
+    if home == "" {
+        return ""
+    }
+    return filepath.Join(home, name)
+}
+
+// Password of the first matching line of the password file, empty if none
+func pgpass_password(conf pgx.ConnConfig) string {
+    path := os.Getenv("PGPASSFILE")
+    if path == "" {
+        path = home_file(".pgpass")
+    }
+    if path == "" {
+        return ""
+    }
+    info, err := os.Stat(path)
+    if err != nil {
+        return ""
+    }
+    if info.Mode().Perm() & 0077 != 0 {
+        fmt.Printf("WARNING: password file %s has group or world access, ignored; " +
+            "permissions should be u=rw (0600) or less\n", path)
+        return ""
+    }
+    f, err := os.Open(path)
+    if err != nil {
+        return ""
+    }
+    defer f.Close()
+
+    host := conf.Host
+    if host == "" || strings.HasPrefix(host, "/") {
+        host = "localhost"
+    }
+    port := conf.Port
+    if port == 0 {
+        port = 5432
+    }
+    user := conf.User
+    if user == "" {
+        user = os.Getenv("USER")
+    }
+    want := []string{host, strconv.Itoa(int(port)), conf.Database, user}
+
+    scanner := bufio.NewScanner(f)
+    for scanner.Scan() {
+        line := scanner.Text()
+        if strings.HasPrefix(line, "#") {
+            continue
+        }
+        fields := split_pgpass(line)
+        if len(fields) != 5 {
+            continue
+        }
+        matches := true
+        for i, w := range want {
+            matches = matches && (fields[i] == "*" || fields[i] == w)
+        }
+        if matches {
+            return fields[4]
+        }
+    }
+    return ""
+}
+
+// Fields of a line of the password file separated by colons, backslash
+// escapes colons and backslashes
+func split_pgpass(line string) []string {
+    var fields []string
+    var field []byte
+    for i := 0; i < len(line); i++ {
+        switch c := line[i]; {
+        case c == '\\' && i + 1 < len(line):
+            i++
+            field = append(field, line[i])
+        case c == ':':
+            fields = append(fields, string(field))
+            field = nil
+        default:
+            field = append(field, c)
+        }
+    }
+    return append(fields, string(field))
+}
+
+// Parameters of the service in the service files as key=value pairs
+func service_params(name string) (string, error) {
+    var paths []string
+    if path := os.Getenv("PGSERVICEFILE"); path != "" {
+        paths = append(paths, path)
+    } else if path := home_file(".pg_service.conf"); path != "" {
+        paths = append(paths, path)
+    }
+    if dir := os.Getenv("PGSYSCONFDIR"); dir != "" {
+        paths = append(paths, filepath.Join(dir, "pg_service.conf"))
+    }
+    for _, path := range paths {
+        params, found, err := read_service(path, name)
+        if err != nil {
+            return "", err
+        }
+        if found {
+            return params, nil
+        }
+    }
+    return "", fmt.Errorf("service '%s' not found in %v", name, paths)
+}
+
+func read_service(path string, name string) (params string, found bool, err error) {
+    f, err := os.Open(path)
+    if os.IsNotExist(err) {
+        return "", false, nil
+    }
+    if err != nil {
+        return "", false, err
+    }
+    defer f.Close()
+
+    var pairs []string
+    in := false
+    scanner := bufio.NewScanner(f)
+    for scanner.Scan() {
+        line := strings.TrimSpace(scanner.Text())
+        if line == "" || strings.HasPrefix(line, "#") {
+            continue
+        }
+        if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+            if in {
+                break
+            }
+            in = line[1:len(line) - 1] == name
+            found = found || in
+            continue
+        }
+        if in {
+            kv := strings.SplitN(line, "=", 2)
+            if len(kv) != 2 {
+                return "", false, fmt.Errorf("%s: bad line '%s' of service '%s'", path, line, name)
+            }
+            pairs = append(pairs, strings.TrimSpace(kv[0]) + "=" + strings.TrimSpace(kv[1]))
+        }
+    }
+    return strings.Join(pairs, " "), found, scanner.Err()
+}
+
+// Replace service=name of the key=value connection string with the
+// parameters of the service, the rest of the string overrides them
+func expand_service(connstr string) (string, error) {
+    var rest []string
+    service := ""
+    for _, pair := range strings.Fields(connstr) {
+        if strings.HasPrefix(pair, "service=") {
+            service = strings.TrimPrefix(pair, "service=")
+        } else {
+            rest = append(rest, pair)
+        }
+    }
+    if service == "" {
+        return connstr, nil
+    }
+    params, err := service_params(service)
+    if err != nil {
+        return "", err
+    }
+    return strings.Join(append([]string{params}, rest...), " "), nil
+}
+
+var passwordParam = regexp.MustCompile(`(^|\s)password\s*=\s*('([^'\\]|\\.)*'|\S*)`)
+
+// The connection string without its password, which is then looked up
+// as any other left out
+func strip_password(connstr string) string {
+    if strings.HasPrefix(connstr, "postgres://") || strings.HasPrefix(connstr, "postgresql://") {
+        u, err := url.Parse(connstr)
+        if err != nil {
+            return "<unparsable connection string>"
+        }
+        if u.User != nil {
+            u.User = url.User(u.User.Username())
+        }
+        query := u.Query()
+        query.Del("password")
+        u.RawQuery = query.Encode()
+        return u.String()
+    }
+    return strings.TrimSpace(passwordParam.ReplaceAllString(connstr, "$1"))
+}
@@ -0,0 +1,41 @@
+package dtmtest
+
+import (
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "testing"
+    "github.com/jackc/pgx"
+)
+
+func TestPgpass(t *testing.T) {
+    dir, err := ioutil.TempDir("", "pgpass")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer os.RemoveAll(dir)
+    path := filepath.Join(dir, "pgpass")
+    lines := "# comment\n" +
+        "db1:5432:postgres:bench:first\n" +
+        "localhost:*:*:bench:sock\\:et\n" +
+        "*:*:*:*:any\n"
+    if err := ioutil.WriteFile(path, []byte(lines), 0600); err != nil {
+        t.Fatal(err)
+    }
+    saved := os.Getenv("PGPASSFILE")
+    defer os.Setenv("PGPASSFILE", saved)
+    os.Setenv("PGPASSFILE", path)
+
+    for _, c := range []struct {
+        conf pgx.ConnConfig
+        password string
+    }{
+        {pgx.ConnConfig{Host: "db1", Database: "postgres", User: "bench"}, "first"},
+        {pgx.ConnConfig{Host: "/tmp", Port: 5433, Database: "bench", User: "bench"}, "sock:et"},
+        {pgx.ConnConfig{Host: "db2", Port: 5432, Database: "postgres", User: "other"}, "any"},
+    } {
+        if password := pgpass_password(c.conf); password != c.password {
+            t.Errorf("password of %s:%d is '%s' instead of '%s'", c.conf.Host, c.conf.Port, password, c.password)
+        }
+    }
+}
@@ -0,0 +1,177 @@
+package dtmtest
+
+import (
+    "encoding/json"
+    "fmt"
+    "os"
+    osexec "os/exec"
+    "path/filepath"
+    "strings"
+    "github.com/jackc/pgx"
+)
+
+// Self-contained run on a cluster started just for it, see -bootstrap and
+// transfers/bootstrap.json for an example. Every node gets its own data
+// directory under Datadir, initialized and started with the binaries from
+// Bindir (PostgreSQL with pg_dtm installed) on consecutive ports from
+// BasePort.
+// The arbiter, if the DTM in use needs one, is started with ArbiterCmd.
+// Everything is stopped after the run and the data directories are
+// removed unless the run has failed or Keep is set.
+type LocalCluster struct {
+    Bindir string `json:"bindir"`
+    Datadir string `json:"datadir"`
+    Nodes int `json:"nodes"`
+    BasePort uint16 `json:"base_port"`
+    // Extra lines of postgresql.conf of every node
+    Settings []string `json:"settings"`
+    ArbiterCmd string `json:"arbiter_cmd"`
+    Keep bool `json:"keep"`
+
+    arbiter *osexec.Cmd
+    started int
+}
+
+// Settings pg_dtm can not work without, before the user ones
+var bootstrapSettings = []string{
+    "shared_preload_libraries = 'pg_dtm'",
+    "max_prepared_transactions = 1000",
+    "max_connections = 500",
+    "listen_addresses = '127.0.0.1'",
+    "fsync = off",
+}
+
+func load_bootstrap(path string) (*LocalCluster, error) {
+    f, err := os.Open(path)
+    if err != nil {
+        return nil, err
+    }
+    defer f.Close()
+
+    c := &LocalCluster{Nodes: 2, BasePort: 5432}
+    if err := json.NewDecoder(f).Decode(c); err != nil {
+        return nil, fmt.Errorf("%s: %v", path, err)
+    }
+    if c.Datadir == "" {
+        c.Datadir = filepath.Join(os.TempDir(), "transfers-cluster")
+    }
+    for _, bin := range []string{"initdb", "pg_ctl"} {
+        if _, err := osexec.LookPath(c.bin(bin)); err != nil {
+            return nil, fmt.Errorf("%s: %v", path, err)
+        }
+    }
+    return c, nil
+}
+
+func (c *LocalCluster) bin(name string) string {
+    if c.Bindir == "" {
+        return name
+    }
+    return filepath.Join(c.Bindir, name)
+}
+
+func (c *LocalCluster) datadir(node int) string {
+    return filepath.Join(c.Datadir, fmt.Sprintf("node%d", node))
+}
+
+func (c *LocalCluster) port(node int) uint16 {
+    return c.BasePort + uint16(node)
+}
+
+func (c *LocalCluster) ConnConfigs() []pgx.ConnConfig {
+    configs := make([]pgx.ConnConfig, c.Nodes)
+    for i := range configs {
+        configs[i] = pgx.ConnConfig{Host: "127.0.0.1", Port: c.port(i), Database: "postgres"}
+    }
+    return configs
+}
+
+func run_cmd(name string, args ...string) error {
+    out, err := osexec.Command(name, args...).CombinedOutput()
+    if err != nil {
+        return fmt.Errorf("'%s %s' failed: %v\n%s", name, strings.Join(args, " "), err, out)
+    }
+    return nil
+}
+
+// Up initializes and starts all nodes and the arbiter, stopping whatever
+// has been started if any of them fails
+func (c *LocalCluster) Up() error {
+    if err := os.RemoveAll(c.Datadir); err != nil {
+        return err
+    }
+    if err := os.MkdirAll(c.Datadir, 0755); err != nil {
+        return err
+    }
+
+    if c.ArbiterCmd != "" {
+        fmt.Printf("[bootstrap] starting arbiter: %s\n", c.ArbiterCmd)
+        c.arbiter = osexec.Command("sh", "-c", c.ArbiterCmd)
+        log, err := os.Create(filepath.Join(c.Datadir, "arbiter.log"))
+        if err != nil {
+            return err
+        }
+        defer log.Close()
+        c.arbiter.Stdout, c.arbiter.Stderr = log, log
+        if err := c.arbiter.Start(); err != nil {
+            c.arbiter = nil
+            return err
+        }
+    }
+
+    for i := 0; i < c.Nodes; i++ {
+        if err := c.start_node(i); err != nil {
+            c.Down(false)
+            return err
+        }
+        c.started++
+    }
+    return nil
+}
+
+func (c *LocalCluster) start_node(node int) error {
+    dir := c.datadir(node)
+    fmt.Printf("[bootstrap] node %d: %s, port %d\n", node, dir, c.port(node))
+    if err := run_cmd(c.bin("initdb"), "-D", dir, "-A", "trust"); err != nil {
+        return err
+    }
+
+    conf, err := os.OpenFile(filepath.Join(dir, "postgresql.conf"), os.O_APPEND | os.O_WRONLY, 0600)
+    if err != nil {
+        return err
+    }
+    settings := append([]string{fmt.Sprintf("port = %d", c.port(node))}, bootstrapSettings...)
+    if cfg.Fsync != "" {
+        // the later line wins
+        settings = append(settings, "fsync = " + cfg.Fsync)
+    }
+    for _, line := range append(settings, c.Settings...) {
+        fmt.Fprintln(conf, line)
+    }
+    if err := conf.Close(); err != nil {
+        return err
+    }
+
+    return run_cmd(c.bin("pg_ctl"), "-D", dir, "-l", filepath.Join(dir, "postgres.log"), "-w", "start")
+}
+
+// Down stops the nodes and the arbiter, the data directories are removed
+// if the run went fine
+func (c *LocalCluster) Down(passed bool) {
+    for i := 0; i < c.started; i++ {
+        if err := run_cmd(c.bin("pg_ctl"), "-D", c.datadir(i), "-m", "fast", "-w", "stop"); err != nil {
+            fmt.Printf("[bootstrap] %v\n", err)
+        }
+    }
+    c.started = 0
+    if c.arbiter != nil {
+        c.arbiter.Process.Kill()
+        c.arbiter.Wait()
+        c.arbiter = nil
+    }
+    if passed && !c.Keep {
+        os.RemoveAll(c.Datadir)
+    } else {
+        fmt.Printf("[bootstrap] data directories and logs are kept in %s\n", c.Datadir)
+    }
+}
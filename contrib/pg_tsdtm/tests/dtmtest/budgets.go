@@ -0,0 +1,107 @@
+package dtmtest
+
+import (
+    "fmt"
+    "strings"
+    "sync/atomic"
+    "time"
+)
+
+// Acceptance budgets of the run, see -max-abort-rate, -max-worker-abort-rate
+// and -max-p99: a run exceeding one of them fails as one finding anomalies
+// does, so that PASS or FAIL at the end is all a release gate has to look
+// at. They are saved in the report, which is judged by its own budgets
+// wherever it is read. Zero is no budget; invariant violations are never
+// allowed.
+type Budgets struct {
+    MaxAbortRate float64 `json:"max_abort_rate"`              // percent of failed attempts
+    MaxWorkerAbortRate float64 `json:"max_worker_abort_rate"`  // of any worker
+    MaxP99 float64 `json:"max_p99_ms"`
+}
+
+func budgets_of_config() Budgets {
+    return Budgets{
+        MaxAbortRate: cfg.MaxAbortRate,
+        MaxWorkerAbortRate: cfg.MaxWorkerAbortRate,
+        MaxP99: ms(cfg.MaxP99),
+    }
+}
+
+func (b Budgets) any() bool {
+    return b.MaxAbortRate > 0 || b.MaxWorkerAbortRate > 0 || b.MaxP99 > 0
+}
+
+// Attempts of every worker and the failed ones, the same as abort_rate
+// counts them: deliberate rollbacks are neither
+var workerAttempts []int64
+var workerFailures []int64
+
+func record_attempt(worker int, err error) {
+    if err == errRolledBack || worker >= len(workerAttempts) {
+        return
+    }
+    atomic.AddInt64(&workerAttempts[worker], 1)
+    if err != nil {
+        atomic.AddInt64(&workerFailures[worker], 1)
+    }
+}
+
+func reset_worker_attempts() {
+    for i := range workerAttempts {
+        atomic.StoreInt64(&workerAttempts[i], 0)
+        atomic.StoreInt64(&workerFailures[i], 0)
+    }
+}
+
+func worker_abort_rates() []float64 {
+    rates := make([]float64, len(workerAttempts))
+    for i := range rates {
+        if attempts := atomic.LoadInt64(&workerAttempts[i]); attempts > 0 {
+            rates[i] = float64(atomic.LoadInt64(&workerFailures[i])) * 100 / float64(attempts)
+        }
+    }
+    return rates
+}
+
+// The worker with the most failed attempts
+func worst_worker(r Report) (worker int, rate float64) {
+    worker = -1
+    for i := range r.WorkerAbortRates {
+        if worker < 0 || r.WorkerAbortRates[i] > rate {
+            worker, rate = i, r.WorkerAbortRates[i]
+        }
+    }
+    return worker, rate
+}
+
+func (r Report) budget_failures() []string {
+    var failures []string
+    b := r.Budgets
+    if rate := abort_rate(r); b.MaxAbortRate > 0 && rate > b.MaxAbortRate {
+        failures = append(failures, fmt.Sprintf("abort rate %0.2f%% over the budget of %g%%", rate, b.MaxAbortRate))
+    }
+    if b.MaxWorkerAbortRate > 0 {
+        var over []string
+        for i, rate := range r.WorkerAbortRates {
+            if rate > b.MaxWorkerAbortRate {
+                over = append(over, fmt.Sprintf("%d (%0.2f%%)", i, rate))
+            }
+        }
+        if len(over) > 0 {
+            failures = append(failures, fmt.Sprintf("abort rate of workers %s over the budget of %g%%",
+                strings.Join(over, ", "), b.MaxWorkerAbortRate))
+        }
+    }
+    if b.MaxP99 > 0 && r.Latency.P99 > b.MaxP99 {
+        failures = append(failures, fmt.Sprintf("p99 latency %0.3fms over the budget of %0.3fms", r.Latency.P99, b.MaxP99))
+    }
+    return failures
+}
+
+func print_budgets(r Report) {
+    b := r.Budgets
+    worker, rate := worst_worker(r)
+    fmt.Printf("Budgets: abort rate %0.2f%% (max %g%%), worst worker %d %0.2f%% (max %g%%), p99 %v (max %v)\n",
+        abort_rate(r), b.MaxAbortRate, worker, rate, b.MaxWorkerAbortRate,
+        time.Duration(r.Latency.P99 * float64(time.Millisecond)), time.Duration(b.MaxP99 * float64(time.Millisecond)))
+}
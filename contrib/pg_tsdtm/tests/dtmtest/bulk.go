@@ -0,0 +1,106 @@
+package dtmtest
+
+import (
+    "fmt"
+    "sort"
+    "sync/atomic"
+    "time"
+    "github.com/jackc/pgx"
+    "github.com/digoal/postgres_cluster/contrib/pg_tsdtm/tests/dtmclient"
+)
+
+// Big write sets: every node has -bulk-rows rows in t_bulk and every
+// transaction moves money between ranges of -bulk-size rows on -fanout
+// nodes, one range update per node, so that snapshots and commits are
+// measured with thousands of rows locked and written by a transaction
+// rather than one. Every row of the paying range gives to the rows of the
+// others, the total stays the same. Ranges of different workers overlap,
+// so the nodes are updated in their order as in the hotrow workload.
+type BulkWorkload struct {}
+
+// Rows updated by committed transactions
+var nBulkRows int64
+
+func init() {
+    register_workload("bulk", func() Workload { return new(BulkWorkload) })
+}
+
+func (b *BulkWorkload) ExpectedTotal() int64 {
+    return int64(len(nodes)) * int64(cfg.BulkRows) * int64(cfg.InitAmount)
+}
+
+func (b *BulkWorkload) TotalQuery() string {
+    return "select sum(v) from t_bulk"
+}
+
+func (b *BulkWorkload) Setup(conns []*pgx.Conn) {
+    create_extension(conns)
+    for _, conn := range conns {
+        exec(conn, "drop table if exists t_bulk")
+        exec(conn, "create table t_bulk(id int, v bigint)")
+        exec(conn, "insert into t_bulk select id, $2 from generate_series(0, $1 - 1) id",
+            cfg.BulkRows, cfg.InitAmount)
+        exec(conn, "alter table t_bulk add primary key (id)")
+        exec(conn, "analyze t_bulk")
+    }
+}
+
+// Nothing is kept in memory
+func (b *BulkWorkload) Attach(conns []*pgx.Conn) {
+}
+
+func (b *BulkWorkload) Iteration(w *Worker) error {
+    owners := pick_nodes(w.Rand, len(w.Conns), cfg.Fanout)
+    sort.Ints(owners)
+    amount := 2*w.Rand.Intn(2) - 1
+    updates := make([]Update, len(owners))
+    for i, node := range owners {
+        updates[i] = Update{Node: node, Account: w.Rand.Intn(cfg.BulkRows - cfg.BulkSize + 1), Delta: amount}
+    }
+    updates[w.Rand.Intn(len(updates))].Delta = -amount * (len(updates) - 1)
+    err := run_transfer(w, updates, bulk_update)
+    if err == nil {
+        atomic.AddInt64(&nBulkRows, int64(len(updates) * cfg.BulkSize))
+    }
+    return err
+}
+
+// The range starts at the account of the update, the balance is the
+// number of rows updated
+func bulk_update(tx *dtmclient.GlobalTx, participant int, conn *pgx.Conn, u *Update) error {
+    stmt, err := prepared(conn, "bulk", "update t_bulk set v = v + $1 where id >= $2 and id < $3")
+    if err != nil {
+        return err
+    }
+    tag, err := tx.Exec(participant, stmt, u.Delta, u.Account, u.Account + cfg.BulkSize)
+    if err != nil {
+        return err
+    }
+    u.Balance = tag.RowsAffected()
+    if u.Balance != int64(cfg.BulkSize) {
+        return fmt.Errorf("%d rows of t_bulk updated from %d instead of %d", u.Balance, u.Account, cfg.BulkSize)
+    }
+    return nil
+}
+
+func (b *BulkWorkload) Verify(conns []*pgx.Conn) int {
+    anomalies := 0
+    for i, conn := range conns {
+        if rows := execQuery(conn, "select count(*) from t_bulk"); rows != int64(cfg.BulkRows) {
+            fmt.Printf("[bulk] node %d has %d rows instead of %d\n", i, rows, cfg.BulkRows)
+            anomalies++
+        }
+    }
+    return anomalies
+}
+
+func (b *BulkWorkload) Teardown(conns []*pgx.Conn) {
+    for _, conn := range conns {
+        exec(conn, "drop table if exists t_bulk")
+    }
+}
+
+// Rows written by committed transactions per second of the run
+func bulk_rate(elapsed time.Duration) float64 {
+    return float64(atomic.LoadInt64(&nBulkRows)) / elapsed.Seconds()
+}
@@ -0,0 +1,75 @@
+package dtmtest
+
+import (
+    "fmt"
+    "github.com/jackc/pgx"
+)
+
+// Optional functions are looked up on every node, features using them are
+// disabled if any node lacks them
+var hasGetCsn bool  // dtm_get_csn(xid) of -check-snapshots, for -protocol csn
+
+// Version of pg_dtm on every node and the functions it provides, checked
+// right after the extension is created so that a node with another API
+// fails the run with a clear message instead of "function does not exist"
+// somewhere in the middle of it. The functions the client calls depend on
+// -protocol, without any of them there is no point to start.
+func check_capabilities(conns []*pgx.Conn) {
+    var versions []string
+    hasGetCsn = true
+    for i, conn := range conns {
+        var version string
+        err := conn.QueryRow("select extversion from pg_extension where extname = 'pg_dtm'").Scan(&version)
+        if err != nil {
+            fail_capabilities("node %d: can not find pg_dtm: %v", i, err)
+        }
+        versions = append(versions, version)
+
+        functions := make(map[string]int)
+        rows, err := conn.Query(
+            "select p.proname::text, p.pronargs::int from pg_proc p " +
+            "join pg_depend d on d.classid = 'pg_proc'::regclass and d.objid = p.oid and d.deptype = 'e' " +
+            "join pg_extension e on e.oid = d.refobjid where e.extname = 'pg_dtm'")
+        checkErr(err)
+        for rows.Next() {
+            var name string
+            var nargs int
+            checkErr(rows.Scan(&name, &nargs))
+            functions[name] = nargs
+        }
+        checkErr(rows.Err())
+
+        for name, nargs := range protocol().Functions() {
+            got, ok := functions[name]
+            if !ok {
+                fail_capabilities("node %d: pg_dtm %s has no %s(), is -protocol %s right?",
+                    i, version, name, cfg.Protocol)
+            }
+            if got != nargs {
+                fail_capabilities("node %d: %s() of pg_dtm %s takes %d arguments instead of %d",
+                    i, name, version, got, nargs)
+            }
+        }
+        if cfg.Protocol != "csn" || functions["dtm_get_csn"] != 1 {
+            hasGetCsn = false
+        }
+    }
+
+    for i := range versions {
+        if versions[i] != versions[0] {
+            fail_capabilities("nodes run different versions of pg_dtm: %v", versions)
+        }
+    }
+    fmt.Printf("pg_dtm %s on all nodes\n", versions[0])
+    if cfg.CheckSnapshots && cfg.Protocol == "csn" && !hasGetCsn {
+        fmt.Println("WARNING: dtm_get_csn() is missing, CSNs of participants are not compared")
+    }
+}
+
+// The failure unwinds the setup like any other, Main reports it as a
+// configuration error rather than a crash
+type capabilityError string
+
+func fail_capabilities(format string, args ...interface{}) {
+    panic(capabilityError(fmt.Sprintf(format, args...)))
+}
@@ -0,0 +1,104 @@
+package dtmtest
+
+import (
+    "fmt"
+    osexec "os/exec"
+    "strconv"
+    "strings"
+    "sync"
+    "sync/atomic"
+    "time"
+    "github.com/jackc/pgx"
+)
+
+// How long to wait for total() to come back to the expected value after
+// the faults are stopped: recovery of restarted nodes takes a while
+const convergenceTimeout = time.Minute
+
+var nKills int64
+var nRestarts int64
+
+// Kill random backend of the node except our own one
+func kill_backend(node int) {
+    conn, err := pgx.Connect(nodes[node])
+    if err != nil {
+        fmt.Printf("[chaos] node %d is unreachable: %v\n", node, err)
+        return
+    }
+    defer conn.Close()
+
+    var killed bool
+    err = conn.QueryRow(
+        "select coalesce(bool_or(pg_terminate_backend(pid)), false) from " +
+        "(select pid from pg_stat_activity " +
+        "where pid <> pg_backend_pid() and datname = current_database() " +
+        "order by random() limit 1) victim").Scan(&killed)
+    if err != nil {
+        fmt.Printf("[chaos] failed to kill backend on node %d: %v\n", node, err)
+        return
+    }
+    if killed {
+        atomic.AddInt64(&nKills, 1)
+    }
+}
+
+func restart_node(node int) {
+    cmd := strings.Replace(cfg.ChaosRestartCmd, "%n", strconv.Itoa(servers[node]), -1)
+    out, err := osexec.Command("sh", "-c", cmd).CombinedOutput()
+    if err != nil {
+        fmt.Printf("[chaos] '%s' failed: %v\n%s", cmd, err, out)
+        return
+    }
+    atomic.AddInt64(&nRestarts, 1)
+}
+
+// Inject faults at random moments until stop is closed
+func chaos(stop chan struct{}, wg *sync.WaitGroup) {
+    defer wg.Done()
+
+    r := new_rand("chaos", 0)
+    for {
+        delay := time.Duration(r.Int63n(2 * int64(cfg.ChaosInterval)))
+        select {
+        case <-stop:
+            fmt.Printf("[chaos] %d backends killed, %d nodes restarted\n",
+                atomic.LoadInt64(&nKills), atomic.LoadInt64(&nRestarts))
+            return
+        case <-time.After(delay):
+        }
+
+        node := r.Intn(len(nodes))
+        if cfg.ChaosRestartCmd != "" && r.Intn(2) == 0 {
+            restart_node(node)
+        } else {
+            kill_backend(node)
+        }
+    }
+}
+
+// After faults have stopped the total amount should return to its initial
+// value, report whether it did
+func check_convergence() bool {
+    expected := expected_total()
+
+    conns := connect_all()
+    defer close_all(conns)
+
+    var sum int64
+    deadline := time.Now().Add(convergenceTimeout)
+    for time.Now().Before(deadline) {
+        var err error
+        if sum, _, err = total(conns); err == nil && sum == expected {
+            fmt.Printf("Total converged to %d\n", sum)
+            return true
+        }
+        if classify(err) == errFatal {
+            reconnect(conns)
+        }
+        time.Sleep(time.Second)
+    }
+    fmt.Printf("Total did not converge: %d instead of %d\n", sum, expected)
+    capture_diagnostics("convergence", fmt.Sprintf("total did not converge in %v: %d instead of %d",
+        convergenceTimeout, sum, expected))
+    return false
+}
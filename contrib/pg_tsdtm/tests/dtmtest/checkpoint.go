@@ -0,0 +1,169 @@
+package dtmtest
+
+import (
+    "encoding/json"
+    "fmt"
+    "io/ioutil"
+    "os"
+    "sync"
+    "sync/atomic"
+    "time"
+)
+
+// Multi-hour soak runs outlive the harness process. With -checkpoint the
+// run saves its state every -checkpoint-interval: the counters, the
+// statistics and the next iteration of every worker. A run restarted with
+// -resume finds the checkpoint and goes on from it instead of setting the
+// workload up again: TPS, latencies and checks cover all the processes,
+// -iterations and -duration are those of the whole run, and iterations
+// are numbered on so that gids of the crashed process do not repeat. The
+// prepared transactions the crashed process has left are finished first.
+// A run that is over removes its checkpoint, so the next -resume starts
+// anew. Without the checkpoint file -resume is a run as usual, a restart
+// loop can always pass it.
+type Checkpoint struct {
+    Time time.Time `json:"time"`
+    Workload string `json:"workload"`
+    Resumes int `json:"resumes"`
+    Warm bool `json:"warm"`            // whether -warmup was over
+    Iterations []int64 `json:"iterations"`
+    Counters map[string]int64 `json:"counters"`
+    Stats StatsState `json:"stats"`
+}
+
+// Counters of reset_state kept by checkpoints, the ones in flight are not
+var checkpointCounters = map[string]*int64{
+    "retries": &nRetries,
+    "aborts": &nAborts,
+    "rollbacks": &nRollbacks,
+    "checks": &nChecks,
+    "violations": &nViolations,
+    "stable_violations": &nStableViolations,
+    "unstable_reads": &nUnstableReads,
+    "stuck": &nStuck,
+    "divergences": &nDivergences,
+    "long_tx": &nLongTx,
+    "standby_reads": &nStandbyReads,
+    "standby_mismatches": &nStandbyMismatches,
+    "xids_burned": &nXidsBurned,
+    "vacuums": &nVacuums,
+    "slots": &nSlots,
+    "ddl": &nDdl,
+    "ddl_timeouts": &nDdlTimeouts,
+    "ddl_mismatches": &nDdlMismatches,
+    "bulk_rows": &nBulkRows,
+    "copy_rows": &nCopyRows,
+    "copy_checks": &nCopyChecks,
+    "copy_torn_reads": &nCopyTornReads,
+    "copy_short_loads": &nCopyShortLoads,
+    "script_errors": &nScriptErrors,
+    "group_timeouts": &nGroupTimeouts,
+    "global_deadlocks": &nGlobalDeadlocks,
+    "deadlock_victims": &nDeadlockVictims,
+    "tpcc_new_orders": &nTpccNewOrders,
+    "tpcc_payments": &nTpccPayments,
+    "tpcc_order_status": &nTpccOrderStatus,
+    "tpcc_remote": &nTpccRemote,
+    "statement_timeouts": &nStatementTimeouts,
+    "lock_timeouts": &nLockTimeouts,
+    "idle_timeouts": &nIdleTimeouts,
+    "session_checks": &nSessionChecks,
+    "read_your_writes": &nReadYourWrites,
+    "monotonic_reads": &nMonotonicReads,
+    "wan_losses": &nWanLosses,
+    "proxy_drops": &nProxyDrops,
+}
+
+// Next iteration of every worker
+var workerIterations []int64
+
+// Times the run has been resumed, saved with the results
+var resumes int
+
+func first_iteration(id int) int {
+    return int(atomic.LoadInt64(&workerIterations[id]))
+}
+
+func started_iteration(id int, i int) {
+    atomic.StoreInt64(&workerIterations[id], int64(i + 1))
+}
+
+func warm() bool {
+    return time.Since(runStart) >= cfg.Warmup
+}
+
+func save_checkpoint(path string) {
+    cp := Checkpoint{
+        Time: time.Now(),
+        Workload: cfg.Workload,
+        Resumes: resumes,
+        Warm: warm(),
+        Iterations: make([]int64, len(workerIterations)),
+        Counters: make(map[string]int64),
+        Stats: stats.State(),
+    }
+    for i := range workerIterations {
+        cp.Iterations[i] = atomic.LoadInt64(&workerIterations[i])
+    }
+    for name, counter := range checkpointCounters {
+        cp.Counters[name] = atomic.LoadInt64(counter)
+    }
+    data, err := json.Marshal(cp)
+    checkErr(err)
+    // a crash in the middle of writing leaves the previous checkpoint
+    tmp := path + ".tmp"
+    checkErr(write_file(tmp, string(data)))
+    checkErr(os.Rename(tmp, path))
+}
+
+// The checkpoint to resume from, nil without -resume or the file
+func load_checkpoint(path string) *Checkpoint {
+    if !cfg.Resume {
+        return nil
+    }
+    data, err := ioutil.ReadFile(path)
+    if os.IsNotExist(err) {
+        fmt.Printf("[checkpoint] %s not found, starting anew\n", path)
+        return nil
+    }
+    checkErr(err)
+    var cp Checkpoint
+    checkErr(json.Unmarshal(data, &cp))
+    if cp.Workload != cfg.Workload || len(cp.Iterations) != cfg.Workers {
+        panic(fmt.Errorf("checkpoint %s is of workload '%s' with %d workers", path, cp.Workload, len(cp.Iterations)))
+    }
+    return &cp
+}
+
+// Go on from the checkpoint, called right after the measuring has begun.
+// Returns whether the warm-up is over, otherwise it is done again and
+// nothing measured before is kept.
+func resume_checkpoint(cp *Checkpoint) bool {
+    resumes = cp.Resumes + 1
+    copy(workerIterations, cp.Iterations)
+    for name, counter := range checkpointCounters {
+        atomic.StoreInt64(counter, cp.Counters[name])
+    }
+    if !cp.Warm {
+        fmt.Printf("[checkpoint] resumed from %s in the middle of warm-up\n", cp.Time.Format(time.RFC3339))
+        return false
+    }
+    stats.Restore(cp.Stats)
+    runStart = stats.Start().Add(-cfg.Warmup)
+    fmt.Printf("[checkpoint] resumed from %s of %v ago, %d commits and %v measured so far\n",
+        cp.Time.Format(time.RFC3339), time.Since(cp.Time).Truncate(time.Second),
+        cp.Stats.Total.Count(), cp.Stats.Elapsed.Truncate(time.Second))
+    return true
+}
+
+func checkpoints(stop chan struct{}, wg *sync.WaitGroup) {
+    defer wg.Done()
+    for {
+        select {
+        case <-stop:
+            return
+        case <-time.After(cfg.CheckpointInterval):
+        }
+        save_checkpoint(cfg.CheckpointPath)
+    }
+}
@@ -0,0 +1,259 @@
+package dtmtest
+
+import (
+    "encoding/json"
+    "flag"
+    "fmt"
+    "os"
+    "sort"
+    "strings"
+    "sync"
+)
+
+// Steps of the harness which can be scripted one by one, e.g.
+//
+//  transfers init -accounts 100000
+//  transfers run -no-setup -duration 10m -journal run.journal -output run.json &
+//  transfers chaos -duration 5m -chaos-interval 10s -chaos-restart-cmd ...
+//  wait
+//  transfers resolve -dry-run
+//  transfers verify -journal run.journal
+//  transfers report run.json
+//  transfers report compare -max-tps-drop 10 old.json run.json
+//  transfers replay -replay-speed 0 run.sql.json
+//  transfers matrix -bootstrap bootstrap.json -matrix-bindirs /usr/local/pg96/bin,/usr/local/pg10/bin
+//
+// Every command takes the same flags, the ones they do not need are ignored.
+// Without a command the whole run is done as by 'run'.
+type command struct {
+    run func(args []string) int
+    help string
+}
+
+var commands = map[string]command{
+    "init": {cmd_init, "create pg_dtm and the data of the workload on all nodes"},
+    "run": {cmd_run, "set the workload up unless -no-setup, run it with the checks and faults, report"},
+    "resolve": {cmd_resolve, "finish prepared transactions left on the nodes by their evidence of commit, see -dry-run"},
+    "verify": {cmd_verify, "finish in-doubt transactions and check the data and -journal left by the runs"},
+    "matrix": {cmd_matrix, "run the workloads on a -bootstrap cluster of every PostgreSQL installation of -matrix-bindirs"},
+    "replay": {cmd_replay, "send the messages recorded with -record to the servers in the same order and timing"},
+    "chaos": {cmd_chaos, "only inject the faults configured by the flags for -duration"},
+    "report": {cmd_report, "print results saved with -output, against -baseline if given; " +
+        "'report compare old new' fails if new has regressed"},
+}
+
+func usage() {
+    fmt.Fprintf(os.Stderr, "Usage: %s [command] [flags] [args]\n\nCommands:\n", os.Args[0])
+    var names []string
+    for name := range commands {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+    for _, name := range names {
+        fmt.Fprintf(os.Stderr, "  %-8s %s\n", name, commands[name].help)
+    }
+}
+
+// Main runs the harness as the transfers command, configured by the command
+// line. The process exits with status 1 if any check has failed.
+func Main() {
+    name, args := "run", os.Args[1:]
+    if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+        name, args = args[0], args[1:]
+    }
+    cmd, ok := commands[name]
+    if !ok {
+        fmt.Fprintf(os.Stderr, "Unknown command '%s'\n\n", name)
+        usage()
+        os.Exit(2)
+    }
+    fs := flag.NewFlagSet(name, flag.ExitOnError)
+    fs.Usage = func() {
+        usage()
+        fmt.Fprintf(os.Stderr, "\nFlags:\n")
+        fs.PrintDefaults()
+    }
+    RegisterFlags(fs)
+    fs.Parse(args)
+    if name != "report" {
+        if err := finish_config(); err != nil {
+            fmt.Printf("ERROR: %v\n", err)
+            os.Exit(1)
+        }
+    }
+    defer func() {
+        if err := recover(); err != nil {
+            if msg, ok := err.(capabilityError); ok {
+                fmt.Printf("ERROR: %s\n", msg)
+                os.Exit(1)
+            }
+            panic(err)
+        }
+    }()
+    if status := cmd.run(fs.Args()); status != 0 {
+        os.Exit(status)
+    }
+}
+
+// Success or failure of the command by the checks it has done
+func pass_or_fail(failures []string) int {
+    if len(failures) > 0 {
+        fmt.Printf("FAIL: %s\n", strings.Join(failures, ", "))
+        return 1
+    }
+    fmt.Println("PASS")
+    return 0
+}
+
+func cmd_init(args []string) int {
+    reset_state()
+    workload = choose_workload()
+    create_databases()
+    open_pools()
+    defer close_pools()
+
+    conns := connect_all()
+    defer close_all(conns)
+    workload.Setup(conns)
+    fmt.Printf("Workload '%s' is set up on %d nodes\n", cfg.Workload, len(nodes))
+    return 0
+}
+
+func cmd_run(args []string) int {
+    handle_signals()
+    if orchestrator != nil {
+        checkErr(orchestrator.Up())
+        defer func() {
+            if err := recover(); err != nil {
+                orchestrator.Down(false)
+                panic(err)
+            }
+        }()
+    }
+
+    results := run()
+    print_results(results)
+    if results.Interrupted {
+        fmt.Println("Interrupted, the results are partial")
+    }
+
+    if cfg.Baseline != "" {
+        report_overhead(read_results(cfg.Baseline), results)
+    }
+    if cfg.Output != "" {
+        write_results(cfg.Output, results)
+    }
+    failures := results.Failures()
+    if orchestrator != nil {
+        orchestrator.Down(len(failures) == 0)
+    }
+    return pass_or_fail(failures)
+}
+
+// What run() does after the workers are done, on the data left by other
+// processes: nothing is in flight any more, so every prepared transaction
+// is finished
+func cmd_verify(args []string) int {
+    reset_state()
+    workload = choose_workload()
+    open_pools()
+    defer close_pools()
+
+    conns := connect_all()
+    attach_workload(conns)
+    close_all(conns)
+
+    results := Report{Converged: true, FinalOk: true}
+    results.Anomalies += resolve_in_doubt(true)
+    if cfg.JournalPath != "" {
+        results.Anomalies += verify_journal(cfg.JournalPath)
+    }
+    if _, balanced := workload.(Balanced); balanced {
+        results.ExpectedTotal = expected_total()
+        results.FinalTotal = final_total()
+        results.FinalOk = results.FinalTotal == results.ExpectedTotal
+        fmt.Printf("Total = %d, expected %d\n", results.FinalTotal, results.ExpectedTotal)
+    }
+    conns = connect_all()
+    results.Anomalies += workload.Verify(conns)
+    close_all(conns)
+    fmt.Printf("Anomalies = %d\n", results.Anomalies)
+    return pass_or_fail(results.Failures())
+}
+
+// Faults for the load run by another process: crashes are left out as
+// they are injected in the middle of commits of this process
+func cmd_chaos(args []string) int {
+    if cfg.Duration == 0 {
+        fmt.Println("ERROR: chaos needs -duration")
+        return 1
+    }
+    if cfg.CrashInterval > 0 {
+        fmt.Println("ERROR: -crash-interval works only with the run command")
+        return 1
+    }
+    reset_state()
+    handle_signals()
+
+    var wg sync.WaitGroup
+    stop := make(chan struct{})
+    if cfg.ChaosInterval > 0 {
+        wg.Add(1)
+        go chaos(stop, &wg)
+    }
+    if cfg.PartitionInterval > 0 {
+        wg.Add(1)
+        go partitions(stop, &wg)
+    }
+    if cfg.ArbiterStopCmd != "" {
+        wg.Add(1)
+        go arbiter_failover(stop, &wg)
+    }
+    if cfg.SkewInterval > 0 {
+        wg.Add(1)
+        go skews(stop, &wg)
+    }
+    sleep_interruptible(cfg.Duration)
+    close(stop)
+    wg.Wait()
+    return 0
+}
+
+// Print every file of results as the run has, the settings of the run are
+// restored from the file
+func cmd_report(args []string) int {
+    if len(args) > 0 && args[0] == "compare" {
+        return cmd_compare(args[1:])
+    }
+    if len(args) == 0 {
+        fmt.Println("ERROR: report needs files saved with -output")
+        return 1
+    }
+    var baseline *Report
+    if cfg.Baseline != "" {
+        base := read_results(cfg.Baseline)
+        baseline = &base
+    }
+    status := 0
+    for _, path := range args {
+        results := read_results(path)
+        restore_config(results)
+        fmt.Printf("== %s\n", path)
+        print_results(results)
+        if baseline != nil {
+            report_overhead(*baseline, results)
+        }
+        if pass_or_fail(results.Failures()) != 0 {
+            status = 1
+        }
+    }
+    return status
+}
+
+// Settings saved with the results, the ones the file lacks keep the values
+// of the flags
+func restore_config(r Report) {
+    encoded, err := json.Marshal(r.Config)
+    checkErr(err)
+    checkErr(json.Unmarshal(encoded, &cfg))
+}
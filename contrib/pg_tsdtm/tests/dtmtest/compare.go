@@ -0,0 +1,58 @@
+package dtmtest
+
+import (
+    "fmt"
+)
+
+// Regression check of two runs of the same test, e.g. before and after a
+// change of pg_dtm in CI: the new run fails if its TPS has dropped by more
+// than -max-tps-drop percent or the share of failed attempts has risen by
+// more than -max-abort-rate-rise percentage points. Whatever the new run
+// has found wrong with the cluster fails it too.
+func cmd_compare(args []string) int {
+    if len(args) != 2 {
+        fmt.Println("ERROR: report compare needs the old and the new file saved with -output")
+        return 1
+    }
+    if cfg.MaxTpsDrop < 0 || cfg.MaxAbortRateRise < 0 {
+        fmt.Println("ERROR: -max-tps-drop and -max-abort-rate-rise can not be negative")
+        return 1
+    }
+    old, cur := read_results(args[0]), read_results(args[1])
+    failures := compare_results(old, cur)
+    return pass_or_fail(append(failures, cur.Failures()...))
+}
+
+// Percentage of the attempts failed, retried or not
+func abort_rate(r Report) float64 {
+    attempts := r.Commits + r.Retries + r.Aborts
+    if attempts == 0 {
+        return 0
+    }
+    return float64(r.Retries + r.Aborts) * 100 / float64(attempts)
+}
+
+func compare_results(old Report, cur Report) []string {
+    var failures []string
+    change := 0.0
+    if old.Tps > 0 {
+        change = (cur.Tps - old.Tps) * 100 / old.Tps
+    }
+    fmt.Printf("TPS %0.2f -> %0.2f (%+0.1f%%)\n", old.Tps, cur.Tps, change)
+    if -change > cfg.MaxTpsDrop {
+        failures = append(failures, fmt.Sprintf("TPS dropped by %0.1f%%", -change))
+    }
+
+    oldRate, rate := abort_rate(old), abort_rate(cur)
+    fmt.Printf("Abort rate %0.2f%% -> %0.2f%% (%+0.2f)\n", oldRate, rate, rate - oldRate)
+    if rate - oldRate > cfg.MaxAbortRateRise {
+        failures = append(failures, fmt.Sprintf("abort rate rose by %0.2f points", rate - oldRate))
+    }
+
+    fmt.Printf("Latency p50 %0.3fms -> %0.3fms, p99 %0.3fms -> %0.3fms\n",
+        old.Latency.P50, cur.Latency.P50, old.Latency.P99, cur.Latency.P99)
+    if old.Nodes != cur.Nodes {
+        fmt.Printf("WARNING: runs on %d and %d nodes\n", old.Nodes, cur.Nodes)
+    }
+    return failures
+}
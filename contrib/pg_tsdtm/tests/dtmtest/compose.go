@@ -0,0 +1,112 @@
+package dtmtest
+
+import (
+    "fmt"
+    "io/ioutil"
+    "os"
+    osexec "os/exec"
+    "path/filepath"
+    "strings"
+    "time"
+    "github.com/jackc/pgx"
+)
+
+// Cluster the run takes place on when the harness starts it itself: a
+// local one with -bootstrap or containers with -compose
+type Orchestrator interface {
+    // Start everything and wait until the nodes accept connections
+    Up() error
+    // Stop everything, passed tells whether the run has found no problems
+    Down(passed bool)
+}
+
+var orchestrator Orchestrator
+
+// How long the containers have to accept connections after 'up'
+const composeReadyTimeout = 2 * time.Minute
+
+// Cluster with the arbiter launched by docker compose, see -compose and
+// transfers/docker/docker-compose.yml. The nodes are those of -config or
+// -conn, i.e. the ports the compose file publishes. If the run fails, logs of all the
+// services are saved to -compose-results.
+type ComposeCluster struct {
+    File string
+    Project string
+    ResultsDir string
+}
+
+func (c *ComposeCluster) compose(args ...string) ([]byte, error) {
+    args = append([]string{"compose", "-f", c.File, "-p", c.Project}, args...)
+    out, err := osexec.Command("docker", args...).CombinedOutput()
+    if err != nil {
+        return out, fmt.Errorf("'docker %s' failed: %v\n%s", strings.Join(args, " "), err, out)
+    }
+    return out, nil
+}
+
+func (c *ComposeCluster) Up() error {
+    fmt.Printf("[compose] starting %s as project %s\n", c.File, c.Project)
+    if _, err := c.compose("up", "-d"); err != nil {
+        return err
+    }
+    if err := wait_ready(composeReadyTimeout); err != nil {
+        c.Down(false)
+        return err
+    }
+    return nil
+}
+
+// Wait for every node to answer a query
+func wait_ready(timeout time.Duration) error {
+    deadline := time.Now().Add(timeout)
+    for i, node := range nodes {
+        for {
+            conn, err := pgx.Connect(node)
+            if err == nil {
+                _, err = conn.Exec("select 1")
+                conn.Close()
+            }
+            if err == nil {
+                break
+            }
+            if time.Now().After(deadline) {
+                return fmt.Errorf("node %d is not ready after %v: %v", i, timeout, err)
+            }
+            time.Sleep(time.Second)
+        }
+    }
+    return nil
+}
+
+func (c *ComposeCluster) Down(passed bool) {
+    if !passed {
+        c.collect_logs()
+    }
+    if _, err := c.compose("down", "-v"); err != nil {
+        fmt.Printf("[compose] %v\n", err)
+    }
+}
+
+// Log of every service to <service>.log in the results directory
+func (c *ComposeCluster) collect_logs() {
+    out, err := c.compose("config", "--services")
+    if err != nil {
+        fmt.Printf("[compose] %v\n", err)
+        return
+    }
+    if err := os.MkdirAll(c.ResultsDir, 0755); err != nil {
+        fmt.Printf("[compose] %v\n", err)
+        return
+    }
+    for _, service := range strings.Fields(string(out)) {
+        log, err := c.compose("logs", "--no-color", "--timestamps", service)
+        if err != nil {
+            fmt.Printf("[compose] %v\n", err)
+        }
+        path := filepath.Join(c.ResultsDir, service + ".log")
+        if err := ioutil.WriteFile(path, log, 0644); err != nil {
+            fmt.Printf("[compose] %v\n", err)
+        }
+    }
+    fmt.Printf("[compose] logs of all services are saved in %s\n", c.ResultsDir)
+}
@@ -0,0 +1,230 @@
+package dtmtest
+
+import (
+    "encoding/json"
+    "fmt"
+    "math/rand"
+    "net"
+    "net/http"
+    "strconv"
+    "sync"
+    "sync/atomic"
+    "time"
+)
+
+// Closed when the paused workers should go on, nil while they run
+var pause struct {
+    sync.Mutex
+    resumed chan struct{}
+}
+
+// Partitions started by the requests, healed before stop_control returns
+var controlEvents sync.WaitGroup
+
+func paused() bool {
+    pause.Lock()
+    defer pause.Unlock()
+    return pause.resumed != nil
+}
+
+// Wait while the run is paused, false if interrupted meanwhile
+func wait_resumed() bool {
+    for !interrupted() {
+        pause.Lock()
+        resumed := pause.resumed
+        pause.Unlock()
+        if resumed == nil {
+            return true
+        }
+        select {
+        case <-resumed:
+        case <-time.After(100 * time.Millisecond):
+        }
+    }
+    return false
+}
+
+// Live state of the run served on /stats
+type LiveStats struct {
+    Elapsed float64 `json:"elapsed_sec"`
+    Paused bool `json:"paused"`
+    TargetTps float64 `json:"target_tps"`
+    Commits int64 `json:"commits"`
+    Tps float64 `json:"tps"`
+    Aborts int64 `json:"aborts"`
+    Retries int64 `json:"retries"`
+    Rollbacks int64 `json:"rollbacks"`
+    InFlight int64 `json:"in_flight"`
+    Latency Latency `json:"latency"`
+    SnapshotLatency Latency `json:"snapshot_latency"`
+    PhaseLatency map[string]Latency `json:"phase_latency"`
+    Kills int64 `json:"kills"`
+    Restarts int64 `json:"restarts"`
+    Partitions int64 `json:"partitions"`
+}
+
+func live_stats() LiveStats {
+    total := stats.Total()
+    snapshots := stats.Snapshots()
+    elapsed := time.Since(stats.Start())
+    phases := make(map[string]Latency)
+    for phase, h := range stats.Phases() {
+        phases[phase] = latency_of(&h)
+    }
+    return LiveStats{
+        Elapsed: elapsed.Seconds(),
+        Paused: paused(),
+        TargetTps: current_rate(),
+        Commits: total.Count(),
+        Tps: float64(total.Count()) / elapsed.Seconds(),
+        Aborts: atomic.LoadInt64(&nAborts),
+        Retries: atomic.LoadInt64(&nRetries),
+        Rollbacks: atomic.LoadInt64(&nRollbacks),
+        InFlight: atomic.LoadInt64(&nInFlight),
+        Latency: latency_of(&total),
+        SnapshotLatency: latency_of(&snapshots),
+        PhaseLatency: phases,
+        Kills: atomic.LoadInt64(&nKills),
+        Restarts: atomic.LoadInt64(&nRestarts),
+        Partitions: atomic.LoadInt64(&nPartitions),
+    }
+}
+
+// Control of the run from outside while it goes on, served over HTTP on
+// -control-addr:
+//
+//  curl -X POST localhost:8081/pause
+//  curl -X POST localhost:8081/resume
+//  curl -X POST 'localhost:8081/rate?tps=500'
+//  curl -X POST 'localhost:8081/chaos?event=partition&node=1'
+//  curl localhost:8081/stats
+//
+// Paused workers finish their transactions in flight and wait before the
+// next one until resumed, the pause counts against -duration. The rate can only be
+// changed in the runs with -rate. Chaos events are 'kill' of a backend,
+// 'restart' of the node with -chaos-restart-cmd and 'partition' of the
+// node for -partition-duration, of a random node unless given. Stats are
+// those measured so far. The requests are served until stop_control.
+func start_control(addr string) (*http.Server, error) {
+    mux := http.NewServeMux()
+    mux.HandleFunc("/pause", control_handler(control_pause))
+    mux.HandleFunc("/resume", control_handler(control_resume))
+    mux.HandleFunc("/rate", control_handler(control_rate))
+    mux.HandleFunc("/chaos", control_handler(control_chaos))
+    mux.HandleFunc("/stats", func(w http.ResponseWriter, r *http.Request) {
+        w.Header().Set("Content-Type", "application/json")
+        json.NewEncoder(w).Encode(live_stats())
+    })
+
+    listener, err := net.Listen("tcp", addr)
+    if err != nil {
+        return nil, err
+    }
+    server := &http.Server{Handler: mux}
+    go server.Serve(listener)
+    fmt.Printf("Serving control of the run on %s\n", listener.Addr())
+    return server, nil
+}
+
+// Stop serving the requests and wait for the events they have started, the
+// paused workers go on
+func stop_control(server *http.Server) {
+    server.Close()
+    controlEvents.Wait()
+    pause.Lock()
+    if pause.resumed != nil {
+        close(pause.resumed)
+        pause.resumed = nil
+    }
+    pause.Unlock()
+}
+
+// Requests changing the run are POSTs, the error of the action is sent
+// back as a bad request
+func control_handler(action func(r *http.Request) (string, error)) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        if r.Method != "POST" {
+            http.Error(w, "use POST", http.StatusMethodNotAllowed)
+            return
+        }
+        done, err := action(r)
+        if err != nil {
+            http.Error(w, err.Error(), http.StatusBadRequest)
+            return
+        }
+        fmt.Printf("[control] %s\n", done)
+        fmt.Fprintln(w, done)
+    }
+}
+
+func control_pause(r *http.Request) (string, error) {
+    pause.Lock()
+    defer pause.Unlock()
+    if pause.resumed != nil {
+        return "", fmt.Errorf("already paused")
+    }
+    pause.resumed = make(chan struct{})
+    return "workers paused", nil
+}
+
+func control_resume(r *http.Request) (string, error) {
+    pause.Lock()
+    defer pause.Unlock()
+    if pause.resumed == nil {
+        return "", fmt.Errorf("not paused")
+    }
+    close(pause.resumed)
+    pause.resumed = nil
+    if cfg.Rate > 0 {
+        // the schedule goes on from now rather than catching up the pause
+        set_rate(current_rate())
+    }
+    return "workers resumed", nil
+}
+
+func control_rate(r *http.Request) (string, error) {
+    if cfg.Rate <= 0 {
+        return "", fmt.Errorf("the run has no schedule to change, start it with -rate")
+    }
+    tps, err := strconv.ParseFloat(r.FormValue("tps"), 64)
+    if err != nil || tps <= 0 {
+        return "", fmt.Errorf("tps should be a positive number")
+    }
+    set_rate(tps)
+    return fmt.Sprintf("rate set to %g tps", tps), nil
+}
+
+func control_chaos(r *http.Request) (string, error) {
+    node := rand.Intn(len(nodes))
+    if s := r.FormValue("node"); s != "" {
+        n, err := strconv.Atoi(s)
+        if err != nil || n < 0 || n >= len(nodes) {
+            return "", fmt.Errorf("node should be between 0 and %d", len(nodes) - 1)
+        }
+        node = n
+    }
+    switch event := r.FormValue("event"); event {
+    case "kill":
+        kill_backend(node)
+    case "restart":
+        if cfg.ChaosRestartCmd == "" {
+            return "", fmt.Errorf("restart needs -chaos-restart-cmd")
+        }
+        restart_node(node)
+    case "partition":
+        if !run_partition_cmd("cut", node) {
+            return "", fmt.Errorf("failed to cut off node %d", node)
+        }
+        atomic.AddInt64(&nPartitions, 1)
+        controlEvents.Add(1)
+        go func() {
+            defer controlEvents.Done()
+            time.Sleep(cfg.PartitionDuration)
+            run_partition_cmd("heal", node)
+            resolve_in_doubt(false)
+        }()
+    default:
+        return "", fmt.Errorf("unknown event '%s', should be 'kill', 'restart' or 'partition'", event)
+    }
+    return fmt.Sprintf("%s of node %d", r.FormValue("event"), node), nil
+}
@@ -0,0 +1,14 @@
+package dtmtest
+
+// Index of the participant coordinating the transaction out of n, see
+// -coordinator. Rotation is shifted by the worker id so that concurrent
+// workers do not pick the same node at the same time.
+func choose_coordinator(w *Worker, n int) int {
+    switch cfg.Coordinator {
+    case "rotate":
+        return (w.Id + w.Iteration) % n
+    case "random":
+        return w.Rand.Intn(n)
+    }
+    return 0
+}
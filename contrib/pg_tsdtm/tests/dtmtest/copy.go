@@ -0,0 +1,205 @@
+package dtmtest
+
+import (
+    "fmt"
+    "sort"
+    "sync"
+    "sync/atomic"
+    "time"
+    "github.com/jackc/pgx"
+    "github.com/digoal/postgres_cluster/contrib/pg_tsdtm/tests/dtmclient"
+)
+
+// Bulk ingest: every transaction loads a batch of -copy-rows rows into
+// t_copy on each of -fanout nodes with COPY FROM STDIN, so that all of the
+// batch or none of it should be there. The rows of a batch give money to
+// each other across the nodes and add up to nothing, a batch committed on
+// some of its nodes only breaks the total. Besides, workers read the batch
+// committed last on all nodes under one snapshot: it should be complete,
+// as it was committed before the snapshot was taken, and a batch seen in
+// part is a torn read. Every attempt loads its own batch, so that a retry
+// after a commit in doubt leaves no duplicates.
+type CopyWorkload struct {
+    next int64          // the batch of the last attempt
+
+    mu sync.Mutex
+    last copyBatch      // committed last by any worker
+}
+
+type copyBatch struct {
+    id int64
+    nodes int
+}
+
+// Rows loaded by committed transactions
+var nCopyRows int64
+var nCopyChecks int64
+var nCopyTornReads int64
+var nCopyShortLoads int64   // COPY which has not taken all rows of the batch
+
+func init() {
+    register_workload("copy", func() Workload { return new(CopyWorkload) })
+}
+
+func (c *CopyWorkload) ExpectedTotal() int64 {
+    return 0
+}
+
+func (c *CopyWorkload) TotalQuery() string {
+    return "select coalesce(sum(v), 0) from t_copy"
+}
+
+func (c *CopyWorkload) Setup(conns []*pgx.Conn) {
+    create_extension(conns)
+    for _, conn := range conns {
+        exec(conn, "drop table if exists t_copy")
+        exec(conn, "create table t_copy(batch bigint, seq int, v bigint)")
+        exec(conn, "create index on t_copy(batch)")
+    }
+    c.Attach(conns)
+}
+
+// Batches of the processes before are kept
+func (c *CopyWorkload) Attach(conns []*pgx.Conn) {
+    c.next, c.last = 0, copyBatch{}
+    for _, conn := range conns {
+        if last := execQuery(conn, "select coalesce(max(batch), 0) from t_copy"); last > c.next {
+            c.next = last
+        }
+    }
+}
+
+func (c *CopyWorkload) Iteration(w *Worker) error {
+    c.mu.Lock()
+    last := c.last
+    c.mu.Unlock()
+    if last.id != 0 && w.Rand.Intn(100) < 20 {
+        return c.check(w, last)
+    }
+    return c.load(w)
+}
+
+// Rows of the batch on every node, the node at the end pays for the rest
+func copy_rows(batch int64, owners []int, amount int) [][][]interface{} {
+    rows := make([][][]interface{}, len(owners))
+    for i := range owners {
+        v := amount
+        if i == len(owners) - 1 {
+            v = -amount * (len(owners) - 1)
+        }
+        for seq := 0; seq < cfg.CopyRows; seq++ {
+            rows[i] = append(rows[i], []interface{}{batch, seq, int64(v)})
+        }
+    }
+    return rows
+}
+
+func (c *CopyWorkload) load(w *Worker) error {
+    owners := pick_nodes(w.Rand, len(w.Conns), cfg.Fanout)
+    sort.Ints(owners)
+    amount := 1 + w.Rand.Intn(100)
+    var participants []*pgx.Conn
+    for _, node := range owners {
+        participants = append(participants, w.Conns[node])
+    }
+    var batch int64
+    err := w.Transaction(func(gtid string) (*dtmclient.GlobalTx, error) {
+        batch = atomic.AddInt64(&c.next, 1)
+        tx, err := begin_global(participants, gtid, w.Isolation)
+        if err != nil {
+            return nil, err
+        }
+        for i, rows := range copy_rows(batch, owners, amount) {
+            n, err := participants[i].CopyFrom(pgx.Identifier{"t_copy"}, []string{"batch", "seq", "v"},
+                pgx.CopyFromRows(rows))
+            if err == nil && n != len(rows) {
+                // a violation rather than an error, the batch is given up
+                fmt.Printf("[copy] %d rows of batch %d copied to node %d instead of %d\n",
+                    n, batch, owners[i], len(rows))
+                atomic.AddInt64(&nCopyShortLoads, 1)
+                err = errRolledBack
+            }
+            if err != nil {
+                tx.Rollback()
+                return tx, err
+            }
+        }
+        return tx, tx.Commit()
+    })
+    if err == nil {
+        atomic.AddInt64(&nCopyRows, int64(len(owners) * cfg.CopyRows))
+        c.mu.Lock()
+        if batch > c.last.id {
+            c.last = copyBatch{batch, len(owners)}
+        }
+        c.mu.Unlock()
+    }
+    return err
+}
+
+// The batch was committed before the check began, all of it should be seen
+func (c *CopyWorkload) check(w *Worker, batch copyBatch) error {
+    var order []int
+    for node := range nodes {
+        order = append(order, node)
+    }
+    return refs_transaction(w, order, true, func(tx *dtmclient.GlobalTx) error {
+        var rows, sum int64
+        seen := 0
+        for i := range tx.Participants() {
+            var n, v int64
+            if err := tx.QueryRow(i, "select count(*), coalesce(sum(v), 0) from t_copy where batch = $1",
+                batch.id).Scan(&n, &v); err != nil {
+                return err
+            }
+            if n > 0 {
+                seen++
+            }
+            rows, sum = rows + n, sum + v
+        }
+        atomic.AddInt64(&nCopyChecks, 1)
+        if seen != batch.nodes || rows != int64(batch.nodes * cfg.CopyRows) || sum != 0 {
+            fmt.Printf("[copy] snapshot %d: batch %d of %d nodes seen on %d with %d rows, sum %d\n",
+                tx.Snapshot, batch.id, batch.nodes, seen, rows, sum)
+            atomic.AddInt64(&nCopyTornReads, 1)
+        }
+        return nil
+    })
+}
+
+func (c *CopyWorkload) Verify(conns []*pgx.Conn) int {
+    anomalies := int(atomic.LoadInt64(&nCopyTornReads) + atomic.LoadInt64(&nCopyShortLoads))
+    sums := make(map[int64]int64)
+    for i, conn := range conns {
+        rows, err := conn.Query("select batch, count(*), sum(v) from t_copy group by batch")
+        checkErr(err)
+        for rows.Next() {
+            var batch, n, v int64
+            checkErr(rows.Scan(&batch, &n, &v))
+            if n != int64(cfg.CopyRows) {
+                fmt.Printf("[copy] batch %d has %d rows on node %d instead of %d\n", batch, n, i, cfg.CopyRows)
+                anomalies++
+            }
+            sums[batch] += v
+        }
+        checkErr(rows.Err())
+    }
+    for batch, sum := range sums {
+        if sum != 0 {
+            fmt.Printf("[copy] batch %d adds up to %d, it is not on all of its nodes\n", batch, sum)
+            anomalies++
+        }
+    }
+    return anomalies
+}
+
+func (c *CopyWorkload) Teardown(conns []*pgx.Conn) {
+    for _, conn := range conns {
+        exec(conn, "drop table if exists t_copy")
+    }
+}
+
+// Rows loaded by committed transactions per second of the run
+func copy_rate(elapsed time.Duration) float64 {
+    return float64(atomic.LoadInt64(&nCopyRows)) / elapsed.Seconds()
+}
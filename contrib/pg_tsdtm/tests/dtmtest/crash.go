@@ -0,0 +1,238 @@
+package dtmtest
+
+import (
+    "fmt"
+    osexec "os/exec"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+    "github.com/jackc/pgx"
+    "github.com/digoal/postgres_cluster/contrib/pg_tsdtm/tests/dtmclient"
+)
+
+// With -crash-interval a node is killed with SIGKILL right after a random
+// step of the commit of some transaction, e.g. after the second participant
+// has voted, then it is started again. Once it has recovered the victim is
+// checked: if its participants agreed on the commit, every participant
+// which has not committed it yet should still have it prepared, otherwise
+// the prepared transaction was lost in the crash and the transaction is
+// left half-committed. Then in-doubt transactions are resolved and the
+// workers go on.
+
+// How long a crashed node may take to accept connections again
+const recoveryTimeout = 2 * time.Minute
+
+// Steps of the commit after which the node may crash, by protocol
+var crashPhases = map[string][]string{
+    "csn": {"prepare", "begin_prepare", "vote", "end_prepare", "commit_prepared"},
+    "xid": {"commit"},
+}
+
+var crash struct {
+    sync.Mutex
+    phase string
+    participant int
+    armed bool
+    node int               // the crashed node
+    victim *dtmclient.GlobalTx
+    done bool
+    fired chan struct{}    // closed when the node is killed
+    finished chan struct{} // closed when the victim has returned to the worker
+    crashes int64
+    halfCommitted int64
+    recovery time.Duration // the longest one
+}
+
+// Data directory of every node, for the default commands
+var dataDirs []string
+
+func crash_cmd(template string, node int) string {
+    cmd := strings.Replace(template, "%n", strconv.Itoa(servers[node]), -1)
+    return strings.Replace(cmd, "%d", dataDirs[node], -1)
+}
+
+func run_crash_cmd(template string, node int) bool {
+    cmd := crash_cmd(template, node)
+    out, err := osexec.Command("sh", "-c", cmd).CombinedOutput()
+    if err != nil {
+        fmt.Printf("[crash] '%s' failed: %v\n%s", cmd, err, out)
+        return false
+    }
+    return true
+}
+
+func read_data_dirs() {
+    dataDirs = make([]string, len(nodes))
+    for i := range nodes {
+        conn, err := pgx.Connect(nodes[i])
+        checkErr(err)
+        checkErr(conn.QueryRow("show data_directory").Scan(&dataDirs[i]))
+        conn.Close()
+    }
+}
+
+// Installed on every global transaction while crashes are on
+func crash_hook(tx *dtmclient.GlobalTx) func(phase string, participant int) {
+    return func(phase string, participant int) {
+        crash.Lock()
+        defer crash.Unlock()
+        if !crash.armed || phase != crash.phase || participant != crash.participant {
+            return
+        }
+        node := node_of(tx.Participants()[participant])
+        if node < 0 {
+            return
+        }
+        crash.armed = false
+        fmt.Printf("[crash] killing node %d after %s of '%s' on participant %d\n",
+            node, phase, tx.Gid, participant)
+        if !run_crash_cmd(cfg.CrashStopCmd, node) {
+            return
+        }
+        crash.node = node
+        crash.victim = tx
+        crash.crashes++
+        close(crash.fired)
+    }
+}
+
+// Called by the worker when the attempt is over
+func crash_finished(tx *dtmclient.GlobalTx) {
+    crash.Lock()
+    defer crash.Unlock()
+    if tx != nil && tx == crash.victim && !crash.done {
+        if tx.State != dtmclient.Committed {
+            record_in_doubt(tx)
+        }
+        crash.done = true
+        close(crash.finished)
+    }
+}
+
+// Wait until the node accepts connections, returns false on timeout
+func wait_recovered(node int) bool {
+    deadline := time.Now().Add(recoveryTimeout)
+    for time.Now().Before(deadline) {
+        conn, err := pgx.Connect(nodes[node])
+        if err == nil {
+            _, err = conn.Exec("select 1")
+            conn.Close()
+            if err == nil {
+                return true
+            }
+        }
+        time.Sleep(100 * time.Millisecond)
+    }
+    return false
+}
+
+// Whether the transaction agreed to be committed is still prepared on every
+// participant which has not committed it before the crash
+func check_victim(tx *dtmclient.GlobalTx) bool {
+    if !committed_in_doubt(tx) {
+        // nobody could commit it without CSN, it is rolled back everywhere
+        return true
+    }
+    committed := make(map[int]bool)
+    for _, span := range tx.Spans {
+        if span.Phase == "commit_prepared" && span.Participant != tx.Failed {
+            committed[span.Participant] = true
+        }
+    }
+    ok := true
+    for i, conn := range tx.Participants() {
+        if committed[i] {
+            continue
+        }
+        node := node_of(conn)
+        direct, err := pgx.Connect(nodes[node])
+        if err != nil {
+            fmt.Printf("[crash] node %d is unreachable: %v\n", node, err)
+            return false
+        }
+        var prepared bool
+        err = direct.QueryRow("select exists(select 1 from pg_prepared_xacts " +
+            "where gid = $1 and database = current_database())", tx.Gid).Scan(&prepared)
+        direct.Close()
+        if err != nil {
+            fmt.Printf("[crash] failed to list prepared transactions on node %d: %v\n", node, err)
+            return false
+        }
+        if !prepared {
+            fmt.Printf("[crash] '%s' is committed on some participants but lost on node %d\n",
+                tx.Gid, node)
+            ok = false
+        }
+    }
+    return ok
+}
+
+// Crash a node at random moments until stop is closed
+func crashes(stop chan struct{}, wg *sync.WaitGroup) {
+    defer wg.Done()
+
+    phases := crashPhases[cfg.Protocol]
+    if cfg.Pipeline {
+        // sent together with prepare
+        phases = []string{"prepare", "vote", "end_prepare", "commit_prepared"}
+    }
+    r := new_rand("crashes", 0)
+    for {
+        delay := time.Duration(r.Int63n(2 * int64(cfg.CrashInterval)))
+        select {
+        case <-stop:
+            fmt.Printf("[crash] %d nodes crashed, %d transactions half-committed\n",
+                crash.crashes, crash.halfCommitted)
+            return
+        case <-time.After(delay):
+        }
+
+        crash.Lock()
+        crash.phase = phases[r.Intn(len(phases))]
+        // every transaction has at least two participants
+        crash.participant = r.Intn(2)
+        crash.victim = nil
+        crash.done = false
+        crash.fired = make(chan struct{})
+        crash.finished = make(chan struct{})
+        crash.armed = true
+        fired, finished := crash.fired, crash.finished
+        crash.Unlock()
+
+        select {
+        case <-stop:
+            crash.Lock()
+            crash.armed = false
+            crash.Unlock()
+            continue
+        case <-fired:
+        }
+        start := time.Now()
+        select {
+        case <-finished:
+        case <-time.After(recoveryTimeout):
+            fmt.Println("[crash] the victim is still running")
+        }
+
+        crash.Lock()
+        node, victim := crash.node, crash.victim
+        crash.Unlock()
+        if !run_crash_cmd(cfg.CrashStartCmd, node) || !wait_recovered(node) {
+            panic(fmt.Sprintf("node %d did not recover after the crash", node))
+        }
+        recovery := time.Since(start)
+        fmt.Printf("[crash] node %d recovered in %v\n", node, recovery)
+
+        ok := check_victim(victim)
+        crash.Lock()
+        if recovery > crash.recovery {
+            crash.recovery = recovery
+        }
+        if !ok {
+            crash.halfCommitted++
+        }
+        crash.Unlock()
+        resolve_in_doubt(false)
+    }
+}
@@ -0,0 +1,90 @@
+package dtmtest
+
+import (
+    "fmt"
+    "strings"
+    "github.com/jackc/pgx"
+)
+
+// With -databases every server of the cluster config serves several
+// participants, one per database: the database of the config and then
+// <database>_1, <database>_2 and so on. Workloads see them as different
+// nodes, so global transactions span both databases of the same server
+// and databases of different servers, and every backend of a transaction
+// belongs to another database.
+
+// Server of every participant, an index into the cluster config
+var servers []int
+
+// Replace every node with its databases, standbys are replaced the same
+// way as they replicate all databases of the node
+func expand_databases() {
+    servers = make([]int, len(nodes))
+    for i := range servers {
+        servers[i] = i
+    }
+    if cfg.Databases <= 1 {
+        return
+    }
+
+    var expanded []pgx.ConnConfig
+    var replicas [][]pgx.ConnConfig
+    servers = nil
+    for i, node := range nodes {
+        for db := 0; db < cfg.Databases; db++ {
+            expanded = append(expanded, with_database(node, db))
+            var copies []pgx.ConnConfig
+            for _, standby := range standbys[i] {
+                copies = append(copies, with_database(standby, db))
+            }
+            replicas = append(replicas, copies)
+            servers = append(servers, i)
+        }
+    }
+    nodes, standbys = expanded, replicas
+}
+
+func database_name(base string, db int) string {
+    if base == "" {
+        base = "postgres"
+    }
+    if db == 0 {
+        return base
+    }
+    return fmt.Sprintf("%s_%d", base, db)
+}
+
+func with_database(conf pgx.ConnConfig, db int) pgx.ConnConfig {
+    conf.Database = database_name(conf.Database, db)
+    return conf
+}
+
+// Create the databases of -databases missing on the servers. They are kept
+// after the run, -teardown drops only what the workload has created in them.
+func create_databases() {
+    if cfg.Databases <= 1 {
+        return
+    }
+    for i, node := range nodes {
+        db := i % cfg.Databases
+        if db == 0 {
+            continue
+        }
+        first := nodes[i - db]
+        conn, err := pgx.Connect(first)
+        checkErr(err)
+        var exists bool
+        err = conn.QueryRow("select exists(select 1 from pg_database where datname = $1)",
+            node.Database).Scan(&exists)
+        checkErr(err)
+        if !exists {
+            fmt.Printf("Creating database %s on node %d\n", node.Database, servers[i])
+            exec(conn, "create database " + quote_ident(node.Database))
+        }
+        conn.Close()
+    }
+}
+
+func quote_ident(name string) string {
+    return `"` + strings.Replace(name, `"`, `""`, -1) + `"`
+}
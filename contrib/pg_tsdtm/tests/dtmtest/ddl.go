@@ -0,0 +1,149 @@
+package dtmtest
+
+import (
+    "fmt"
+    "sync"
+    "sync/atomic"
+    "time"
+    "github.com/jackc/pgx"
+)
+
+// With -ddl-interval the schema of -ddl-table is changed on all nodes in
+// global transactions while the workers keep updating it: a column is
+// added, indexed, the index and then the column are dropped, and so on.
+// Every change should be visible on all nodes once committed and on none
+// when rolled back, which is tried every now and then after some of the
+// participants have prepared it. DDL takes the exclusive lock of the table
+// node by node, so it waits behind workers holding the table on one node
+// while holding it on another one: lock_timeout breaks such distributed
+// deadlocks and the change is tried again later.
+const ddlLockTimeout = time.Second
+
+var nDdl int64
+var nDdlTimeouts int64
+var nDdlMismatches int64
+
+// Step of the cycle of changes, the query checks whether the change is in
+// place on a node
+type ddlStep struct {
+    stmt string
+    check string
+    present bool
+}
+
+func ddl_step(round int, step int) ddlStep {
+    table := cfg.DdlTable
+    column := fmt.Sprintf("ddl_%d", round)
+    index := fmt.Sprintf("%s_ddl_%d", table, round)
+    hasColumn := fmt.Sprintf("select exists(select 1 from pg_attribute where attrelid = '%s'::regclass " +
+        "and attname = '%s' and not attisdropped)", table, column)
+    hasIndex := fmt.Sprintf("select exists(select 1 from pg_class where relname = '%s' and relkind = 'i')", index)
+    switch step {
+    case 0:
+        return ddlStep{fmt.Sprintf("alter table %s add column %s int", table, column), hasColumn, true}
+    case 1:
+        return ddlStep{fmt.Sprintf("create index %s on %s (%s)", index, table, column), hasIndex, true}
+    case 2:
+        return ddlStep{fmt.Sprintf("drop index %s", index), hasIndex, false}
+    default:
+        return ddlStep{fmt.Sprintf("alter table %s drop column %s", table, column), hasColumn, false}
+    }
+}
+
+// Whether every node has the change in place as expected
+func check_ddl(conns []*pgx.Conn, step ddlStep, present bool) error {
+    for i, conn := range conns {
+        var got bool
+        if err := conn.QueryRow(step.check).Scan(&got); err != nil {
+            return err
+        }
+        if got != present {
+            atomic.AddInt64(&nDdlMismatches, 1)
+            fmt.Printf("[ddl] mismatch: '%s' is %v on node %d, should be %v\n",
+                step.stmt, got, i, present)
+        }
+    }
+    return nil
+}
+
+func ddl_changes(stop chan struct{}, wg *sync.WaitGroup) {
+    defer wg.Done()
+
+    conns, err := connect_direct()
+    if err != nil {
+        fmt.Printf("[ddl] failed to connect: %v\n", err)
+        return
+    }
+    defer close_direct(conns)
+    for _, conn := range conns {
+        exec(conn, fmt.Sprintf("set lock_timeout = %d", ddlLockTimeout / time.Millisecond))
+    }
+
+    r := new_rand("ddl", 0)
+    for i, n := 0, 0; ; i++ {
+        select {
+        case <-stop:
+            fmt.Printf("[ddl] %d changes committed, %d lock timeouts\n",
+                atomic.LoadInt64(&nDdl), atomic.LoadInt64(&nDdlTimeouts))
+            return
+        case <-time.After(cfg.DdlInterval):
+        }
+
+        step := ddl_step(n / 4, n % 4)
+        rollback := r.Intn(4) == 0
+        tx, err := begin_global(conns, fmt.Sprintf("ddl.%d", i), "default")
+        if err == nil {
+            for node := range conns {
+                if _, err = tx.Exec(node, step.stmt); err != nil {
+                    tx.Rollback()
+                    break
+                }
+            }
+        }
+        if err == nil {
+            if rollback {
+                err = tx.RollbackAfterPrepare(len(conns) - 1)
+            } else {
+                err = tx.Commit()
+            }
+        }
+        switch classify(err) {
+        case errNone:
+        case errRetry:
+            atomic.AddInt64(&nDdlTimeouts, 1)
+            continue
+        default:
+            fmt.Printf("[ddl] '%s' failed: %v\n", step.stmt, err)
+            return
+        }
+
+        if err := check_ddl(conns, step, step.present != rollback); err != nil {
+            fmt.Printf("[ddl] failed to check '%s': %v\n", step.stmt, err)
+            return
+        }
+        if !rollback {
+            atomic.AddInt64(&nDdl, 1)
+            n++
+        }
+    }
+}
+
+// Undo whatever the last round has left in the table
+func ddl_cleanup(conns []*pgx.Conn) {
+    for _, conn := range conns {
+        rows, err := conn.Query("select attname::text from pg_attribute where attrelid = $1::regclass " +
+            "and attname like 'ddl\\_%' and not attisdropped", cfg.DdlTable)
+        checkErr(err)
+        var columns []string
+        for rows.Next() {
+            var column string
+            checkErr(rows.Scan(&column))
+            columns = append(columns, column)
+        }
+        checkErr(rows.Err())
+        for _, column := range columns {
+            // indexes on the column go with it
+            exec(conn, fmt.Sprintf("alter table %s drop column %s", cfg.DdlTable, column))
+        }
+    }
+}
@@ -0,0 +1,13 @@
+package dtmtest
+
+// Workers 2k and 2k+1 share the same pair of rows on two nodes, worker 2k
+// updates them in one order and worker 2k+1 in the opposite one, so each
+// of them may hold the lock on one node while waiting for the other node.
+func deadlock_pair(id int) (account1, account2, src, dst int) {
+    pair := id / 2
+    src = pair % len(nodes)
+    dst = (pair + 1) % len(nodes)
+    account1 = pair % cfg.Accounts
+    account2 = pair % cfg.Accounts
+    return
+}
@@ -0,0 +1,267 @@
+package dtmtest
+
+import (
+    "fmt"
+    "sort"
+    "strings"
+    "sync"
+    "sync/atomic"
+    "time"
+    "github.com/jackc/pgx"
+)
+
+// Cycles found and transactions cancelled to break them
+var nGlobalDeadlocks int64
+var nDeadlockVictims int64
+
+// Backend of a server, pids of different servers may be the same
+type backend struct {
+    server int
+    pid int32
+}
+
+// Global transactions running on the backends of the workers and the
+// ones chosen as victims which have not noticed it yet
+var globalBackends = struct {
+    sync.Mutex
+    gids map[backend]string
+    victims map[string]bool
+}{gids: make(map[backend]string), victims: make(map[string]bool)}
+
+var errGlobalDeadlock = pgx.PgError{Code: "40P01",
+    Message: "global deadlock detected by the harness, transaction cancelled"}
+
+// Tell the detector that the connections of the nodes run the
+// transaction, the returned function forgets it
+func register_backends(gtid string, conns []*pgx.Conn) func() {
+    if cfg.DeadlockDetect == "" {
+        return func() {}
+    }
+    var backends []backend
+    globalBackends.Lock()
+    for node, conn := range conns {
+        b := backend{servers[node], conn.Pid}
+        globalBackends.gids[b] = gtid
+        backends = append(backends, b)
+    }
+    globalBackends.Unlock()
+    return func() {
+        globalBackends.Lock()
+        for _, b := range backends {
+            delete(globalBackends.gids, b)
+        }
+        globalBackends.Unlock()
+    }
+}
+
+// Whether the attempt has been cancelled by the detector, the error it
+// has failed with is then errGlobalDeadlock
+func deadlock_victim(gtid string) bool {
+    globalBackends.Lock()
+    defer globalBackends.Unlock()
+    victim := globalBackends.victims[gtid]
+    delete(globalBackends.victims, gtid)
+    return victim
+}
+
+// Transaction waiting for another one on the server
+type wait struct {
+    waiter, holder string
+    server int
+    pid int32
+}
+
+// Detector of distributed deadlocks, see -deadlock-detect. Every
+// -deadlock-detect-interval it takes the lock waits of every server from
+// pg_blocking_pids(), maps the backends to the global transactions the
+// workers run on them and looks for cycles of waits going through more
+// than one server: no local detector sees those, they are only broken by
+// lock_timeout otherwise. As the servers are sampled one after another, a
+// cycle is only taken for real if it is there in two samples in a row.
+// With 'cancel' the waiting statement of one transaction of the cycle is
+// cancelled and the transaction is retried as after a local deadlock.
+func deadlock_detector(stop chan struct{}, wg *sync.WaitGroup) {
+    defer wg.Done()
+
+    // one connection per server, pg_locks covers all its databases
+    conns := make(map[int]*pgx.Conn)
+    for node, server := range servers {
+        if conns[server] != nil {
+            continue
+        }
+        conn, err := pgx.Connect(nodes[node])
+        if err != nil {
+            fmt.Printf("[deadlocks] server %d is unreachable, detector stopped: %v\n", server, err)
+            return
+        }
+        defer conn.Close()
+        conns[server] = conn
+    }
+
+    seen := make(map[string]bool)      // cycles of the previous sample
+    reported := make(map[string]bool)  // of them, those already counted
+    for {
+        select {
+        case <-stop:
+            return
+        case <-time.After(cfg.DeadlockDetectInterval):
+        }
+        waits, err := sample_waits(conns)
+        if err != nil {
+            fmt.Printf("[deadlocks] %v\n", err)
+            continue
+        }
+        cycles := global_cycles(waits)
+        now, counted := make(map[string]bool), make(map[string]bool)
+        for key, cycle := range cycles {
+            now[key] = true
+            if !seen[key] {
+                continue
+            }
+            counted[key] = true
+            if !reported[key] {
+                atomic.AddInt64(&nGlobalDeadlocks, 1)
+                fmt.Printf("[deadlocks] global deadlock: %s\n", describe_cycle(cycle))
+                if cfg.DeadlockDetect == "cancel" {
+                    cancel_victim(conns, cycle)
+                }
+            }
+        }
+        seen, reported = now, counted
+    }
+}
+
+// Lock waits of all servers, backends of the workers are named by their
+// transactions, the rest by server and pid
+func sample_waits(conns map[int]*pgx.Conn) ([]wait, error) {
+    var waits []wait
+    for server, conn := range conns {
+        rows, err := conn.Query("select l.pid, b from pg_locks l, unnest(pg_blocking_pids(l.pid)) b " +
+            "where not l.granted")
+        if err != nil {
+            return nil, fmt.Errorf("server %d: %v", server, err)
+        }
+        for rows.Next() {
+            var pid, blocker int32
+            if err := rows.Scan(&pid, &blocker); err != nil {
+                rows.Close()
+                return nil, fmt.Errorf("server %d: %v", server, err)
+            }
+            waits = append(waits, wait{backend_name(server, pid), backend_name(server, blocker), server, pid})
+        }
+        rows.Close()
+        if err := rows.Err(); err != nil {
+            return nil, fmt.Errorf("server %d: %v", server, err)
+        }
+    }
+    return waits, nil
+}
+
+func backend_name(server int, pid int32) string {
+    globalBackends.Lock()
+    defer globalBackends.Unlock()
+    if gid, ok := globalBackends.gids[backend{server, pid}]; ok {
+        return gid
+    }
+    return fmt.Sprintf("server %d pid %d", server, pid)
+}
+
+// Cycles of waits spanning more than one server by their sorted
+// transactions
+func global_cycles(waits []wait) map[string][]wait {
+    edges := make(map[string][]wait)
+    for _, w := range waits {
+        if w.waiter != w.holder {
+            edges[w.waiter] = append(edges[w.waiter], w)
+        }
+    }
+
+    cycles := make(map[string][]wait)
+    done := make(map[string]bool)
+    var path []wait
+    onPath := make(map[string]int)  // vertex -> its position in path
+    var visit func(v string)
+    visit = func(v string) {
+        onPath[v] = len(path)
+        for _, w := range edges[v] {
+            if start, ok := onPath[w.holder]; ok {
+                cycle := append(append([]wait(nil), path[start:]...), w)
+                if spans_servers(cycle) {
+                    cycles[cycle_key(cycle)] = cycle
+                }
+                continue
+            }
+            if !done[w.holder] {
+                path = append(path, w)
+                visit(w.holder)
+                path = path[:len(path) - 1]
+            }
+        }
+        delete(onPath, v)
+        done[v] = true
+    }
+    var vertices []string
+    for v := range edges {
+        vertices = append(vertices, v)
+    }
+    sort.Strings(vertices)
+    for _, v := range vertices {
+        if !done[v] {
+            visit(v)
+        }
+    }
+    return cycles
+}
+
+func spans_servers(cycle []wait) bool {
+    for _, w := range cycle[1:] {
+        if w.server != cycle[0].server {
+            return true
+        }
+    }
+    return false
+}
+
+func cycle_key(cycle []wait) string {
+    var names []string
+    for _, w := range cycle {
+        names = append(names, w.waiter)
+    }
+    sort.Strings(names)
+    return strings.Join(names, ",")
+}
+
+func describe_cycle(cycle []wait) string {
+    var steps []string
+    for _, w := range cycle {
+        steps = append(steps, fmt.Sprintf("'%s' waits for '%s' on server %d", w.waiter, w.holder, w.server))
+    }
+    return strings.Join(steps, ", ")
+}
+
+// Cancel the wait of one transaction of the workers in the cycle, the one
+// with the greatest gtid
+func cancel_victim(conns map[int]*pgx.Conn, cycle []wait) {
+    var victim *wait
+    for i := range cycle {
+        w := &cycle[i]
+        if strings.HasPrefix(w.waiter, "server ") {
+            continue
+        }
+        if victim == nil || w.waiter > victim.waiter {
+            victim = w
+        }
+    }
+    if victim == nil {
+        fmt.Println("[deadlocks] no transaction of the workers to cancel")
+        return
+    }
+    globalBackends.Lock()
+    globalBackends.victims[victim.waiter] = true
+    globalBackends.Unlock()
+    if _, err := conns[victim.server].Exec("select pg_cancel_backend($1)", victim.pid); err != nil {
+        fmt.Printf("[deadlocks] failed to cancel '%s': %v\n", victim.waiter, err)
+        return
+    }
+    atomic.AddInt64(&nDeadlockVictims, 1)
+}
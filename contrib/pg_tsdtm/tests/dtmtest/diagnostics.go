@@ -0,0 +1,154 @@
+package dtmtest
+
+import (
+    "fmt"
+    "io"
+    "os"
+    "path/filepath"
+    "strings"
+    "sync"
+    "time"
+    "github.com/jackc/pgx"
+)
+
+// With -diagnostics-dir every invariant violation, stuck transaction and
+// failed convergence saves the state of all nodes to a bundle directory
+// of its own, one file per node, while the state is still there: what
+// the backends do, the locks they hold and wait for, the prepared
+// transactions and what pg_dtm of the node knows. Bundles are taken at
+// most once every bundleInterval and at most maxBundles per run, a broken
+// cluster breaks the check over and over again.
+const maxBundles = 20
+const bundleInterval = 5 * time.Second
+
+var bundles struct {
+    sync.Mutex
+    paths []string
+    last time.Time
+}
+
+// Queries of a bundle by the name of their section
+var diagnosticQueries = []struct {
+    name string
+    query string
+}{
+    {"activity", "select * from pg_stat_activity"},
+    {"locks", "select l.*, now() - a.query_start as waiting from pg_locks l " +
+        "left join pg_stat_activity a on a.pid = l.pid"},
+    {"prepared", "select * from pg_prepared_xacts"},
+    {"extension", "select extname, extversion from pg_extension where extname = 'pg_dtm'"},
+    {"settings", "select name, setting from pg_settings where name like 'dtm%'"},
+    // the xid protocol only, the rest report the missing function
+    {"dtm snapshot", "select dtm_get_current_snapshot_xmin(), dtm_get_current_snapshot_xmax(), " +
+        "dtm_get_current_snapshot_xcnt()"},
+}
+
+// Bundles saved by the run
+func diagnostic_bundles() []string {
+    bundles.Lock()
+    defer bundles.Unlock()
+    return append([]string(nil), bundles.paths...)
+}
+
+// Save the state of every node, why tells what happened and is also the
+// first line of the summary of the bundle
+func capture_diagnostics(reason string, why string) {
+    if cfg.DiagnosticsDir == "" {
+        return
+    }
+    bundles.Lock()
+    defer bundles.Unlock()
+    if len(bundles.paths) >= maxBundles || time.Since(bundles.last) < bundleInterval {
+        return
+    }
+    bundles.last = time.Now()
+
+    dir := filepath.Join(cfg.DiagnosticsDir,
+        fmt.Sprintf("%s-%02d-%s", bundles.last.Format("20060102-150405"), len(bundles.paths), reason))
+    if err := os.MkdirAll(dir, 0755); err != nil {
+        fmt.Printf("[diagnostics] can not create bundle: %v\n", err)
+        return
+    }
+    summary := fmt.Sprintf("%s\ntime: %s\nseed: %d\nnodes: %d\n",
+        why, bundles.last.Format(time.RFC3339Nano), cfg.Seed, len(nodes))
+    if err := write_file(filepath.Join(dir, "summary.txt"), summary); err != nil {
+        fmt.Printf("[diagnostics] %v\n", err)
+    }
+
+    var wg sync.WaitGroup
+    for i := range nodes {
+        wg.Add(1)
+        go func(node int) {
+            defer wg.Done()
+            if err := capture_node(filepath.Join(dir, fmt.Sprintf("node%d.txt", node)), node); err != nil {
+                fmt.Printf("[diagnostics] node %d: %v\n", node, err)
+            }
+        }(i)
+    }
+    wg.Wait()
+    bundles.paths = append(bundles.paths, dir)
+    fmt.Printf("[diagnostics] state of the nodes saved to %s\n", dir)
+}
+
+func write_file(path string, text string) error {
+    f, err := os.Create(path)
+    if err != nil {
+        return err
+    }
+    if _, err = io.WriteString(f, text); err != nil {
+        f.Close()
+        return err
+    }
+    return f.Close()
+}
+
+// Run every diagnostic query by a connection of its own, the ones of the
+// workers may be the stuck ones
+func capture_node(path string, node int) error {
+    f, err := os.Create(path)
+    if err != nil {
+        return err
+    }
+    defer f.Close()
+
+    conn, err := pgx.Connect(nodes[node])
+    if err != nil {
+        fmt.Fprintf(f, "node is unreachable: %v\n", err)
+        return nil
+    }
+    defer conn.Close()
+    for _, q := range diagnosticQueries {
+        fmt.Fprintf(f, "== %s\n", q.name)
+        if err := write_rows(f, conn, q.query); err != nil {
+            fmt.Fprintf(f, "ERROR: %v\n", err)
+        }
+        fmt.Fprintln(f)
+    }
+    return nil
+}
+
+// Columns of the result as text separated by " | ", the names first
+func write_rows(out io.Writer, conn *pgx.Conn, query string) error {
+    rows, err := conn.Query(query)
+    if err != nil {
+        return err
+    }
+    defer rows.Close()
+    var names []string
+    for _, field := range rows.FieldDescriptions() {
+        names = append(names, field.Name)
+    }
+    fmt.Fprintln(out, strings.Join(names, " | "))
+    for rows.Next() {
+        values, err := rows.Values()
+        if err != nil {
+            return err
+        }
+        columns := make([]string, len(values))
+        for i, v := range values {
+            columns[i] = fmt.Sprint(v)
+        }
+        fmt.Fprintln(out, strings.Join(columns, " | "))
+    }
+    return rows.Err()
+}
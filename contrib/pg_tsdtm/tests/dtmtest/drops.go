@@ -0,0 +1,182 @@
+package dtmtest
+
+import (
+    "fmt"
+    "strings"
+    "sync"
+    "sync/atomic"
+    "time"
+)
+
+// Connections reset by the proxies at chosen points of two-phase commit,
+// see -proxy-drop:
+//
+//     prepare  PREPARE TRANSACTION has run, its reply is lost
+//     commit   COMMIT PREPARED has run, its reply is lost
+//
+// The harness then knows as little as after a failed link: the
+// transaction is left prepared on the node and the client has to decide
+// it in doubt, see record_in_doubt. While the workers run, the in-doubt
+// transactions are resolved every dropInterval, and once they are done
+// every transaction whose connection was reset should be finished on all
+// nodes the way the decision says: rolled back if its prepare was lost, as
+// nobody has voted for the commit then, committed if its commit was.
+// Whether it is committed is told by the markers of -journal.
+const dropInterval = time.Second
+
+var nProxyDrops int64
+
+// Whether the proxies reset connections, only while the workers run
+var dropping int32
+
+// Point of the reset of every transaction, by gid
+var proxyDrops = struct {
+    sync.Mutex
+    points map[string]string
+}{points: make(map[string]string)}
+
+var dropStatements = map[string]string{
+    "prepare": "prepare transaction",
+    "commit": "commit prepared",
+}
+
+func parse_drop_points(spec string) (map[string]bool, error) {
+    points := make(map[string]bool)
+    for _, point := range strings.Split(spec, ",") {
+        point = strings.TrimSpace(point)
+        if point == "" {
+            continue
+        }
+        if _, ok := dropStatements[point]; !ok {
+            return nil, fmt.Errorf("unknown -proxy-drop point '%s', should be prepare or commit", point)
+        }
+        points[point] = true
+    }
+    return points, nil
+}
+
+// The point and the gid of the statement, "" if it is none of them
+func drop_point(sql string) (point string, gid string) {
+    sql = strings.TrimSpace(sql)
+    for point, prefix := range dropStatements {
+        if strings.HasPrefix(strings.ToLower(sql), prefix) {
+            gid = strings.TrimSpace(sql[len(prefix):])
+            if semicolon := strings.Index(gid, ";"); semicolon >= 0 {
+                gid = strings.TrimSpace(gid[:semicolon])
+            }
+            return point, strings.Trim(gid, "'")
+        }
+    }
+    return "", ""
+}
+
+// Arm the connection if the statement is one of -proxy-drop and the dice
+// say so
+func (c *proxyConn) statement(sql string) {
+    point, gid := drop_point(sql)
+    if point == "" || !c.proxy.drops[point] || atomic.LoadInt32(&dropping) == 0 {
+        return
+    }
+    c.proxy.mu.Lock()
+    drop := c.proxy.rand.Intn(100) < cfg.ProxyDropPct
+    c.proxy.mu.Unlock()
+    if drop {
+        c.mu.Lock()
+        c.armed, c.gid = point, gid
+        c.mu.Unlock()
+    }
+}
+
+// Whether the reply of the statement armed has come, then it never gets
+// through
+func (c *proxyConn) dropped() bool {
+    c.mu.Lock()
+    point, gid := c.armed, c.gid
+    c.mu.Unlock()
+    if point == "" {
+        return false
+    }
+    atomic.AddInt64(&nProxyDrops, 1)
+    proxyDrops.Lock()
+    if _, seen := proxyDrops.points[gid]; !seen {
+        proxyDrops.points[gid] = point
+    }
+    proxyDrops.Unlock()
+    fmt.Printf("[proxy] connection to server %d reset after %s of '%s'\n", c.proxy.server, point, gid)
+    return true
+}
+
+func start_drops() {
+    proxyDrops.Lock()
+    proxyDrops.points = make(map[string]string)
+    proxyDrops.Unlock()
+    atomic.StoreInt32(&dropping, 1)
+}
+
+// Resolve the transactions left in doubt by the resets until stop is
+// closed, then stop resetting
+func drop_resolver(stop chan struct{}, wg *sync.WaitGroup) {
+    defer wg.Done()
+    defer atomic.StoreInt32(&dropping, 0)
+    for {
+        select {
+        case <-stop:
+            fmt.Printf("[proxy] %d connections reset\n", atomic.LoadInt64(&nProxyDrops))
+            return
+        case <-time.After(dropInterval):
+        }
+        if atomic.LoadInt64(&nProxyDrops) > 0 {
+            resolve_in_doubt(false)
+        }
+    }
+}
+
+// After the in-doubt transactions are resolved: how many of those whose
+// connection was reset are still prepared somewhere, and how many have
+// ended otherwise than decided. Gids repeat from run to run, the markers
+// are those of the xids of the intent, see verify_journal.
+func check_drops() (unresolved int64, wrong int64) {
+    conns, err := connect_direct()
+    checkErr(err)
+    defer close_direct(conns)
+
+    intents := make(map[string]JournalRecord)
+    if cfg.JournalPath != "" {
+        records, _ := read_journal(cfg.JournalPath)
+        for _, r := range records {
+            intents[r.Gid] = r
+        }
+    }
+
+    proxyDrops.Lock()
+    defer proxyDrops.Unlock()
+    for gid, point := range proxyDrops.points {
+        var prepared, markers int64
+        for _, conn := range conns {
+            var n int64
+            checkErr(conn.QueryRow("select count(*) from pg_prepared_xacts where gid = $1 " +
+                "and database = current_database()", gid).Scan(&n))
+            prepared += n
+        }
+        intent, journaled := intents[gid]
+        for i, node := range intent.Nodes {
+            var n int64
+            checkErr(conns[node].QueryRow("select count(*) from t_journal where gid = $1 and xid = $2",
+                gid, intent.Xids[i]).Scan(&n))
+            markers += n
+        }
+        if prepared > 0 {
+            fmt.Printf("[proxy] '%s' reset after %s is still prepared on %d nodes\n", gid, point, prepared)
+            unresolved++
+        } else if !journaled {
+            continue
+        } else if point == "commit" && markers == 0 {
+            fmt.Printf("[proxy] '%s' reset after commit is rolled back\n", gid)
+            wrong++
+        } else if point == "prepare" && markers > 0 {
+            fmt.Printf("[proxy] '%s' reset after prepare is committed on %d nodes\n", gid, markers)
+            wrong++
+        }
+    }
+    return unresolved, wrong
+}
@@ -0,0 +1,52 @@
+package dtmtest
+
+import (
+    "fmt"
+    "time"
+    "github.com/digoal/postgres_cluster/contrib/pg_tsdtm/tests/dtmclient"
+)
+
+// Profile of the leader, see -dtm-profile: the phases of transactions
+// which are calls of pg_dtm functions, dtm_extend and dtm_access or with
+// the xid protocol dtm_begin_transaction and dtm_join_transaction asking
+// the arbiter, then dtm_begin_prepare, dtm_prepare and dtm_end_prepare
+// agreeing on the commit. Their round trips are added up for every
+// committed transaction, aborted attempts before it included, and compared
+// with its latency: the greater the share, the more the transaction waits
+// for DTM rather than for its statements and 2PC. With -ramp-step the
+// share is reported for every number of workers, showing whether the
+// leader becomes the bottleneck as concurrency goes up.
+var dtmPhases = map[string]bool{
+    "extend": true,
+    "access": true,
+    "begin_prepare": true,
+    "vote": true,
+    "end_prepare": true,
+}
+
+func dtm_time(spans []dtmclient.Span) time.Duration {
+    var d time.Duration
+    for _, span := range spans {
+        if dtmPhases[span.Phase] {
+            d += span.Duration
+        }
+    }
+    return d
+}
+
+func dtm_share(dtm time.Duration, latency time.Duration) float64 {
+    if latency == 0 {
+        return 0
+    }
+    return float64(dtm) / float64(latency)
+}
+
+func print_dtm_profile(r Report) {
+    fmt.Printf("pg_dtm calls: p50=%0.3fms p99=%0.3fms max=%0.3fms per transaction, %0.1f%% of its latency\n",
+        r.DtmLatency.P50, r.DtmLatency.P99, r.DtmLatency.Max, r.DtmShare * 100)
+    for _, phase := range phaseNames {
+        if l, ok := r.PhaseLatency[phase]; ok && dtmPhases[phase] {
+            fmt.Printf("  %-14s p50=%0.3fms p99=%0.3fms\n", phase, l.P50, l.P99)
+        }
+    }
+}
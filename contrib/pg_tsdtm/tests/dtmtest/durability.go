@@ -0,0 +1,86 @@
+package dtmtest
+
+import (
+    "fmt"
+    "github.com/jackc/pgx"
+)
+
+// Durability of commits the run is measured with, see -synchronous-commit
+// and -fsync: synchronous_commit is set in every session of the harness,
+// fsync on the servers with ALTER SYSTEM for the run and reset afterwards.
+// What the nodes have actually used is saved in the report.
+
+var synchronousCommitValues = []string{"on", "off", "local", "remote_write", "remote_apply"}
+
+// Server settings the report keeps of every node
+var durabilitySettings = []string{"synchronous_commit", "fsync", "full_page_writes", "wal_sync_method"}
+
+// Settings of every node as they were during the run
+var nodeSettings []map[string]string
+
+func check_durability() error {
+    if cfg.SynchronousCommit != "" && !contains(synchronousCommitValues, cfg.SynchronousCommit) {
+        return fmt.Errorf("-synchronous-commit should be one of %v", synchronousCommitValues)
+    }
+    if cfg.Fsync != "" && cfg.Fsync != "on" && cfg.Fsync != "off" {
+        return fmt.Errorf("-fsync should be 'on' or 'off'")
+    }
+    return nil
+}
+
+func contains(values []string, value string) bool {
+    for _, v := range values {
+        if v == value {
+            return true
+        }
+    }
+    return false
+}
+
+// Change fsync of every server, value "" resets it to the configured one
+func set_fsync(value string) {
+    for _, node := range server_nodes() {
+        conn, err := pgx.Connect(nodes[node])
+        checkErr(err)
+        if value == "" {
+            exec(conn, "alter system reset fsync")
+        } else {
+            exec(conn, "alter system set fsync = " + value)
+        }
+        exec(conn, "select pg_reload_conf()")
+        conn.Close()
+    }
+}
+
+// Settings of the sessions of the harness on every node
+func read_settings(conns []*pgx.Conn) {
+    nodeSettings = nil
+    for _, conn := range conns {
+        settings := make(map[string]string)
+        for _, name := range durabilitySettings {
+            var value string
+            checkErr(conn.QueryRow("select setting from pg_settings where name = $1", name).Scan(&value))
+            settings[name] = value
+        }
+        nodeSettings = append(nodeSettings, settings)
+    }
+}
+
+// Settings of the first node, the ones of the rest are those which differ
+func print_settings(settings []map[string]string) {
+    if len(settings) == 0 {
+        return
+    }
+    line := "Durability:"
+    for _, name := range durabilitySettings {
+        line += fmt.Sprintf(" %s=%s", name, settings[0][name])
+    }
+    fmt.Println(line)
+    for i, s := range settings[1:] {
+        for _, name := range durabilitySettings {
+            if s[name] != settings[0][name] {
+                fmt.Printf("WARNING: %s=%s on node %d\n", name, s[name], i + 1)
+            }
+        }
+    }
+}
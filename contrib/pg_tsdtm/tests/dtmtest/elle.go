@@ -0,0 +1,127 @@
+package dtmtest
+
+import (
+    "bufio"
+    "encoding/json"
+    "fmt"
+    "os"
+    "strings"
+    "sync"
+    "time"
+)
+
+// History of the fuzz workload for the checkers of Jepsen, see
+// -elle-history: every attempt of a transaction is an invoke operation
+// followed by its completion, ok if committed, fail if rolled back and
+// info if the commit failed and its outcome is unknown, with the micro
+// operations of list-append as their value. In "edn" format lines are
+//
+//  {:index 0, :type :invoke, :f :txn, :value [[:append 3 1] [:r 5 nil]], :process 0, :time 1200}
+//  {:index 1, :type :ok, :f :txn, :value [[:append 3 1] [:r 5 [2 4]]], :process 0, :time 5300}
+//
+// which elle.list-append/check reads, in "json" format they are objects
+// of the same keys as elle-cli takes. Processes are the workers, one whose
+// transaction has ended with info goes on as a new process as Jepsen
+// expects. Time is in nanoseconds since the start of the run.
+type ElleHistory struct {
+    sync.Mutex
+    file *os.File
+    w *bufio.Writer
+    json bool
+    index int64
+    start time.Time
+    processes map[int]int  // of every worker
+}
+
+var elleHistory *ElleHistory
+
+func open_elle_history(path string, format string) *ElleHistory {
+    f, err := os.Create(path)
+    checkErr(err)
+    return &ElleHistory{file: f, w: bufio.NewWriter(f), json: format == "json",
+        start: time.Now(), processes: make(map[int]int)}
+}
+
+func (h *ElleHistory) Close() {
+    h.Lock()
+    defer h.Unlock()
+    checkErr(h.w.Flush())
+    checkErr(h.file.Close())
+}
+
+func (h *ElleHistory) process(worker int) int {
+    if p, ok := h.processes[worker]; ok {
+        return p
+    }
+    return worker
+}
+
+// The operation of the worker begins, reads are not known yet
+func (h *ElleHistory) Invoke(worker int, ops []fuzzOp) {
+    h.Lock()
+    defer h.Unlock()
+    h.write("invoke", h.process(worker), ops, false)
+}
+
+// The operation of the worker ends as the status of the attempt tells
+func (h *ElleHistory) Complete(worker int, t *fuzzTxn) {
+    h.Lock()
+    defer h.Unlock()
+    kind := map[int]string{fuzzCommitted: "ok", fuzzAborted: "fail", fuzzUnknown: "info"}[t.Status]
+    h.write(kind, h.process(worker), t.Ops, t.Status == fuzzCommitted)
+    if t.Status == fuzzUnknown {
+        h.processes[worker] = h.process(worker) + cfg.Workers
+    }
+}
+
+func (h *ElleHistory) write(kind string, process int, ops []fuzzOp, reads bool) {
+    at := time.Since(h.start).Nanoseconds()
+    if h.json {
+        var value [][]interface{}
+        for _, op := range ops {
+            if op.Append != 0 {
+                value = append(value, []interface{}{"append", op.Key, op.Append})
+            } else if reads {
+                value = append(value, []interface{}{"r", op.Key, elems_or_empty(op.Read)})
+            } else {
+                value = append(value, []interface{}{"r", op.Key, nil})
+            }
+        }
+        line, err := json.Marshal(map[string]interface{}{"index": h.index, "type": kind, "f": "txn",
+            "value": value, "process": process, "time": at})
+        checkErr(err)
+        _, err = h.w.Write(append(line, '\n'))
+        checkErr(err)
+    } else {
+        var value []string
+        for _, op := range ops {
+            if op.Append != 0 {
+                value = append(value, fmt.Sprintf("[:append %d %d]", op.Key, op.Append))
+            } else if reads {
+                value = append(value, fmt.Sprintf("[:r %d %s]", op.Key, edn_list(op.Read)))
+            } else {
+                value = append(value, fmt.Sprintf("[:r %d nil]", op.Key))
+            }
+        }
+        _, err := fmt.Fprintf(h.w, "{:index %d, :type :%s, :f :txn, :value [%s], :process %d, :time %d}\n",
+            h.index, kind, strings.Join(value, " "), process, at)
+        checkErr(err)
+    }
+    h.index++
+}
+
+// Reads of empty lists are [], not null
+func elems_or_empty(elems []int64) []int64 {
+    if elems == nil {
+        return []int64{}
+    }
+    return elems
+}
+
+func edn_list(elems []int64) string {
+    var items []string
+    for _, e := range elems {
+        items = append(items, fmt.Sprint(e))
+    }
+    return "[" + strings.Join(items, " ") + "]"
+}
@@ -0,0 +1,87 @@
+package dtmtest
+
+import (
+    "errors"
+    "math/rand"
+    "strings"
+    "sync/atomic"
+    "time"
+    "github.com/jackc/pgx"
+)
+
+// Classes of errors a global transaction may fail with
+const (
+    errNone = iota
+    errRetry // serialization failure or deadlock: the same transaction may succeed later
+    errAbort // any other server-side error: the transaction is rolled back and skipped
+    errFatal // the connection itself is broken: there is no way to continue
+)
+
+const maxBackoff = 100 * time.Millisecond
+
+var nRetries int64
+var nAborts int64
+var nRollbacks int64
+
+// Transaction was rolled back on purpose, see -abort-pct
+var errRolledBack = errors.New("transaction rolled back by the workload")
+
+func classify(err error) int {
+    if err == nil {
+        return errNone
+    }
+    if err == errRolledBack {
+        return errAbort
+    }
+    if _, ok := err.(scriptError); ok {
+        return errAbort
+    }
+    pgerr, ok := err.(pgx.PgError)
+    if !ok {
+        return errFatal
+    }
+    switch pgerr.Code {
+    case "40001", "40P01", "55P03":
+        // lock_not_available is what lock_timeout gives for distributed
+        // deadlocks invisible to local detectors
+        return errRetry
+    case "57P01", "57P02", "57P03", "25P03":
+        // admin_shutdown, crash_shutdown, cannot_connect_now and
+        // idle_in_transaction_session_timeout which ends the session
+        return errFatal
+    }
+    if strings.HasPrefix(pgerr.Code, "08") {
+        return errFatal
+    }
+    return errAbort
+}
+
+func is_deadlock(err error) bool {
+    pgerr, ok := err.(pgx.PgError)
+    return ok && (pgerr.Code == "40P01" || pgerr.Code == "55P03")
+}
+
+// Run fn until it succeeds, fails with non-retryable error or runs out of
+// attempts. Retries are delayed with exponential backoff and jitter.
+// Connection-level failures are returned at once as there is nothing left
+// to retry with, see handle_fatal().
+func with_retries(fn func(attempt int) error) error {
+    backoff := time.Millisecond
+    for attempt := 0; ; attempt++ {
+        err := fn(attempt)
+        switch classify(err) {
+        case errNone:
+            return nil
+        case errFatal, errAbort:
+            return err
+        }
+        if attempt >= cfg.Retries || interrupted() {
+            return err
+        }
+        atomic.AddInt64(&nRetries, 1)
+        time.Sleep(backoff + time.Duration(rand.Int63n(int64(backoff))))
+        if backoff < maxBackoff {
+            backoff *= 2
+        }
+    }
+}
@@ -0,0 +1,108 @@
+package dtmtest
+
+import (
+    "fmt"
+    "strings"
+    "time"
+    "github.com/jackc/pgx"
+    "github.com/digoal/postgres_cluster/contrib/pg_tsdtm/tests/dtmclient"
+)
+
+// With -backend fdw the transfers run on the coordinator alone: accounts
+// of the other nodes are updated through foreign tables of postgres_fdw,
+// which commits the remote transactions one after another when the local
+// one commits. That is how a cluster without DTM is often used, and the
+// same workload run this way shows what DTM costs and what it guarantees:
+// there is neither a global snapshot nor an atomic commit.
+//
+// Every node gets a server and a foreign table t_node<N> for every other
+// node, so the nodes should reach each other by the addresses the harness
+// uses.
+
+func fdw_table(node int) string {
+    return fmt.Sprintf("t_node%d", node)
+}
+
+func quote_literal(value string) string {
+    return "'" + strings.Replace(value, "'", "''", -1) + "'"
+}
+
+func create_fdw(conns []*pgx.Conn) {
+    for i, conn := range conns {
+        exec(conn, "create extension if not exists postgres_fdw")
+        for j, node := range nodes {
+            if j == i {
+                continue
+            }
+            server := fmt.Sprintf("node%d", j)
+            exec(conn, "drop server if exists " + server + " cascade")
+            exec(conn, fmt.Sprintf("create server %s foreign data wrapper postgres_fdw " +
+                "options (host %s, port '%d', dbname %s)",
+                server, quote_literal(node.Host), node.Port, quote_literal(node.Database)))
+            mapping := "options (user " + quote_literal(node.User)
+            if node.Password != "" {
+                mapping += ", password " + quote_literal(node.Password)
+            }
+            exec(conn, "create user mapping for current_user server " + server + " " + mapping + ")")
+            exec(conn, "create foreign table " + fdw_table(j) + "(u int, v int) server " + server +
+                " options (table_name 't')")
+        }
+    }
+}
+
+func drop_fdw(conns []*pgx.Conn) {
+    for i, conn := range conns {
+        for j := range nodes {
+            if j != i {
+                exec(conn, fmt.Sprintf("drop server if exists node%d cascade", j))
+            }
+        }
+    }
+}
+
+// The transfer in a local transaction of the coordinator, the foreign
+// tables of the rest of nodes are updated in the order of the updates
+func fdw_transfer(conns []*pgx.Conn, gtid string, isolation string, updates []Update, coordinator int, end int) (*dtmclient.GlobalTx, error) {
+    conn := conns[coordinator]
+    tx, err := dtmclient.BeginLocalIsolated([]*pgx.Conn{conn}, gtid, isolationNames[isolation])
+    if err != nil {
+        return nil, err
+    }
+    log_transaction(tx)
+
+    for i := range updates {
+        u := &updates[i]
+        if i > 0 {
+            think(cfg.StatementThinkTime)
+        }
+        table := "t"
+        if u.Node != coordinator {
+            table = fdw_table(u.Node)
+        }
+        start := time.Now()
+        var stmt string
+        stmt, err = prepared(conn, "transfer_" + table, "update " + table + " set v = v + $1 where u=$2 returning v")
+        if err == nil {
+            err = tx.QueryRow(0, stmt, u.Delta, u.Account).Scan(&u.Balance)
+        }
+        stats.RecordNodeStatement(u.Node, time.Since(start))
+        if err != nil {
+            stats.RecordNodeError(u.Node)
+            tx.Rollback()
+            return nil, err
+        }
+    }
+    think(cfg.StatementThinkTime)
+
+    if end != endCommit {
+        // nothing is prepared, both ways to abort are the same
+        if err = tx.Rollback(); err != nil {
+            return tx, err
+        }
+        return tx, errRolledBack
+    }
+    if err = tx.CommitLocal(); err != nil {
+        stats.RecordNodeError(coordinator)
+    }
+    return tx, err
+}
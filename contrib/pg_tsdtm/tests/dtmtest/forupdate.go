@@ -0,0 +1,33 @@
+package dtmtest
+
+import (
+    "time"
+    "github.com/jackc/pgx"
+    "github.com/digoal/postgres_cluster/contrib/pg_tsdtm/tests/dtmclient"
+)
+
+// With -for-update every account of the transfer is locked with SELECT
+// FOR UPDATE on its node before any of them is updated, so that the row
+// locks are taken under the global snapshot and held across the nodes
+// while the rest of them is being locked. Workers locking the same
+// accounts in different order deadlock on the rows, and as the deadlock
+// may span nodes it is only broken by lock_timeout, see -deadlock-timeout.
+func lock_accounts(tx *dtmclient.GlobalTx, conns []*pgx.Conn, index map[int]int, updates []Update) error {
+    start := time.Now()
+    for _, u := range updates {
+        stmt, err := prepared(conns[u.Node], "lock", "select v from t where u=$1 for update")
+        if err == nil {
+            var v int64
+            err = tx.QueryRow(index[u.Node], stmt, u.Account).Scan(&v)
+        }
+        if err != nil {
+            stats.RecordNodeError(u.Node)
+            if is_deadlock(err) {
+                stats.RecordLockDeadlock()
+            }
+            return err
+        }
+    }
+    stats.RecordLocks(time.Since(start))
+    return nil
+}
@@ -0,0 +1,481 @@
+package dtmtest
+
+import (
+    "fmt"
+    "sort"
+    "strconv"
+    "strings"
+    "sync"
+    "sync/atomic"
+    "time"
+    "github.com/jackc/pgx"
+    "github.com/digoal/postgres_cluster/contrib/pg_tsdtm/tests/dtmclient"
+)
+
+// Fuzzer of snapshots: every transaction is a random sequence of up to
+// -fuzz-ops reads and appends of -fuzz-keys lists spread over the nodes,
+// with random pauses of up to -fuzz-delay after begin, between the
+// operations and before the end, and -abort-pct of them rolled back
+// instead of commit. Every append adds an element no other one adds, so
+// whatever a read returns tells which transactions it has seen, and the
+// final lists give the order of versions of every key. Verify builds the
+// dependency graph of the committed transactions from the recorded reads
+// and appends, as Elle does for list-append histories, and looks for what
+// snapshot isolation forbids:
+//
+//  G0        cycle of write-write dependencies
+//  G1a       read of an element appended by an aborted transaction
+//  G1c       cycle of write-write and write-read dependencies
+//  G-single  cycle with exactly one read-write anti-dependency
+//  order     read list which is not a prefix of the final one
+//
+// Transactions run at repeatable read unless -isolation is serializable.
+// The history can also be checked by Elle itself, see -elle-history.
+type FuzzWorkload struct {
+    mu sync.Mutex
+    txns []*fuzzTxn
+}
+
+// Read or append of a key, the element appended is positive
+type fuzzOp struct {
+    Key int
+    Append int64
+    Read []int64
+}
+
+const (
+    fuzzCommitted = iota
+    fuzzAborted
+    fuzzUnknown  // commit failed, possibly in doubt
+)
+
+// Attempt of a transaction with what it has done
+type fuzzTxn struct {
+    Gtid string
+    Ops []fuzzOp
+    Status int
+}
+
+// Next element to append
+var fuzzNext int64
+
+// Committed transactions checked by the last Verify and the anomalies
+// found by their kind
+var fuzzChecked int64
+var fuzzAnomalies map[string]int64
+
+func init() {
+    register_workload("fuzz", func() Workload { return new(FuzzWorkload) })
+}
+
+func fuzz_node(key int) int {
+    return key % len(nodes)
+}
+
+func (f *FuzzWorkload) Setup(conns []*pgx.Conn) {
+    create_extension(conns)
+    for i, conn := range conns {
+        exec(conn, "drop table if exists t_fuzz")
+        exec(conn, "create table t_fuzz(k int primary key, elems text)")
+        exec(conn, "insert into t_fuzz select k, '' from generate_series(0, $1 - 1) k where k % $2 = $3",
+            cfg.FuzzKeys, len(conns), i)
+    }
+    f.txns = nil
+    atomic.StoreInt64(&fuzzNext, 0)
+}
+
+func (f *FuzzWorkload) record(t *fuzzTxn) {
+    f.mu.Lock()
+    f.txns = append(f.txns, t)
+    f.mu.Unlock()
+}
+
+func fuzz_pause(w *Worker) {
+    if cfg.FuzzDelay > 0 {
+        time.Sleep(time.Duration(w.Rand.Int63n(int64(cfg.FuzzDelay))))
+    }
+}
+
+// Elements of the list stored as ",e1,e2"
+func parse_elems(s string) []int64 {
+    var elems []int64
+    for _, e := range strings.Split(s, ",") {
+        if e == "" {
+            continue
+        }
+        n, err := strconv.ParseInt(e, 10, 64)
+        checkErr(err)
+        elems = append(elems, n)
+    }
+    return elems
+}
+
+func (f *FuzzWorkload) Iteration(w *Worker) error {
+    ops := make([]fuzzOp, 1 + w.Rand.Intn(cfg.FuzzOps))
+    var order []int
+    participant := make(map[int]int)
+    for i := range ops {
+        ops[i].Key = w.Rand.Intn(cfg.FuzzKeys)
+        if w.Rand.Intn(2) == 0 {
+            ops[i].Append = -1  // numbered by every attempt
+        }
+        node := fuzz_node(ops[i].Key)
+        if _, ok := participant[node]; !ok {
+            participant[node] = len(order)
+            order = append(order, node)
+        }
+    }
+    abort := w.Rand.Intn(100) < cfg.AbortPct
+    var participants []*pgx.Conn
+    for _, node := range order {
+        participants = append(participants, w.Conns[node])
+    }
+
+    return w.Transaction(func(gtid string) (*dtmclient.GlobalTx, error) {
+        t := &fuzzTxn{Gtid: gtid, Ops: make([]fuzzOp, len(ops)), Status: fuzzAborted}
+        copy(t.Ops, ops)
+        for i := range t.Ops {
+            if t.Ops[i].Append != 0 {
+                t.Ops[i].Append = atomic.AddInt64(&fuzzNext, 1)
+            }
+        }
+        if elleHistory != nil {
+            elleHistory.Invoke(w.Id, t.Ops)
+            defer elleHistory.Complete(w.Id, t)
+        }
+        defer f.record(t)
+
+        tx, err := begin_global(participants, gtid, refs_isolation(w.Isolation))
+        if err != nil {
+            return nil, err
+        }
+        for i := range t.Ops {
+            fuzz_pause(w)
+            op := &t.Ops[i]
+            p := participant[fuzz_node(op.Key)]
+            if op.Append != 0 {
+                _, err = tx.Exec(p, "update t_fuzz set elems = elems || ',' || $1 where k = $2",
+                    strconv.FormatInt(op.Append, 10), op.Key)
+            } else {
+                var elems string
+                if err = tx.QueryRow(p, "select elems from t_fuzz where k = $1", op.Key).Scan(&elems); err == nil {
+                    op.Read = parse_elems(elems)
+                }
+            }
+            if err != nil {
+                tx.Rollback()
+                return tx, err
+            }
+        }
+        fuzz_pause(w)
+        if abort {
+            if err = tx.Rollback(); err != nil {
+                return tx, err
+            }
+            return tx, errRolledBack
+        }
+        if !cfg.Use2PC {
+            err = tx.CommitLocal()
+        } else {
+            err = tx.Commit()
+        }
+        if err != nil {
+            t.Status = fuzzUnknown
+            record_in_doubt(tx)
+            return tx, err
+        }
+        t.Status = fuzzCommitted
+        return tx, nil
+    })
+}
+
+// Dependency of a transaction on another one
+type fuzzEdge struct {
+    to int
+    kind string  // ww, wr or rw
+    key int
+}
+
+func (f *FuzzWorkload) Verify(conns []*pgx.Conn) int {
+    fuzzAnomalies = make(map[string]int64)
+    found := func(kind string, format string, args ...interface{}) {
+        if fuzzAnomalies[kind] < 5 {
+            fmt.Printf("[fuzz] %s: " + format + "\n", append([]interface{}{kind}, args...)...)
+        }
+        fuzzAnomalies[kind]++
+    }
+
+    final := make(map[int][]int64)
+    for key := 0; key < cfg.FuzzKeys; key++ {
+        var elems string
+        checkErr(conns[fuzz_node(key)].QueryRow("select elems from t_fuzz where k = $1", key).Scan(&elems))
+        final[key] = parse_elems(elems)
+    }
+
+    f.mu.Lock()
+    txns := f.txns
+    f.mu.Unlock()
+    committed := check_history(txns, final, found)
+
+    fuzzChecked = 0
+    for _, c := range committed {
+        if c {
+            fuzzChecked++
+        }
+    }
+    anomalies := 0
+    for _, n := range fuzzAnomalies {
+        anomalies += int(n)
+    }
+    return anomalies
+}
+
+// Look for the anomalies of the transactions given the final lists of the
+// keys, telling found about every one; returns which of the transactions
+// have committed
+func check_history(txns []*fuzzTxn, final map[int][]int64,
+        found func(kind string, format string, args ...interface{})) []bool {
+    writer := make(map[int64]int)
+    for i, t := range txns {
+        for _, op := range t.Ops {
+            if op.Append > 0 {
+                writer[op.Append] = i
+            }
+        }
+    }
+    // the ones failed to commit have if their elements are there
+    committed := make([]bool, len(txns))
+    for i, t := range txns {
+        committed[i] = t.Status == fuzzCommitted
+    }
+    for _, elems := range final {
+        for _, e := range elems {
+            if i, ok := writer[e]; ok && txns[i].Status == fuzzUnknown {
+                committed[i] = true
+            }
+        }
+    }
+
+    for key, elems := range final {
+        for _, e := range elems {
+            if i, ok := writer[e]; !ok || !committed[i] {
+                found("G1a", "element %d of key %d is there, appended by an aborted transaction", e, key)
+            }
+        }
+    }
+
+    edges := make([][]fuzzEdge, len(txns))
+    add := func(from int, to int, kind string, key int) {
+        if from != to {
+            edges[from] = append(edges[from], fuzzEdge{to, kind, key})
+        }
+    }
+    for key, elems := range final {
+        for j := 1; j < len(elems); j++ {
+            prev, ok1 := writer[elems[j - 1]]
+            next, ok2 := writer[elems[j]]
+            if ok1 && ok2 {
+                add(prev, next, "ww", key)
+            }
+        }
+    }
+    for i, t := range txns {
+        if !committed[i] {
+            continue
+        }
+        for _, op := range t.Ops {
+            if op.Append > 0 {
+                continue
+            }
+            versions := final[op.Key]
+            if !is_prefix(op.Read, versions) {
+                found("order", "'%s' read %v of key %d, which ends up %v", t.Gtid, op.Read, op.Key, versions)
+                continue
+            }
+            if m := len(op.Read); m > 0 {
+                last := op.Read[m - 1]
+                if w, ok := writer[last]; !ok || !committed[w] {
+                    found("G1a", "'%s' read element %d of key %d appended by an aborted transaction",
+                        t.Gtid, last, op.Key)
+                } else {
+                    add(w, i, "wr", op.Key)
+                }
+            }
+            if m := len(op.Read); m < len(versions) {
+                if w, ok := writer[versions[m]]; ok {
+                    add(i, w, "rw", op.Key)
+                }
+            }
+        }
+    }
+
+    for _, cycle := range dependency_cycles(edges, committed) {
+        kind := "G0"
+        for _, e := range cycle {
+            if e.kind == "wr" {
+                kind = "G1c"
+            }
+        }
+        found(kind, "%s", describe_dependencies(txns, cycle))
+    }
+    for i, out := range edges {
+        for _, e := range out {
+            if e.kind != "rw" || !committed[i] || !committed[e.to] {
+                continue
+            }
+            if path := dependency_path(edges, committed, e.to, i); path != nil {
+                cycle := append([]fuzzEdge{{e.to, "rw", e.key}}, path...)
+                found("G-single", "%s", describe_dependencies(txns, cycle))
+            }
+        }
+    }
+    return committed
+}
+
+func is_prefix(read []int64, versions []int64) bool {
+    if len(read) > len(versions) {
+        return false
+    }
+    for i := range read {
+        if read[i] != versions[i] {
+            return false
+        }
+    }
+    return true
+}
+
+// One cycle of ww and wr dependencies of every strongly connected
+// component of the committed transactions, by Tarjan
+func dependency_cycles(edges [][]fuzzEdge, committed []bool) [][]fuzzEdge {
+    index, low := make([]int, len(edges)), make([]int, len(edges))
+    for i := range index {
+        index[i] = -1
+    }
+    onStack := make([]bool, len(edges))
+    var stack []int
+    var cycles [][]fuzzEdge
+    next := 0
+    var connect func(v int)
+    connect = func(v int) {
+        index[v], low[v] = next, next
+        next++
+        stack = append(stack, v)
+        onStack[v] = true
+        for _, e := range edges[v] {
+            if e.kind == "rw" || !committed[e.to] {
+                continue
+            }
+            if index[e.to] < 0 {
+                connect(e.to)
+                if low[e.to] < low[v] {
+                    low[v] = low[e.to]
+                }
+            } else if onStack[e.to] && index[e.to] < low[v] {
+                low[v] = index[e.to]
+            }
+        }
+        if low[v] != index[v] {
+            return
+        }
+        component := make(map[int]bool)
+        for {
+            u := stack[len(stack) - 1]
+            stack = stack[:len(stack) - 1]
+            onStack[u] = false
+            component[u] = true
+            if u == v {
+                break
+            }
+        }
+        if len(component) > 1 {
+            for _, e := range edges[v] {
+                if e.kind != "rw" && component[e.to] {
+                    path := dependency_path(edges, component_of(component), e.to, v)
+                    cycles = append(cycles, append([]fuzzEdge{{e.to, e.kind, e.key}}, path...))
+                    break
+                }
+            }
+        }
+    }
+    for v := range edges {
+        if committed[v] && index[v] < 0 {
+            connect(v)
+        }
+    }
+    return cycles
+}
+
+func component_of(component map[int]bool) []bool {
+    max := 0
+    for v := range component {
+        if v > max {
+            max = v
+        }
+    }
+    in := make([]bool, max + 1)
+    for v := range component {
+        in[v] = true
+    }
+    return in
+}
+
+// Shortest path of ww and wr dependencies between the transactions
+// allowed, nil if there is none; empty if from is to
+func dependency_path(edges [][]fuzzEdge, allowed []bool, from int, to int) []fuzzEdge {
+    if from == to {
+        return []fuzzEdge{}
+    }
+    type step struct {
+        prev int
+        edge fuzzEdge
+    }
+    came := map[int]step{from: {-1, fuzzEdge{}}}
+    queue := []int{from}
+    for len(queue) > 0 {
+        v := queue[0]
+        queue = queue[1:]
+        for _, e := range edges[v] {
+            if e.kind == "rw" || e.to >= len(allowed) || !allowed[e.to] {
+                continue
+            }
+            if _, seen := came[e.to]; seen {
+                continue
+            }
+            came[e.to] = step{v, e}
+            if e.to == to {
+                var path []fuzzEdge
+                for u := to; u != from; u = came[u].prev {
+                    path = append([]fuzzEdge{came[u].edge}, path...)
+                }
+                return path
+            }
+            queue = append(queue, e.to)
+        }
+    }
+    return nil
+}
+
+// The cycle from the transaction it ends with
+func describe_dependencies(txns []*fuzzTxn, cycle []fuzzEdge) string {
+    steps := []string{fmt.Sprintf("'%s'", txns[cycle[len(cycle) - 1].to].Gtid)}
+    for _, e := range cycle {
+        steps = append(steps, fmt.Sprintf("-%s(%d)-> '%s'", e.kind, e.key, txns[e.to].Gtid))
+    }
+    return strings.Join(steps, " ")
+}
+
+func (f *FuzzWorkload) Teardown(conns []*pgx.Conn) {
+    for _, conn := range conns {
+        exec(conn, "drop table if exists t_fuzz")
+    }
+}
+
+// Kinds of anomalies found in their order
+func print_fuzz(r Report) {
+    var kinds []string
+    for kind, n := range r.FuzzAnomalies {
+        kinds = append(kinds, fmt.Sprintf("%s=%d", kind, n))
+    }
+    sort.Strings(kinds)
+    fmt.Printf("Fuzzer: %d transactions, anomalies: %s\n", r.FuzzTransactions, strings.Join(kinds, " "))
+}
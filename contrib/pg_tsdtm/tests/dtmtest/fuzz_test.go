@@ -0,0 +1,46 @@
+package dtmtest
+
+import (
+    "fmt"
+    "testing"
+)
+
+func TestFuzzHistories(t *testing.T) {
+    appends := func(key int, elem int64) fuzzOp { return fuzzOp{Key: key, Append: elem} }
+    reads := func(key int, elems ...int64) fuzzOp { return fuzzOp{Key: key, Read: elems} }
+    txn := func(gtid string, ops ...fuzzOp) *fuzzTxn { return &fuzzTxn{Gtid: gtid, Ops: ops} }
+
+    for _, c := range []struct {
+        name string
+        txns []*fuzzTxn
+        final map[int][]int64
+        anomalies map[string]int64
+    }{
+        {"acyclic", []*fuzzTxn{
+            txn("1", appends(0, 1)),
+            txn("2", reads(0, 1), appends(0, 2), appends(1, 3)),
+            txn("3", reads(0, 1, 2), reads(1, 3)),
+        }, map[int][]int64{0: {1, 2}, 1: {3}}, map[string]int64{}},
+        // two anti-dependencies, allowed by snapshot isolation
+        {"write skew", []*fuzzTxn{
+            txn("1", reads(0), appends(1, 1)),
+            txn("2", reads(1), appends(0, 2)),
+        }, map[int][]int64{0: {2}, 1: {1}}, map[string]int64{}},
+        {"lost update", []*fuzzTxn{
+            txn("1", reads(0), appends(0, 1)),
+            txn("2", reads(0), appends(0, 2)),
+        }, map[int][]int64{0: {1, 2}}, map[string]int64{"G-single": 1}},
+        {"circular information flow", []*fuzzTxn{
+            txn("1", appends(0, 1), reads(1, 2)),
+            txn("2", appends(1, 2), reads(0, 1)),
+        }, map[int][]int64{0: {1}, 1: {2}}, map[string]int64{"G1c": 1}},
+    } {
+        found := make(map[string]int64)
+        check_history(c.txns, c.final, func(kind string, format string, args ...interface{}) {
+            found[kind]++
+        })
+        if fmt.Sprint(found) != fmt.Sprint(c.anomalies) {
+            t.Errorf("%s: found %v instead of %v", c.name, found, c.anomalies)
+        }
+    }
+}
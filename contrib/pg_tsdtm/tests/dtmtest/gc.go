@@ -0,0 +1,77 @@
+package dtmtest
+
+import (
+    "runtime/debug"
+    "sync"
+    "time"
+)
+
+// Pauses of the Go garbage collector stop the workers in the middle of
+// their transactions, and the time would be counted as the latency of the
+// cluster. The pauses are read from the runtime after every committed
+// transaction, and the part of its latency that falls into them is
+// reported apart: the latency without GC pauses and the number of
+// transactions a pause has hit. Run with GODEBUG=gctrace=1 to have every
+// collection printed as well.
+
+type gcPause struct {
+    end time.Time
+    pause time.Duration
+}
+
+var gc struct {
+    sync.Mutex
+    stats debug.GCStats
+    seen int64         // cycles of the runtime already in pauses
+    pauses []gcPause   // since the start of the run, oldest first
+}
+
+// Forget the pauses before the run
+func gc_reset() {
+    gc.Lock()
+    debug.ReadGCStats(&gc.stats)
+    gc.seen = gc.stats.NumGC
+    gc.pauses = nil
+    gc.Unlock()
+}
+
+// Take the cycles finished since the last read, called with the lock held
+func gc_read() {
+    debug.ReadGCStats(&gc.stats)
+    n := int(gc.stats.NumGC - gc.seen)
+    if n > len(gc.stats.Pause) {
+        // the runtime keeps only the last 256 pauses
+        n = len(gc.stats.Pause)
+    }
+    // the most recent pause comes first
+    for i := n - 1; i >= 0; i-- {
+        p := gcPause{gc.stats.PauseEnd[i], gc.stats.Pause[i]}
+        gc.pauses = append(gc.pauses, p)
+        stats.RecordGcPause(p.pause)
+    }
+    gc.seen = gc.stats.NumGC
+}
+
+// How long the process has been stopped by the collector since the moment
+func gc_paused_since(start time.Time) time.Duration {
+    gc.Lock()
+    defer gc.Unlock()
+    gc_read()
+    var paused time.Duration
+    for i := len(gc.pauses) - 1; i >= 0 && gc.pauses[i].end.After(start); i-- {
+        p := gc.pauses[i]
+        if p.end.Add(-p.pause).Before(start) {
+            paused += p.end.Sub(start)
+        } else {
+            paused += p.pause
+        }
+    }
+    return paused
+}
+
+// Take the cycles after the last commit into the report
+func gc_flush() {
+    gc.Lock()
+    gc_read()
+    gc.Unlock()
+}
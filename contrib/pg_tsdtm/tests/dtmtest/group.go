@@ -0,0 +1,203 @@
+package dtmtest
+
+import (
+    "fmt"
+    "math/rand"
+    "sync"
+    "sync/atomic"
+    "time"
+    "github.com/jackc/pgx"
+    "github.com/digoal/postgres_cluster/contrib/pg_tsdtm/tests/dtmclient"
+)
+
+// Commits in bursts: every iteration of a worker is -group-size independent
+// transfers, each in its own global transaction on its own connections.
+// The transfers do their updates, wait for each other and then commit all
+// at once, so that the votes reach the arbiter or the coordinators
+// together as they would with many clients. If the votes are coalesced,
+// committing the burst takes about as long as committing one transaction
+// of it, otherwise as long as all of them one after another: the ratio of
+// the two is reported. The transfers of a burst touch different accounts,
+// and a transfer which has not got its turn to commit in a second, e.g.
+// waiting for the locks of another burst, lets the rest commit without it.
+// Every burst counts as one transaction of the worker.
+type GroupWorkload struct {
+    TransferWorkload
+
+    mu sync.Mutex
+    conns map[int][][]*pgx.Conn  // of the transfers of every worker but the first one
+}
+
+// How long the transfers of a burst wait for each other to commit
+const groupWait = time.Second
+
+// Transfers which have committed without the rest of their burst
+var nGroupTimeouts int64
+
+func init() {
+    register_workload("group", func() Workload { return new(GroupWorkload) })
+}
+
+// Connections of every transfer of the burst of the worker
+func (g *GroupWorkload) worker_conns(w *Worker) [][]*pgx.Conn {
+    g.mu.Lock()
+    defer g.mu.Unlock()
+    if g.conns == nil {
+        g.conns = make(map[int][][]*pgx.Conn)
+    }
+    extra, ok := g.conns[w.Id]
+    if !ok {
+        for i := 1; i < cfg.GroupSize; i++ {
+            extra = append(extra, connect_all())
+        }
+        g.conns[w.Id] = extra
+    }
+    return append([][]*pgx.Conn{w.Conns}, extra...)
+}
+
+// Transfers of a burst on different accounts of every node
+func group_updates(w *Worker) [][]Update {
+    var group [][]Update
+    taken := make(map[Update]bool)
+    for len(group) < cfg.GroupSize {
+        updates := transfer_updates(w)
+        free := true
+        for _, u := range updates {
+            free = free && !taken[Update{Node: u.Node, Account: u.Account}]
+        }
+        if !free {
+            continue
+        }
+        for _, u := range updates {
+            taken[Update{Node: u.Node, Account: u.Account}] = true
+        }
+        group = append(group, updates)
+    }
+    return group
+}
+
+// Transfer of a burst: when it is released to commit and when it is done
+type member struct {
+    arrive sync.Once
+    released time.Time
+    done time.Time
+    retried bool
+    err error
+}
+
+func (g *GroupWorkload) Iteration(w *Worker) error {
+    conns := g.worker_conns(w)
+    group := group_updates(w)
+    members := make([]member, len(group))
+
+    var ready sync.WaitGroup
+    ready.Add(len(group))
+    all := make(chan struct{})
+    go func() {
+        ready.Wait()
+        close(all)
+    }()
+
+    var wg sync.WaitGroup
+    for i := range group {
+        m := &members[i]
+        // own gtids and random choices for every transfer
+        mw := &Worker{
+            Id: w.Id,
+            Iteration: w.Iteration * cfg.GroupSize + i,
+            Conns: conns[i],
+            Rand: rand.New(rand.NewSource(w.Rand.Int63())),
+            Keys: w.Keys,
+        }
+        updates := group[i]
+        last := len(updates) - 1
+        apply := func(tx *dtmclient.GlobalTx, participant int, conn *pgx.Conn, u *Update) error {
+            err := update_account(tx, participant, conn, u)
+            if u != &updates[last] || err != nil {
+                return err
+            }
+            if !m.released.IsZero() {
+                m.retried = true
+                return nil
+            }
+            m.arrive.Do(ready.Done)
+            select {
+            case <-all:
+            case <-time.After(groupWait):
+                atomic.AddInt64(&nGroupTimeouts, 1)
+            }
+            m.released = time.Now()
+            return nil
+        }
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            m.err = run_transfer(mw, updates, apply)
+            m.done = time.Now()
+            m.arrive.Do(ready.Done)
+        }()
+    }
+    wg.Wait()
+
+    record_burst(members)
+    for i := range members {
+        if members[i].err != nil {
+            return members[i].err
+        }
+    }
+    return nil
+}
+
+// Time the burst took to commit against the time its transfers took one
+// by one, of the transfers committed in the burst at the first attempt
+func record_burst(members []member) {
+    var first, last time.Time
+    var serial time.Duration
+    n := 0
+    for i := range members {
+        m := &members[i]
+        if m.err != nil || m.retried || m.released.IsZero() {
+            continue
+        }
+        if n == 0 || m.released.Before(first) {
+            first = m.released
+        }
+        if n == 0 || m.done.After(last) {
+            last = m.done
+        }
+        serial += m.done.Sub(m.released)
+        n++
+    }
+    if n > 1 {
+        stats.RecordBurst(last.Sub(first), serial)
+    }
+}
+
+// The extra connections are given back once the workers are done
+func (g *GroupWorkload) Verify(conns []*pgx.Conn) int {
+    g.mu.Lock()
+    for _, extra := range g.conns {
+        for _, c := range extra {
+            close_all(c)
+        }
+    }
+    g.conns = nil
+    g.mu.Unlock()
+    return g.TransferWorkload.Verify(conns)
+}
+
+// Commit of the bursts was that many times faster than of their transfers
+// one by one, 1 if the votes are not coalesced at all
+func coalescing(bursts *Histogram, serial time.Duration) float64 {
+    if bursts.sum == 0 {
+        return 0
+    }
+    return float64(serial) / float64(bursts.sum)
+}
+
+func print_group(r Report) {
+    fmt.Printf("Bursts of %d: %d committed in p50=%0.3fms p99=%0.3fms, %0.2f times faster than one by one, " +
+        "%d transfers committed alone after %v\n",
+        cfg.GroupSize, r.GroupBursts, r.GroupCommit.P50, r.GroupCommit.P99, r.GroupCoalescing,
+        r.GroupTimeouts, groupWait)
+}
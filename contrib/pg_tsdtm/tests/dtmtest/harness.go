@@ -0,0 +1,609 @@
+package dtmtest
+
+import (
+    "fmt"
+    "net/http"
+    "os"
+    "sync"
+    "sync/atomic"
+    "math/rand"
+    "time"
+    "github.com/jackc/pgx"
+)
+
+var nodes []pgx.ConnConfig
+
+var running = false
+
+const reconnectTimeout = time.Minute
+
+var nInFlight int64
+
+// Take a connection to every node from the pools, return them with close_all()
+func connect_all() []*pgx.Conn {
+    conns := make([]*pgx.Conn, len(nodes))
+    for i := range nodes {
+        conn, err := acquire(i)
+        checkErr(err)
+        conns[i] = conn
+    }
+    return conns
+}
+
+// Replace broken connections, waiting for the node to come back if needed
+func reconnect(conns []*pgx.Conn) {
+    for i := range conns {
+        if conns[i].IsAlive() {
+            continue
+        }
+        release(i, conns[i])
+        deadline := time.Now().Add(reconnectTimeout)
+        for {
+            conn, err := acquire(i)
+            if err == nil {
+                conns[i] = conn
+                break
+            }
+            if time.Now().After(deadline) {
+                panic(err)
+            }
+            time.Sleep(100 * time.Millisecond)
+        }
+    }
+}
+
+// Whether neither chaos nor partitions are injected, so that connection
+// failures are not expected
+func no_faults() bool {
+    return cfg.ChaosInterval == 0 && cfg.PartitionInterval == 0 && cfg.ArbiterStopCmd == "" &&
+        cfg.CrashInterval == 0 && cfg.ProxyDrop == ""
+}
+
+// Connection-level failure is expected only while faults are injected:
+// reconnect then, panic otherwise
+func handle_fatal(err error, conns []*pgx.Conn) {
+    if no_faults() && !is_idle_timeout(err) {
+        panic(err)
+    }
+    reconnect(conns)
+}
+
+func close_all(conns []*pgx.Conn) {
+    for i, conn := range conns {
+        release(i, conn)
+    }
+}
+
+// Sum of all accounts over all nodes taken under a global snapshot
+func total(conns []*pgx.Conn) (sum int64, snapshot int64, err error) {
+    sums, snapshot, err := node_sums(conns)
+    return sum_of(sums), snapshot, err
+}
+
+// Total once nothing runs anymore, so that it is meaningful even with
+// -no-dtm
+func final_total() int64 {
+    conns := connect_all()
+    defer close_all(conns)
+
+    sum, _, err := total(conns)
+    if err != nil && classify(err) == errFatal {
+        reconnect(conns)
+        sum, _, err = total(conns)
+    }
+    checkErr(err)
+    return sum
+}
+
+func totalrep(wg *sync.WaitGroup) {
+    conns := connect_all()
+    defer close_all(conns)
+
+    var replicas []Standby
+    if cfg.StandbyReads {
+        replicas = connect_standbys()
+        defer close_standbys(replicas)
+    }
+
+    var prevSum int64 = 0 
+
+    for running {
+        sums, snapshot, err := node_sums(conns)
+        if err != nil {
+            if classify(err) == errFatal {
+                handle_fatal(err, conns)
+            }
+            continue
+        }
+        var sum int64
+        for _, s := range sums {
+            sum += s
+        }
+        check_standbys(replicas, snapshot, sums)
+
+        if (sum != prevSum) {
+            fmt.Printf("Total=%d snapshot=%d\n", sum, snapshot)
+            prevSum = sum
+        }
+    }
+    wg.Done()
+}
+
+// Counters of the previous run are forgotten, so that run() can be called
+// many times by tests
+func reset_state() {
+    for _, counter := range []*int64{&nRetries, &nAborts, &nRollbacks, &nChecks, &nViolations,
+        &nStuck, &nDivergences, &nInFlight, &nLongTx,
+        &nStandbyReads, &nStandbyMismatches, &nXidsBurned, &nVacuums, &nSlots,
+        &nDdl, &nDdlTimeouts, &nDdlMismatches, &nStableViolations, &nUnstableReads, &nBulkRows,
+        &nCopyRows, &nCopyChecks, &nCopyTornReads, &nCopyShortLoads, &nScriptErrors,
+        &nGroupTimeouts, &nGlobalDeadlocks, &nDeadlockVictims, &nKills, &nRestarts, &nPartitions,
+        &nTpccNewOrders, &nTpccPayments, &nTpccOrderStatus, &nTpccRemote,
+        &nStatementTimeouts, &nLockTimeouts, &nIdleTimeouts,
+        &nSessionChecks, &nReadYourWrites, &nMonotonicReads, &nWanLosses, &nProxyDrops} {
+        atomic.StoreInt64(counter, 0)
+    }
+    skew.changes, skew.max = 0, 0
+    outage = Outage{}
+    steady.Once = sync.Once{}
+    steady.commits, steady.elapsed = 0, 0
+    history = nil
+    rampLevels = nil
+    xidAges.max = nil
+    lastProgress.Progress = Progress{}
+    // tests change cfg between runs
+    checkErr(parse_isolation())
+    inDoubt.commit = make(map[string]inDoubtDecision)
+    connNodes.nodes = make(map[*pgx.Conn]int)
+    crash.crashes, crash.halfCommitted, crash.recovery = 0, 0, 0
+    statements.conns = make(map[*pgx.Conn]map[string]bool)
+    scriptErrors.seen = make(map[string]bool)
+    bundles.paths, bundles.last = nil, time.Time{}
+    workerIterations = make([]int64, cfg.Workers)
+    workerAttempts = make([]int64, cfg.Workers)
+    workerFailures = make([]int64, cfg.Workers)
+    serverStatements.time, serverStatements.top = nil, nil
+    schedule.rate = 0
+    pause.resumed = nil
+    tableUpdates.updates, tableUpdates.hot = nil, nil
+    tableUpdates.run, tableUpdates.runHot = 0, 0
+    resumes = 0
+    stats.Reset()
+    gc_reset()
+}
+
+// Set up the workload, run it with the configured checks and faults and
+// collect the results. Setup failures panic.
+func run() Report {
+    var transferWg sync.WaitGroup
+    var inspectWg sync.WaitGroup
+
+    reset_state()
+    if cfg.TracePath != "" {
+        tracer = open_tracer(cfg.TracePath, cfg.TraceFormat)
+        defer func() {
+            tracer.Close()
+            tracer = nil
+        }()
+    }
+    if cfg.ElleHistoryPath != "" {
+        elleHistory = open_elle_history(cfg.ElleHistoryPath, cfg.ElleFormat)
+        defer func() {
+            elleHistory.Close()
+            elleHistory = nil
+        }()
+    }
+    rand.Seed(cfg.Seed)
+    fmt.Printf("Seed = %d (rerun with -seed %d to repeat the workload)\n", cfg.Seed, cfg.Seed)
+
+    workload = choose_workload()
+    _, balanced := workload.(Balanced)
+    var resumed *Checkpoint
+    if cfg.CheckpointPath != "" {
+        resumed = load_checkpoint(cfg.CheckpointPath)
+    }
+
+    create_databases()
+    if proxied() {
+        defer start_proxies()()
+    }
+    open_pools()
+    defer close_pools()
+
+    if cfg.Fsync != "" {
+        set_fsync(cfg.Fsync)
+        defer set_fsync("")
+    }
+    conns := connect_all()
+    read_settings(conns)
+    if cfg.NoSetup || resumed != nil {
+        attach_workload(conns)
+    } else {
+        workload.Setup(conns)
+    }
+    if cfg.VacuumInterval > 0 {
+        create_probe(conns)
+    }
+    if cfg.SessionChecks {
+        create_session_tables(conns)
+    }
+    if cfg.JournalPath != "" {
+        create_journal_tables(conns)
+        open_journal(cfg.JournalPath)
+        defer close_journal()
+    }
+    if cfg.ServerStatements {
+        reset_server_statements(conns)
+    }
+    close_all(conns)
+    leftAnomalies := 0
+    if resumed != nil {
+        // of the crashed process
+        leftAnomalies = resolve_in_doubt(true)
+    }
+
+    runStart = time.Now()
+    stats.Reset()
+    warmedUp := resumed != nil && resume_checkpoint(resumed)
+    var warmup *time.Timer
+    if cfg.Warmup > 0 && !warmedUp {
+        warmup = time.AfterFunc(cfg.Warmup, end_warmup)
+    }
+    stopReports := make(chan struct{})
+    defer close(stopReports)
+    if cfg.ReportInterval > 0 {
+        go report_intervals(cfg.ReportInterval, stopReports)
+    }
+    if cfg.MetricsAddr != "" {
+        go serve_metrics(cfg.MetricsAddr)
+    }
+    var control *http.Server
+    if cfg.ControlAddr != "" {
+        var err error
+        control, err = start_control(cfg.ControlAddr)
+        checkErr(err)
+    }
+    transferWg.Add(cfg.Workers)
+    if cfg.RampStep > 0 {
+        go ramp(&transferWg)
+    } else {
+        for i:=0; i<cfg.Workers; i++ {
+            go worker(i, &transferWg)
+        }
+    }
+    running = true
+    if balanced && !cfg.NoDTM {
+        // without global snapshots readers see transfers half-done
+        inspectWg.Add(1)
+        go totalrep(&inspectWg)
+        inspectWg.Add(cfg.Verifiers)
+        for i := 0; i < cfg.Verifiers; i++ {
+            go verifier(i, &inspectWg)
+        }
+    }
+
+    stopFaults := make(chan struct{})
+    if cfg.ChaosInterval > 0 {
+        inspectWg.Add(1)
+        go chaos(stopFaults, &inspectWg)
+    }
+    if cfg.PartitionInterval > 0 {
+        inspectWg.Add(1)
+        go partitions(stopFaults, &inspectWg)
+    }
+    if cfg.SkewInterval > 0 {
+        inspectWg.Add(1)
+        go skews(stopFaults, &inspectWg)
+    }
+    if cfg.CrashInterval > 0 {
+        read_data_dirs()
+        inspectWg.Add(1)
+        go crashes(stopFaults, &inspectWg)
+    }
+    if cfg.ArbiterStopCmd != "" {
+        inspectWg.Add(1)
+        go arbiter_failover(stopFaults, &inspectWg)
+    }
+    if cfg.ProxyDrop != "" {
+        start_drops()
+        inspectWg.Add(1)
+        go drop_resolver(stopFaults, &inspectWg)
+    }
+    if cfg.XidBurners > 0 {
+        start_burners(stopFaults, &inspectWg)
+    }
+    if cfg.VacuumInterval > 0 {
+        start_vacuum(stopFaults, &inspectWg)
+    }
+    if cfg.DdlInterval > 0 {
+        inspectWg.Add(1)
+        go ddl_changes(stopFaults, &inspectWg)
+    }
+    if cfg.LongTxInterval > 0 {
+        inspectWg.Add(1)
+        go long_transactions(stopFaults, &inspectWg)
+    }
+    if cfg.CheckpointPath != "" {
+        inspectWg.Add(1)
+        go checkpoints(stopFaults, &inspectWg)
+    }
+    if cfg.DeadlockDetect != "" {
+        inspectWg.Add(1)
+        go deadlock_detector(stopFaults, &inspectWg)
+    }
+
+    transferWg.Wait()
+    if control != nil {
+        stop_control(control)
+    }
+    if warmup != nil && warmup.Stop() {
+        fmt.Println("WARNING: workers finished before the end of warm-up, nothing is excluded")
+    }
+    elapsed := time.Since(stats.Start())
+    running = false
+    close(stopFaults)
+    inspectWg.Wait()
+    close_journal()
+    if cfg.ServerStatements {
+        collect_server_statements()
+    }
+
+    gc_flush()
+    results := collect_results(elapsed)
+    results.Anomalies += leftAnomalies
+    if cfg.CheckpointPath != "" {
+        if results.Interrupted {
+            save_checkpoint(cfg.CheckpointPath)
+        } else if err := os.Remove(cfg.CheckpointPath); err != nil && !os.IsNotExist(err) {
+            checkErr(err)
+        }
+    }
+    if cfg.PartitionInterval > 0 || cfg.CrashInterval > 0 || cfg.ProxyDrop != "" {
+        results.Anomalies += resolve_in_doubt(true)
+    }
+    if cfg.JournalPath != "" {
+        results.Anomalies += verify_journal(cfg.JournalPath)
+    }
+    if cfg.ProxyDrop != "" {
+        results.UnresolvedDrops, results.WrongDrops = check_drops()
+    }
+    if cfg.Arbiters != "" {
+        verify_final_decisions()
+        results.DecisionsChecked, results.LostDecisions, results.FlippedDecisions = outage.Decisions()
+    }
+    if !no_faults() && balanced {
+        results.Converged = check_convergence()
+        results.DiagnosticBundles = diagnostic_bundles()
+    }
+    if balanced {
+        results.ExpectedTotal = expected_total()
+        results.FinalTotal = final_total()
+        results.FinalOk = results.FinalTotal == results.ExpectedTotal
+    }
+
+    conns = connect_all()
+    if cfg.DdlInterval > 0 {
+        ddl_cleanup(conns)
+    }
+    results.Anomalies += workload.Verify(conns)
+    if cfg.Workload == "fuzz" {
+        results.FuzzTransactions, results.FuzzAnomalies = fuzzChecked, fuzzAnomalies
+    }
+    if cfg.Teardown {
+        workload.Teardown(conns)
+        if cfg.XidBurners > 0 {
+            for _, conn := range conns {
+                exec(conn, "drop table if exists xid_burner")
+            }
+        }
+        if cfg.VacuumInterval > 0 {
+            drop_probe(conns)
+        }
+        if cfg.JournalPath != "" {
+            drop_journal_tables(conns)
+        }
+        if cfg.SessionChecks {
+            drop_session_tables(conns)
+        }
+    }
+    close_all(conns)
+    return results
+}
+
+func print_results(results Report) {
+    print_settings(results.Settings)
+    fmt.Printf("Elapsed time %f sec\n", results.Elapsed)
+    fmt.Printf("TPS = %f\n", results.Tps)
+    if cfg.Rate > 0 {
+        fmt.Printf("Target TPS = %f, schedule lag p50=%0.3fms p99=%0.3fms max=%0.3fms\n",
+            results.TargetTps, results.ScheduleLag.P50, results.ScheduleLag.P99, results.ScheduleLag.Max)
+    }
+    fmt.Printf("Steady-state TPS = %f (all workers busy for %f sec)\n",
+        results.SteadyTps, results.SteadyElapsed)
+    fmt.Printf("Aborts = %d, retries = %d, rollbacks = %d\n",
+        results.Aborts, results.Retries, results.Rollbacks)
+    fmt.Printf("Latency: p50=%0.3fms p95=%0.3fms p99=%0.3fms max=%0.3fms\n",
+        results.Latency.P50, results.Latency.P95, results.Latency.P99, results.Latency.Max)
+    if results.GcCycles > 0 {
+        fmt.Printf("Go GC: %d cycles paused %0.3fms (max %0.3fms), hit %d trans, latency without pauses p50=%0.3fms p99=%0.3fms max=%0.3fms\n",
+            results.GcCycles, results.GcPause, results.GcPauses.Max, results.GcHit,
+            results.GcFreeLatency.P50, results.GcFreeLatency.P99, results.GcFreeLatency.Max)
+    }
+    fmt.Printf("Invariant checks = %d, violations = %d, anomalies = %d\n",
+        results.Checks, results.Violations, results.Anomalies)
+    if results.Violations > 0 {
+        fmt.Printf("Violations: %d the same on every read of the snapshot, %d changing within it\n",
+            results.StableViolations, results.UnstableReads)
+    }
+    if cfg.ArbiterStopCmd != "" {
+        fmt.Printf("Arbiter outage: %d errors, first commit %v after restart\n",
+            results.OutageErrors, time.Duration(results.OutageRecovery * float64(time.Second)))
+    }
+    if cfg.Arbiters != "" {
+        fmt.Printf("Arbiter failover: %d leader changes, up to %v without a leader, %d decisions checked, %d lost, %d flipped\n",
+            results.ArbiterLeaderChanges, time.Duration(results.ArbiterFailover * float64(time.Second)),
+            results.DecisionsChecked, results.LostDecisions, results.FlippedDecisions)
+    }
+    if cfg.SkewInterval > 0 {
+        fmt.Printf("Clock skew: %d changes, offsets up to %0.3fms\n", results.ClockSkews, results.MaxClockSkew)
+    }
+    if cfg.DdlInterval > 0 {
+        fmt.Printf("Schema changes = %d, lock timeouts = %d, mismatches = %d\n",
+            results.DdlChanges, results.DdlLockTimeouts, results.DdlMismatches)
+    }
+    if cfg.Wan != "" {
+        print_wan(results)
+    }
+    if results.Budgets.any() {
+        print_budgets(results)
+    }
+    if cfg.ProxyDrop != "" {
+        fmt.Printf("Connections reset = %d, left prepared = %d, ended against the decision = %d\n",
+            results.ProxyDrops, results.UnresolvedDrops, results.WrongDrops)
+    }
+    if cfg.SessionChecks {
+        fmt.Printf("Session checks = %d, read-your-writes violations = %d, monotonic reads violations = %d\n",
+            results.SessionChecks, results.ReadYourWrites, results.MonotonicReads)
+    }
+    if cfg.CrashInterval > 0 {
+        fmt.Printf("Crashes = %d, longest recovery %0.1f sec, half-committed = %d\n",
+            results.Crashes, results.CrashRecovery, results.HalfCommitted)
+    }
+    if cfg.ReadPct > 0 {
+        fmt.Printf("Reads = %d, latency p50=%0.3fms p99=%0.3fms, snapshot p50=%0.3fms p99=%0.3fms\n",
+            results.Reads, results.ReadLatency.P50, results.ReadLatency.P99,
+            results.ReadSnapshotLatency.P50, results.ReadSnapshotLatency.P99)
+        fmt.Printf("Writes = %d, snapshot p50=%0.3fms p99=%0.3fms\n",
+            results.Commits - results.Reads,
+            results.WriteSnapshotLatency.P50, results.WriteSnapshotLatency.P99)
+    }
+    if cfg.CheckSnapshots {
+        fmt.Printf("Snapshot divergences = %d\n", results.Divergences)
+    }
+    if cfg.XidBurners > 0 {
+        fmt.Printf("Xids burned = %d, max datfrozenxid age on nodes: %v\n", results.XidsBurned, results.MaxXidAge)
+    }
+    if cfg.StandbyReads {
+        fmt.Printf("Standby reads = %d, mismatches = %d\n", results.StandbyReads, results.StandbyMismatches)
+    }
+    if cfg.LongTxInterval > 0 {
+        fmt.Printf("Long transactions = %d\n", results.LongTransactions)
+    }
+    if results.Resumes > 0 {
+        fmt.Printf("Resumed from -checkpoint %d times\n", results.Resumes)
+    }
+    if results.Stuck > 0 {
+        fmt.Printf("Stuck transactions = %d\n", results.Stuck)
+    }
+    for _, path := range results.DiagnosticBundles {
+        fmt.Printf("Diagnostics saved to %s\n", path)
+    }
+    if cfg.Isolation != "default" {
+        for _, level := range isolationMix {
+            if is, ok := results.PerIsolation[level.name]; ok {
+                fmt.Printf("Isolation %s: %d commits, %d retries, %d aborts, %0.2f%% attempts failed\n",
+                    level.name, is.Commits, is.Retries, is.Aborts, 100 * is.AbortRate)
+            }
+        }
+    }
+    for _, phase := range phaseNames {
+        if l, ok := results.PhaseLatency[phase]; ok {
+            fmt.Printf("Phase %s: p50=%0.3fms p99=%0.3fms max=%0.3fms\n", phase, l.P50, l.P99, l.Max)
+        }
+    }
+    print_server_statements(results)
+    for i, n := range results.PerNode {
+        fmt.Printf("Node %d: %d trans, %0.2f tps, latency p50=%0.3fms p99=%0.3fms, " +
+            "statements p50=%0.3fms p99=%0.3fms, errors=%d\n",
+            i, n.Commits, n.Tps, n.Latency.P50, n.Latency.P99,
+            n.StatementLatency.P50, n.StatementLatency.P99, n.Errors)
+    }
+    if cfg.Coordinator != "first" {
+        for i, h := range stats.Coordinators() {
+            fmt.Printf("Coordinator node %d: %s\n", i, h.Summary(
+                time.Duration(results.Elapsed * float64(time.Second))))
+        }
+    }
+    for _, l := range results.Scalability {
+        fmt.Printf("Workers %d (%s): %d trans, %0.2f tps, latency p50=%0.3fms p99=%0.3fms",
+            l.Workers, l.Direction, l.Commits, l.Tps, l.Latency.P50, l.Latency.P99)
+        if cfg.DtmProfile {
+            fmt.Printf(", pg_dtm %0.1f%%", l.DtmShare * 100)
+        }
+        fmt.Println()
+    }
+    if cfg.DtmProfile {
+        print_dtm_profile(results)
+    }
+    if len(timeout_settings()) > 0 {
+        print_timeouts(results)
+    }
+    if cfg.Deadlocks || cfg.ForUpdate {
+        fmt.Printf("Deadlocks = %d, resolved in p50=%0.3fms p99=%0.3fms max=%0.3fms\n",
+            results.Deadlocks, results.DeadlockLatency.P50,
+            results.DeadlockLatency.P99, results.DeadlockLatency.Max)
+    }
+    if cfg.DeadlockDetect != "" {
+        fmt.Printf("Global deadlocks = %d found by the detector, %d transactions cancelled\n",
+            results.GlobalDeadlocks, results.DeadlockVictims)
+    }
+    if cfg.Workload == "hotrow" {
+        fmt.Printf("Hot row updates waited p50=%0.3fms p95=%0.3fms p99=%0.3fms max=%0.3fms, %d retries, %d aborts\n",
+            results.HotRowWait.P50, results.HotRowWait.P95, results.HotRowWait.P99, results.HotRowWait.Max,
+            results.Retries, results.Aborts)
+    }
+    if cfg.Workload == "bulk" {
+        fmt.Printf("Bulk updates: %d rows, %0.0f rows/sec, %d rows per node and transaction\n",
+            results.BulkRows, results.BulkRowRate, cfg.BulkSize)
+    }
+    if cfg.Workload == "copy" {
+        fmt.Printf("COPY loads: %d rows, %0.0f rows/sec, %d rows per node and transaction, %d checks, %d torn reads, %d short loads\n",
+            results.CopyRows, results.CopyRowRate, cfg.CopyRows, results.CopyChecks, results.CopyTornReads,
+            results.CopyShortLoads)
+    }
+    if cfg.Workload == "group" {
+        print_group(results)
+    }
+    if cfg.Workload == "tpcc" {
+        print_tpcc(results)
+    }
+    if cfg.Workload == "ycsb" {
+        print_ycsb(results)
+    }
+    if cfg.Workload == "fuzz" {
+        print_fuzz(results)
+    }
+    if cfg.Indexes > 0 || cfg.FillFactor != 100 {
+        fmt.Printf("HOT updates = %d of %d (%0.1f%%), %d secondary indexes, fillfactor %d\n",
+            results.HotUpdates, results.TableUpdates, hot_pct(results), cfg.Indexes, cfg.FillFactor)
+    }
+    if cfg.ForUpdate {
+        fmt.Printf("Locking: p50=%0.3fms p99=%0.3fms max=%0.3fms, %d deadlocks while locking, %d retries\n",
+            results.LockLatency.P50, results.LockLatency.P99, results.LockLatency.Max,
+            results.LockDeadlocks, results.Retries)
+    }
+}
+
+func exec(conn *pgx.Conn, stmt string, arguments ...interface{}) {
+    var err error
+    start := time.Now()
+    _, err = conn.Exec(stmt, arguments... )
+    log_exec(conn, stmt, arguments, start, err)
+    checkErr(err)
+}
+
+func execQuery(conn *pgx.Conn, stmt string, arguments ...interface{}) int64 {
+    var err error
+    var result int64
+    start := time.Now()
+    err = conn.QueryRow(stmt, arguments...).Scan(&result)
+    log_exec(conn, stmt, arguments, start, err)
+    checkErr(err)
+    return result
+}
+
+func checkErr(err error) {
+    if err != nil {
+        panic(err)
+    }
+}
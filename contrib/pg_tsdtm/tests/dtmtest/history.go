@@ -0,0 +1,138 @@
+package dtmtest
+
+import (
+    "bufio"
+    "encoding/json"
+    "fmt"
+    "io"
+    "os"
+    "sort"
+    "sync"
+    "github.com/digoal/postgres_cluster/contrib/pg_tsdtm/tests/dtmclient"
+)
+
+// Journal entry of a committed global transaction
+type HistoryEntry struct {
+    Gtid string
+    Snapshot int64
+    Csn int64
+    Seq int64       // order of commit on the client, used if there is no CSN
+    Updates []Update
+}
+
+type History struct {
+    sync.Mutex
+    file *os.File
+    out *bufio.Writer
+    enc *json.Encoder
+    seq int64
+}
+
+var history *History
+
+func open_history(path string) *History {
+    f, err := os.Create(path)
+    checkErr(err)
+    h := &History{file: f, out: bufio.NewWriter(f)}
+    h.enc = json.NewEncoder(h.out)
+    return h
+}
+
+func (h *History) Record(tx *dtmclient.GlobalTx, updates []Update) {
+    h.Lock()
+    defer h.Unlock()
+    h.seq++
+    checkErr(h.enc.Encode(HistoryEntry{
+        Gtid: tx.Gid,
+        Snapshot: tx.Snapshot,
+        Csn: tx.Csn,
+        Seq: h.seq,
+        Updates: updates,
+    }))
+}
+
+func (h *History) Close() {
+    h.Lock()
+    defer h.Unlock()
+    checkErr(h.out.Flush())
+    checkErr(h.file.Close())
+}
+
+func read_history(path string) []HistoryEntry {
+    var entries []HistoryEntry
+
+    f, err := os.Open(path)
+    checkErr(err)
+    defer f.Close()
+
+    dec := json.NewDecoder(f)
+    for {
+        var e HistoryEntry
+        if err := dec.Decode(&e); err == io.EOF {
+            break
+        } else {
+            checkErr(err)
+        }
+        entries = append(entries, e)
+    }
+    return entries
+}
+
+type accountKey struct {
+    node int
+    account int
+}
+
+// Replay the journal in commit order and check that every update observed
+// the balance produced by the previous committed update of the same account
+// (otherwise some update was lost or two transactions wrote on top of the
+// same version), that commit happened after the snapshot it was based on,
+// and that final balances in the database match the replayed ones.
+func verify_history(path string) int {
+    entries := read_history(path)
+    anomalies := 0
+
+    sort.Slice(entries, func(i, j int) bool {
+        if entries[i].Csn != entries[j].Csn {
+            return entries[i].Csn < entries[j].Csn
+        }
+        return entries[i].Seq < entries[j].Seq
+    })
+
+    balances := make(map[accountKey]int64)
+    for _, e := range entries {
+        if e.Csn != 0 && e.Csn <= e.Snapshot {
+            fmt.Printf("anomaly: transaction %s committed at csn %d not after its snapshot %d\n",
+                e.Gtid, e.Csn, e.Snapshot)
+            anomalies++
+        }
+        for _, u := range e.Updates {
+            key := accountKey{u.Node, u.Account}
+            prev, ok := balances[key]
+            if !ok {
+                prev = int64(cfg.InitAmount)
+            }
+            if u.Balance != prev + int64(u.Delta) {
+                fmt.Printf("anomaly: transaction %s (csn %d) set account %d on node %d to %d, expected %d + %d\n",
+                    e.Gtid, e.Csn, u.Account, u.Node, u.Balance, prev, u.Delta)
+                anomalies++
+            }
+            balances[key] = prev + int64(u.Delta)
+        }
+    }
+
+    conns := connect_all()
+    defer close_all(conns)
+
+    for key, expected := range balances {
+        actual := execQueryPrepared(conns[key.node], "balance", "select v from t where u=$1", key.account)
+        if actual != expected {
+            fmt.Printf("anomaly: account %d on node %d is %d, history gives %d\n",
+                key.account, key.node, actual, expected)
+            anomalies++
+        }
+    }
+
+    fmt.Printf("History of %d transactions verified, %d anomalies\n", len(entries), anomalies)
+    return anomalies
+}
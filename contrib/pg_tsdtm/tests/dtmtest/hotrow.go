@@ -0,0 +1,83 @@
+package dtmtest
+
+import (
+    "fmt"
+    "sort"
+    "time"
+    "github.com/jackc/pgx"
+    "github.com/digoal/postgres_cluster/contrib/pg_tsdtm/tests/dtmclient"
+)
+
+// Extreme contention: every node has a single row in t_hot and every
+// transfer moves money between the rows of -fanout nodes, so all workers
+// queue for the same row locks, held until the whole global commit is
+// over. How long the updates wait for the locks and how many attempts
+// are retried tell what DTM costs when nothing can run in parallel. The
+// rows are always updated in the order of nodes, otherwise the workers
+// would deadlock across nodes all the time.
+type HotRowWorkload struct {}
+
+func init() {
+    register_workload("hotrow", func() Workload { return new(HotRowWorkload) })
+}
+
+func (h *HotRowWorkload) ExpectedTotal() int64 {
+    return int64(len(nodes)) * int64(cfg.InitAmount)
+}
+
+func (h *HotRowWorkload) TotalQuery() string {
+    return "select sum(v) from t_hot"
+}
+
+func (h *HotRowWorkload) Setup(conns []*pgx.Conn) {
+    create_extension(conns)
+    for _, conn := range conns {
+        exec(conn, "drop table if exists t_hot")
+        exec(conn, "create table t_hot(id int primary key, v bigint)")
+        exec(conn, "insert into t_hot values (0, $1)", cfg.InitAmount)
+    }
+}
+
+// Nothing is kept in memory
+func (h *HotRowWorkload) Attach(conns []*pgx.Conn) {
+}
+
+func (h *HotRowWorkload) Iteration(w *Worker) error {
+    owners := pick_nodes(w.Rand, len(w.Conns), cfg.Fanout)
+    sort.Ints(owners)
+    amount := 2*w.Rand.Intn(2) - 1
+    updates := make([]Update, len(owners))
+    for i, node := range owners {
+        updates[i] = Update{Node: node, Delta: amount}
+    }
+    updates[w.Rand.Intn(len(updates))].Delta = -amount * (len(updates) - 1)
+    return run_transfer(w, updates, hot_update)
+}
+
+func hot_update(tx *dtmclient.GlobalTx, participant int, conn *pgx.Conn, u *Update) error {
+    stmt, err := prepared(conn, "hot", "update t_hot set v = v + $1 where id = 0 returning v")
+    if err != nil {
+        return err
+    }
+    start := time.Now()
+    err = tx.QueryRow(participant, stmt, u.Delta).Scan(&u.Balance)
+    stats.RecordHotWait(time.Since(start))
+    return err
+}
+
+func (h *HotRowWorkload) Verify(conns []*pgx.Conn) int {
+    anomalies := 0
+    for i, conn := range conns {
+        if rows := execQuery(conn, "select count(*) from t_hot"); rows != 1 {
+            fmt.Printf("[hotrow] node %d has %d hot rows instead of one\n", i, rows)
+            anomalies++
+        }
+    }
+    return anomalies
+}
+
+func (h *HotRowWorkload) Teardown(conns []*pgx.Conn) {
+    for _, conn := range conns {
+        exec(conn, "drop table if exists t_hot")
+    }
+}
@@ -0,0 +1,867 @@
+// +build dtm_integration
+
+package dtmtest
+
+// Scenarios of the harness as tests against a live cluster. Nodes and
+// other settings are given by the usual flags after -args, e.g.
+//
+//  go test -tags dtm_integration -args -config ../transfers/nodes.json
+//
+// Every scenario overrides the size of the run to keep it short.
+
+import (
+    "encoding/json"
+    "flag"
+    "fmt"
+    "io/ioutil"
+    "net/http"
+    "os"
+    "path/filepath"
+    "runtime"
+    "strings"
+    "testing"
+    "time"
+    "github.com/jackc/pgx"
+)
+
+func TestMain(m *testing.M) {
+    RegisterFlags(flag.CommandLine)
+    flag.Parse()
+    if err := finish_config(); err != nil {
+        fmt.Printf("ERROR: %v\n", err)
+        os.Exit(1)
+    }
+    os.Exit(m.Run())
+}
+
+// Run the workload with settings changed by setup, restoring them after
+func scenario(t *testing.T, setup func()) (results Report) {
+    saved := cfg
+    defer func() { cfg = saved }()
+
+    cfg.Workers = 4
+    cfg.Iterations = 500
+    cfg.Accounts = 1000
+    cfg.Verifiers = 1
+    cfg.Teardown = true
+    setup()
+
+    defer func() {
+        if err := recover(); err != nil {
+            t.Fatalf("run failed: %v", err)
+        }
+    }()
+    results = run()
+
+    if results.Commits == 0 {
+        t.Errorf("no transaction committed, %d aborts", results.Aborts)
+    }
+    if failures := results.Failures(); len(failures) > 0 {
+        t.Errorf("failed: %s", strings.Join(failures, ", "))
+    }
+    return results
+}
+
+func TestTransfers(t *testing.T) {
+    scenario(t, func() {})
+}
+
+func TestTransfersHistory(t *testing.T) {
+    dir, err := ioutil.TempDir("", "transfers")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer os.RemoveAll(dir)
+
+    scenario(t, func() {
+        cfg.HistoryPath = filepath.Join(dir, "history.json")
+        cfg.CheckSnapshots = true
+    })
+}
+
+func TestTransfersSharded(t *testing.T) {
+    scenario(t, func() {
+        cfg.Sharded = true
+    })
+}
+
+func TestTransfersHotspot(t *testing.T) {
+    scenario(t, func() {
+        cfg.Distribution = "hotspot"
+        cfg.Coordinator = "random"
+    })
+}
+
+func TestRollbacks(t *testing.T) {
+    for _, mode := range []string{"all", "one"} {
+        r := scenario(t, func() {
+            cfg.AbortPct = 20
+            cfg.AbortMode = mode
+        })
+        if r.Rollbacks == 0 {
+            t.Errorf("abort mode '%s': nothing rolled back", mode)
+        }
+    }
+}
+
+func TestDeadlocks(t *testing.T) {
+    scenario(t, func() {
+        cfg.Deadlocks = true
+        cfg.Iterations = 100
+    })
+}
+
+func TestTemplate(t *testing.T) {
+    scenario(t, func() {
+        cfg.Workload = "template"
+    })
+}
+
+func TestSavepoints(t *testing.T) {
+    scenario(t, func() {
+        cfg.Workload = "savepoints"
+        cfg.CheckSnapshots = true
+    })
+}
+
+func TestBackend2PC(t *testing.T) {
+    scenario(t, func() {
+        cfg.Backend = "2pc"
+    })
+}
+
+func TestBackendFdw(t *testing.T) {
+    scenario(t, func() {
+        cfg.Backend = "fdw"
+    })
+}
+
+func TestPipeline(t *testing.T) {
+    scenario(t, func() {
+        cfg.Pipeline = true
+        cfg.AbortPct = 10
+        cfg.AbortMode = "one"
+    })
+}
+
+func TestConcurrentAccess(t *testing.T) {
+    var snapshots [2]float64
+    for i, concurrent := range []bool{false, true} {
+        r := scenario(t, func() {
+            cfg.ConcurrentAccess = concurrent
+            cfg.CheckSnapshots = true
+            cfg.Fanout = len(nodes)
+        })
+        snapshots[i] = r.SnapshotLatency.P50
+    }
+    t.Logf("median snapshot latency %0.3fms one by one, %0.3fms at once", snapshots[0], snapshots[1])
+}
+
+func TestHotRow(t *testing.T) {
+    r := scenario(t, func() {
+        cfg.Workload = "hotrow"
+    })
+    if r.HotRowWait.Max == 0 {
+        t.Errorf("no wait for the hot rows measured")
+    }
+}
+
+func TestBulk(t *testing.T) {
+    r := scenario(t, func() {
+        cfg.Workload = "bulk"
+        cfg.Iterations = 50
+        cfg.BulkRows = 20000
+        cfg.BulkSize = 2000
+    })
+    if r.BulkRows != r.Commits * int64(cfg.Fanout) * 2000 {
+        t.Errorf("%d rows updated by %d commits", r.BulkRows, r.Commits)
+    }
+}
+
+func TestCopy(t *testing.T) {
+    r := scenario(t, func() {
+        cfg.Workload = "copy"
+        cfg.Iterations = 50
+        cfg.CopyRows = 500
+    })
+    if r.CopyRows == 0 || r.CopyRows % 500 != 0 {
+        t.Errorf("%d rows loaded in batches of 500", r.CopyRows)
+    }
+    if r.CopyChecks == 0 {
+        t.Errorf("no batch checked")
+    }
+}
+
+func TestRefs(t *testing.T) {
+    r := scenario(t, func() {
+        cfg.Workload = "refs"
+        cfg.Accounts = 20
+    })
+    if r.Rollbacks == 0 {
+        t.Errorf("no child was refused nor parent kept, the references are not contended")
+    }
+}
+
+func TestForUpdate(t *testing.T) {
+    scenario(t, func() {
+        cfg.ForUpdate = true
+        cfg.Distribution = "hotspot"
+    })
+}
+
+func TestLongTransactions(t *testing.T) {
+    r := scenario(t, func() {
+        cfg.Duration = 30 * time.Second
+        cfg.LongTxInterval = time.Second
+        cfg.LongTxDuration = 20 * time.Second
+    })
+    if r.LongTransactions == 0 {
+        t.Errorf("no long transaction was run")
+    }
+}
+
+func TestRamp(t *testing.T) {
+    r := scenario(t, func() {
+        cfg.Workers = 3
+        cfg.RampStep = 2 * time.Second
+        cfg.RampDown = true
+    })
+    if len(r.Scalability) != 5 {
+        t.Errorf("%d steps measured instead of 5", len(r.Scalability))
+    }
+}
+
+func TestIsolationLevels(t *testing.T) {
+    for _, level := range []string{"read-committed", "repeatable-read", "serializable", "mixed"} {
+        r := scenario(t, func() {
+            cfg.Isolation = level
+            cfg.Distribution = "hotspot"
+        })
+        for name, is := range r.PerIsolation {
+            t.Logf("%s: %d commits, %d retries, %d aborts", name, is.Commits, is.Retries, is.Aborts)
+        }
+    }
+}
+
+func TestStandbyReads(t *testing.T) {
+    n := 0
+    for _, replicas := range standbys {
+        n += len(replicas)
+    }
+    if n == 0 {
+        t.Skip("no standbys in the cluster config")
+    }
+    r := scenario(t, func() {
+        cfg.StandbyReads = true
+    })
+    if r.StandbyReads == 0 {
+        t.Errorf("nothing was read on the standbys")
+    }
+}
+
+func TestXidBurners(t *testing.T) {
+    r := scenario(t, func() {
+        cfg.Duration = 30 * time.Second
+        cfg.XidBurners = 2
+    })
+    if r.XidsBurned == 0 {
+        t.Errorf("no xids burned")
+    }
+}
+
+func TestReads(t *testing.T) {
+    r := scenario(t, func() {
+        cfg.ReadPct = 50
+    })
+    if r.Reads == 0 {
+        t.Errorf("no read-only transaction committed")
+    }
+}
+
+func TestAudit(t *testing.T) {
+    scenario(t, func() {
+        cfg.Audit = true
+        cfg.AbortPct = 10
+        cfg.AbortMode = "one"
+    })
+}
+
+func TestDatabases(t *testing.T) {
+    if cfg.Databases > 1 {
+        t.Skip("already run with -databases")
+    }
+    savedNodes, savedStandbys := nodes, standbys
+    defer func() {
+        nodes, standbys = savedNodes, savedStandbys
+        expand_databases()
+    }()
+    r := scenario(t, func() {
+        cfg.Databases = 2
+        expand_databases()
+    })
+    if r.Nodes != 2 * len(savedNodes) {
+        t.Errorf("%d participants instead of %d", r.Nodes, 2 * len(savedNodes))
+    }
+}
+
+func TestCrashRecovery(t *testing.T) {
+    if cfg.CrashInterval == 0 {
+        t.Skip("kills the nodes, only run with -crash-interval")
+    }
+    r := scenario(t, func() {
+        cfg.Duration = time.Minute
+    })
+    if r.Crashes == 0 {
+        t.Errorf("no node crashed")
+    }
+}
+
+func TestClockSkew(t *testing.T) {
+    if cfg.SkewCmd == "" {
+        t.Skip("changes clocks of the servers, only run with -skew-cmd")
+    }
+    dir, err := ioutil.TempDir("", "transfers")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer os.RemoveAll(dir)
+
+    // CSNs ordered wrong by the clocks show up as lost commits
+    r := scenario(t, func() {
+        cfg.Duration = time.Minute
+        cfg.SkewInterval = 2 * time.Second
+        cfg.HistoryPath = filepath.Join(dir, "history.json")
+    })
+    if r.ClockSkews == 0 {
+        t.Errorf("no clock was set off")
+    }
+}
+
+func TestVacuum(t *testing.T) {
+    r := scenario(t, func() {
+        cfg.Duration = 30 * time.Second
+        cfg.VacuumInterval = 100 * time.Millisecond
+    })
+    if r.Vacuums == 0 {
+        t.Errorf("no vacuum done")
+    }
+}
+
+func TestRate(t *testing.T) {
+    r := scenario(t, func() {
+        cfg.Duration = 20 * time.Second
+        cfg.Rate = 50
+    })
+    if r.Tps > 1.1 * r.TargetTps {
+        t.Errorf("%0.1f TPS run at target %0.1f", r.Tps, r.TargetTps)
+    }
+}
+
+func TestGcPauses(t *testing.T) {
+    stop := make(chan struct{})
+    go func() {
+        for {
+            select {
+            case <-stop:
+                return
+            case <-time.After(50 * time.Millisecond):
+                runtime.GC()
+            }
+        }
+    }()
+    r := scenario(t, func() {})
+    close(stop)
+    if r.GcCycles == 0 {
+        t.Errorf("no GC cycle seen")
+    }
+    if r.GcHit > r.Commits || r.GcFreeLatency.Max > r.Latency.Max {
+        t.Errorf("%d of %d trans hit by GC, max latency %0.3fms without pauses, %0.3fms with",
+            r.GcHit, r.Commits, r.GcFreeLatency.Max, r.Latency.Max)
+    }
+}
+
+func TestDdl(t *testing.T) {
+    r := scenario(t, func() {
+        cfg.Duration = 30 * time.Second
+        cfg.DdlInterval = 500 * time.Millisecond
+    })
+    if r.DdlChanges == 0 {
+        t.Errorf("no schema change committed, %d lock timeouts", r.DdlLockTimeouts)
+    }
+}
+
+func TestDisjointAccounts(t *testing.T) {
+    r := scenario(t, func() {
+        cfg.DisjointAccounts = true
+    })
+    if r.Retries > 0 {
+        t.Errorf("%d retries although workers share no accounts", r.Retries)
+    }
+}
+
+func TestFanout(t *testing.T) {
+    if len(nodes) < 3 {
+        t.Skip("needs at least three nodes")
+    }
+    scenario(t, func() {
+        cfg.Fanout = len(nodes)
+        cfg.Audit = true
+    })
+}
+
+func TestThinkTime(t *testing.T) {
+    r := scenario(t, func() {
+        cfg.Workers = 16
+        cfg.Iterations = 50
+        cfg.ThinkTime = 10 * time.Millisecond
+        cfg.StatementThinkTime = 20 * time.Millisecond
+    })
+    // two pauses of at least half the mean in every transfer
+    if r.Latency.P50 < 20 {
+        t.Errorf("median latency %0.3fms is shorter than the thinking", r.Latency.P50)
+    }
+}
+
+func TestJournal(t *testing.T) {
+    dir, err := ioutil.TempDir("", "transfers")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer os.RemoveAll(dir)
+
+    path := filepath.Join(dir, "journal.json")
+    r := scenario(t, func() {
+        cfg.JournalPath = path
+        cfg.AbortPct = 10
+    })
+    intents, outcomes := read_journal(path)
+    committed := 0
+    for _, outcome := range outcomes {
+        if outcome == outcomeCommitted {
+            committed++
+        }
+    }
+    if int64(committed) != r.Commits || len(intents) < len(outcomes) {
+        t.Errorf("%d intents and %d outcomes journaled, %d committed of %d",
+            len(intents), len(outcomes), committed, r.Commits)
+    }
+}
+
+func TestServerStatements(t *testing.T) {
+    r := scenario(t, func() {
+        cfg.ServerStatements = true
+    })
+    if len(r.ServerStatements) == 0 {
+        t.Skip("no pg_stat_statements on the nodes")
+    }
+    if r.ServerTime["dtm"] == 0 || r.ServerTime["workload"] == 0 {
+        t.Errorf("server time by class: %v", r.ServerTime)
+    }
+}
+
+func TestCheckpoint(t *testing.T) {
+    dir, err := ioutil.TempDir("", "transfers")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer os.RemoveAll(dir)
+
+    path := filepath.Join(dir, "checkpoint.json")
+    first := scenario(t, func() {
+        cfg.Iterations = 250
+        cfg.Teardown = false
+        cfg.CheckpointPath = path
+    })
+    if _, err := os.Stat(path); !os.IsNotExist(err) {
+        t.Errorf("checkpoint of the finished run is left")
+    }
+    // as if the run had been killed at the end
+    save_checkpoint(path)
+    r := scenario(t, func() {
+        cfg.CheckpointPath = path
+        cfg.Resume = true
+    })
+    if r.Resumes != 1 || r.Commits <= first.Commits {
+        t.Errorf("%d resumes, %d commits after resume of %d", r.Resumes, r.Commits, first.Commits)
+    }
+}
+
+func TestResolve(t *testing.T) {
+    for i := range nodes {
+        conn, err := pgx.Connect(nodes[i])
+        if err != nil {
+            t.Fatal(err)
+        }
+        // as left by a coordinator crashed before the vote
+        exec(conn, "begin")
+        exec(conn, "prepare transaction 'resolve-test'")
+        conn.Close()
+    }
+    if status := cmd_resolve(nil); status != 0 {
+        t.Fatalf("resolve failed")
+    }
+    for i := range nodes {
+        conn, err := pgx.Connect(nodes[i])
+        if err != nil {
+            t.Fatal(err)
+        }
+        if n := execQuery(conn, "select count(*) from pg_prepared_xacts where gid = 'resolve-test'"); n != 0 {
+            t.Errorf("transaction is left prepared on node %d", i)
+        }
+        conn.Close()
+    }
+}
+
+func TestCompare(t *testing.T) {
+    r := scenario(t, func() {})
+    if failures := compare_results(r, r); len(failures) > 0 {
+        t.Errorf("run regressed against itself: %s", strings.Join(failures, ", "))
+    }
+    worse := r
+    worse.Tps = r.Tps / 2
+    worse.Aborts += r.Commits
+    if failures := compare_results(r, worse); len(failures) != 2 {
+        t.Errorf("%d regressions found instead of 2: %s", len(failures), strings.Join(failures, ", "))
+    }
+}
+
+func TestRunner(t *testing.T) {
+    config := DefaultConfig()
+    config.Workers = 2
+    config.Iterations = 100
+    config.Teardown = true
+    saved, savedNodes, savedStandbys, savedServers := cfg, nodes, standbys, servers
+    defer func() {
+        cfg, nodes, standbys, servers = saved, savedNodes, savedStandbys, savedServers
+    }()
+
+    runner := Runner{Cluster: Cluster{Nodes: nodes, Standbys: standbys}, Config: config}
+    report, err := runner.Run()
+    if err != nil {
+        t.Fatal(err)
+    }
+    if report.Commits == 0 {
+        t.Errorf("no transaction committed")
+    }
+    if failures := report.Failures(); len(failures) > 0 {
+        t.Errorf("failed: %s", strings.Join(failures, ", "))
+    }
+}
+
+func TestMatrix(t *testing.T) {
+    if cfg.BootstrapPath == "" || cfg.MatrixBindirs == "" {
+        t.Skip("starts clusters of its own, only run with -bootstrap and -matrix-bindirs")
+    }
+    saved := cfg
+    defer func() { cfg = saved }()
+    cfg.Workers = 2
+    cfg.Iterations = 100
+    cfg.Accounts = 1000
+    cfg.BulkRows = 10000
+    cfg.Teardown = true
+
+    for _, c := range run_matrix() {
+        if !c.Passed() {
+            t.Errorf("%s %s: %s %s", c.Version, c.Workload, c.Error, strings.Join(c.Failures, ", "))
+        }
+    }
+}
+
+func TestGroupCommit(t *testing.T) {
+    r := scenario(t, func() {
+        cfg.Workload = "group"
+        cfg.Iterations = 100
+        cfg.GroupSize = 4
+    })
+    if r.GroupBursts == 0 {
+        t.Errorf("no burst committed, %d transfers committed alone", r.GroupTimeouts)
+    }
+    t.Logf("bursts committed %0.2f times faster than one by one", r.GroupCoalescing)
+}
+
+func TestIndexes(t *testing.T) {
+    r := scenario(t, func() {
+        cfg.Indexes = 3
+    })
+    if r.HotUpdates != 0 {
+        t.Errorf("%d of %d updates are HOT with indexes on the balance", r.HotUpdates, r.TableUpdates)
+    }
+    r = scenario(t, func() {
+        cfg.FillFactor = 50
+    })
+    t.Logf("%d of %d updates are HOT with fillfactor 50", r.HotUpdates, r.TableUpdates)
+}
+
+func TestTpcb(t *testing.T) {
+    scenario(t, func() {
+        cfg.Workload = "tpcb"
+        cfg.Iterations = 200
+        cfg.Accounts = 1000
+        cfg.Branches = 2 * len(nodes)
+        cfg.RemotePct = 50
+    })
+}
+
+func TestTpcc(t *testing.T) {
+    r := scenario(t, func() {
+        cfg.Workload = "tpcc"
+        cfg.Iterations = 200
+        cfg.Warehouses = 2 * len(nodes)
+    })
+    if r.TpccNewOrders == 0 || r.TpccPayments == 0 || r.TpccRemote == 0 {
+        t.Errorf("%d new orders, %d payments, %d of them remote", r.TpccNewOrders, r.TpccPayments, r.TpccRemote)
+    }
+}
+
+func TestYcsb(t *testing.T) {
+    for mix := range ycsbMixes {
+        r := scenario(t, func() {
+            cfg.Workload = "ycsb"
+            cfg.YcsbMix = mix
+            cfg.Iterations = 100
+            cfg.Distribution = "zipf"
+        })
+        t.Logf("mix %s: %v", mix, r.YcsbCounts)
+    }
+}
+
+func TestFuzz(t *testing.T) {
+    r := scenario(t, func() {
+        cfg.Workload = "fuzz"
+        cfg.Iterations = 300
+        cfg.AbortPct = 10
+    })
+    if r.FuzzTransactions == 0 {
+        t.Errorf("no transaction of the fuzzer checked")
+    }
+}
+
+func TestElleHistory(t *testing.T) {
+    path := filepath.Join(os.TempDir(), fmt.Sprintf("dtmtest-elle-%d.edn", os.Getpid()))
+    defer os.Remove(path)
+    scenario(t, func() {
+        cfg.Workload = "fuzz"
+        cfg.Iterations = 50
+        cfg.ElleHistoryPath = path
+    })
+    data, err := ioutil.ReadFile(path)
+    if err != nil {
+        t.Fatal(err)
+    }
+    lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+    // an invoke and a completion of every iteration of the 4 workers at least
+    if len(lines) < 2 * 4 * 50 || !strings.HasPrefix(lines[0], "{:index 0, :type :invoke") {
+        t.Errorf("%d operations in the history, first %s", len(lines), lines[0])
+    }
+}
+
+func TestDtmProfile(t *testing.T) {
+    r := scenario(t, func() {
+        cfg.DtmProfile = true
+        cfg.Workers = 3
+        cfg.RampStep = time.Second
+    })
+    if r.DtmShare <= 0 || r.DtmShare >= 1 {
+        t.Errorf("pg_dtm calls take %0.1f%% of latency", r.DtmShare * 100)
+    }
+    for _, l := range r.Scalability {
+        t.Logf("%d workers: pg_dtm %0.1f%% of latency", l.Workers, l.DtmShare * 100)
+    }
+}
+
+func TestTimeouts(t *testing.T) {
+    r := scenario(t, func() {
+        cfg.Iterations = 100
+        // pauses of 0 to 20ms, some of them longer than the timeout
+        cfg.StatementThinkTime = 10 * time.Millisecond
+        cfg.ThinkJitter = 1
+        cfg.IdleTimeout = 10 * time.Millisecond
+        cfg.StatementTimeout = time.Second
+    })
+    if r.IdleTimeouts == 0 {
+        t.Errorf("no session ended idle in transaction, %d commits", r.Commits)
+    }
+}
+
+func TestDeadlockDetector(t *testing.T) {
+    r := scenario(t, func() {
+        cfg.Deadlocks = true
+        cfg.Iterations = 100
+        // long enough for the detector to come first
+        cfg.DeadlockTimeout = time.Minute
+        cfg.DeadlockDetect = "cancel"
+        cfg.DeadlockDetectInterval = 20 * time.Millisecond
+    })
+    if r.GlobalDeadlocks == 0 || r.DeadlockVictims == 0 {
+        t.Errorf("%d global deadlocks found, %d transactions cancelled", r.GlobalDeadlocks, r.DeadlockVictims)
+    }
+}
+
+func TestControl(t *testing.T) {
+    const addr = "127.0.0.1:18081"
+    done := make(chan error, 1)
+    go func() {
+        post := func(path string) error {
+            resp, err := http.Post("http://" + addr + path, "text/plain", nil)
+            if err != nil {
+                return err
+            }
+            resp.Body.Close()
+            if resp.StatusCode != http.StatusOK {
+                return fmt.Errorf("%s: %s", path, resp.Status)
+            }
+            return nil
+        }
+        live := func() (s LiveStats, err error) {
+            resp, err := http.Get("http://" + addr + "/stats")
+            if err != nil {
+                return s, err
+            }
+            defer resp.Body.Close()
+            err = json.NewDecoder(resp.Body).Decode(&s)
+            return s, err
+        }
+        for start := time.Now(); ; time.Sleep(10 * time.Millisecond) {
+            if _, err := live(); err == nil {
+                break
+            } else if time.Since(start) > time.Minute {
+                done <- err
+                return
+            }
+        }
+        if err := post("/pause"); err != nil {
+            done <- err
+            return
+        }
+        time.Sleep(500 * time.Millisecond)
+        before, err := live()
+        time.Sleep(500 * time.Millisecond)
+        after, err2 := live()
+        if err == nil {
+            err = err2
+        }
+        if err == nil && (!after.Paused || after.Commits != before.Commits) {
+            err = fmt.Errorf("%d commits while paused", after.Commits - before.Commits)
+        }
+        if err2 := post("/resume"); err == nil {
+            err = err2
+        }
+        done <- err
+    }()
+    scenario(t, func() {
+        cfg.ControlAddr = addr
+        cfg.Iterations = 2000
+    })
+    if err := <-done; err != nil {
+        t.Error(err)
+    }
+}
+
+func TestSynchronousCommit(t *testing.T) {
+    r := scenario(t, func() {
+        cfg.SynchronousCommit = "off"
+    })
+    for i, s := range r.Settings {
+        if s["synchronous_commit"] != "off" {
+            t.Errorf("synchronous_commit=%s on node %d", s["synchronous_commit"], i)
+        }
+    }
+}
+
+func TestArbiterFailover(t *testing.T) {
+    if cfg.Arbiters == "" {
+        t.Skip("stops the leading arbiter, only run with -arbiters and -arbiter-stop-cmd")
+    }
+    r := scenario(t, func() {
+        cfg.Duration = time.Minute
+        cfg.ArbiterOutageAfter = 10 * time.Second
+        cfg.ArbiterFailovers = 3
+    })
+    if r.ArbiterLeaderChanges < 3 {
+        t.Errorf("%d leader changes instead of 3", r.ArbiterLeaderChanges)
+    }
+    if r.DecisionsChecked == 0 {
+        t.Errorf("no decision checked")
+    }
+}
+
+func TestSessionGuarantees(t *testing.T) {
+    r := scenario(t, func() {
+        cfg.SessionChecks = true
+        cfg.ReadPct = 30
+    })
+    if r.SessionChecks == 0 {
+        t.Errorf("no session check done")
+    }
+}
+
+func TestWan(t *testing.T) {
+    r := scenario(t, func() {
+        cfg.Wan = "1=5ms/2ms/1%"
+    })
+    // every statement takes at least a round trip of 10ms
+    if len(r.PerNode) > 1 && r.PerNode[1].StatementLatency.P50 < 10 {
+        t.Errorf("median statement on server 1 takes %0.3fms", r.PerNode[1].StatementLatency.P50)
+    }
+    if r.WanLosses == 0 {
+        t.Errorf("no chunk lost")
+    }
+}
+
+func TestProxyDrops(t *testing.T) {
+    dir, err := ioutil.TempDir("", "transfers")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer os.RemoveAll(dir)
+
+    r := scenario(t, func() {
+        cfg.ProxyDrop = "prepare,commit"
+        cfg.ProxyDropPct = 2
+        cfg.JournalPath = filepath.Join(dir, "journal.json")
+    })
+    if r.ProxyDrops == 0 {
+        t.Errorf("no connection reset")
+    }
+}
+
+func TestBudgets(t *testing.T) {
+    r := scenario(t, func() {
+        cfg.MaxAbortRate = 100
+        cfg.MaxP99 = time.Hour
+    })
+    if len(r.WorkerAbortRates) != 4 {
+        t.Errorf("abort rates of %d workers instead of 4", len(r.WorkerAbortRates))
+    }
+    over := r
+    over.Budgets.MaxP99 = r.Latency.P99 / 2
+    over.Budgets.MaxWorkerAbortRate = 0.001
+    over.WorkerAbortRates = append([]float64{1}, r.WorkerAbortRates[1:]...)
+    if failures := over.budget_failures(); len(failures) != 2 {
+        t.Errorf("%d budgets exceeded instead of 2: %s", len(failures), strings.Join(failures, ", "))
+    }
+}
+
+func TestRecord(t *testing.T) {
+    dir, err := ioutil.TempDir("", "transfers")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer os.RemoveAll(dir)
+
+    path := filepath.Join(dir, "run.sql.json")
+    scenario(t, func() {
+        cfg.RecordPath = path
+    })
+    events, err := read_recording(path)
+    if err != nil {
+        t.Fatal(err)
+    }
+    kinds := make(map[string]int)
+    for _, e := range events {
+        kinds[e.Kind]++
+    }
+    if kinds["connect"] == 0 || kinds["message"] == 0 {
+        t.Errorf("%d connections and %d messages recorded", kinds["connect"], kinds["message"])
+    }
+}
@@ -0,0 +1,81 @@
+package dtmtest
+
+import (
+    "fmt"
+    "math/rand"
+    "strconv"
+    "strings"
+    "github.com/digoal/postgres_cluster/contrib/pg_tsdtm/tests/dtmclient"
+)
+
+// Isolation levels of global transactions, see -isolation. In "mixed"
+// mode every transaction picks its level at random with the weights of
+// -isolation-mix, e.g. "read-committed=20,repeatable-read=70,serializable=10".
+var isolationNames = map[string]string{
+    "default": dtmclient.Default,
+    "read-committed": dtmclient.ReadCommitted,
+    "repeatable-read": dtmclient.RepeatableRead,
+    "serializable": dtmclient.Serializable,
+}
+
+type isolationWeight struct {
+    name string
+    weight int
+}
+
+// Levels chosen from, single one unless -isolation is "mixed"
+var isolationMix []isolationWeight
+var isolationWeights int
+
+func parse_isolation() error {
+    isolationMix, isolationWeights = nil, 0
+    if cfg.Isolation != "mixed" {
+        if _, ok := isolationNames[cfg.Isolation]; !ok {
+            return fmt.Errorf("unknown isolation level '%s'", cfg.Isolation)
+        }
+        isolationMix = []isolationWeight{{cfg.Isolation, 1}}
+        isolationWeights = 1
+        return nil
+    }
+    for _, item := range strings.Split(cfg.IsolationMix, ",") {
+        parts := strings.SplitN(strings.TrimSpace(item), "=", 2)
+        if _, ok := isolationNames[parts[0]]; !ok {
+            return fmt.Errorf("unknown isolation level '%s' in -isolation-mix", parts[0])
+        }
+        weight := 1
+        if len(parts) == 2 {
+            var err error
+            if weight, err = strconv.Atoi(parts[1]); err != nil || weight < 0 {
+                return fmt.Errorf("bad weight of '%s' in -isolation-mix", parts[0])
+            }
+        }
+        isolationMix = append(isolationMix, isolationWeight{parts[0], weight})
+        isolationWeights += weight
+    }
+    if isolationWeights == 0 {
+        return fmt.Errorf("-isolation-mix has no levels with positive weight")
+    }
+    return nil
+}
+
+// Name of the level for the next transaction
+func choose_isolation(r *rand.Rand) string {
+    if len(isolationMix) == 1 {
+        return isolationMix[0].name
+    }
+    n := r.Intn(isolationWeights)
+    for _, level := range isolationMix {
+        if n < level.weight {
+            return level.name
+        }
+        n -= level.weight
+    }
+    return isolationMix[len(isolationMix) - 1].name
+}
+
+// Outcome of attempts of transactions run with the level
+type IsolationStats struct {
+    Commits int64
+    Retries int64   // serialization failures and deadlocks
+    Aborts int64    // other errors
+}
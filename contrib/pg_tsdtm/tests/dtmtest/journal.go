@@ -0,0 +1,209 @@
+package dtmtest
+
+import (
+    "bufio"
+    "encoding/json"
+    "fmt"
+    "os"
+    "sync"
+    "github.com/jackc/pgx"
+    "github.com/digoal/postgres_cluster/contrib/pg_tsdtm/tests/dtmclient"
+)
+
+// Client-side write-ahead journal of global transactions, see -journal.
+// Right after a transaction begins it inserts a marker row into
+// t_journal on every participant, with its local xid there, and the
+// intent is journaled: the gid, the nodes and their xids. Once the
+// client knows how the commit has ended, the outcome is journaled too.
+// The markers commit or abort together with the transaction, so after
+// the run, or after a crash by the verify command, every journaled
+// transaction is looked up on its participants: it should be on all of
+// them or on none, on all if committed and on none if aborted. The
+// transactions whose outcome the client could not know, e.g. because a
+// node crashed in the middle of commit, are checked for atomicity only.
+//
+// Records are written to the file unbuffered, so the journal survives
+// the client killed in the middle of a run.
+
+const (
+    outcomeCommitted = "committed"
+    outcomeAborted = "aborted"
+    outcomeUnknown = "unknown"
+)
+
+// Intent has no Outcome, the outcome has only the Gid
+type JournalRecord struct {
+    Gid string `json:"gid"`
+    Nodes []int `json:"nodes,omitempty"`
+    Xids []int64 `json:"xids,omitempty"`
+    Outcome string `json:"outcome,omitempty"`
+}
+
+var journal struct {
+    sync.Mutex
+    file *os.File
+}
+
+func create_journal_tables(conns []*pgx.Conn) {
+    for _, conn := range conns {
+        if !cfg.NoSetup {
+            exec(conn, "drop table if exists t_journal")
+        }
+        // gids repeat from run to run, xids do not
+        exec(conn, "create table if not exists t_journal(gid text, xid bigint)")
+    }
+}
+
+func drop_journal_tables(conns []*pgx.Conn) {
+    for _, conn := range conns {
+        exec(conn, "drop table if exists t_journal")
+    }
+}
+
+func open_journal(path string) {
+    f, err := os.Create(path)
+    checkErr(err)
+    journal.file = f
+}
+
+func close_journal() {
+    journal.Lock()
+    defer journal.Unlock()
+    if journal.file != nil {
+        checkErr(journal.file.Close())
+        journal.file = nil
+    }
+}
+
+func write_journal(r JournalRecord) {
+    line, err := json.Marshal(r)
+    checkErr(err)
+    journal.Lock()
+    defer journal.Unlock()
+    if journal.file != nil {
+        _, err = journal.file.Write(append(line, '\n'))
+        checkErr(err)
+    }
+}
+
+// Put the markers into the transaction just begun and journal its intent
+func journal_intent(tx *dtmclient.GlobalTx) error {
+    r := JournalRecord{Gid: tx.Gid}
+    for i, conn := range tx.Participants() {
+        var xid int64
+        err := tx.QueryRow(i, "insert into t_journal values ($1, txid_current()) returning xid", tx.Gid).Scan(&xid)
+        if err != nil {
+            return err
+        }
+        r.Nodes = append(r.Nodes, node_of(conn))
+        r.Xids = append(r.Xids, xid)
+    }
+    write_journal(r)
+    return nil
+}
+
+// What the client knows about the end of the transaction: once anything
+// has been prepared or committed a failure may have left it either way
+func transaction_outcome(tx *dtmclient.GlobalTx, err error) string {
+    outcome := outcomeAborted
+    if err == nil {
+        outcome = outcomeCommitted
+    } else if err != errRolledBack {
+        for _, span := range tx.Spans {
+            switch span.Phase {
+            case "prepare", "begin_prepare", "vote", "end_prepare", "commit_prepared", "commit":
+                outcome = outcomeUnknown
+            }
+        }
+    }
+    return outcome
+}
+
+func journal_outcome(tx *dtmclient.GlobalTx, err error) {
+    write_journal(JournalRecord{Gid: tx.Gid, Outcome: transaction_outcome(tx, err)})
+}
+
+func read_journal(path string) (intents []JournalRecord, outcomes map[string]string) {
+    f, err := os.Open(path)
+    checkErr(err)
+    defer f.Close()
+
+    outcomes = make(map[string]string)
+    lines := bufio.NewScanner(f)
+    for lines.Scan() {
+        var r JournalRecord
+        if err := json.Unmarshal(lines.Bytes(), &r); err != nil {
+            // the last record may be cut by a crash of the client
+            fmt.Printf("[journal] skipping broken record: %s\n", lines.Text())
+            continue
+        }
+        if r.Outcome == "" {
+            intents = append(intents, r)
+        } else {
+            outcomes[r.Gid] = r.Outcome
+        }
+    }
+    checkErr(lines.Err())
+    return intents, outcomes
+}
+
+type journalMarker struct {
+    gid string
+    xid int64
+}
+
+// Replay the journal against the markers left on the nodes, returns the
+// number of transactions found broken. Nothing may be in flight.
+func verify_journal(path string) int {
+    intents, outcomes := read_journal(path)
+
+    conns := connect_all()
+    defer close_all(conns)
+    markers := make([]map[journalMarker]bool, len(conns))
+    for i, conn := range conns {
+        markers[i] = make(map[journalMarker]bool)
+        rows, err := conn.Query("select gid, xid from t_journal")
+        checkErr(err)
+        for rows.Next() {
+            var m journalMarker
+            checkErr(rows.Scan(&m.gid, &m.xid))
+            markers[i][m] = true
+        }
+        checkErr(rows.Err())
+    }
+
+    anomalies := 0
+    tally := make(map[string]int)
+    for _, r := range intents {
+        var found []int
+        for i, node := range r.Nodes {
+            if markers[node][journalMarker{r.Gid, r.Xids[i]}] {
+                found = append(found, node)
+            }
+        }
+        outcome, ok := outcomes[r.Gid]
+        if !ok {
+            // the client never got to the end of it
+            outcome = outcomeUnknown
+        }
+        tally[outcome]++
+
+        switch {
+        case len(found) != 0 && len(found) != len(r.Nodes):
+            fmt.Printf("[journal] transaction '%s' (%s) of nodes %v with xids %v is only on nodes %v\n",
+                r.Gid, outcome, r.Nodes, r.Xids, found)
+            anomalies++
+        case outcome == outcomeCommitted && len(found) == 0:
+            fmt.Printf("[journal] committed transaction '%s' of nodes %v with xids %v is lost\n",
+                r.Gid, r.Nodes, r.Xids)
+            anomalies++
+        case outcome == outcomeAborted && len(found) != 0:
+            fmt.Printf("[journal] aborted transaction '%s' of nodes %v with xids %v is visible\n",
+                r.Gid, r.Nodes, r.Xids)
+            anomalies++
+        }
+    }
+    fmt.Printf("[journal] %d transactions checked: %d committed, %d aborted, %d of unknown outcome, %d anomalies\n",
+        len(intents), tally[outcomeCommitted], tally[outcomeAborted], tally[outcomeUnknown], anomalies)
+    return anomalies
+}
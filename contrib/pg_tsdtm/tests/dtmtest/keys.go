@@ -0,0 +1,109 @@
+package dtmtest
+
+import (
+    "fmt"
+    "math/rand"
+    "os"
+)
+
+// Chooses accounts to transfer money between
+type KeyChooser interface {
+    Next() int
+}
+
+type uniformKeys struct {
+    r *rand.Rand
+    n int
+}
+
+func (k *uniformKeys) Next() int {
+    return k.r.Intn(k.n)
+}
+
+// Account 0 is the hottest one, then 1 and so on
+type zipfKeys struct {
+    z *rand.Zipf
+}
+
+func (k *zipfKeys) Next() int {
+    return int(k.z.Uint64())
+}
+
+// HotspotPct percent of accesses go to the first HotspotFraction of accounts
+type hotspotKeys struct {
+    r *rand.Rand
+    n int
+    hot int
+    pct int
+}
+
+func (k *hotspotKeys) Next() int {
+    if k.r.Intn(100) < k.pct || k.hot == k.n {
+        return k.r.Intn(k.hot)
+    }
+    return k.hot + k.r.Intn(k.n - k.hot)
+}
+
+// With -disjoint-accounts every worker gets its own range of accounts, so
+// that workers never conflict with each other and what is measured is the
+// cost of the commit path rather than waiting for locks
+type disjointKeys struct {
+    keys KeyChooser
+    first int
+}
+
+func (k *disjointKeys) Next() int {
+    return k.first + k.keys.Next()
+}
+
+// Chooser of the worker over all accounts or its own range of them
+func worker_keys(r *rand.Rand, id int) KeyChooser {
+    if !cfg.DisjointAccounts {
+        return new_key_chooser(r, total_accounts())
+    }
+    first, last := worker_range(id)
+    return &disjointKeys{new_key_chooser(r, last - first), first}
+}
+
+// Accounts from first up to last the worker chooses from
+func worker_range(id int) (first int, last int) {
+    n := total_accounts()
+    if !cfg.DisjointAccounts {
+        return 0, n
+    }
+    return id * n / cfg.Workers, (id + 1) * n / cfg.Workers
+}
+
+// Accounts from first up to last the chooser of the worker ever returns:
+// all of its range but the hot ones only with -hotspot-pct 100
+func reachable_range(id int) (first int, last int) {
+    first, last = worker_range(id)
+    if cfg.Distribution == "hotspot" && cfg.HotspotPct >= 100 {
+        hot := int(float64(last - first) * cfg.HotspotFraction)
+        if hot < 1 {
+            hot = 1
+        }
+        last = first + hot
+    }
+    return first, last
+}
+
+// Every worker has its own chooser as rand.Rand is not safe for
+// concurrent use
+func new_key_chooser(r *rand.Rand, n int) KeyChooser {
+    switch cfg.Distribution {
+    case "uniform":
+        return &uniformKeys{r: r, n: n}
+    case "zipf":
+        return &zipfKeys{rand.NewZipf(r, cfg.ZipfS, 1, uint64(n - 1))}
+    case "hotspot":
+        hot := int(float64(n) * cfg.HotspotFraction)
+        if hot < 1 {
+            hot = 1
+        }
+        return &hotspotKeys{r: r, n: n, hot: hot, pct: cfg.HotspotPct}
+    }
+    fmt.Printf("ERROR: unknown distribution '%s'\n", cfg.Distribution)
+    os.Exit(1)
+    return nil
+}
@@ -0,0 +1,77 @@
+package dtmtest
+
+import (
+    "fmt"
+    "sync"
+    "sync/atomic"
+    "time"
+)
+
+// Accounts are generated on the nodes themselves, in batches of loadBatch
+// rows, each batch in its own local transaction. The table is filled before
+// any global transaction starts, so there is no need to load it atomically.
+const loadBatch = 100000
+
+// Fill table t on all nodes at once with -load-jobs connections per node
+func load_accounts() {
+    var wg sync.WaitGroup
+    var loaded int64
+
+    // sharded accounts are spread over the whole range of keys
+    nKeys := cfg.Accounts
+    if cfg.Sharded {
+        nKeys = total_accounts()
+    }
+    nBatches := (nKeys + loadBatch - 1) / loadBatch
+    todo := int64(nKeys * len(nodes))
+
+    start := time.Now()
+    for node := range nodes {
+        var next int64
+        for job := 0; job < cfg.LoadJobs; job++ {
+            wg.Add(1)
+            go func(node int) {
+                defer wg.Done()
+                conn, err := acquire(node)
+                checkErr(err)
+                defer release(node, conn)
+
+                for {
+                    batch := int(atomic.AddInt64(&next, 1) - 1)
+                    if batch >= nBatches {
+                        return
+                    }
+                    from := batch * loadBatch
+                    to := from + loadBatch
+                    if to > nKeys {
+                        to = nKeys
+                    }
+                    if cfg.Sharded {
+                        exec(conn, "insert into t (select u, $3 from generate_series($1, $2 - 1) u " +
+                            "where " + shard_predicate(node) + ")", from, to, cfg.InitAmount)
+                    } else {
+                        exec(conn, "insert into t (select generate_series($1, $2 - 1), $3)",
+                            from, to, cfg.InitAmount)
+                    }
+                    atomic.AddInt64(&loaded, int64(to - from))
+                }
+            }(node)
+        }
+    }
+
+    done := make(chan struct{})
+    go func() {
+        wg.Wait()
+        close(done)
+    }()
+    for {
+        select {
+        case <-done:
+            fmt.Printf("\rLoading accounts: 100%% (%d keys) in %v\n", todo, time.Since(start))
+            return
+        case <-time.After(500 * time.Millisecond):
+            n := atomic.LoadInt64(&loaded)
+            fmt.Printf("\rLoading accounts: %3d%% (%d/%d keys)", n * 100 / todo, n, todo)
+        }
+    }
+}
@@ -0,0 +1,61 @@
+package dtmtest
+
+import (
+    "fmt"
+    "strings"
+    "sync"
+    "time"
+    "github.com/jackc/pgx"
+    "github.com/digoal/postgres_cluster/contrib/pg_tsdtm/tests/dtmclient"
+)
+
+// Statements which fail are logged with their context, one line of
+// key=value fields each:
+//
+//  [sql] node=1 gid="3.17" elapsed=1.204ms sql="update t set v = v + $1 where u=$2 returning v" args=[-5 8812] error="..."
+//
+// The node is the index of the participant in the cluster config, -1 for
+// connections of no node, the gid is empty outside global transactions.
+// Serialization failures and deadlocks are retried as a matter of course
+// and logged only with -verbose, which logs every statement run.
+
+var logMutex sync.Mutex
+
+func log_statement(node int, gid string, sql string, args []interface{}, elapsed time.Duration, err error) {
+    if err == nil && !cfg.Verbose || err != nil && !cfg.Verbose && classify(err) == errRetry {
+        return
+    }
+    line := fmt.Sprintf("[sql] node=%d gid=%q elapsed=%0.3fms sql=%q args=%v",
+        node, gid, ms(elapsed), strings.Join(strings.Fields(sql), " "), args)
+    if err != nil {
+        line += fmt.Sprintf(" error=%q", err.Error())
+    }
+    logMutex.Lock()
+    fmt.Println(line)
+    logMutex.Unlock()
+}
+
+// Log statements of the transaction with the nodes of its participants
+func log_transaction(tx *dtmclient.GlobalTx) {
+    participants := tx.Participants()
+    tx.Log = func(participant int, sql string, args []interface{}, elapsed time.Duration, err error) {
+        log_statement(node_of(participants[participant]), tx.Gid, sql, args, elapsed, err)
+    }
+}
+
+// Steps of the protocol run by dtmclient itself are not statements of the
+// transaction, the one failed is logged by its phase
+func log_failed_step(tx *dtmclient.GlobalTx, err error) {
+    for i := len(tx.Spans) - 1; i >= 0; i-- {
+        if span := tx.Spans[i]; span.Participant == tx.Failed && span.Phase != "rollback" {
+            node := node_of(tx.Participants()[tx.Failed])
+            log_statement(node, tx.Gid, "-- " + span.Phase, nil, span.Duration, err)
+            return
+        }
+    }
+}
+
+// Statement of exec and execQuery, which panic on errors
+func log_exec(conn *pgx.Conn, sql string, args []interface{}, start time.Time, err error) {
+    log_statement(node_of(conn), "", sql, args, time.Since(start), err)
+}
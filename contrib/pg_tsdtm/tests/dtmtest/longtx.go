@@ -0,0 +1,152 @@
+package dtmtest
+
+import (
+    "fmt"
+    "sync"
+    "sync/atomic"
+    "time"
+    "github.com/jackc/pgx"
+    "github.com/digoal/postgres_cluster/contrib/pg_tsdtm/tests/dtmclient"
+)
+
+// Long transactions, see -long-tx-interval: every interval a global
+// transaction is opened on all nodes and kept open for -long-tx-duration
+// while the workers go on. Its snapshot should stay intact all this time:
+// the total is read again every longTxCheck, after vacuum of every node
+// with -long-tx-vacuum, and should never change. The age of the oldest
+// xmin on every node shows whether the xid horizon is held back by the
+// transaction as expected.
+const longTxCheck = 10 * time.Second
+
+var nLongTx int64
+
+// Direct connections not to starve the pools for minutes
+func connect_direct() ([]*pgx.Conn, error) {
+    var conns []*pgx.Conn
+    for _, node := range nodes {
+        conn, err := pgx.Connect(node)
+        if err != nil {
+            close_direct(conns)
+            return nil, err
+        }
+        conns = append(conns, conn)
+    }
+    return conns, nil
+}
+
+func close_direct(conns []*pgx.Conn) {
+    for _, conn := range conns {
+        conn.Close()
+    }
+}
+
+func long_transactions(stop chan struct{}, wg *sync.WaitGroup) {
+    defer wg.Done()
+
+    for id := 0; ; id++ {
+        select {
+        case <-stop:
+            return
+        case <-time.After(cfg.LongTxInterval):
+        }
+        if err := hold_snapshot(id, stop); err != nil {
+            fmt.Printf("[longtx] transaction %d failed: %v\n", id, err)
+        }
+    }
+}
+
+func hold_snapshot(id int, stop chan struct{}) error {
+    conns, err := connect_direct()
+    if err != nil {
+        return err
+    }
+    defer close_direct(conns)
+    others, err := connect_direct()
+    if err != nil {
+        return err
+    }
+    defer close_direct(others)
+
+    gid := fmt.Sprintf("long.%d", id)
+    tx, err := begin_global(conns, gid, "repeatable-read")
+    if err != nil {
+        return err
+    }
+    // nothing is written, there is nothing to commit
+    defer tx.Rollback()
+    atomic.AddInt64(&nLongTx, 1)
+
+    _, balanced := workload.(Balanced)
+    check := balanced && !cfg.NoDTM
+    var first int64
+    if check {
+        if first, err = snapshot_total(tx); err != nil {
+            return err
+        }
+    }
+
+    start := time.Now()
+    deadline := time.After(cfg.LongTxDuration)
+    ticker := time.NewTicker(longTxCheck)
+    defer ticker.Stop()
+    for done := false; !done; {
+        select {
+        case <-ticker.C:
+        case <-deadline:
+            done = true
+        case <-stop:
+            done = true
+        }
+        if cfg.LongTxVacuum {
+            vacuum_all(others)
+        }
+        if check {
+            sum, err := snapshot_total(tx)
+            if err != nil {
+                return err
+            }
+            atomic.AddInt64(&nChecks, 1)
+            if sum != first {
+                atomic.AddInt64(&nViolations, 1)
+                fmt.Printf("[longtx] violation: '%s' sees total=%d after %v, %d at the beginning (snapshot=%d)\n",
+                    gid, sum, time.Since(start), first, tx.Snapshot)
+            }
+        }
+    }
+
+    fmt.Printf("[longtx] '%s' held snapshot %d for %v, oldest xmin age on nodes: %v\n",
+        gid, tx.Snapshot, time.Since(start), xmin_ages(others))
+    return nil
+}
+
+// Total of the balanced workload under the snapshot of the transaction
+func snapshot_total(tx *dtmclient.GlobalTx) (int64, error) {
+    var total int64
+    for i := range tx.Participants() {
+        var sum int64
+        if err := tx.QueryRow(i, workload.(Balanced).TotalQuery()).Scan(&sum); err != nil {
+            return 0, err
+        }
+        total += sum
+    }
+    return total, nil
+}
+
+func vacuum_all(conns []*pgx.Conn) {
+    for i, conn := range conns {
+        if _, err := conn.Exec("vacuum"); err != nil {
+            fmt.Printf("[longtx] vacuum of node %d failed: %v\n", i, err)
+        }
+    }
+}
+
+func xmin_ages(conns []*pgx.Conn) []int64 {
+    ages := make([]int64, len(conns))
+    for i, conn := range conns {
+        err := conn.QueryRow("select coalesce(max(age(backend_xmin)), 0) from pg_stat_activity").Scan(&ages[i])
+        if err != nil {
+            ages[i] = -1
+        }
+    }
+    return ages
+}
@@ -0,0 +1,188 @@
+package dtmtest
+
+import (
+    "encoding/json"
+    "fmt"
+    "os"
+    osexec "os/exec"
+    "path/filepath"
+    "strings"
+    "github.com/jackc/pgx"
+)
+
+// One workload run on one installation by 'matrix'
+type MatrixCell struct {
+    Bindir string `json:"bindir"`
+    Version string `json:"version"`
+    Workload string `json:"workload"`
+    // Empty if the cell has been run, otherwise why it has not
+    Error string `json:"error,omitempty"`
+    Failures []string `json:"failures"`
+    Report *Report `json:"report,omitempty"`
+}
+
+func (c MatrixCell) Passed() bool {
+    return c.Error == "" && len(c.Failures) == 0
+}
+
+// Compatibility and performance of several PostgreSQL installations in one
+// go, e.g. builds of pg_dtm against different major versions:
+//
+//  transfers matrix -bootstrap bootstrap.json -duration 1m \
+//      -matrix-bindirs /usr/local/pg96/bin,/usr/local/pg10/bin
+//
+// For every bin directory of -matrix-bindirs a cluster is started as
+// -bootstrap describes, with the data under its own subdirectory of the
+// datadir, and every workload of -matrix-workloads is run on it with the
+// rest of flags. The installations are tried one after another on the same
+// ports. -output saves the whole matrix instead of a single report.
+func cmd_matrix(args []string) int {
+    if cfg.BootstrapPath == "" || cfg.MatrixBindirs == "" {
+        fmt.Println("ERROR: matrix needs -bootstrap and -matrix-bindirs")
+        return 1
+    }
+    handle_signals()
+    cells := run_matrix()
+    print_matrix(cells)
+    if cfg.Output != "" {
+        write_matrix(cfg.Output, cells)
+    }
+
+    var failures []string
+    for _, c := range cells {
+        if c.Error != "" {
+            failures = append(failures, fmt.Sprintf("%s %s: %s", c.Version, c.Workload, c.Error))
+        }
+        for _, f := range c.Failures {
+            failures = append(failures, fmt.Sprintf("%s %s: %s", c.Version, c.Workload, f))
+        }
+    }
+    return pass_or_fail(failures)
+}
+
+func split_list(list string) []string {
+    var items []string
+    for _, item := range strings.Split(list, ",") {
+        if item = strings.TrimSpace(item); item != "" {
+            items = append(items, item)
+        }
+    }
+    return items
+}
+
+// Version reported by the postgres binary of the installation, the bin
+// directory itself if it can not tell
+func installation_version(c *LocalCluster) string {
+    out, err := osexec.Command(c.bin("postgres"), "--version").Output()
+    if err != nil {
+        return c.Bindir
+    }
+    return strings.TrimPrefix(strings.TrimSpace(string(out)), "postgres (PostgreSQL) ")
+}
+
+// Run the workloads on every installation, the nodes and the settings of
+// the harness are restored afterwards
+func run_matrix() []MatrixCell {
+    template, err := load_bootstrap(cfg.BootstrapPath)
+    checkErr(err)
+    saved, savedNodes, savedStandbys, savedServers := cfg, nodes, standbys, servers
+    defer func() {
+        cfg, nodes, standbys, servers = saved, savedNodes, savedStandbys, savedServers
+    }()
+
+    var cells []MatrixCell
+    workloads := split_list(cfg.MatrixWorkloads)
+    for i, bindir := range split_list(cfg.MatrixBindirs) {
+        local := *template
+        local.Bindir = bindir
+        local.Datadir = filepath.Join(template.Datadir, fmt.Sprintf("pg%d", i))
+        version := installation_version(&local)
+        fmt.Printf("[matrix] %s (%s)\n", version, bindir)
+
+        cell := func(workload string) MatrixCell {
+            return MatrixCell{Bindir: bindir, Version: version, Workload: workload}
+        }
+        fail_all := func(err error) {
+            for _, w := range workloads {
+                c := cell(w)
+                c.Error = err.Error()
+                cells = append(cells, c)
+            }
+        }
+        if _, err := osexec.LookPath(local.bin("initdb")); err != nil {
+            fail_all(err)
+            continue
+        }
+        if err := local.Up(); err != nil {
+            fail_all(err)
+            continue
+        }
+
+        passed := true
+        for _, w := range workloads {
+            c := cell(w)
+            if interrupted() {
+                c.Error = "interrupted"
+                cells = append(cells, c)
+                passed = false
+                continue
+            }
+            cfg = saved
+            cfg.Workload = w
+            nodes = local.ConnConfigs()
+            standbys = make([][]pgx.ConnConfig, len(nodes))
+            if err := check_config(); err != nil {
+                c.Error = err.Error()
+            } else if r, err := run_matrix_cell(); err != nil {
+                c.Error = err.Error()
+            } else {
+                c.Report = &r
+                c.Failures = r.Failures()
+            }
+            passed = passed && c.Passed()
+            cells = append(cells, c)
+        }
+        local.Down(passed)
+    }
+    return cells
+}
+
+// A run panicking on one installation, e.g. on a missing function of
+// pg_dtm, fails its cell only
+func run_matrix_cell() (r Report, err error) {
+    defer func() {
+        if e := recover(); e != nil {
+            err = fmt.Errorf("%v", e)
+        }
+    }()
+    r = run()
+    print_results(r)
+    return r, nil
+}
+
+func print_matrix(cells []MatrixCell) {
+    fmt.Println()
+    fmt.Printf("%-24s %-12s %-6s %10s %10s %10s\n", "version", "workload", "result", "tps", "p99 ms", "abort %")
+    for _, c := range cells {
+        if c.Report == nil {
+            fmt.Printf("%-24s %-12s %-6s %s\n", c.Version, c.Workload, "ERROR", c.Error)
+            continue
+        }
+        result := "PASS"
+        if !c.Passed() {
+            result = "FAIL"
+        }
+        fmt.Printf("%-24s %-12s %-6s %10.2f %10.3f %10.2f\n", c.Version, c.Workload, result,
+            c.Report.Tps, c.Report.Latency.P99, abort_rate(*c.Report))
+    }
+}
+
+func write_matrix(path string, cells []MatrixCell) {
+    f, err := os.Create(path)
+    checkErr(err)
+    defer f.Close()
+
+    enc := json.NewEncoder(f)
+    enc.SetIndent("", "    ")
+    checkErr(enc.Encode(cells))
+}
@@ -0,0 +1,98 @@
+package dtmtest
+
+import (
+    "fmt"
+    "net/http"
+    "sync/atomic"
+    "time"
+    "github.com/jackc/pgx"
+)
+
+const rttInterval = time.Second
+
+// Round trip time of 'select 1' to every node, in nanoseconds
+var nodeRtt []int64
+
+func ping_nodes() {
+    conns := make([]*pgx.Conn, len(nodes))
+    for range time.Tick(rttInterval) {
+        for i := range nodes {
+            if conns[i] == nil || !conns[i].IsAlive() {
+                conn, err := pgx.Connect(nodes[i])
+                if err != nil {
+                    atomic.StoreInt64(&nodeRtt[i], -1)
+                    continue
+                }
+                conns[i] = conn
+            }
+            start := time.Now()
+            if _, err := conns[i].Exec("select 1"); err != nil {
+                atomic.StoreInt64(&nodeRtt[i], -1)
+                continue
+            }
+            atomic.StoreInt64(&nodeRtt[i], int64(time.Since(start)))
+        }
+    }
+}
+
+func write_summary(w http.ResponseWriter, name string, help string, h *Histogram) {
+    fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s summary\n", name, help, name)
+    for _, q := range []float64{50, 95, 99} {
+        fmt.Fprintf(w, "%s{quantile=\"%g\"} %g\n", name, q/100, h.Percentile(q).Seconds())
+    }
+    fmt.Fprintf(w, "%s_sum %g\n", name, h.sum.Seconds())
+    fmt.Fprintf(w, "%s_count %d\n", name, h.Count())
+}
+
+// Text exposition format of Prometheus, see
+// https://prometheus.io/docs/instrumenting/exposition_formats/
+func metrics_handler(w http.ResponseWriter, r *http.Request) {
+    total := stats.Total()
+    snapshots := stats.Snapshots()
+
+    w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+    fmt.Fprintf(w, "# HELP dtm_transactions_in_flight Global transactions being executed now\n")
+    fmt.Fprintf(w, "# TYPE dtm_transactions_in_flight gauge\n")
+    fmt.Fprintf(w, "dtm_transactions_in_flight %d\n", atomic.LoadInt64(&nInFlight))
+
+    fmt.Fprintf(w, "# HELP dtm_commits_total Committed global transactions\n")
+    fmt.Fprintf(w, "# TYPE dtm_commits_total counter\n")
+    fmt.Fprintf(w, "dtm_commits_total %d\n", total.Count())
+
+    fmt.Fprintf(w, "# HELP dtm_aborts_total Aborted global transactions\n")
+    fmt.Fprintf(w, "# TYPE dtm_aborts_total counter\n")
+    fmt.Fprintf(w, "dtm_aborts_total %d\n", atomic.LoadInt64(&nAborts))
+
+    fmt.Fprintf(w, "# HELP dtm_retries_total Retries after serialization failures and deadlocks\n")
+    fmt.Fprintf(w, "# TYPE dtm_retries_total counter\n")
+    fmt.Fprintf(w, "dtm_retries_total %d\n", atomic.LoadInt64(&nRetries))
+
+    fmt.Fprintf(w, "# HELP dtm_node_rtt_seconds Round trip time of a trivial query, -1 if node is down\n")
+    fmt.Fprintf(w, "# TYPE dtm_node_rtt_seconds gauge\n")
+    for i := range nodeRtt {
+        rtt := atomic.LoadInt64(&nodeRtt[i])
+        if rtt < 0 {
+            fmt.Fprintf(w, "dtm_node_rtt_seconds{node=\"%d\"} -1\n", i)
+        } else {
+            fmt.Fprintf(w, "dtm_node_rtt_seconds{node=\"%d\"} %g\n", i, time.Duration(rtt).Seconds())
+        }
+    }
+
+    write_summary(w, "dtm_transaction_latency_seconds",
+        "Latency of committed global transactions", &total)
+    write_summary(w, "dtm_snapshot_latency_seconds",
+        "Time to obtain global snapshot (dtm_extend and dtm_access)", &snapshots)
+}
+
+func serve_metrics(addr string) {
+    nodeRtt = make([]int64, len(nodes))
+    go ping_nodes()
+
+    http.HandleFunc("/metrics", metrics_handler)
+    http.HandleFunc("/progress", progress_handler)
+    fmt.Printf("Serving metrics on %s/metrics and progress on %s/progress\n", addr, addr)
+    if err := http.ListenAndServe(addr, nil); err != nil {
+        fmt.Printf("metrics server failed: %v\n", err)
+    }
+}
@@ -0,0 +1,165 @@
+package dtmtest
+
+import (
+    "fmt"
+    osexec "os/exec"
+    "strconv"
+    "strings"
+    "sync"
+    "sync/atomic"
+    "time"
+    "github.com/jackc/pgx"
+    "github.com/digoal/postgres_cluster/contrib/pg_tsdtm/tests/dtmclient"
+)
+
+// Network partitions between the coordinator (pg_tsdtm transactions are
+// driven by the client, so that is this process) and one of participants.
+// By default iptables rejects traffic to the port of the node, which needs
+// root; -partition-cmd replaces it with any other script.
+
+var nPartitions int64
+
+// Decisions about transactions which failed to finish and may be left
+// prepared on some of the nodes. The ones which failed after participants
+// agreed on commit CSN are committed on some nodes and must be committed on
+// the rest. The others are rolled back: nobody could commit them without
+// CSN. The CSN is kept: the nodes which have not got it by dtm_end_prepare
+// would commit at the one of their own dtm_begin_prepare otherwise.
+type inDoubtDecision struct {
+    commit bool
+    csn int64   // 0 without CSN, e.g. of plain 2PC
+}
+
+var inDoubt = struct {
+    sync.Mutex
+    commit map[string]inDoubtDecision
+}{commit: make(map[string]inDoubtDecision)}
+
+// Remember the decision about the transaction which failed to finish
+func record_in_doubt(tx *dtmclient.GlobalTx) {
+    inDoubt.Lock()
+    inDoubt.commit[tx.Gid] = inDoubtDecision{committed_in_doubt(tx), tx.Csn}
+    inDoubt.Unlock()
+}
+
+func committed_in_doubt(tx *dtmclient.GlobalTx) bool {
+    // plain 2PC decides to commit once all participants are prepared
+    return tx != nil && tx.State == dtmclient.Prepared && (tx.Csn != 0 || cfg.Backend == "2pc")
+}
+
+func partition_cmd(action string, node int) string {
+    if cfg.PartitionCmd != "" {
+        cmd := strings.Replace(cfg.PartitionCmd, "%n", strconv.Itoa(servers[node]), -1)
+        return strings.Replace(cmd, "%a", action, -1)
+    }
+    op := "-I"
+    if action == "heal" {
+        op = "-D"
+    }
+    return fmt.Sprintf("iptables %s OUTPUT -p tcp -d %s --dport %d -j REJECT --reject-with tcp-reset",
+        op, nodes[node].Host, nodes[node].Port)
+}
+
+func run_partition_cmd(action string, node int) bool {
+    cmd := partition_cmd(action, node)
+    out, err := osexec.Command("sh", "-c", cmd).CombinedOutput()
+    if err != nil {
+        fmt.Printf("[partition] '%s' failed: %v\n%s", cmd, err, out)
+        return false
+    }
+    return true
+}
+
+// Finish prepared transactions left on the nodes after the partition has
+// healed. While workers are running only transactions known to have failed
+// are touched, the rest may be in the middle of commit; once workers are
+// done every prepared transaction is finished. Returns the number of
+// transactions which could not be finished.
+func resolve_in_doubt(all bool) int {
+    var committed, aborted, failed int
+
+    inDoubt.Lock()
+    defer inDoubt.Unlock()
+    for i := range nodes {
+        conn, err := pgx.Connect(nodes[i])
+        if err != nil {
+            fmt.Printf("[partition] node %d is unreachable: %v\n", i, err)
+            failed++
+            continue
+        }
+        var gids []string
+        rows, err := conn.Query("select gid from pg_prepared_xacts where database = current_database()")
+        if err == nil {
+            for rows.Next() {
+                var gid string
+                if err = rows.Scan(&gid); err != nil {
+                    break
+                }
+                gids = append(gids, gid)
+            }
+            rows.Close()
+        }
+        if err != nil {
+            fmt.Printf("[partition] failed to list prepared transactions on node %d: %v\n", i, err)
+            failed++
+        }
+        for _, gid := range gids {
+            decision, known := inDoubt.commit[gid]
+            if !known && !all {
+                continue
+            }
+            err = nil
+            if decision.commit {
+                if decision.csn != 0 {
+                    _, err = conn.Exec("select dtm_end_prepare($1, $2)", gid, decision.csn)
+                }
+                if err == nil {
+                    _, err = conn.Exec("commit prepared " + quote_literal(gid))
+                    committed++
+                }
+            } else {
+                _, err = conn.Exec("rollback prepared " + quote_literal(gid))
+                aborted++
+            }
+            if err != nil {
+                fmt.Printf("[partition] failed to finish '%s' on node %d: %v\n", gid, i, err)
+                failed++
+            }
+        }
+        conn.Close()
+    }
+    if committed + aborted + failed > 0 {
+        fmt.Printf("[partition] in-doubt transactions: %d committed, %d rolled back, %d failed\n",
+            committed, aborted, failed)
+    }
+    return failed
+}
+
+// Cut off a random node at random moments until stop is closed, resolving
+// in-doubt transactions every time the partition heals
+func partitions(stop chan struct{}, wg *sync.WaitGroup) {
+    defer wg.Done()
+
+    r := new_rand("partitions", 0)
+    for {
+        delay := time.Duration(r.Int63n(2 * int64(cfg.PartitionInterval)))
+        select {
+        case <-stop:
+            fmt.Printf("[partition] %d partitions injected\n", atomic.LoadInt64(&nPartitions))
+            return
+        case <-time.After(delay):
+        }
+
+        node := r.Intn(len(nodes))
+        if !run_partition_cmd("cut", node) {
+            continue
+        }
+        atomic.AddInt64(&nPartitions, 1)
+        select {
+        case <-stop:
+        case <-time.After(cfg.PartitionDuration):
+        }
+        run_partition_cmd("heal", node)
+        resolve_in_doubt(false)
+    }
+}
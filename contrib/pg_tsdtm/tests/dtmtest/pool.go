@@ -0,0 +1,113 @@
+package dtmtest
+
+import (
+    "fmt"
+    "sync"
+    "time"
+    "github.com/jackc/pgx"
+)
+
+// One connection pool per node shared by workers and checkers
+var pools []*pgx.ConnPool
+
+// Node of every connection taken from the pools
+var connNodes = struct {
+    sync.Mutex
+    nodes map[*pgx.Conn]int
+}{nodes: make(map[*pgx.Conn]int)}
+
+func open_pools() {
+    size := cfg.PoolSize
+    if size == 0 {
+        // every worker and verifier holds a connection for the whole run,
+        // leave some room for totalrep and final checks
+        size = cfg.Workers + cfg.Verifiers + 4
+        if cfg.Workload == "group" {
+            // and the 'group' workers one per transaction of the burst
+            size += cfg.Workers * (cfg.GroupSize - 1)
+        }
+    }
+    pools = make([]*pgx.ConnPool, len(nodes))
+    for i, node := range nodes {
+        pool, err := pgx.NewConnPool(pgx.ConnPoolConfig{
+            ConnConfig: node,
+            MaxConnections: size,
+            AfterConnect: setup_session,
+        })
+        checkErr(err)
+        pools[i] = pool
+    }
+}
+
+// Session settings of every connection to the cluster
+func setup_session(conn *pgx.Conn) error {
+    if cfg.SynchronousCommit != "" {
+        if _, err := conn.Exec("set synchronous_commit = " + cfg.SynchronousCommit); err != nil {
+            return err
+        }
+    }
+    if cfg.Deadlocks || cfg.ForUpdate {
+        ms := cfg.DeadlockTimeout / time.Millisecond
+        if _, err := conn.Exec(fmt.Sprintf("set lock_timeout = %d", ms)); err != nil {
+            return err
+        }
+    }
+    for _, setting := range timeout_settings() {
+        if _, err := conn.Exec(setting); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+func close_pools() {
+    for _, pool := range pools {
+        pool.Close()
+    }
+}
+
+// Get connection to the node from the pool. With health checks enabled
+// the connection is pinged first and broken ones are thrown away.
+func acquire(node int) (*pgx.Conn, error) {
+    pool := pools[node]
+    for attempt := 0; ; attempt++ {
+        conn, err := pool.Acquire()
+        if err == nil {
+            connNodes.Lock()
+            connNodes.nodes[conn] = node
+            connNodes.Unlock()
+        }
+        if err != nil || !cfg.PoolHealthCheck {
+            return conn, err
+        }
+        if _, err = conn.Exec("select 1"); err == nil {
+            return conn, nil
+        }
+        // a dead connection is forgotten here and discarded by the pool,
+        // one still alive goes back to it
+        release(node, conn)
+        if attempt >= pool.Stat().MaxConnections {
+            return nil, fmt.Errorf("no healthy connection to node %d: %v", node, err)
+        }
+    }
+}
+
+// Node the connection of the pools belongs to, -1 for other connections
+func node_of(conn *pgx.Conn) int {
+    connNodes.Lock()
+    defer connNodes.Unlock()
+    if node, ok := connNodes.nodes[conn]; ok {
+        return node
+    }
+    return -1
+}
+
+func release(node int, conn *pgx.Conn) {
+    if !conn.IsAlive() {
+        forget_prepared(conn)
+        connNodes.Lock()
+        delete(connNodes.nodes, conn)
+        connNodes.Unlock()
+    }
+    pools[node].Release(conn)
+}
@@ -0,0 +1,51 @@
+package dtmtest
+
+import (
+    "sync"
+    "github.com/jackc/pgx"
+)
+
+// Statements of the measured path are prepared once per connection and then
+// executed by name (pgx runs the prepared statement when the sql passed to
+// Exec or Query is its name), so that parse and plan time is not counted as
+// the cost of DTM. With -prepared=false the text is sent every time.
+var statements = struct {
+    sync.Mutex
+    conns map[*pgx.Conn]map[string]bool
+}{conns: make(map[*pgx.Conn]map[string]bool)}
+
+// Returns what should be passed to Exec/Query instead of sql
+func prepared(conn *pgx.Conn, name string, sql string) (string, error) {
+    if !cfg.Prepared {
+        return sql, nil
+    }
+
+    statements.Lock()
+    defer statements.Unlock()
+    names := statements.conns[conn]
+    if names == nil {
+        names = make(map[string]bool)
+        statements.conns[conn] = names
+    }
+    if !names[name] {
+        if _, err := conn.Prepare(name, sql); err != nil {
+            return "", err
+        }
+        names[name] = true
+    }
+    return name, nil
+}
+
+// Called for connections which are closed for good
+func forget_prepared(conn *pgx.Conn) {
+    statements.Lock()
+    delete(statements.conns, conn)
+    statements.Unlock()
+}
+
+// The same as execQuery but through prepared statement
+func execQueryPrepared(conn *pgx.Conn, name string, stmt string, arguments ...interface{}) int64 {
+    stmt, err := prepared(conn, name, stmt)
+    checkErr(err)
+    return execQuery(conn, stmt, arguments...)
+}
@@ -0,0 +1,73 @@
+package dtmtest
+
+import (
+    "encoding/json"
+    "fmt"
+    "net/http"
+    "sync"
+    "sync/atomic"
+    "time"
+)
+
+// Progress of the run reported every -report-interval and served as JSON
+// on /progress of -metrics-addr: totals since the start of measurement and
+// throughput and latency of the last interval
+type Progress struct {
+    Elapsed float64 `json:"elapsed_sec"`
+    Committed int64 `json:"committed"`
+    Aborted int64 `json:"aborted"`
+    Retries int64 `json:"retries"`
+    InFlight int64 `json:"in_flight"`
+    Tps float64 `json:"tps"`
+    P99 float64 `json:"p99_ms"`
+}
+
+func (p Progress) String() string {
+    return fmt.Sprintf("%0.0fs: committed=%d aborted=%d retries=%d in-flight=%d tps=%0.2f p99=%0.3fms",
+        p.Elapsed, p.Committed, p.Aborted, p.Retries, p.InFlight, p.Tps, p.P99)
+}
+
+var lastProgress struct {
+    sync.Mutex
+    Progress
+}
+
+func report_intervals(interval time.Duration, stop chan struct{}) {
+    ticker := time.NewTicker(interval)
+    defer ticker.Stop()
+
+    last := time.Now()
+    for {
+        select {
+        case <-stop:
+            return
+        case <-ticker.C:
+        }
+        h := stats.Interval()
+        total := stats.Total()
+        p := Progress{
+            Elapsed: time.Since(stats.Start()).Seconds(),
+            Committed: total.Count(),
+            Aborted: atomic.LoadInt64(&nAborts),
+            Retries: atomic.LoadInt64(&nRetries),
+            InFlight: atomic.LoadInt64(&nInFlight),
+            Tps: float64(h.Count()) / time.Since(last).Seconds(),
+            P99: float64(h.Percentile(99)) / float64(time.Millisecond),
+        }
+        last = time.Now()
+
+        lastProgress.Lock()
+        lastProgress.Progress = p
+        lastProgress.Unlock()
+        fmt.Printf("[progress] %s\n", p)
+    }
+}
+
+func progress_handler(w http.ResponseWriter, r *http.Request) {
+    lastProgress.Lock()
+    p := lastProgress.Progress
+    lastProgress.Unlock()
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(p)
+}
@@ -0,0 +1,501 @@
+package dtmtest
+
+import (
+    "encoding/binary"
+    "fmt"
+    "math/rand"
+    "net"
+    "path/filepath"
+    "strconv"
+    "strings"
+    "sync"
+    "sync/atomic"
+    "time"
+    "github.com/jackc/pgx"
+)
+
+// With -wan the harness reaches the nodes named there through TCP proxies
+// of its own, one per server, which delay every chunk of data in both
+// directions by the latency plus a random jitter as a WAN link would. A
+// chunk is lost with the given probability: TCP would send it again, so
+// the proxy delivers it one retransmission timeout late, and as the stream
+// keeps its order everything behind it waits too. The nodes of the run are
+// replaced with the proxies, the servers and their configs stay as they are.
+//
+//     -wan SERVER=LATENCY[/JITTER[/LOSS%]],...
+//
+// Latency and jitter are one way, a round trip takes twice as long.
+//
+// With -proxy-drop every server is reached through a proxy, which reads
+// the statements the harness sends and resets the connection instead of
+// passing on the reply to some of those named, see drops.go.
+
+// What TCP would wait before sending a lost segment again, the minimal
+// RTO of Linux
+const wanRetransmit = 200 * time.Millisecond
+
+var nWanLosses int64
+
+type WanLink struct {
+    Latency time.Duration
+    Jitter time.Duration
+    Loss float64    // percent of chunks lost
+}
+
+func (l WanLink) String() string {
+    return fmt.Sprintf("%v±%v %g%% loss", l.Latency, l.Jitter, l.Loss)
+}
+
+// Links of -wan by server, an index into the cluster config
+func parse_wan(spec string) (map[int]WanLink, error) {
+    links := make(map[int]WanLink)
+    for _, entry := range strings.Split(spec, ",") {
+        entry = strings.TrimSpace(entry)
+        if entry == "" {
+            continue
+        }
+        eq := strings.Index(entry, "=")
+        if eq < 0 {
+            return nil, fmt.Errorf("-wan entry '%s' is not SERVER=LATENCY[/JITTER[/LOSS%%]]", entry)
+        }
+        server, err := strconv.Atoi(entry[:eq])
+        if err != nil || server < 0 {
+            return nil, fmt.Errorf("bad server in -wan entry '%s'", entry)
+        }
+        var link WanLink
+        parts := strings.Split(entry[eq + 1:], "/")
+        if len(parts) > 3 {
+            return nil, fmt.Errorf("-wan entry '%s' is not SERVER=LATENCY[/JITTER[/LOSS%%]]", entry)
+        }
+        if link.Latency, err = time.ParseDuration(parts[0]); err != nil {
+            return nil, fmt.Errorf("bad latency in -wan entry '%s': %v", entry, err)
+        }
+        if len(parts) > 1 {
+            if link.Jitter, err = time.ParseDuration(parts[1]); err != nil {
+                return nil, fmt.Errorf("bad jitter in -wan entry '%s': %v", entry, err)
+            }
+        }
+        if len(parts) > 2 {
+            link.Loss, err = strconv.ParseFloat(strings.TrimSuffix(parts[2], "%"), 64)
+            if err != nil || link.Loss < 0 || link.Loss >= 100 {
+                return nil, fmt.Errorf("bad loss in -wan entry '%s', should be a percent below 100", entry)
+            }
+        }
+        if link.Latency < 0 || link.Jitter < 0 {
+            return nil, fmt.Errorf("latency and jitter in -wan entry '%s' should not be negative", entry)
+        }
+        links[server] = link
+    }
+    return links, nil
+}
+
+// Proxy of one server, forwarding the connections accepted on the
+// listener to the server
+type Proxy struct {
+    server int
+    network string
+    address string
+    link WanLink
+    drops map[string]bool   // the points of -proxy-drop
+    listener net.Listener
+
+    mu sync.Mutex
+    rand *rand.Rand
+    conns map[net.Conn]bool
+    wg sync.WaitGroup
+}
+
+// Address of the server the way pgx dials it
+func server_address(conf pgx.ConnConfig) (network, address string) {
+    port := conf.Port
+    if port == 0 {
+        port = 5432
+    }
+    if strings.HasPrefix(conf.Host, "/") {
+        return "unix", filepath.Join(conf.Host, fmt.Sprintf(".s.PGSQL.%d", port))
+    }
+    return "tcp", net.JoinHostPort(conf.Host, strconv.Itoa(int(port)))
+}
+
+func start_proxy(server int, conf pgx.ConnConfig, link WanLink, drops map[string]bool) (*Proxy, error) {
+    listener, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        return nil, err
+    }
+    p := &Proxy{server: server, link: link, drops: drops, listener: listener,
+        rand: new_rand("proxy", server), conns: make(map[net.Conn]bool)}
+    p.network, p.address = server_address(conf)
+    p.wg.Add(1)
+    go p.accept()
+    return p, nil
+}
+
+// Config of the node reaching it through the proxy
+func (p *Proxy) route(conf pgx.ConnConfig) pgx.ConnConfig {
+    if conf.TLSConfig != nil && conf.TLSConfig.ServerName == "" {
+        // the certificate is still the one of the server
+        tls := conf.TLSConfig.Clone()
+        tls.ServerName = conf.Host
+        conf.TLSConfig = tls
+    }
+    addr := p.listener.Addr().(*net.TCPAddr)
+    conf.Host = addr.IP.String()
+    conf.Port = uint16(addr.Port)
+    return conf
+}
+
+func (p *Proxy) accept() {
+    defer p.wg.Done()
+    for {
+        client, err := p.listener.Accept()
+        if err != nil {
+            return
+        }
+        server, err := net.Dial(p.network, p.address)
+        if err != nil {
+            fmt.Printf("[proxy] server %d is unreachable: %v\n", p.server, err)
+            client.Close()
+            continue
+        }
+        if !p.track(client, server) {
+            return
+        }
+        c := &proxyConn{proxy: p}
+        if recording_on() {
+            c.id = new_recorded_conn()
+        }
+        p.wg.Add(2)
+        go func() {
+            defer p.wg.Done()
+            p.forward(server, client, c.request)
+            c.closed()
+        }()
+        go func() {
+            defer p.wg.Done()
+            p.forward(client, server, c.reply)
+        }()
+    }
+}
+
+// Remember the connections to close them when the proxy stops, false if
+// it already has
+func (p *Proxy) track(conns ...net.Conn) bool {
+    p.mu.Lock()
+    defer p.mu.Unlock()
+    if p.conns == nil {
+        for _, conn := range conns {
+            conn.Close()
+        }
+        return false
+    }
+    for _, conn := range conns {
+        p.conns[conn] = true
+    }
+    return true
+}
+
+// When the chunk read now should arrive
+func (p *Proxy) due() time.Time {
+    p.mu.Lock()
+    defer p.mu.Unlock()
+    delay := p.link.Latency
+    if p.link.Jitter > 0 {
+        delay += time.Duration(p.rand.Int63n(int64(p.link.Jitter) + 1))
+    }
+    if p.link.Loss > 0 && p.rand.Float64() * 100 < p.link.Loss {
+        atomic.AddInt64(&nWanLosses, 1)
+        delay += wanRetransmit
+    }
+    return time.Now().Add(delay)
+}
+
+type chunk struct {
+    data []byte
+    due time.Time
+}
+
+// Copy from src to dst in order, every chunk once it is due and pass
+// lets it through. Whichever side closes, both are closed; if pass stops
+// the copy, both are reset.
+func (p *Proxy) forward(dst, src net.Conn, pass func(data []byte) bool) {
+    chunks := make(chan chunk, 1024)
+    go func() {
+        defer close(chunks)
+        var last time.Time
+        for {
+            buf := make([]byte, 32 * 1024)
+            n, err := src.Read(buf)
+            if n > 0 {
+                due := p.due()
+                if due.Before(last) {
+                    due = last
+                }
+                last = due
+                chunks <- chunk{buf[:n], due}
+            }
+            if err != nil {
+                return
+            }
+        }
+    }()
+    for c := range chunks {
+        time.Sleep(time.Until(c.due))
+        if !pass(c.data) {
+            reset(dst)
+            reset(src)
+            break
+        }
+        if _, err := dst.Write(c.data); err != nil {
+            break
+        }
+    }
+    dst.Close()
+    src.Close()
+    for range chunks {
+    }
+    p.mu.Lock()
+    if p.conns != nil {
+        delete(p.conns, dst)
+        delete(p.conns, src)
+    }
+    p.mu.Unlock()
+}
+
+// Connection through a proxy, following the messages of the harness to
+// find the statements of -proxy-drop and to -record them, and the replies
+// of the server to record its errors
+type proxyConn struct {
+    proxy *Proxy
+    id int     // in the recording
+
+    // owned by the request side
+    requests []byte
+    started bool
+
+    // owned by the reply side
+    replies []byte
+
+    mu sync.Mutex
+    opaque bool   // encrypted, there is nothing to follow
+    armed string  // the point whose reply should not get through
+    gid string
+}
+
+const (
+    sslRequestCode = 80877103
+    messageHeader = 5
+)
+
+func (c *proxyConn) follows() bool {
+    if len(c.proxy.drops) == 0 && !recording_on() {
+        return false
+    }
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    return !c.opaque
+}
+
+func (c *proxyConn) request(data []byte) bool {
+    if !c.follows() {
+        return true
+    }
+    c.requests = append(c.requests, data...)
+    for {
+        if !c.started {
+            // the startup packet has a length but no type
+            if len(c.requests) < 8 {
+                return true
+            }
+            size := int(binary.BigEndian.Uint32(c.requests))
+            if len(c.requests) < size {
+                return true
+            }
+            if binary.BigEndian.Uint32(c.requests[4:]) == sslRequestCode {
+                c.mu.Lock()
+                c.opaque = true
+                c.mu.Unlock()
+                c.requests = nil
+                record_event(RecordedEvent{Conn: c.id, Server: c.proxy.server, Kind: "opaque"})
+                return true
+            }
+            c.started = true
+            record_event(RecordedEvent{Conn: c.id, Server: c.proxy.server, Kind: "connect",
+                Params: startup_params(c.requests[8:size])})
+            c.requests = c.requests[size:]
+            continue
+        }
+        if len(c.requests) < messageHeader {
+            return true
+        }
+        size := 1 + int(binary.BigEndian.Uint32(c.requests[1:]))
+        if len(c.requests) < size {
+            return true
+        }
+        msg := c.requests[:size]
+        sql := statement_of(msg)
+        if sql != "" {
+            c.statement(sql)
+        }
+        if msg[0] != 'p' {
+            // the password is the replay's own business
+            record_event(RecordedEvent{Conn: c.id, Server: c.proxy.server, Kind: "message",
+                Type: string(msg[:1]), Sql: sql, Data: append([]byte(nil), msg...)})
+        }
+        c.requests = c.requests[size:]
+    }
+}
+
+// Text of the query of the simple or extended protocol, "" for anything else
+func statement_of(msg []byte) string {
+    body := msg[messageHeader:]
+    switch msg[0] {
+    case 'Q':
+        return cstring(body)
+    case 'P':
+        // the name of the statement, then the query
+        name := cstring(body)
+        if len(name) < len(body) {
+            return cstring(body[len(name) + 1:])
+        }
+    }
+    return ""
+}
+
+func cstring(data []byte) string {
+    for i, b := range data {
+        if b == 0 {
+            return string(data[:i])
+        }
+    }
+    return string(data)
+}
+
+// Names and values following the protocol version of the startup packet
+func startup_params(data []byte) map[string]string {
+    params := make(map[string]string)
+    for len(data) > 0 && data[0] != 0 {
+        name := cstring(data)
+        data = data[len(name) + 1:]
+        value := cstring(data)
+        if len(value) < len(data) {
+            data = data[len(value) + 1:]
+        } else {
+            data = nil
+        }
+        params[name] = value
+    }
+    return params
+}
+
+func (c *proxyConn) reply(data []byte) bool {
+    if c.dropped() {
+        return false
+    }
+    if !recording_on() || !c.follows() {
+        return true
+    }
+    c.replies = append(c.replies, data...)
+    for len(c.replies) >= messageHeader {
+        size := 1 + int(binary.BigEndian.Uint32(c.replies[1:]))
+        if len(c.replies) < size {
+            break
+        }
+        if c.replies[0] == 'E' {
+            record_event(RecordedEvent{Conn: c.id, Server: c.proxy.server, Kind: "error",
+                Error: error_message(c.replies[messageHeader:size])})
+        }
+        c.replies = c.replies[size:]
+    }
+    return true
+}
+
+// The message field of ErrorResponse
+func error_message(body []byte) string {
+    for len(body) > 0 && body[0] != 0 {
+        value := cstring(body[1:])
+        if body[0] == 'M' {
+            return value
+        }
+        if 1 + len(value) >= len(body) {
+            break
+        }
+        body = body[1 + len(value) + 1:]
+    }
+    return ""
+}
+
+func (c *proxyConn) closed() {
+    if c.started {
+        record_event(RecordedEvent{Conn: c.id, Server: c.proxy.server, Kind: "close"})
+    }
+}
+
+// Close with RST rather than FIN, as a failed link or host would
+func reset(conn net.Conn) {
+    if tcp, ok := conn.(*net.TCPConn); ok {
+        tcp.SetLinger(0)
+    }
+    conn.Close()
+}
+
+// Close the listener and all connections through the proxy
+func (p *Proxy) Close() {
+    p.listener.Close()
+    p.mu.Lock()
+    for conn := range p.conns {
+        conn.Close()
+    }
+    p.conns = nil
+    p.mu.Unlock()
+    p.wg.Wait()
+}
+
+// Proxies of the run, by server
+var proxies map[int]*Proxy
+
+// Whether the run goes through the proxies
+func proxied() bool {
+    return cfg.Wan != "" || cfg.ProxyDrop != "" || cfg.RecordPath != ""
+}
+
+// Put the proxies of -wan, -proxy-drop and -record between the harness and
+// the nodes, the returned function removes them
+func start_proxies() func() {
+    links, err := parse_wan(cfg.Wan)
+    checkErr(err)
+    drops, err := parse_drop_points(cfg.ProxyDrop)
+    checkErr(err)
+    saved := nodes
+    routed := append([]pgx.ConnConfig(nil), nodes...)
+    proxies = make(map[int]*Proxy)
+    for i := range nodes {
+        link, ok := links[servers[i]]
+        if !ok && len(drops) == 0 && cfg.RecordPath == "" {
+            continue
+        }
+        p := proxies[servers[i]]
+        if p == nil {
+            p, err = start_proxy(servers[i], nodes[i], link, drops)
+            checkErr(err)
+            proxies[servers[i]] = p
+            fmt.Printf("[proxy] server %d through %s, %v\n", servers[i], p.listener.Addr(), link)
+        }
+        routed[i] = p.route(nodes[i])
+    }
+    nodes = routed
+    if cfg.RecordPath != "" {
+        open_recording(cfg.RecordPath)
+    }
+    return func() {
+        for _, p := range proxies {
+            p.Close()
+        }
+        close_recording()
+        proxies = nil
+        nodes = saved
+    }
+}
+
+func print_wan(r Report) {
+    fmt.Printf("WAN: %s, %d chunks lost\n", cfg.Wan, r.WanLosses)
+}
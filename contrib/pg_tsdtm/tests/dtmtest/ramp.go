@@ -0,0 +1,68 @@
+package dtmtest
+
+import (
+    "fmt"
+    "sync"
+    "sync/atomic"
+    "time"
+)
+
+// Staged concurrency, see -ramp-step: the run starts with one worker and
+// gets one more every step until all -workers are busy, then with
+// -ramp-down loses one every step until one is left. Throughput of every
+// step makes the scalability curve of the cluster.
+type LevelResults struct {
+    Workers int `json:"workers"`
+    Direction string `json:"direction"` // "up" or "down"
+    Commits int64 `json:"commits"`
+    Tps float64 `json:"tps"`
+    Latency Latency `json:"latency"`
+    DtmShare float64 `json:"dtm_share"`  // of latency, see -dtm-profile
+}
+
+// Workers with id below it keep running
+var rampActive int64
+
+// Filled by ramp() by the time the last worker is done
+var rampLevels []LevelResults
+
+func ramp_keeps(id int) bool {
+    return id < int(atomic.LoadInt64(&rampActive))
+}
+
+// All cfg.Workers should be already added to wg
+func ramp(wg *sync.WaitGroup) {
+    step := func(workers int, direction string) {
+        stats.Level() // forget the previous step
+        stats.LevelDtm()
+        start := time.Now()
+        if !sleep_interruptible(cfg.RampStep) {
+            // the rest of workers are still started to leave at once
+            return
+        }
+        h := stats.Level()
+        elapsed := time.Since(start)
+        rampLevels = append(rampLevels, LevelResults{
+            Workers: workers,
+            Direction: direction,
+            Commits: h.Count(),
+            Tps: float64(h.Count()) / elapsed.Seconds(),
+            Latency: latency_of(&h),
+            DtmShare: stats.LevelDtm(),
+        })
+        fmt.Printf("[ramp] %d workers (%s): %s\n", workers, direction, h.Summary(elapsed))
+    }
+
+    for n := 1; n <= cfg.Workers; n++ {
+        atomic.StoreInt64(&rampActive, int64(n))
+        go worker(n - 1, wg)
+        step(n, "up")
+    }
+    if cfg.RampDown {
+        for n := cfg.Workers - 1; n >= 1; n-- {
+            atomic.StoreInt64(&rampActive, int64(n))
+            step(n, "down")
+        }
+    }
+    atomic.StoreInt64(&rampActive, 0)
+}
@@ -0,0 +1,64 @@
+package dtmtest
+
+import (
+    "sync"
+    "sync/atomic"
+    "time"
+)
+
+// With -rate the load is open-loop: transactions are scheduled at a fixed
+// rate from the start of the run and every worker takes the next free slot
+// of the schedule. Latency is counted from the scheduled start rather than
+// the actual one, so when the cluster falls behind the schedule the time
+// transactions have waited for a free worker is counted too, as a client
+// arriving at the fixed rate would see it. How late transactions have
+// started is reported separately as the schedule lag.
+
+// Slots of the schedule taken so far
+var nSlots int64
+
+// Schedule changed in the middle of the run, see set_rate: slots from
+// first on go at rate from start. Zero rate is the one of -rate from the
+// start of the run.
+var schedule struct {
+    sync.Mutex
+    start time.Time
+    first int64
+    rate float64
+}
+
+// Go on with the new rate from now, the slots late by now are not caught up
+func set_rate(rate float64) {
+    schedule.Lock()
+    schedule.start = time.Now()
+    schedule.first = atomic.LoadInt64(&nSlots)
+    schedule.rate = rate
+    schedule.Unlock()
+}
+
+func current_rate() float64 {
+    schedule.Lock()
+    defer schedule.Unlock()
+    if schedule.rate == 0 {
+        return cfg.Rate
+    }
+    return schedule.rate
+}
+
+// Wait for the next slot of the schedule and return its time, false if
+// interrupted meanwhile
+func wait_slot() (time.Time, bool) {
+    slot := atomic.AddInt64(&nSlots, 1) - 1
+    schedule.Lock()
+    start, first, rate := runStart, int64(0), cfg.Rate
+    if schedule.rate != 0 {
+        start, first, rate = schedule.start, schedule.first, schedule.rate
+    }
+    schedule.Unlock()
+    at := start.Add(time.Duration(float64(slot - first) * float64(time.Second) / rate))
+    if wait := at.Sub(time.Now()); wait > 0 && !sleep_interruptible(wait) {
+        return at, false
+    }
+    stats.RecordLag(time.Since(at))
+    return at, true
+}
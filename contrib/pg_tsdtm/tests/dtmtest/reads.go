@@ -0,0 +1,48 @@
+package dtmtest
+
+import (
+    "time"
+    "github.com/jackc/pgx"
+    "github.com/digoal/postgres_cluster/contrib/pg_tsdtm/tests/dtmclient"
+)
+
+// Pure reads, see -read-pct: balances of the accounts a transfer would
+// touch are read under one global snapshot and nothing is written, so
+// that the cost of global snapshots of read-only transactions is measured
+// apart from that of transfers.
+func read_balances(w *Worker, updates []Update) error {
+    order := participant_nodes(updates)
+    index := make(map[int]int)
+    var participants []*pgx.Conn
+    for _, node := range order {
+        index[node] = len(participants)
+        participants = append(participants, w.Conns[node])
+    }
+
+    return w.Transaction(func(gtid string) (*dtmclient.GlobalTx, error) {
+        start := time.Now()
+        // without gid the transaction is read-only and committed locally
+        tx, err := begin_global(participants, "", w.Isolation)
+        if err != nil {
+            return nil, err
+        }
+        for _, u := range updates {
+            var stmt string
+            var balance int64
+            stmt, err = prepared(w.Conns[u.Node], "lookup", "select v from t where u=$1")
+            if err == nil {
+                err = tx.QueryRow(index[u.Node], stmt, u.Account).Scan(&balance)
+            }
+            if err != nil {
+                stats.RecordNodeError(u.Node)
+                tx.Rollback()
+                return tx, err
+            }
+        }
+        if err = tx.Commit(); err != nil {
+            return tx, err
+        }
+        stats.RecordRead(time.Since(start), tx.SnapshotTime)
+        return tx, nil
+    })
+}
@@ -0,0 +1,311 @@
+package dtmtest
+
+import (
+    "bufio"
+    "crypto/md5"
+    "encoding/binary"
+    "encoding/hex"
+    "encoding/json"
+    "fmt"
+    "io"
+    "net"
+    "os"
+    "sort"
+    "sync"
+    "time"
+    "github.com/jackc/pgx"
+)
+
+// With -record every server is reached through a proxy which writes
+// whatever the harness sends to it into the file, one JSON line per
+// message with the connection, the server and the time since the start
+// of the run, as well as the errors the servers reply with. The replay
+// command sends the same messages to the servers of its cluster config,
+// typically a fresh cluster, on as many connections and in the same order
+// and timing, and reports where the errors it gets differ from the
+// recorded ones:
+//
+//  transfers run -record run.sql.json ...
+//  transfers replay -replay-speed 0 run.sql.json
+//
+// Everything the harness took from the replies, snapshots, CSNs and xids,
+// is sent as it was recorded: the replay repeats the run, it does not
+// redo the workload. Encrypted connections can not be recorded.
+type RecordedEvent struct {
+    At float64 `json:"at"`       // seconds since the start of the recording
+    Conn int `json:"conn"`
+    Server int `json:"server"`   // index into the cluster config
+    Kind string `json:"kind"`    // connect, message, error, close or opaque
+    Params map[string]string `json:"params,omitempty"`  // of the startup packet
+    Type string `json:"type,omitempty"`
+    Sql string `json:"sql,omitempty"`      // of Query and Parse, for reading
+    Data []byte `json:"data,omitempty"`    // the whole message
+    Error string `json:"error,omitempty"`
+}
+
+var recording struct {
+    sync.Mutex
+    file *os.File
+    start time.Time
+    conns int
+}
+
+func open_recording(path string) {
+    f, err := os.Create(path)
+    checkErr(err)
+    recording.Lock()
+    recording.file, recording.start, recording.conns = f, time.Now(), 0
+    recording.Unlock()
+}
+
+func close_recording() {
+    recording.Lock()
+    defer recording.Unlock()
+    if recording.file != nil {
+        checkErr(recording.file.Close())
+        recording.file = nil
+    }
+}
+
+func recording_on() bool {
+    recording.Lock()
+    defer recording.Unlock()
+    return recording.file != nil
+}
+
+func new_recorded_conn() int {
+    recording.Lock()
+    defer recording.Unlock()
+    recording.conns++
+    return recording.conns
+}
+
+func record_event(e RecordedEvent) {
+    recording.Lock()
+    defer recording.Unlock()
+    if recording.file == nil {
+        return
+    }
+    e.At = time.Since(recording.start).Seconds()
+    line, err := json.Marshal(e)
+    checkErr(err)
+    _, err = recording.file.Write(append(line, '\n'))
+    checkErr(err)
+}
+
+func read_recording(path string) ([]RecordedEvent, error) {
+    f, err := os.Open(path)
+    if err != nil {
+        return nil, err
+    }
+    defer f.Close()
+    var events []RecordedEvent
+    scanner := bufio.NewScanner(f)
+    scanner.Buffer(make([]byte, 1024 * 1024), 64 * 1024 * 1024)
+    for scanner.Scan() {
+        var e RecordedEvent
+        if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+            return nil, fmt.Errorf("bad line in %s: %v", path, err)
+        }
+        events = append(events, e)
+    }
+    return events, scanner.Err()
+}
+
+// Connection of the replay with the errors the server has replied with
+type replayConn struct {
+    conn net.Conn
+    mu sync.Mutex
+    errors []string
+    done chan struct{}
+}
+
+func write_message(conn net.Conn, typ byte, body []byte) error {
+    msg := make([]byte, messageHeader, messageHeader + len(body))
+    msg[0] = typ
+    binary.BigEndian.PutUint32(msg[1:], uint32(4 + len(body)))
+    _, err := conn.Write(append(msg, body...))
+    return err
+}
+
+func read_message(r io.Reader) (byte, []byte, error) {
+    var header [messageHeader]byte
+    if _, err := io.ReadFull(r, header[:]); err != nil {
+        return 0, nil, err
+    }
+    body := make([]byte, binary.BigEndian.Uint32(header[1:]) - 4)
+    if _, err := io.ReadFull(r, body); err != nil {
+        return 0, nil, err
+    }
+    return header[0], body, nil
+}
+
+func md5_hex(s string) string {
+    sum := md5.Sum([]byte(s))
+    return hex.EncodeToString(sum[:])
+}
+
+// Start the session as the recorded one, with the user and the password
+// of the config, until the server is ready for queries
+func replay_connect(conf pgx.ConnConfig, params map[string]string) (net.Conn, error) {
+    network, address := server_address(conf)
+    conn, err := net.Dial(network, address)
+    if err != nil {
+        return nil, err
+    }
+    params["user"] = conf.User
+    var names []string
+    for name := range params {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+    startup := make([]byte, 8)
+    binary.BigEndian.PutUint32(startup[4:], 196608)
+    for _, name := range names {
+        startup = append(append(append(startup, name...), 0), append([]byte(params[name]), 0)...)
+    }
+    startup = append(startup, 0)
+    binary.BigEndian.PutUint32(startup, uint32(len(startup)))
+    if _, err := conn.Write(startup); err != nil {
+        conn.Close()
+        return nil, err
+    }
+    for {
+        typ, body, err := read_message(conn)
+        if err == nil && typ == 'E' {
+            err = fmt.Errorf("%s", error_message(body))
+        }
+        if err == nil && typ == 'R' && len(body) >= 4 {
+            switch binary.BigEndian.Uint32(body) {
+            case 0:
+            case 3:
+                err = write_message(conn, 'p', append([]byte(conf.Password), 0))
+            case 5:
+                hash := "md5" + md5_hex(md5_hex(conf.Password + conf.User) + string(body[4:8]))
+                err = write_message(conn, 'p', append([]byte(hash), 0))
+            default:
+                err = fmt.Errorf("authentication method %d is not supported", binary.BigEndian.Uint32(body))
+            }
+        }
+        if err != nil {
+            conn.Close()
+            return nil, err
+        }
+        if typ == 'Z' {
+            return conn, nil
+        }
+    }
+}
+
+func (c *replayConn) read() {
+    defer close(c.done)
+    r := bufio.NewReader(c.conn)
+    for {
+        typ, body, err := read_message(r)
+        if err != nil {
+            return
+        }
+        if typ == 'E' {
+            c.mu.Lock()
+            c.errors = append(c.errors, error_message(body))
+            c.mu.Unlock()
+        }
+    }
+}
+
+// The config of the server from the cluster config of the replay
+func server_config(server int) (pgx.ConnConfig, bool) {
+    for i := range nodes {
+        if servers[i] == server {
+            return nodes[i], true
+        }
+    }
+    return pgx.ConnConfig{}, false
+}
+
+func cmd_replay(args []string) int {
+    if len(args) != 1 {
+        fmt.Println("ERROR: replay needs the file written with -record")
+        return 1
+    }
+    events, err := read_recording(args[0])
+    if err != nil {
+        fmt.Printf("ERROR: %v\n", err)
+        return 1
+    }
+
+    conns := make(map[int]*replayConn)
+    recorded := make(map[int][]string)
+    var failures []string
+    var messages int
+    start := time.Now()
+    for _, e := range events {
+        if cfg.ReplaySpeed > 0 {
+            time.Sleep(time.Until(start.Add(time.Duration(e.At / cfg.ReplaySpeed * float64(time.Second)))))
+        }
+        c := conns[e.Conn]
+        switch e.Kind {
+        case "connect":
+            conf, ok := server_config(e.Server)
+            if !ok {
+                failures = append(failures, fmt.Sprintf("no server %d in the cluster config", e.Server))
+                return pass_or_fail(failures)
+            }
+            conn, err := replay_connect(conf, e.Params)
+            if err != nil {
+                failures = append(failures, fmt.Sprintf("connection %d to server %d failed: %v", e.Conn, e.Server, err))
+                continue
+            }
+            c = &replayConn{conn: conn, done: make(chan struct{})}
+            conns[e.Conn] = c
+            go c.read()
+        case "message":
+            if c != nil {
+                // stopped by the server or by the reply of the recorded run
+                c.conn.Write(e.Data)
+                messages++
+            }
+        case "error":
+            recorded[e.Conn] = append(recorded[e.Conn], e.Error)
+        case "close":
+            // the session ends as the server sees the end of the stream
+            if c == nil {
+                continue
+            }
+            if closer, ok := c.conn.(interface{ CloseWrite() error }); ok {
+                closer.CloseWrite()
+            }
+        case "opaque":
+            fmt.Printf("WARNING: encrypted connection %d to server %d was not recorded\n", e.Conn, e.Server)
+        }
+    }
+
+    var ids []int
+    for id := range conns {
+        ids = append(ids, id)
+    }
+    sort.Ints(ids)
+    diverged := 0
+    for _, id := range ids {
+        c := conns[id]
+        select {
+        case <-c.done:
+        case <-time.After(reconnectTimeout):
+            fmt.Printf("[replay] connection %d is still busy\n", id)
+        }
+        c.conn.Close()
+        c.mu.Lock()
+        replayed := c.errors
+        c.mu.Unlock()
+        if fmt.Sprint(replayed) != fmt.Sprint(recorded[id]) {
+            diverged++
+            fmt.Printf("[replay] connection %d: errors %q, recorded %q\n", id, replayed, recorded[id])
+        }
+    }
+    fmt.Printf("Replayed %d messages on %d connections in %v, %d diverged\n",
+        messages, len(conns), time.Since(start), diverged)
+    if diverged > 0 {
+        failures = append(failures, fmt.Sprintf("%d connections got other errors than recorded", diverged))
+    }
+    return pass_or_fail(failures)
+}
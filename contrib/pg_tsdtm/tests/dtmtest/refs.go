@@ -0,0 +1,295 @@
+package dtmtest
+
+import (
+    "fmt"
+    "sync"
+    "sync/atomic"
+    "github.com/jackc/pgx"
+    "github.com/digoal/postgres_cluster/contrib/pg_tsdtm/tests/dtmclient"
+)
+
+// Referential integrity across nodes kept by the application: parent k
+// lives in t_parent on node k % nodes and its children in t_child on the
+// other nodes. A child is added only if its parent exists and a parent is
+// deleted only if no node has children of it, checked under the global
+// snapshot. Both touch the parent row, adding or removing a child updates
+// its count of references, so that the two conflict on the node of the
+// parent. Transactions run at least REPEATABLE READ, under READ COMMITTED
+// the delete would go on after the conflict and orphans would be the fault
+// of the application, not of DTM. If the snapshot of a transaction is not
+// the same on all nodes, checks see a parent and its children out of step
+// and orphans are left in the end.
+type RefsWorkload struct {
+    sync.Mutex
+    children map[int][]refChild    // added by every worker
+    base int64                      // ids of children before are below
+}
+
+type refChild struct {
+    id int64
+    parent int
+    node int
+}
+
+// Parents and children found out of step by checks of the workers
+var nRefViolations int64
+
+func init() {
+    register_workload("refs", func() Workload { return new(RefsWorkload) })
+}
+
+func parent_node(parent int) int {
+    return parent % len(nodes)
+}
+
+func (f *RefsWorkload) Setup(conns []*pgx.Conn) {
+    create_extension(conns)
+    for i, conn := range conns {
+        exec(conn, "drop table if exists t_parent")
+        exec(conn, "drop table if exists t_child")
+        exec(conn, "create table t_parent(id int primary key, refs int)")
+        exec(conn, "create table t_child(id bigint primary key, parent int)")
+        exec(conn, "create index on t_child(parent)")
+        exec(conn, "insert into t_parent select id, 0 from generate_series(0, $1 - 1) id where id % $2 = $3",
+            cfg.Accounts, len(conns), i)
+    }
+    f.Attach(conns)
+}
+
+// Children of the processes before are not removed
+func (f *RefsWorkload) Attach(conns []*pgx.Conn) {
+    f.children = make(map[int][]refChild)
+    f.base = 0
+    for _, conn := range conns {
+        if next := execQuery(conn, "select coalesce(max(id), -1) + 1 from t_child"); next > f.base {
+            f.base = next
+        }
+    }
+    atomic.StoreInt64(&nRefViolations, 0)
+}
+
+// Level of the transaction, see RefsWorkload
+func refs_isolation(name string) string {
+    if name == "default" || name == "read-committed" {
+        return "repeatable-read"
+    }
+    return name
+}
+
+func (f *RefsWorkload) Iteration(w *Worker) error {
+    parent := w.Rand.Intn(cfg.Accounts)
+    switch op := w.Rand.Intn(100); {
+    case op < 40:
+        node := (parent_node(parent) + 1 + w.Rand.Intn(len(nodes) - 1)) % len(nodes)
+        child := refChild{f.base + (int64(w.Id) << 32 | int64(w.Iteration)), parent, node}
+        err := f.add_child(w, child)
+        if err == nil {
+            f.Lock()
+            f.children[w.Id] = append(f.children[w.Id], child)
+            f.Unlock()
+        }
+        return err
+    case op < 65:
+        f.Lock()
+        mine := f.children[w.Id]
+        f.Unlock()
+        if len(mine) == 0 {
+            return f.check(w, parent)
+        }
+        i := w.Rand.Intn(len(mine))
+        err := f.remove_child(w, mine[i])
+        if err == nil {
+            f.Lock()
+            mine[i] = mine[len(mine) - 1]
+            f.children[w.Id] = mine[:len(mine) - 1]
+            f.Unlock()
+        }
+        return err
+    case op < 75:
+        return f.remove_parent(w, parent)
+    case op < 85:
+        return f.restore_parent(w, parent)
+    }
+    return f.check(w, parent)
+}
+
+// Run body in a global transaction over the nodes, the first one is the
+// coordinator; gid is empty for read-only ones
+func refs_transaction(w *Worker, order []int, readOnly bool,
+        body func(tx *dtmclient.GlobalTx) error) error {
+    var participants []*pgx.Conn
+    for _, node := range order {
+        participants = append(participants, w.Conns[node])
+    }
+    return w.Transaction(func(gtid string) (*dtmclient.GlobalTx, error) {
+        if readOnly {
+            gtid = ""
+        }
+        tx, err := begin_global(participants, gtid, refs_isolation(w.Isolation))
+        if err != nil {
+            return nil, err
+        }
+        if err = body(tx); err != nil {
+            tx.Rollback()
+            return tx, err
+        }
+        return tx, tx.Commit()
+    })
+}
+
+// 1 if the row was there to update
+func touch_parent(tx *dtmclient.GlobalTx, parent int, delta int) error {
+    tag, err := tx.Exec(0, "update t_parent set refs = refs + $1 where id = $2", delta, parent)
+    if err == nil && tag.RowsAffected() == 0 {
+        // the parent is gone, there is nothing to do
+        return errRolledBack
+    }
+    return err
+}
+
+func (f *RefsWorkload) add_child(w *Worker, c refChild) error {
+    return refs_transaction(w, []int{parent_node(c.parent), c.node}, false, func(tx *dtmclient.GlobalTx) error {
+        if err := touch_parent(tx, c.parent, 1); err != nil {
+            return err
+        }
+        _, err := tx.Exec(1, "insert into t_child values ($1, $2)", c.id, c.parent)
+        return err
+    })
+}
+
+func (f *RefsWorkload) remove_child(w *Worker, c refChild) error {
+    return refs_transaction(w, []int{parent_node(c.parent), c.node}, false, func(tx *dtmclient.GlobalTx) error {
+        if err := touch_parent(tx, c.parent, -1); err != nil {
+            return err
+        }
+        _, err := tx.Exec(1, "delete from t_child where id = $1", c.id)
+        return err
+    })
+}
+
+// Nodes of the children of the parent after the node of the parent
+func refs_order(parent int) []int {
+    order := []int{parent_node(parent)}
+    for node := range nodes {
+        if node != order[0] {
+            order = append(order, node)
+        }
+    }
+    return order
+}
+
+// The children on the rest of participants
+func count_children(tx *dtmclient.GlobalTx, parent int) (int64, error) {
+    var total int64
+    for i := 1; i < len(tx.Participants()); i++ {
+        var n int64
+        if err := tx.QueryRow(i, "select count(*) from t_child where parent = $1", parent).Scan(&n); err != nil {
+            return 0, err
+        }
+        total += n
+    }
+    return total, nil
+}
+
+func (f *RefsWorkload) remove_parent(w *Worker, parent int) error {
+    return refs_transaction(w, refs_order(parent), false, func(tx *dtmclient.GlobalTx) error {
+        children, err := count_children(tx, parent)
+        if err != nil {
+            return err
+        }
+        if children > 0 {
+            return errRolledBack
+        }
+        _, err = tx.Exec(0, "delete from t_parent where id = $1", parent)
+        return err
+    })
+}
+
+func (f *RefsWorkload) restore_parent(w *Worker, parent int) error {
+    return refs_transaction(w, []int{parent_node(parent)}, false, func(tx *dtmclient.GlobalTx) error {
+        _, err := tx.Exec(0, "insert into t_parent values ($1, 0) on conflict do nothing", parent)
+        return err
+    })
+}
+
+// The parent and its children under one snapshot should agree
+func (f *RefsWorkload) check(w *Worker, parent int) error {
+    return refs_transaction(w, refs_order(parent), true, func(tx *dtmclient.GlobalTx) error {
+        var refs int64 = -1
+        err := tx.QueryRow(0, "select refs from t_parent where id = $1", parent).Scan(&refs)
+        if err == pgx.ErrNoRows {
+            err = nil
+        }
+        if err != nil {
+            return err
+        }
+        children, err := count_children(tx, parent)
+        if err != nil {
+            return err
+        }
+        if refs < 0 && children > 0 || refs >= 0 && refs != children {
+            fmt.Printf("[refs] snapshot %d: parent %d with %d references has %d children\n",
+                tx.Snapshot, parent, refs, children)
+            atomic.AddInt64(&nRefViolations, 1)
+        }
+        return nil
+    })
+}
+
+func (f *RefsWorkload) Verify(conns []*pgx.Conn) int {
+    anomalies := int(atomic.LoadInt64(&nRefViolations))
+    refs := make(map[int]int64)
+    for i, conn := range conns {
+        rows, err := conn.Query("select id, refs from t_parent")
+        checkErr(err)
+        for rows.Next() {
+            var id int
+            var n int64
+            checkErr(rows.Scan(&id, &n))
+            if parent_node(id) != i {
+                fmt.Printf("[refs] parent %d is on node %d\n", id, i)
+                anomalies++
+            }
+            refs[id] = n
+        }
+        checkErr(rows.Err())
+    }
+    children := make(map[int]int64)
+    for _, conn := range conns {
+        rows, err := conn.Query("select parent, count(*) from t_child group by parent")
+        checkErr(err)
+        for rows.Next() {
+            var parent int
+            var n int64
+            checkErr(rows.Scan(&parent, &n))
+            children[parent] += n
+        }
+        checkErr(rows.Err())
+    }
+    orphans := 0
+    for parent, n := range children {
+        if _, ok := refs[parent]; !ok {
+            orphans += int(n)
+        } else if refs[parent] != n {
+            fmt.Printf("[refs] parent %d has %d references and %d children\n", parent, refs[parent], n)
+            anomalies++
+        }
+    }
+    for parent, n := range refs {
+        if _, ok := children[parent]; !ok && n != 0 {
+            fmt.Printf("[refs] parent %d has %d references and no children\n", parent, n)
+            anomalies++
+        }
+    }
+    if orphans > 0 {
+        fmt.Printf("[refs] %d children of deleted parents\n", orphans)
+    }
+    return anomalies + orphans
+}
+
+func (f *RefsWorkload) Teardown(conns []*pgx.Conn) {
+    for _, conn := range conns {
+        exec(conn, "drop table if exists t_parent")
+        exec(conn, "drop table if exists t_child")
+    }
+}
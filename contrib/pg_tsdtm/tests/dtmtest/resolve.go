@@ -0,0 +1,160 @@
+package dtmtest
+
+import (
+    "fmt"
+    "sort"
+    "github.com/jackc/pgx"
+)
+
+// The resolve command finishes the prepared transactions tests have left
+// on the nodes, e.g. after the harness crashed in the middle of commits.
+// Unlike run and verify, it does not take every unknown one for aborted but
+// looks for evidence of commit on all nodes first:
+//
+//  - pg_committed_xacts, where pg_tsdtm records every transaction which
+//    has got its CSN when dtm.record_commits is on: the participants have
+//    voted, the transaction is to be committed everywhere;
+//  - the markers of -journal in t_journal, visible only on the nodes
+//    where the transaction has committed. Gids repeat from run to run,
+//    so the markers of a gid are not taken for evidence if any node the
+//    transaction is still prepared on has one: they are of another run.
+//
+// A transaction committed on any node is committed on the rest, the others
+// are rolled back: without all votes nobody could commit them. With
+// -dry-run the decisions are only printed.
+
+// What is known about one prepared transaction
+type inDoubtTx struct {
+    prepared []int      // nodes where it is prepared
+    committed []int     // nodes where it is known to be committed
+    evidence string
+}
+
+func table_exists(conn *pgx.Conn, table string) bool {
+    var exists bool
+    checkErr(conn.QueryRow("select to_regclass($1::cstring) is not null", table).Scan(&exists))
+    return exists
+}
+
+func query_gids(conn *pgx.Conn, query string, args ...interface{}) []string {
+    rows, err := conn.Query(query, args...)
+    checkErr(err)
+    defer rows.Close()
+    var gids []string
+    for rows.Next() {
+        var gid string
+        checkErr(rows.Scan(&gid))
+        gids = append(gids, gid)
+    }
+    checkErr(rows.Err())
+    return gids
+}
+
+// Gather the prepared transactions of all nodes and what the nodes know
+// about their commit
+func find_in_doubt(conns []*pgx.Conn) map[string]*inDoubtTx {
+    found := make(map[string]*inDoubtTx)
+    for i, conn := range conns {
+        for _, gid := range query_gids(conn, "select gid from pg_prepared_xacts where database = current_database()") {
+            if found[gid] == nil {
+                found[gid] = &inDoubtTx{}
+            }
+            found[gid].prepared = append(found[gid].prepared, i)
+        }
+    }
+    if len(found) == 0 {
+        return found
+    }
+    var gids []string
+    for gid := range found {
+        gids = append(gids, gid)
+    }
+    for _, source := range []string{"pg_committed_xacts", "t_journal"} {
+        seen := make(map[string][]int)
+        for i, conn := range conns {
+            if table_exists(conn, source) {
+                for _, gid := range query_gids(conn, "select distinct gid from " + source + " where gid = any($1)", gids) {
+                    seen[gid] = append(seen[gid], i)
+                }
+            }
+        }
+        for gid, on := range seen {
+            tx := found[gid]
+            if tx.evidence != "" || source == "t_journal" && overlap(on, tx.prepared) {
+                continue
+            }
+            tx.committed, tx.evidence = on, source
+        }
+    }
+    return found
+}
+
+func overlap(a []int, b []int) bool {
+    for _, x := range a {
+        for _, y := range b {
+            if x == y {
+                return true
+            }
+        }
+    }
+    return false
+}
+
+func cmd_resolve(args []string) int {
+    conns := make([]*pgx.Conn, len(nodes))
+    for i := range nodes {
+        conn, err := pgx.Connect(nodes[i])
+        if err != nil {
+            fmt.Printf("ERROR: node %d is unreachable, its transactions can not be resolved: %v\n", i, err)
+            return 1
+        }
+        defer conn.Close()
+        conns[i] = conn
+    }
+
+    found := find_in_doubt(conns)
+    var gids []string
+    for gid := range found {
+        gids = append(gids, gid)
+    }
+    sort.Strings(gids)
+
+    var committed, aborted, failed int
+    for _, gid := range gids {
+        tx := found[gid]
+        action, why := "rollback", "no node has committed it"
+        if len(tx.committed) > 0 {
+            action = "commit"
+            why = fmt.Sprintf("committed on nodes %v by %s", tx.committed, tx.evidence)
+        }
+        fmt.Printf("[resolve] '%s' prepared on nodes %v, %s: %s\n", gid, tx.prepared, why, action)
+        if cfg.DryRun {
+            if action == "commit" {
+                committed += len(tx.prepared)
+            } else {
+                aborted += len(tx.prepared)
+            }
+            continue
+        }
+        for _, node := range tx.prepared {
+            if _, err := conns[node].Exec(action + " prepared " + quote_literal(gid)); err != nil {
+                fmt.Printf("[resolve] failed to %s '%s' on node %d: %v\n", action, gid, node, err)
+                failed++
+            } else if action == "commit" {
+                committed++
+            } else {
+                aborted++
+            }
+        }
+    }
+    verb := "done"
+    if cfg.DryRun {
+        verb = "to do, nothing done for -dry-run"
+    }
+    fmt.Printf("%d in-doubt transactions found, %d commits and %d rollbacks of prepared ones %s, %d failed\n",
+        len(gids), committed, aborted, verb, failed)
+    if failed > 0 {
+        return 1
+    }
+    return 0
+}
@@ -0,0 +1,457 @@
+package dtmtest
+
+import (
+    "encoding/csv"
+    "encoding/json"
+    "fmt"
+    "os"
+    "strconv"
+    "strings"
+    "sync/atomic"
+    "time"
+)
+
+type Latency struct {
+    P50 float64 `json:"p50_ms"`
+    P95 float64 `json:"p95_ms"`
+    P99 float64 `json:"p99_ms"`
+    Max float64 `json:"max_ms"`
+    Mean float64 `json:"mean_ms"`
+}
+
+// Attempts of transactions by isolation level, see -isolation
+type IsolationResults struct {
+    Commits int64 `json:"commits"`
+    Retries int64 `json:"retries"`
+    Aborts int64 `json:"aborts"`
+    AbortRate float64 `json:"abort_rate"` // failed attempts per attempt
+}
+
+type NodeResults struct {
+    Commits int64 `json:"commits"`
+    Tps float64 `json:"tps"`
+    Latency Latency `json:"latency"`
+    StatementLatency Latency `json:"statement_latency"`
+    Errors int64 `json:"errors"`
+}
+
+// Machine readable results of the run, see -output
+type Report struct {
+    Config interface{} `json:"config"`
+    Seed int64 `json:"seed"`
+    Nodes int `json:"nodes"`
+    // Durability settings of every node, see -synchronous-commit and -fsync
+    Settings []map[string]string `json:"settings"`
+    Elapsed float64 `json:"elapsed_sec"`
+    Commits int64 `json:"commits"`
+    Tps float64 `json:"tps"`
+    TargetTps float64 `json:"target_tps"`
+    ScheduleLag Latency `json:"schedule_lag"`
+    SteadyElapsed float64 `json:"steady_elapsed_sec"`
+    SteadyTps float64 `json:"steady_tps"`
+    Aborts int64 `json:"aborts"`
+    Retries int64 `json:"retries"`
+    Rollbacks int64 `json:"rollbacks"`
+    Latency Latency `json:"latency"`
+    // Pauses of the Go collector of the harness, see gc.go
+    GcCycles int64 `json:"gc_cycles"`
+    GcPause float64 `json:"gc_pause_ms"`  // total
+    GcPauses Latency `json:"gc_pauses"`
+    GcHit int64 `json:"gc_hit"`          // committed transactions stopped by a pause
+    GcFreeLatency Latency `json:"gc_free_latency"`
+    SnapshotLatency Latency `json:"snapshot_latency"`
+    Reads int64 `json:"reads"`
+    ReadLatency Latency `json:"read_latency"`
+    ReadSnapshotLatency Latency `json:"read_snapshot_latency"`
+    WriteSnapshotLatency Latency `json:"write_snapshot_latency"`
+    Deadlocks int64 `json:"deadlocks"`
+    DeadlockLatency Latency `json:"deadlock_latency"`
+    GlobalDeadlocks int64 `json:"global_deadlocks"`  // found by -deadlock-detect
+    DeadlockVictims int64 `json:"deadlock_victims"`
+    LockLatency Latency `json:"lock_latency"`
+    LockDeadlocks int64 `json:"lock_deadlocks"`
+    // Attempts failed by the timeouts of the sessions
+    StatementTimeouts int64 `json:"statement_timeouts"`
+    LockTimeouts int64 `json:"lock_timeouts"`
+    IdleTimeouts int64 `json:"idle_timeouts"`
+    HotRowWait Latency `json:"hot_row_wait"`  // of every update of the hotrow workload
+    BulkRows int64 `json:"bulk_rows"`           // updated by committed transactions of the bulk workload
+    BulkRowRate float64 `json:"bulk_rows_per_sec"`
+    CopyRows int64 `json:"copy_rows"`           // loaded by committed transactions of the copy workload
+    CopyRowRate float64 `json:"copy_rows_per_sec"`
+    CopyChecks int64 `json:"copy_checks"`
+    CopyTornReads int64 `json:"copy_torn_reads"`   // batches seen in part
+    CopyShortLoads int64 `json:"copy_short_loads"` // COPY taking fewer rows than sent
+    // Updates of t by the transfers, see -indexes and -fillfactor
+    TableUpdates int64 `json:"table_updates"`
+    HotUpdates int64 `json:"hot_updates"`
+    // Commits of the bursts of the group workload
+    GroupBursts int64 `json:"group_bursts"`
+    GroupCommit Latency `json:"group_commit"`
+    GroupCoalescing float64 `json:"group_coalescing"`  // times faster than the transactions one by one
+    GroupTimeouts int64 `json:"group_timeouts"`
+    // Committed transactions of the tpcc workload, remote ones on two warehouses
+    TpccNewOrders int64 `json:"tpcc_new_orders"`
+    TpccPayments int64 `json:"tpcc_payments"`
+    TpccOrderStatus int64 `json:"tpcc_order_status"`
+    TpccRemote int64 `json:"tpcc_remote"`
+    TpmC float64 `json:"tpmc"`
+    // Committed operations of the ycsb workload and their latency, by kind
+    YcsbCounts map[string]int64 `json:"ycsb_counts"`
+    YcsbOperations map[string]Latency `json:"ycsb_operations"`
+    // Committed transactions of the fuzz workload checked and the anomalies by kind
+    FuzzTransactions int64 `json:"fuzz_transactions"`
+    FuzzAnomalies map[string]int64 `json:"fuzz_anomalies"`
+    // Time of committed transactions in pg_dtm calls and its share of their latency, see -dtm-profile
+    DtmLatency Latency `json:"dtm_latency"`
+    DtmShare float64 `json:"dtm_share"`
+    CoordinatorLatency []Latency `json:"coordinator_latency"`
+    PerNode []NodeResults `json:"per_node"`
+    PhaseLatency map[string]Latency `json:"phase_latency"`
+    ServerTime map[string]float64 `json:"server_time_ms"`  // by class, see -server-statements
+    ServerStatements []ServerStatement `json:"server_statements"`
+    PerIsolation map[string]IsolationResults `json:"per_isolation"`
+    Checks int64 `json:"checks"`
+    Violations int64 `json:"violations"`
+    StableViolations int64 `json:"stable_violations"`  // see nStableViolations
+    UnstableReads int64 `json:"unstable_reads"`
+    Anomalies int `json:"anomalies"`
+    Stuck int64 `json:"stuck"`
+    Divergences int64 `json:"divergences"`
+    LongTransactions int64 `json:"long_transactions"`
+    StandbyReads int64 `json:"standby_reads"`
+    StandbyMismatches int64 `json:"standby_mismatches"`
+    Vacuums int64 `json:"vacuums"`
+    DdlChanges int64 `json:"ddl_changes"`
+    DdlLockTimeouts int64 `json:"ddl_lock_timeouts"`
+    DdlMismatches int64 `json:"ddl_mismatches"`
+    SessionChecks int64 `json:"session_checks"`
+    ReadYourWrites int64 `json:"read_your_writes_violations"`
+    MonotonicReads int64 `json:"monotonic_reads_violations"`
+    WanLosses int64 `json:"wan_losses"`
+    ProxyDrops int64 `json:"proxy_drops"`
+    UnresolvedDrops int64 `json:"unresolved_drops"`
+    WrongDrops int64 `json:"wrong_drops"`
+    XidsBurned int64 `json:"xids_burned"`
+    MaxXidAge []int64 `json:"max_xid_age"`   // of datfrozenxid on every node
+    ClockSkews int `json:"clock_skews"`
+    MaxClockSkew float64 `json:"max_clock_skew_ms"`
+    Crashes int64 `json:"crashes"`
+    CrashRecovery float64 `json:"crash_recovery_sec"`  // the longest one
+    HalfCommitted int64 `json:"half_committed"`
+    OutageErrors int64 `json:"outage_errors"`
+    OutageRecovery float64 `json:"outage_recovery_sec"`
+    ArbiterLeaderChanges int `json:"arbiter_leader_changes"`
+    ArbiterFailover float64 `json:"arbiter_failover_sec"`  // the longest one
+    DecisionsChecked int64 `json:"decisions_checked"`
+    LostDecisions int64 `json:"lost_decisions"`        // commits the new leader does not know
+    FlippedDecisions int64 `json:"flipped_decisions"`  // rollbacks it says are committed
+    DiagnosticBundles []string `json:"diagnostic_bundles"`
+    Converged bool `json:"converged"`
+    // Total read once the workers are done, for Balanced workloads only
+    ExpectedTotal int64 `json:"expected_total"`
+    FinalTotal int64 `json:"final_total"`
+    FinalOk bool `json:"final_ok"`
+    Scalability []LevelResults `json:"scalability"`
+    WorkerAbortRates []float64 `json:"worker_abort_rates"`
+    Budgets Budgets `json:"budgets"`
+    Interrupted bool `json:"interrupted"`
+    Resumes int `json:"resumes"`    // see -checkpoint
+}
+
+// What the run has found wrong with the cluster
+func (r Report) Failures() []string {
+    var failures []string
+    if r.Violations > 0 {
+        failures = append(failures, fmt.Sprintf("%d invariant violations", r.Violations))
+    }
+    if r.Anomalies > 0 {
+        failures = append(failures, fmt.Sprintf("%d anomalies", r.Anomalies))
+    }
+    if r.Divergences > 0 {
+        failures = append(failures, fmt.Sprintf("%d snapshot divergences", r.Divergences))
+    }
+    if r.StandbyMismatches > 0 {
+        failures = append(failures, fmt.Sprintf("%d standby mismatches", r.StandbyMismatches))
+    }
+    if r.DdlMismatches > 0 {
+        failures = append(failures, fmt.Sprintf("%d schema changes not seen on all nodes", r.DdlMismatches))
+    }
+    if r.ReadYourWrites > 0 {
+        failures = append(failures, fmt.Sprintf("%d own writes not read", r.ReadYourWrites))
+    }
+    if r.MonotonicReads > 0 {
+        failures = append(failures, fmt.Sprintf("%d reads older than the previous ones", r.MonotonicReads))
+    }
+    if r.UnresolvedDrops > 0 {
+        failures = append(failures, fmt.Sprintf("%d transactions reset by the proxies left prepared", r.UnresolvedDrops))
+    }
+    if r.WrongDrops > 0 {
+        failures = append(failures, fmt.Sprintf("%d transactions reset by the proxies ended against the decision", r.WrongDrops))
+    }
+    if r.HalfCommitted > 0 {
+        failures = append(failures, fmt.Sprintf("%d transactions half-committed by crashes", r.HalfCommitted))
+    }
+    if r.LostDecisions > 0 {
+        failures = append(failures, fmt.Sprintf("%d commits lost by arbiter failover", r.LostDecisions))
+    }
+    if r.FlippedDecisions > 0 {
+        failures = append(failures, fmt.Sprintf("%d rollbacks turned into commits by arbiter failover", r.FlippedDecisions))
+    }
+    if !r.Converged {
+        failures = append(failures, "total did not converge after faults")
+    }
+    if !r.FinalOk {
+        failures = append(failures, fmt.Sprintf("final total %d instead of %d", r.FinalTotal, r.ExpectedTotal))
+    }
+    return append(failures, r.budget_failures()...)
+}
+
+func (r Report) Failed() bool {
+    return len(r.Failures()) > 0
+}
+
+func ms(d time.Duration) float64 {
+    return float64(d) / float64(time.Millisecond)
+}
+
+func latency_of(h *Histogram) Latency {
+    return Latency{
+        P50: ms(h.Percentile(50)),
+        P95: ms(h.Percentile(95)),
+        P99: ms(h.Percentile(99)),
+        Max: ms(h.Max()),
+        Mean: ms(h.Mean()),
+    }
+}
+
+// Settings of the run as they are saved with the results, which are meant
+// to be shared: without the passwords of -conn
+func saved_config() Config {
+    saved := cfg
+    saved.ConnStrs = nil
+    for _, connstr := range cfg.ConnStrs {
+        saved.ConnStrs = append(saved.ConnStrs, strip_password(connstr))
+    }
+    return saved
+}
+
+func collect_results(elapsed time.Duration) Report {
+    total := stats.Total()
+    snapshots := stats.Snapshots()
+    lag := stats.Lag()
+    gcFree, gcPauses, gcHit := stats.Gc()
+    reads, readSnapshots, writeSnapshots := stats.Reads()
+    deadlocks := stats.Deadlocks()
+    locks := stats.Locks()
+    hotWaits := stats.HotWaits()
+    leaderChanges, failover := outage.LeaderChanges()
+    bursts, burstSerial := stats.Bursts()
+    var coordinators []Latency
+    for _, h := range stats.Coordinators() {
+        coordinators = append(coordinators, latency_of(&h))
+    }
+    var perNode []NodeResults
+    for _, n := range stats.Nodes() {
+        perNode = append(perNode, NodeResults{
+            Commits: n.Transactions.Count(),
+            Tps: float64(n.Transactions.Count()) / elapsed.Seconds(),
+            Latency: latency_of(&n.Transactions),
+            StatementLatency: latency_of(&n.Statements),
+            Errors: n.Errors,
+        })
+    }
+    phases := make(map[string]Latency)
+    for phase, h := range stats.Phases() {
+        phases[phase] = latency_of(&h)
+    }
+    dtm, dtmLatency := stats.Dtm()
+    counts, operations := make(map[string]int64), make(map[string]Latency)
+    for op, h := range stats.Operations() {
+        counts[op] = h.Count()
+        operations[op] = latency_of(&h)
+    }
+    levels := make(map[string]IsolationResults)
+    for level, is := range stats.Isolation() {
+        attempts := is.Commits + is.Retries + is.Aborts
+        levels[level] = IsolationResults{
+            Commits: is.Commits,
+            Retries: is.Retries,
+            Aborts: is.Aborts,
+            AbortRate: float64(is.Retries + is.Aborts) / float64(attempts),
+        }
+    }
+    return Report{
+        Config: saved_config(),
+        Seed: cfg.Seed,
+        Nodes: len(nodes),
+        Settings: nodeSettings,
+        Elapsed: elapsed.Seconds(),
+        Commits: total.Count(),
+        Tps: float64(total.Count()) / elapsed.Seconds(),
+        TargetTps: cfg.Rate,
+        ScheduleLag: latency_of(&lag),
+        SteadyElapsed: steady.elapsed.Seconds(),
+        SteadyTps: float64(steady.commits) / steady.elapsed.Seconds(),
+        Aborts: atomic.LoadInt64(&nAborts),
+        Retries: atomic.LoadInt64(&nRetries),
+        Rollbacks: atomic.LoadInt64(&nRollbacks),
+        Latency: latency_of(&total),
+        GcCycles: gcPauses.Count(),
+        GcPause: ms(gcPauses.sum),
+        GcPauses: latency_of(&gcPauses),
+        GcHit: gcHit,
+        GcFreeLatency: latency_of(&gcFree),
+        SnapshotLatency: latency_of(&snapshots),
+        Reads: reads.Count(),
+        ReadLatency: latency_of(&reads),
+        ReadSnapshotLatency: latency_of(&readSnapshots),
+        WriteSnapshotLatency: latency_of(&writeSnapshots),
+        Deadlocks: deadlocks.Count(),
+        DeadlockLatency: latency_of(&deadlocks),
+        GlobalDeadlocks: atomic.LoadInt64(&nGlobalDeadlocks),
+        DeadlockVictims: atomic.LoadInt64(&nDeadlockVictims),
+        LockLatency: latency_of(&locks),
+        LockDeadlocks: stats.LockDeadlocks(),
+        StatementTimeouts: atomic.LoadInt64(&nStatementTimeouts),
+        LockTimeouts: atomic.LoadInt64(&nLockTimeouts),
+        IdleTimeouts: atomic.LoadInt64(&nIdleTimeouts),
+        HotRowWait: latency_of(&hotWaits),
+        BulkRows: atomic.LoadInt64(&nBulkRows),
+        BulkRowRate: bulk_rate(elapsed),
+        CopyRows: atomic.LoadInt64(&nCopyRows),
+        CopyRowRate: copy_rate(elapsed),
+        CopyChecks: atomic.LoadInt64(&nCopyChecks),
+        CopyTornReads: atomic.LoadInt64(&nCopyTornReads),
+        CopyShortLoads: atomic.LoadInt64(&nCopyShortLoads),
+        TableUpdates: tableUpdates.run,
+        HotUpdates: tableUpdates.runHot,
+        GroupBursts: bursts.Count(),
+        GroupCommit: latency_of(&bursts),
+        GroupCoalescing: coalescing(&bursts, burstSerial),
+        GroupTimeouts: atomic.LoadInt64(&nGroupTimeouts),
+        TpccNewOrders: atomic.LoadInt64(&nTpccNewOrders),
+        TpccPayments: atomic.LoadInt64(&nTpccPayments),
+        TpccOrderStatus: atomic.LoadInt64(&nTpccOrderStatus),
+        TpccRemote: atomic.LoadInt64(&nTpccRemote),
+        TpmC: tpmc(elapsed),
+        YcsbCounts: counts,
+        YcsbOperations: operations,
+        DtmLatency: latency_of(&dtm),
+        DtmShare: dtm_share(dtm.sum, dtmLatency),
+        CoordinatorLatency: coordinators,
+        PerNode: perNode,
+        PhaseLatency: phases,
+        ServerTime: serverStatements.time,
+        ServerStatements: serverStatements.top,
+        PerIsolation: levels,
+        Checks: atomic.LoadInt64(&nChecks),
+        Violations: atomic.LoadInt64(&nViolations),
+        StableViolations: atomic.LoadInt64(&nStableViolations),
+        UnstableReads: atomic.LoadInt64(&nUnstableReads),
+        Stuck: atomic.LoadInt64(&nStuck),
+        Divergences: atomic.LoadInt64(&nDivergences),
+        LongTransactions: atomic.LoadInt64(&nLongTx),
+        StandbyReads: atomic.LoadInt64(&nStandbyReads),
+        StandbyMismatches: atomic.LoadInt64(&nStandbyMismatches),
+        Vacuums: atomic.LoadInt64(&nVacuums),
+        DdlChanges: atomic.LoadInt64(&nDdl),
+        DdlLockTimeouts: atomic.LoadInt64(&nDdlTimeouts),
+        DdlMismatches: atomic.LoadInt64(&nDdlMismatches),
+        SessionChecks: atomic.LoadInt64(&nSessionChecks),
+        ReadYourWrites: atomic.LoadInt64(&nReadYourWrites),
+        MonotonicReads: atomic.LoadInt64(&nMonotonicReads),
+        WanLosses: atomic.LoadInt64(&nWanLosses),
+        ProxyDrops: atomic.LoadInt64(&nProxyDrops),
+        XidsBurned: atomic.LoadInt64(&nXidsBurned),
+        MaxXidAge: max_xid_ages(),
+        ClockSkews: skew.changes,
+        MaxClockSkew: ms(skew.max),
+        Crashes: crash.crashes,
+        CrashRecovery: crash.recovery.Seconds(),
+        HalfCommitted: crash.halfCommitted,
+        OutageErrors: outage.Errors(),
+        OutageRecovery: outage.Recovery().Seconds(),
+        ArbiterLeaderChanges: leaderChanges,
+        ArbiterFailover: failover.Seconds(),
+        DiagnosticBundles: diagnostic_bundles(),
+        Converged: true,
+        FinalOk: true,
+        Scalability: rampLevels,
+        WorkerAbortRates: worker_abort_rates(),
+        Budgets: budgets_of_config(),
+        Interrupted: interrupted(),
+        Resumes: resumes,
+    }
+}
+
+func write_results(path string, r Report) {
+    f, err := os.Create(path)
+    checkErr(err)
+    defer f.Close()
+
+    if strings.HasSuffix(path, ".csv") {
+        write_csv(f, r)
+        return
+    }
+
+    enc := json.NewEncoder(f)
+    enc.SetIndent("", "    ")
+    checkErr(enc.Encode(r))
+}
+
+func read_results(path string) Report {
+    f, err := os.Open(path)
+    checkErr(err)
+    defer f.Close()
+
+    var r Report
+    checkErr(json.NewDecoder(f).Decode(&r))
+    return r
+}
+
+// Compare the run with the baseline one done with -no-dtm
+func report_overhead(base Report, r Report) {
+    pct := func(before, after float64) float64 {
+        if before == 0 {
+            return 0
+        }
+        return (after - before) * 100 / before
+    }
+    fmt.Printf("DTM overhead: TPS %0.2f -> %0.2f (%+0.1f%%)\n",
+        base.Tps, r.Tps, pct(base.Tps, r.Tps))
+    fmt.Printf("DTM overhead: latency p50 %0.3fms -> %0.3fms (%+0.3fms, %+0.1f%%)\n",
+        base.Latency.P50, r.Latency.P50, r.Latency.P50 - base.Latency.P50,
+        pct(base.Latency.P50, r.Latency.P50))
+    fmt.Printf("DTM overhead: latency p99 %0.3fms -> %0.3fms (%+0.3fms, %+0.1f%%)\n",
+        base.Latency.P99, r.Latency.P99, r.Latency.P99 - base.Latency.P99,
+        pct(base.Latency.P99, r.Latency.P99))
+}
+
+// Single header line and single line of values, configuration is left out
+func write_csv(f *os.File, r Report) {
+    float := func(x float64) string {
+        return strconv.FormatFloat(x, 'f', 3, 64)
+    }
+    w := csv.NewWriter(f)
+    checkErr(w.Write([]string{
+        "seed", "nodes", "elapsed_sec", "commits", "tps", "steady_tps", "aborts", "retries", "rollbacks",
+        "p50_ms", "p95_ms", "p99_ms", "max_ms", "mean_ms",
+        "snapshot_p50_ms", "snapshot_p99_ms",
+        "checks", "violations", "anomalies", "converged", "final_ok",
+    }))
+    checkErr(w.Write([]string{
+        strconv.FormatInt(r.Seed, 10), strconv.Itoa(r.Nodes), float(r.Elapsed),
+        strconv.FormatInt(r.Commits, 10), float(r.Tps), float(r.SteadyTps),
+        strconv.FormatInt(r.Aborts, 10), strconv.FormatInt(r.Retries, 10),
+        strconv.FormatInt(r.Rollbacks, 10),
+        float(r.Latency.P50), float(r.Latency.P95), float(r.Latency.P99),
+        float(r.Latency.Max), float(r.Latency.Mean),
+        float(r.SnapshotLatency.P50), float(r.SnapshotLatency.P99),
+        strconv.FormatInt(r.Checks, 10), strconv.FormatInt(r.Violations, 10),
+        strconv.Itoa(r.Anomalies), strconv.FormatBool(r.Converged),
+        strconv.FormatBool(r.FinalOk),
+    }))
+    w.Flush()
+    checkErr(w.Error())
+}
@@ -0,0 +1,95 @@
+package dtmtest
+
+import (
+    "fmt"
+    "math/rand"
+    "sync/atomic"
+    "github.com/jackc/pgx"
+    "github.com/digoal/postgres_cluster/contrib/pg_tsdtm/tests/dtmclient"
+)
+
+// Transfers with subtransactions: on every participant the account is
+// first spoiled in a subtransaction which is then rolled back, either
+// explicitly or after the statement failed, and only then updated for
+// real in a released subtransaction. Aborted subtransactions must leave
+// no trace neither in the snapshot of the transaction itself nor in the
+// database after the global commit, and a released one must be committed
+// with the rest of the transaction on every node.
+type SavepointWorkload struct {
+    TransferWorkload
+}
+
+// Spoils the balance beyond anything the transfers may produce
+const bogusDelta = 1000000
+
+// Rolled back subtransactions still visible to the transaction
+var nSubxactLeaks int64
+
+func init() {
+    register_workload("savepoints", func() Workload { return new(SavepointWorkload) })
+}
+
+func (s *SavepointWorkload) Iteration(w *Worker) error {
+    return run_transfer(w, transfer_updates(w), savepoint_update(w.Rand))
+}
+
+func (s *SavepointWorkload) Verify(conns []*pgx.Conn) int {
+    anomalies := int(atomic.LoadInt64(&nSubxactLeaks))
+    atomic.StoreInt64(&nSubxactLeaks, 0)
+    for i, conn := range conns {
+        var spoiled int64
+        checkErr(conn.QueryRow("select count(*) from t where abs(v - $1) >= $2",
+            cfg.InitAmount, bogusDelta / 2).Scan(&spoiled))
+        if spoiled != 0 {
+            fmt.Printf("[savepoints] %d accounts on node %d keep updates of rolled back subtransactions\n", spoiled, i)
+            anomalies += int(spoiled)
+        }
+    }
+    return anomalies + s.TransferWorkload.Verify(conns)
+}
+
+func savepoint_update(r *rand.Rand) applyUpdate {
+    return func(tx *dtmclient.GlobalTx, participant int, conn *pgx.Conn, u *Update) error {
+        var before, after int64
+        if err := tx.QueryRow(participant, "select v from t where u=$1", u.Account).Scan(&before); err != nil {
+            return err
+        }
+
+        if _, err := tx.Exec(participant, "savepoint bogus"); err != nil {
+            return err
+        }
+        if r.Intn(2) == 0 {
+            _, err := tx.Exec(participant, "update t set v = v + $1 where u=$2", bogusDelta, u.Account)
+            if err != nil {
+                return err
+            }
+        } else {
+            // the failure aborts the subtransaction only
+            _, err := tx.Exec(participant, "update t set v = v / 0 where u=$1", u.Account)
+            if pgerr, ok := err.(pgx.PgError); !ok || pgerr.Code != "22012" {
+                return fmt.Errorf("division by zero expected, got %v", err)
+            }
+        }
+        if _, err := tx.Exec(participant, "rollback to savepoint bogus"); err != nil {
+            return err
+        }
+
+        if err := tx.QueryRow(participant, "select v from t where u=$1", u.Account).Scan(&after); err != nil {
+            return err
+        }
+        if after != before {
+            atomic.AddInt64(&nSubxactLeaks, 1)
+            fmt.Printf("[savepoints] transaction '%s' sees balance %d of account %d after rollback to savepoint, %d before\n",
+                tx.Gid, after, u.Account, before)
+        }
+
+        if _, err := tx.Exec(participant, "savepoint transfer"); err != nil {
+            return err
+        }
+        if err := update_account(tx, participant, conn, u); err != nil {
+            return err
+        }
+        _, err := tx.Exec(participant, "release savepoint transfer")
+        return err
+    }
+}
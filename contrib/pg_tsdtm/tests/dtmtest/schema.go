@@ -0,0 +1,64 @@
+package dtmtest
+
+import (
+    "fmt"
+    "github.com/jackc/pgx"
+)
+
+// Variants of the accounts table t, see -indexes and -fillfactor. Every
+// secondary index is on the balance the transfers update, so none of
+// their updates is HOT once there is one, while a lower fillfactor leaves
+// room for HOT updates in the pages otherwise. How many updates have been
+// HOT is reported as the statistics collector tells. These are the
+// storage parameters of t.
+func table_options() string {
+    if cfg.FillFactor == 100 {
+        return ""
+    }
+    return fmt.Sprintf(" with (fillfactor = %d)", cfg.FillFactor)
+}
+
+func create_indexes(conns []*pgx.Conn) {
+    for _, conn := range conns {
+        for i := 0; i < cfg.Indexes; i++ {
+            exec(conn, fmt.Sprintf("create index t_v%d on t ((v + %d))", i, i))
+        }
+    }
+}
+
+// Updates of t on every node counted by the collector when the workload is
+// set up or attached, and all and HOT ones the run has added to them
+var tableUpdates struct {
+    updates, hot []int64
+    run, runHot int64
+}
+
+func table_update_counts(conns []*pgx.Conn) (updates []int64, hot []int64) {
+    for _, conn := range conns {
+        var n, h int64
+        checkErr(conn.QueryRow("select n_tup_upd, n_tup_hot_upd from pg_stat_user_tables " +
+            "where relid = 't'::regclass").Scan(&n, &h))
+        updates, hot = append(updates, n), append(hot, h)
+    }
+    return updates, hot
+}
+
+func start_table_updates(conns []*pgx.Conn) {
+    tableUpdates.updates, tableUpdates.hot = table_update_counts(conns)
+}
+
+func finish_table_updates(conns []*pgx.Conn) {
+    n, h := table_update_counts(conns)
+    tableUpdates.run, tableUpdates.runHot = 0, 0
+    for i := range n {
+        tableUpdates.run += n[i] - tableUpdates.updates[i]
+        tableUpdates.runHot += h[i] - tableUpdates.hot[i]
+    }
+}
+
+func hot_pct(r Report) float64 {
+    if r.TableUpdates == 0 {
+        return 0
+    }
+    return float64(r.HotUpdates) * 100 / float64(r.TableUpdates)
+}
@@ -0,0 +1,518 @@
+package dtmtest
+
+import (
+    "bufio"
+    "fmt"
+    "math/rand"
+    "os"
+    "regexp"
+    "strconv"
+    "strings"
+    "sync"
+    "sync/atomic"
+    "github.com/jackc/pgx"
+    "github.com/digoal/postgres_cluster/contrib/pg_tsdtm/tests/dtmclient"
+)
+
+// Custom scripts in the spirit of pgbench, see -script. Every run of the
+// script is one global transaction over all nodes. Supported are:
+//
+//  \set name expression   integer arithmetic (+ - * / %), :variables and
+//                         random(lo, hi), abs(x), min(x, y), max(x, y)
+//  \node expression       following SQL commands are sent to node
+//                         expression % number of nodes, until the next
+//                         \node; without it they are sent to every node
+//  SQL command            may refer to variables as :name, one command per
+//                         line; begin/end/commit are skipped as commit is up
+//                         to DTM
+//
+// Predefined variables: client_id, nodes, accounts (-accounts).
+// Variables used before they are set and constant divisions by zero or
+// empty ranges of random() are refused when the script is read; the same
+// found only at run time, e.g. random(1, :x) with :x of 0, abort the
+// transaction and fail the run without stopping it.
+type ScriptWorkload struct {
+    commands []scriptCommand
+}
+
+// Error of the script itself rather than of the servers
+type scriptError struct {
+    where string
+    err error
+}
+
+func (e scriptError) Error() string {
+    return e.where + ": " + e.err.Error()
+}
+
+// Runs of the script failed by scriptError
+var nScriptErrors int64
+
+var scriptErrors = struct {
+    sync.Mutex
+    seen map[string]bool
+}{seen: make(map[string]bool)}
+
+// Count the error, print every one once
+func script_error(where string, err error) error {
+    e := scriptError{where, err}
+    atomic.AddInt64(&nScriptErrors, 1)
+    scriptErrors.Lock()
+    if !scriptErrors.seen[e.Error()] {
+        scriptErrors.seen[e.Error()] = true
+        fmt.Printf("[script] %v\n", e)
+    }
+    scriptErrors.Unlock()
+    return e
+}
+
+const (
+    scriptSet = iota
+    scriptNode
+    scriptSQL
+)
+
+type scriptCommand struct {
+    kind int
+    name string
+    expr scriptExpr
+    sql string
+    vars []string   // variables bound to $1, $2, ... of sql
+    where string    // file and line
+}
+
+func init() {
+    register_workload("script", func() Workload {
+        if cfg.ScriptPath == "" {
+            fmt.Println("ERROR: 'script' workload needs -script")
+            os.Exit(1)
+        }
+        commands, err := parse_script(cfg.ScriptPath)
+        if err != nil {
+            fmt.Printf("ERROR: %v\n", err)
+            os.Exit(1)
+        }
+        return &ScriptWorkload{commands: commands}
+    })
+}
+
+var scriptVar = regexp.MustCompile(`:([a-zA-Z_][a-zA-Z0-9_]*)`)
+
+func parse_script(path string) ([]scriptCommand, error) {
+    f, err := os.Open(path)
+    if err != nil {
+        return nil, err
+    }
+    defer f.Close()
+
+    var commands []scriptCommand
+    defined := map[string]bool{"client_id": true, "nodes": true, "accounts": true}
+    scanner := bufio.NewScanner(f)
+    for lineno := 1; scanner.Scan(); lineno++ {
+        line := strings.TrimSpace(scanner.Text())
+        if line == "" || strings.HasPrefix(line, "--") {
+            continue
+        }
+        where := fmt.Sprintf("%s:%d", path, lineno)
+
+        if strings.HasPrefix(line, `\`) {
+            fields := strings.Fields(line)
+            var cmd scriptCommand
+            var text string
+            switch {
+            case fields[0] == `\set` && len(fields) >= 3:
+                cmd = scriptCommand{kind: scriptSet, name: fields[1]}
+                text = strings.Join(fields[2:], " ")
+            case fields[0] == `\node` && len(fields) >= 2:
+                cmd = scriptCommand{kind: scriptNode}
+                text = strings.Join(fields[1:], " ")
+            default:
+                return nil, fmt.Errorf("%s: unsupported meta command '%s'", where, line)
+            }
+            if cmd.expr, err = parse_expr(text); err == nil {
+                err = check_expr(cmd.expr, defined)
+            }
+            if err != nil {
+                return nil, fmt.Errorf("%s: %v", where, err)
+            }
+            if cmd.kind == scriptSet {
+                defined[cmd.name] = true
+            }
+            cmd.where = where
+            commands = append(commands, cmd)
+            continue
+        }
+
+        sql := strings.TrimSuffix(line, ";")
+        switch strings.ToLower(sql) {
+        case "begin", "end", "commit":
+            continue
+        }
+        cmd := bind_vars(sql)
+        for _, name := range cmd.vars {
+            if !defined[name] {
+                return nil, fmt.Errorf("%s: undefined variable '%s'", where, name)
+            }
+        }
+        cmd.where = where
+        commands = append(commands, cmd)
+    }
+    return commands, scanner.Err()
+}
+
+// Replace :name with parameters, leaving casts like u::int alone
+func bind_vars(sql string) scriptCommand {
+    cmd := scriptCommand{kind: scriptSQL}
+    var b strings.Builder
+    last := 0
+    for _, m := range scriptVar.FindAllStringSubmatchIndex(sql, -1) {
+        if m[0] > 0 && sql[m[0] - 1] == ':' {
+            continue
+        }
+        cmd.vars = append(cmd.vars, sql[m[2]:m[3]])
+        b.WriteString(sql[last:m[0]])
+        b.WriteString("$" + strconv.Itoa(len(cmd.vars)))
+        last = m[1]
+    }
+    b.WriteString(sql[last:])
+    cmd.sql = b.String()
+    return cmd
+}
+
+func (s *ScriptWorkload) Setup(conns []*pgx.Conn) {
+    create_extension(conns)
+}
+
+func (s *ScriptWorkload) Attach(conns []*pgx.Conn) {
+}
+
+func (s *ScriptWorkload) Iteration(w *Worker) error {
+    return w.Transaction(func(gtid string) (*dtmclient.GlobalTx, error) {
+        tx, err := begin_global(w.Conns, gtid, w.Isolation)
+        if err != nil {
+            return nil, err
+        }
+        if err = s.run(w, tx); err != nil {
+            tx.Rollback()
+            return tx, err
+        }
+        if !cfg.Use2PC {
+            return tx, tx.CommitLocal()
+        }
+        return tx, tx.Commit()
+    })
+}
+
+func (s *ScriptWorkload) run(w *Worker, tx *dtmclient.GlobalTx) error {
+    vars := map[string]int64{
+        "client_id": int64(w.Id),
+        "nodes": int64(len(w.Conns)),
+        "accounts": int64(cfg.Accounts),
+    }
+    node := -1
+    for _, cmd := range s.commands {
+        switch cmd.kind {
+        case scriptSet, scriptNode:
+            v, err := cmd.expr.eval(vars, w.Rand)
+            if err != nil {
+                return script_error(cmd.where, err)
+            }
+            if cmd.kind == scriptSet {
+                vars[cmd.name] = v
+            } else {
+                node = int(v % int64(len(w.Conns)))
+                if node < 0 {
+                    node += len(w.Conns)
+                }
+            }
+        case scriptSQL:
+            args := make([]interface{}, len(cmd.vars))
+            for i, name := range cmd.vars {
+                v, ok := vars[name]
+                if !ok {
+                    return script_error(cmd.where, fmt.Errorf("undefined variable '%s'", name))
+                }
+                args[i] = v
+            }
+            for i := range w.Conns {
+                if node >= 0 && i != node {
+                    continue
+                }
+                if _, err := tx.Exec(i, cmd.sql, args...); err != nil {
+                    return err
+                }
+            }
+        }
+    }
+    return nil
+}
+
+func (s *ScriptWorkload) Verify(conns []*pgx.Conn) int {
+    failed := atomic.LoadInt64(&nScriptErrors)
+    if failed > 0 {
+        fmt.Printf("[script] %d runs of the script failed\n", failed)
+    }
+    return int(failed)
+}
+
+// The schema belongs to the user
+func (s *ScriptWorkload) Teardown(conns []*pgx.Conn) {
+}
+
+// Integer expression of \set and \node
+type scriptExpr interface {
+    eval(vars map[string]int64, r *rand.Rand) (int64, error)
+}
+
+type exprConst int64
+type exprVar string
+type exprBinary struct {
+    op byte
+    left, right scriptExpr
+}
+type exprCall struct {
+    fn string
+    args []scriptExpr
+}
+
+func (e exprConst) eval(vars map[string]int64, r *rand.Rand) (int64, error) {
+    return int64(e), nil
+}
+
+func (e exprVar) eval(vars map[string]int64, r *rand.Rand) (int64, error) {
+    v, ok := vars[string(e)]
+    if !ok {
+        return 0, fmt.Errorf("undefined variable '%s'", string(e))
+    }
+    return v, nil
+}
+
+func (e *exprBinary) eval(vars map[string]int64, r *rand.Rand) (int64, error) {
+    x, err := e.left.eval(vars, r)
+    if err != nil {
+        return 0, err
+    }
+    y, err := e.right.eval(vars, r)
+    if err != nil {
+        return 0, err
+    }
+    switch e.op {
+    case '+':
+        return x + y, nil
+    case '-':
+        return x - y, nil
+    case '*':
+        return x * y, nil
+    }
+    if y == 0 {
+        return 0, fmt.Errorf("division by zero")
+    }
+    if e.op == '/' {
+        return x / y, nil
+    }
+    return x % y, nil
+}
+
+func (e *exprCall) eval(vars map[string]int64, r *rand.Rand) (int64, error) {
+    args := make([]int64, len(e.args))
+    for i, arg := range e.args {
+        var err error
+        if args[i], err = arg.eval(vars, r); err != nil {
+            return 0, err
+        }
+    }
+    switch e.fn {
+    case "random":
+        if args[1] < args[0] {
+            return 0, fmt.Errorf("empty range of random(%d, %d)", args[0], args[1])
+        }
+        return args[0] + r.Int63n(args[1] - args[0] + 1), nil
+    case "abs":
+        if args[0] < 0 {
+            return -args[0], nil
+        }
+        return args[0], nil
+    case "min":
+        if args[1] < args[0] {
+            return args[1], nil
+        }
+        return args[0], nil
+    default: // max
+        if args[1] > args[0] {
+            return args[1], nil
+        }
+        return args[0], nil
+    }
+}
+
+// Whether the expression has the same value every time: no variables and
+// no random()
+func is_constant(e scriptExpr) bool {
+    switch e := e.(type) {
+    case exprVar:
+        return false
+    case *exprBinary:
+        return is_constant(e.left) && is_constant(e.right)
+    case *exprCall:
+        for _, arg := range e.args {
+            if !is_constant(arg) {
+                return false
+            }
+        }
+        return e.fn != "random"
+    }
+    return true
+}
+
+// Refuse variables not defined yet and what is sure to fail at run time
+func check_expr(e scriptExpr, defined map[string]bool) error {
+    switch e := e.(type) {
+    case exprVar:
+        if !defined[string(e)] {
+            return fmt.Errorf("undefined variable '%s'", string(e))
+        }
+    case *exprBinary:
+        for _, operand := range []scriptExpr{e.left, e.right} {
+            if err := check_expr(operand, defined); err != nil {
+                return err
+            }
+        }
+        if is_constant(e) {
+            _, err := e.eval(nil, nil)
+            return err
+        }
+        if e.op == '/' || e.op == '%' {
+            if y, err := e.right.eval(nil, nil); is_constant(e.right) && err == nil && y == 0 {
+                return fmt.Errorf("division by zero")
+            }
+        }
+    case *exprCall:
+        for _, arg := range e.args {
+            if err := check_expr(arg, defined); err != nil {
+                return err
+            }
+        }
+        if e.fn == "random" && is_constant(e.args[0]) && is_constant(e.args[1]) {
+            lo, _ := e.args[0].eval(nil, nil)
+            hi, _ := e.args[1].eval(nil, nil)
+            if hi < lo {
+                return fmt.Errorf("empty range of random(%d, %d)", lo, hi)
+            }
+        }
+    }
+    return nil
+}
+
+var exprArity = map[string]int{"random": 2, "abs": 1, "min": 2, "max": 2}
+
+var exprToken = regexp.MustCompile(`\s*(\d+|:?[a-zA-Z_][a-zA-Z0-9_]*|[-+*/%(),])`)
+
+// Recursive descent over tokens: sum := term {('+'|'-') term},
+// term := factor {('*'|'/'|'%') factor}, factor := number | :var |
+// function '(' sum {',' sum} ')' | '(' sum ')' | '-' factor
+type exprParser struct {
+    tokens []string
+    pos int
+}
+
+func parse_expr(text string) (scriptExpr, error) {
+    p := &exprParser{}
+    rest := text
+    for strings.TrimSpace(rest) != "" {
+        m := exprToken.FindStringSubmatchIndex(rest)
+        if m == nil || m[0] != 0 {
+            return nil, fmt.Errorf("can not parse '%s'", text)
+        }
+        p.tokens = append(p.tokens, rest[m[2]:m[3]])
+        rest = rest[m[1]:]
+    }
+    e, err := p.sum()
+    if err == nil && p.pos < len(p.tokens) {
+        err = fmt.Errorf("unexpected '%s' in '%s'", p.tokens[p.pos], text)
+    }
+    return e, err
+}
+
+func (p *exprParser) peek() string {
+    if p.pos < len(p.tokens) {
+        return p.tokens[p.pos]
+    }
+    return ""
+}
+
+func (p *exprParser) next() string {
+    t := p.peek()
+    p.pos++
+    return t
+}
+
+func (p *exprParser) sum() (scriptExpr, error) {
+    e, err := p.term()
+    for err == nil && (p.peek() == "+" || p.peek() == "-") {
+        op := p.next()[0]
+        var right scriptExpr
+        if right, err = p.term(); err == nil {
+            e = &exprBinary{op, e, right}
+        }
+    }
+    return e, err
+}
+
+func (p *exprParser) term() (scriptExpr, error) {
+    e, err := p.factor()
+    for err == nil && (p.peek() == "*" || p.peek() == "/" || p.peek() == "%") {
+        op := p.next()[0]
+        var right scriptExpr
+        if right, err = p.factor(); err == nil {
+            e = &exprBinary{op, e, right}
+        }
+    }
+    return e, err
+}
+
+func (p *exprParser) factor() (scriptExpr, error) {
+    t := p.next()
+    switch {
+    case t == "":
+        return nil, fmt.Errorf("unexpected end of expression")
+    case t == "-":
+        e, err := p.factor()
+        return &exprBinary{'-', exprConst(0), e}, err
+    case t == "(":
+        e, err := p.sum()
+        if err == nil && p.next() != ")" {
+            err = fmt.Errorf("')' expected")
+        }
+        return e, err
+    case t[0] >= '0' && t[0] <= '9':
+        v, err := strconv.ParseInt(t, 10, 64)
+        return exprConst(v), err
+    case t[0] == ':':
+        return exprVar(t[1:]), nil
+    }
+
+    arity, ok := exprArity[t]
+    if !ok {
+        return nil, fmt.Errorf("unknown function '%s'", t)
+    }
+    if p.next() != "(" {
+        return nil, fmt.Errorf("'(' expected after '%s'", t)
+    }
+    call := &exprCall{fn: t}
+    for {
+        arg, err := p.sum()
+        if err != nil {
+            return nil, err
+        }
+        call.args = append(call.args, arg)
+        if sep := p.next(); sep == ")" {
+            break
+        } else if sep != "," {
+            return nil, fmt.Errorf("',' or ')' expected in arguments of '%s'", t)
+        }
+    }
+    if len(call.args) != arity {
+        return nil, fmt.Errorf("%s() takes %d arguments", t, arity)
+    }
+    return call, nil
+}
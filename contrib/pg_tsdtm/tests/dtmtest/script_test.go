@@ -0,0 +1,53 @@
+package dtmtest
+
+import (
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "strings"
+    "testing"
+)
+
+func TestScriptChecks(t *testing.T) {
+    dir, err := ioutil.TempDir("", "script")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer os.RemoveAll(dir)
+
+    for _, c := range []struct {
+        script string
+        err string    // "" if the script is fine
+    }{
+        {"\\set a random(1, :accounts)\nselect :a, :client_id\n", ""},
+        {"\\set a :b + 1\n", "undefined variable 'b'"},
+        {"select :a\n\\set a 1\n", "undefined variable 'a'"},
+        {"\\set a 10 / (2 - 2)\n", "division by zero"},
+        {"\\set a :nodes % 0\n", "division by zero"},
+        {"\\set a random(5, 1)\n", "empty range"},
+        {"\\set z 0\n\\set a random(1, :z)\n", ""},   // known only at run time
+    } {
+        path := filepath.Join(dir, "test.sql")
+        if err := ioutil.WriteFile(path, []byte(c.script), 0644); err != nil {
+            t.Fatal(err)
+        }
+        _, err := parse_script(path)
+        if c.err == "" && err != nil || c.err != "" && (err == nil || !strings.Contains(err.Error(), c.err)) {
+            t.Errorf("%q: error %v, expected %q", c.script, err, c.err)
+        }
+    }
+}
+
+func TestScriptErrorAborts(t *testing.T) {
+    e, err := parse_expr("random(1, :z)")
+    if err != nil {
+        t.Fatal(err)
+    }
+    _, err = e.eval(map[string]int64{"z": 0}, nil)
+    if err == nil {
+        t.Fatal("empty range of random() evaluated")
+    }
+    if class := classify(scriptError{"test.sql:1", err}); class != errAbort {
+        t.Errorf("script error classified as %d instead of abort", class)
+    }
+}
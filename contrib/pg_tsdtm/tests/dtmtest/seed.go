@@ -0,0 +1,18 @@
+package dtmtest
+
+import (
+    "hash/fnv"
+    "math/rand"
+    "strconv"
+)
+
+// Random generators of the run, see -seed. Every stream (a worker, its key
+// chooser, chaos...) has its own generator seeded from -seed and the name
+// of the stream, so that the sequence of every worker is reproduced by the
+// same seed however goroutines are scheduled. Interleaving of the workers
+// is of course not.
+func new_rand(stream string, id int) *rand.Rand {
+    h := fnv.New64a()
+    h.Write([]byte(strconv.FormatInt(cfg.Seed, 10) + "/" + stream + "/" + strconv.Itoa(id)))
+    return rand.New(rand.NewSource(int64(h.Sum64())))
+}
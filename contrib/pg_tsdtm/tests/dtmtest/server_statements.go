@@ -0,0 +1,128 @@
+package dtmtest
+
+import (
+    "fmt"
+    "sort"
+    "strings"
+    "github.com/jackc/pgx"
+)
+
+// With -server-statements the statistics of pg_stat_statements are reset
+// on every node before the workers start and pulled once they are done: the
+// time the servers spend in the functions of pg_dtm, in 2PC and in the
+// statements of the workload, summed over the nodes, shows where the
+// server-side time of a global transaction goes. The nodes should have
+// pg_stat_statements in shared_preload_libraries, a node without it is
+// left out with a warning. With -databases the statistics of the other
+// databases of the same server are reset too.
+const topServerStatements = 20
+
+// Time of the statements of one text on all nodes
+type ServerStatement struct {
+    Query string `json:"query"`
+    Class string `json:"class"`
+    Calls int64 `json:"calls"`
+    Total float64 `json:"total_ms"`
+    Mean float64 `json:"mean_ms"`
+    Rows int64 `json:"rows"`
+}
+
+var serverStatements struct {
+    skipped map[int]bool        // nodes without pg_stat_statements
+    time map[string]float64     // by class
+    top []ServerStatement
+}
+
+// What the statement is for: dtm, 2pc, transaction or workload
+func statement_class(query string) string {
+    q := strings.ToLower(strings.TrimSpace(query))
+    switch {
+    case strings.Contains(q, "dtm_"):
+        return "dtm"
+    case strings.HasPrefix(q, "prepare transaction"), strings.HasPrefix(q, "commit prepared"),
+        strings.HasPrefix(q, "rollback prepared"):
+        return "2pc"
+    case strings.HasPrefix(q, "begin"), strings.HasPrefix(q, "commit"), strings.HasPrefix(q, "rollback"),
+        strings.HasPrefix(q, "savepoint"), strings.HasPrefix(q, "release"):
+        return "transaction"
+    }
+    return "workload"
+}
+
+func reset_server_statements(conns []*pgx.Conn) {
+    serverStatements.skipped = make(map[int]bool)
+    for i, conn := range conns {
+        _, err := conn.Exec("create extension if not exists pg_stat_statements")
+        if err == nil {
+            _, err = conn.Exec("select pg_stat_statements_reset()")
+        }
+        if err != nil {
+            fmt.Printf("WARNING: node %d is left out of -server-statements: %v\n", i, err)
+            serverStatements.skipped[i] = true
+        }
+    }
+}
+
+// Once nothing runs anymore
+func collect_server_statements() {
+    conns := connect_all()
+    defer close_all(conns)
+
+    byQuery := make(map[string]*ServerStatement)
+    serverStatements.time = make(map[string]float64)
+    for i, conn := range conns {
+        if serverStatements.skipped[i] {
+            continue
+        }
+        rows, err := conn.Query("select query, calls, total_time, rows from pg_stat_statements " +
+            "where dbid = (select oid from pg_database where datname = current_database())")
+        checkErr(err)
+        for rows.Next() {
+            var query string
+            var calls, nrows int64
+            var total float64
+            checkErr(rows.Scan(&query, &calls, &total, &nrows))
+            s := byQuery[query]
+            if s == nil {
+                s = &ServerStatement{Query: query, Class: statement_class(query)}
+                byQuery[query] = s
+            }
+            s.Calls += calls
+            s.Total += total
+            s.Rows += nrows
+            serverStatements.time[s.Class] += total
+        }
+        checkErr(rows.Err())
+    }
+
+    var all []ServerStatement
+    for _, s := range byQuery {
+        s.Mean = s.Total / float64(s.Calls)
+        all = append(all, *s)
+    }
+    sort.Slice(all, func(i, j int) bool { return all[i].Total > all[j].Total })
+    if len(all) > topServerStatements {
+        all = all[:topServerStatements]
+    }
+    serverStatements.top = all
+}
+
+func print_server_statements(r Report) {
+    var sum float64
+    for _, t := range r.ServerTime {
+        sum += t
+    }
+    if sum == 0 {
+        return
+    }
+    var classes []string
+    for _, class := range []string{"dtm", "2pc", "transaction", "workload"} {
+        classes = append(classes, fmt.Sprintf("%s %0.1fms (%0.1f%%)", class,
+            r.ServerTime[class], r.ServerTime[class] * 100 / sum))
+    }
+    fmt.Printf("Server time: %s\n", strings.Join(classes, ", "))
+    for _, s := range r.ServerStatements {
+        fmt.Printf("Server %s: %d calls, %0.1fms, mean %0.3fms: %s\n",
+            s.Class, s.Calls, s.Total, s.Mean, strings.Join(strings.Fields(s.Query), " "))
+    }
+}
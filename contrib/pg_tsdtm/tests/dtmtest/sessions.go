@@ -0,0 +1,155 @@
+package dtmtest
+
+import (
+    "fmt"
+    "sync"
+    "sync/atomic"
+    "github.com/jackc/pgx"
+    "github.com/digoal/postgres_cluster/contrib/pg_tsdtm/tests/dtmclient"
+)
+
+// Session guarantees of the workers, see -session-checks. Every worker
+// owns a row of t_session on every node, and every global transaction it
+// begins reads the row on each participant and, unless read-only, bumps
+// it. Nobody else writes the row, so what a worker reads is the last value
+// it has committed there: a smaller one than committed before breaks
+// read-your-writes, a smaller one than read before breaks monotonic reads.
+// Writes whose commit has ended in doubt may or may not be seen.
+var nSessionChecks int64
+var nReadYourWrites int64
+var nMonotonicReads int64
+
+// What a worker knows about its row on a node
+type sessionNode struct {
+    written int64   // the last value committed
+    read int64      // the greatest value read
+    pending int64   // written by the transaction in progress, 0 if none
+    next int64
+}
+
+type Session struct {
+    worker int
+    nodes []sessionNode
+}
+
+// Sessions of the connections of the attempts in progress
+var sessions struct {
+    sync.Mutex
+    conns map[*pgx.Conn]*Session
+}
+
+func create_session_tables(conns []*pgx.Conn) {
+    for _, conn := range conns {
+        if !cfg.NoSetup {
+            exec(conn, "drop table if exists t_session")
+        }
+        exec(conn, "create table if not exists t_session(worker int primary key, seq bigint)")
+    }
+}
+
+func drop_session_tables(conns []*pgx.Conn) {
+    for _, conn := range conns {
+        exec(conn, "drop table if exists t_session")
+    }
+}
+
+// The rows of the worker start from zero, whatever an earlier run has left
+func new_session(worker int, conns []*pgx.Conn) *Session {
+    for _, conn := range conns {
+        exec(conn, "delete from t_session where worker = $1", worker)
+        exec(conn, "insert into t_session values ($1, 0)", worker)
+    }
+    return &Session{worker: worker, nodes: make([]sessionNode, len(conns))}
+}
+
+// Transactions begun on the connections belong to the session until the
+// returned function is called
+func attach_session(s *Session, conns []*pgx.Conn) func() {
+    if s == nil {
+        return func() {}
+    }
+    sessions.Lock()
+    if sessions.conns == nil {
+        sessions.conns = make(map[*pgx.Conn]*Session)
+    }
+    for _, conn := range conns {
+        sessions.conns[conn] = s
+    }
+    sessions.Unlock()
+    return func() {
+        sessions.Lock()
+        for _, conn := range conns {
+            delete(sessions.conns, conn)
+        }
+        sessions.Unlock()
+    }
+}
+
+// Read and, if the transaction has a gid, bump the row of the session on
+// every participant the session is attached to
+func session_begin(tx *dtmclient.GlobalTx, gid string) error {
+    for i, conn := range tx.Participants() {
+        sessions.Lock()
+        s := sessions.conns[conn]
+        sessions.Unlock()
+        node := node_of(conn)
+        if s == nil || node < 0 {
+            continue
+        }
+        n := &s.nodes[node]
+        var seq int64
+        var err error
+        if gid == "" {
+            err = tx.QueryRow(i, "select seq from t_session where worker = $1", s.worker).Scan(&seq)
+        } else {
+            n.next++
+            err = tx.QueryRow(i, "update t_session s set seq = $2 from " +
+                "(select seq from t_session where worker = $1) old where s.worker = $1 returning old.seq",
+                s.worker, n.next).Scan(&seq)
+            if err == nil {
+                n.pending = n.next
+            }
+        }
+        if err != nil {
+            return err
+        }
+        check_session(tx, s, node, seq)
+    }
+    return nil
+}
+
+func check_session(tx *dtmclient.GlobalTx, s *Session, node int, seq int64) {
+    n := &s.nodes[node]
+    atomic.AddInt64(&nSessionChecks, 1)
+    if seq < n.read {
+        atomic.AddInt64(&nMonotonicReads, 1)
+        fmt.Printf("[session] worker %d reads %d on node %d after %d, snapshot %d\n",
+            s.worker, seq, node, n.read, tx.Snapshot)
+    } else if seq < n.written {
+        atomic.AddInt64(&nReadYourWrites, 1)
+        fmt.Printf("[session] worker %d reads %d on node %d though it has committed %d, snapshot %d\n",
+            s.worker, seq, node, n.written, tx.Snapshot)
+    }
+    if seq > n.read {
+        n.read = seq
+    }
+}
+
+// Once the attempt has ended the writes pending are committed, aborted or
+// in doubt, see transaction_outcome
+func session_outcome(s *Session, tx *dtmclient.GlobalTx, err error) {
+    if s == nil {
+        return
+    }
+    outcome := outcomeAborted
+    if tx != nil {
+        outcome = transaction_outcome(tx, err)
+    }
+    for node := range s.nodes {
+        n := &s.nodes[node]
+        if n.pending != 0 && outcome == outcomeCommitted {
+            n.written = n.pending
+        }
+        n.pending = 0
+    }
+}
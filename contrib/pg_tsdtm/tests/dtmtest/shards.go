@@ -0,0 +1,80 @@
+package dtmtest
+
+import (
+    "fmt"
+)
+
+// In sharded mode every account lives on exactly one node chosen by
+// multiplicative hash of its number. The same hash is computed by SQL in
+// shard_predicate(), keep them in sync.
+const shardHashMult = 2654435761
+
+// SQL condition selecting accounts of the shard
+func shard_predicate(shard int) string {
+    return column_shard_predicate("u", shard)
+}
+
+// The same for the keys in the column
+func column_shard_predicate(column string, shard int) string {
+    return fmt.Sprintf("(%s::bigint * %d) %% 4294967296 %% %d = %d",
+        column, shardHashMult, len(nodes), shard)
+}
+
+func shard_of(account int) int {
+    return int((uint64(account) * shardHashMult) % (1 << 32) % uint64(len(nodes)))
+}
+
+// The number of accounts in the whole cluster
+func total_accounts() int {
+    if cfg.Sharded {
+        return cfg.Accounts * len(nodes)
+    }
+    return cfg.Accounts
+}
+
+// Shards of the accounts from first up to last, counted up to n
+func range_shards(first int, last int, n int) int {
+    shards := make(map[int]bool)
+    for account := first; account < last && len(shards) < n; account++ {
+        shards[shard_of(account)] = true
+    }
+    return len(shards)
+}
+
+// Pick n accounts living on different shards: money leaves one shard
+// and comes to the others
+func pick_sharded(keys KeyChooser, n int) []int {
+    var accounts []int
+    shards := make(map[int]bool)
+    for len(accounts) < n {
+        account := keys.Next()
+        if !shards[shard_of(account)] {
+            shards[shard_of(account)] = true
+            accounts = append(accounts, account)
+        }
+    }
+    return accounts
+}
+
+// Every shard should hold exactly the accounts hashed to it
+func check_shards() int {
+    conns := connect_all()
+    defer close_all(conns)
+
+    expected := make([]int64, len(nodes))
+    for a := 0; a < total_accounts(); a++ {
+        expected[shard_of(a)]++
+    }
+
+    anomalies := 0
+    for i, conn := range conns {
+        count := execQuery(conn, "select count(*) from t")
+        strays := execQuery(conn, "select count(*) from t where not (" + shard_predicate(i) + ")")
+        if count != expected[i] || strays != 0 {
+            fmt.Printf("shard %d holds %d accounts (%d foreign), expected %d\n",
+                i, count, strays, expected[i])
+            anomalies++
+        }
+    }
+    return anomalies
+}
@@ -0,0 +1,50 @@
+package dtmtest
+
+import (
+    "fmt"
+    "os"
+    "os/signal"
+    "sync/atomic"
+    "syscall"
+    "time"
+)
+
+// Set by the first SIGINT or SIGTERM: workers finish the transactions they
+// have started and launch no more, the run then ends as usual with the
+// final checks and partial results. The second signal exits at once.
+var nInterrupts int32
+
+func interrupted() bool {
+    return atomic.LoadInt32(&nInterrupts) > 0
+}
+
+func handle_signals() {
+    signals := make(chan os.Signal, 2)
+    signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+    go func() {
+        for sig := range signals {
+            if atomic.AddInt32(&nInterrupts, 1) > 1 {
+                fmt.Printf("Got %v again, exiting without cleanup\n", sig)
+                os.Exit(130)
+            }
+            fmt.Printf("Got %v, finishing transactions in flight (%d), send it again to exit at once\n",
+                sig, atomic.LoadInt64(&nInFlight))
+        }
+    }()
+}
+
+// Sleep for d unless interrupted meanwhile, returns false if interrupted
+func sleep_interruptible(d time.Duration) bool {
+    deadline := time.Now().Add(d)
+    for !interrupted() {
+        left := deadline.Sub(time.Now())
+        if left <= 0 {
+            return true
+        }
+        if left > 100 * time.Millisecond {
+            left = 100 * time.Millisecond
+        }
+        time.Sleep(left)
+    }
+    return false
+}
@@ -0,0 +1,111 @@
+package dtmtest
+
+import (
+    "fmt"
+    osexec "os/exec"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+    "github.com/jackc/pgx"
+)
+
+// Clock skew between the servers while the workload runs. CSNs of pg_tsdtm
+// are timestamps of the local clocks, so whatever in the DTM takes clocks
+// for synchronized should show up as violations, lost commits of -history
+// or snapshot divergences when the clocks drift apart. Every -skew-interval
+// on average the clock of a random server is set by -skew-cmd off the true
+// time by up to -skew-max either way, e.g. through libfaketime or date
+// in a container of the node; all the clocks are set back once the run is
+// over. The offset the server then reports is printed next to the one
+// asked for, to tell that the command works.
+
+var skew struct {
+    sync.Mutex
+    changes int
+    max time.Duration   // the largest offset asked for
+}
+
+func skew_cmd(server int, offset time.Duration) string {
+    cmd := strings.Replace(cfg.SkewCmd, "%n", strconv.Itoa(server), -1)
+    return strings.Replace(cmd, "%o", strconv.FormatInt(int64(offset / time.Millisecond), 10), -1)
+}
+
+func run_skew_cmd(server int, offset time.Duration) bool {
+    cmd := skew_cmd(server, offset)
+    out, err := osexec.Command("sh", "-c", cmd).CombinedOutput()
+    if err != nil {
+        fmt.Printf("[skew] '%s' failed: %v\n%s", cmd, err, out)
+        return false
+    }
+    return true
+}
+
+// How far the clock of the node is off the clock of this process, by the
+// middle of the round trip
+func clock_offset(node int) (time.Duration, error) {
+    conn, err := pgx.Connect(nodes[node])
+    if err != nil {
+        return 0, err
+    }
+    defer conn.Close()
+    var epoch float64
+    start := time.Now()
+    if err = conn.QueryRow("select extract(epoch from clock_timestamp())::float8").Scan(&epoch); err != nil {
+        return 0, err
+    }
+    middle := start.Add(time.Since(start) / 2)
+    server := time.Unix(0, int64(epoch * 1e9))
+    return server.Sub(middle), nil
+}
+
+// Node of every server, the first one
+func server_nodes() []int {
+    var first []int
+    for node, server := range servers {
+        if server == len(first) {
+            first = append(first, node)
+        }
+    }
+    return first
+}
+
+// Set clocks off at random moments until stop is closed
+func skews(stop chan struct{}, wg *sync.WaitGroup) {
+    defer wg.Done()
+
+    r := new_rand("skews", 0)
+    first := server_nodes()
+    for {
+        delay := time.Duration(r.Int63n(2 * int64(cfg.SkewInterval)))
+        select {
+        case <-stop:
+            for server := range first {
+                run_skew_cmd(server, 0)
+            }
+            fmt.Printf("[skew] %d clock changes, offsets up to %v\n", skew.changes, skew.max)
+            return
+        case <-time.After(delay):
+        }
+
+        server := r.Intn(len(first))
+        offset := time.Duration(r.Int63n(2 * int64(cfg.SkewMax) + 1)) - cfg.SkewMax
+        if !run_skew_cmd(server, offset) {
+            continue
+        }
+        skew.Lock()
+        skew.changes++
+        if offset > skew.max {
+            skew.max = offset
+        } else if -offset > skew.max {
+            skew.max = -offset
+        }
+        skew.Unlock()
+        if seen, err := clock_offset(first[server]); err == nil {
+            fmt.Printf("[skew] server %d set off by %v, reports %v\n",
+                server, offset, seen.Truncate(time.Millisecond))
+        } else {
+            fmt.Printf("[skew] server %d set off by %v, can not read its clock: %v\n", server, offset, err)
+        }
+    }
+}
@@ -0,0 +1,56 @@
+package dtmtest
+
+import (
+    "fmt"
+    "sync/atomic"
+    "github.com/digoal/postgres_cluster/contrib/pg_tsdtm/tests/dtmclient"
+)
+
+// Divergences found by -check-snapshots: participants of one global
+// transaction should work with the same snapshot and commit it with the
+// same CSN
+var nDivergences int64
+
+func diverged(format string, args ...interface{}) {
+    atomic.AddInt64(&nDivergences, 1)
+    fmt.Printf("[snapshots] divergence: " + format + "\n", args...)
+}
+
+// Snapshot adopted by every participant should be that of the coordinator
+func check_snapshots(tx *dtmclient.GlobalTx, order []int) {
+    for i, snapshot := range tx.Snapshots {
+        if snapshot != tx.Snapshots[0] {
+            diverged("transaction '%s' got snapshot %d on node %d but %d on coordinator node %d (%v)",
+                tx.Gid, snapshot, order[i], tx.Snapshots[0], order[0], tx.Snapshots)
+        }
+    }
+}
+
+// Local xid of the transaction on every participant, dtm_get_csn() takes
+// them as integer
+func local_xids(tx *dtmclient.GlobalTx) ([]int32, error) {
+    xids := make([]int32, len(tx.Participants()))
+    for i := range xids {
+        err := tx.QueryRow(i, "select (txid_current() % 4294967296)::bit(32)::int").Scan(&xids[i])
+        if err != nil {
+            return nil, err
+        }
+    }
+    return xids, nil
+}
+
+// After commit every participant should know the transaction under the
+// CSN participants have voted for
+func check_csns(tx *dtmclient.GlobalTx, order []int, xids []int32) {
+    for i, conn := range tx.Participants() {
+        var csn int64
+        if err := conn.QueryRow("select dtm_get_csn($1)", xids[i]).Scan(&csn); err != nil {
+            fmt.Printf("[snapshots] failed to get CSN of '%s' on node %d: %v\n", tx.Gid, order[i], err)
+            continue
+        }
+        if csn != tx.Csn {
+            diverged("transaction '%s' (xid %d) committed with CSN %d on node %d instead of %d, snapshot %d",
+                tx.Gid, uint32(xids[i]), csn, order[i], tx.Csn, tx.Snapshot)
+        }
+    }
+}
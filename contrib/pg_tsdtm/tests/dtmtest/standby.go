@@ -0,0 +1,90 @@
+package dtmtest
+
+import (
+    "fmt"
+    "sync/atomic"
+    "time"
+    "github.com/jackc/pgx"
+    "github.com/digoal/postgres_cluster/contrib/pg_tsdtm/tests/dtmclient"
+)
+
+// Hot standbys of every node, see "standbys" in the cluster config
+var standbys [][]pgx.ConnConfig
+
+// With -standby-reads totalrep reads every node sum again on the standbys
+// of the node under the same global snapshot it has just read the
+// primaries with. Replicated visibility should match that of the primary:
+// the sums should be the same once the standby has replayed up to the
+// snapshot, so a mismatch is only counted if it lasts standbyLagTimeout.
+const standbyLagTimeout = 5 * time.Second
+
+var nStandbyReads int64
+var nStandbyMismatches int64
+
+type Standby struct {
+    Node int
+    Index int
+    Conn *pgx.Conn
+}
+
+// Direct connections to all standbys, unreachable ones are reported and
+// skipped
+func connect_standbys() []Standby {
+    var conns []Standby
+    for node, replicas := range standbys {
+        for i, replica := range replicas {
+            conn, err := pgx.Connect(replica)
+            if err != nil {
+                fmt.Printf("[standby] standby %d of node %d is unreachable: %v\n", i, node, err)
+                continue
+            }
+            conns = append(conns, Standby{node, i, conn})
+        }
+    }
+    return conns
+}
+
+func close_standbys(conns []Standby) {
+    for _, s := range conns {
+        s.Conn.Close()
+    }
+}
+
+// Sum of the node on the standby under a snapshot taken on the primaries
+func standby_sum(s Standby, snapshot int64) (sum int64, err error) {
+    tx, err := dtmclient.BeginAt(s.Conn, snapshot, dtmclient.RepeatableRead)
+    if err != nil {
+        return 0, err
+    }
+    if err = tx.QueryRow(0, workload.(Balanced).TotalQuery()).Scan(&sum); err != nil {
+        tx.Rollback()
+        return 0, err
+    }
+    return sum, tx.Commit()
+}
+
+// Compare sums of the primaries with those of their standbys
+func check_standbys(conns []Standby, snapshot int64, sums []int64) {
+    for _, s := range conns {
+        deadline := time.Now().Add(standbyLagTimeout)
+        for {
+            sum, err := standby_sum(s, snapshot)
+            atomic.AddInt64(&nStandbyReads, 1)
+            if err == nil && sum == sums[s.Node] {
+                break
+            }
+            if time.Now().After(deadline) {
+                atomic.AddInt64(&nStandbyMismatches, 1)
+                if err != nil {
+                    fmt.Printf("[standby] standby %d of node %d failed to read snapshot %d: %v\n",
+                        s.Index, s.Node, snapshot, err)
+                } else {
+                    fmt.Printf("[standby] mismatch: standby %d of node %d sees sum=%d under snapshot %d, primary %d\n",
+                        s.Index, s.Node, sum, snapshot, sums[s.Node])
+                }
+                break
+            }
+            time.Sleep(100 * time.Millisecond)
+        }
+    }
+}
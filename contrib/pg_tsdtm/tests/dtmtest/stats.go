@@ -0,0 +1,718 @@
+package dtmtest
+
+import (
+    "encoding/json"
+    "fmt"
+    "math/bits"
+    "sync"
+    "sync/atomic"
+    "time"
+    "github.com/digoal/postgres_cluster/contrib/pg_tsdtm/tests/dtmclient"
+)
+
+// HDR-style latency histogram with microsecond resolution: values below
+// 2*subBuckets microseconds are exact, larger ones are kept with
+// 1/subBuckets relative precision.
+const subBuckets = 64
+
+type Histogram struct {
+    counts []int64
+    count int64
+    sum time.Duration
+    max time.Duration
+}
+
+func bucket_of(us uint64) int {
+    if us < 2*subBuckets {
+        return int(us)
+    }
+    shift := bits.Len64(us) - 7
+    return shift*subBuckets + int(us>>uint(shift))
+}
+
+// The highest value that falls into the bucket
+func bucket_value(idx int) time.Duration {
+    if idx < 2*subBuckets {
+        return time.Duration(idx) * time.Microsecond
+    }
+    shift := uint(idx/subBuckets - 1)
+    us := (uint64(idx%subBuckets+subBuckets) << shift) + (1 << shift) - 1
+    return time.Duration(us) * time.Microsecond
+}
+
+func (h *Histogram) Record(d time.Duration) {
+    if d < 0 {
+        d = 0
+    }
+    idx := bucket_of(uint64(d / time.Microsecond))
+    if idx >= len(h.counts) {
+        counts := make([]int64, idx+1)
+        copy(counts, h.counts)
+        h.counts = counts
+    }
+    h.counts[idx]++
+    h.count++
+    h.sum += d
+    if d > h.max {
+        h.max = d
+    }
+}
+
+func (h *Histogram) Merge(other *Histogram) {
+    if len(other.counts) > len(h.counts) {
+        counts := make([]int64, len(other.counts))
+        copy(counts, h.counts)
+        h.counts = counts
+    }
+    for i, c := range other.counts {
+        h.counts[i] += c
+    }
+    h.count += other.count
+    h.sum += other.sum
+    if other.max > h.max {
+        h.max = other.max
+    }
+}
+
+// Histograms are saved as they are by checkpoints
+type histogramJSON struct {
+    Counts []int64 `json:"counts"`
+    Count int64 `json:"count"`
+    Sum time.Duration `json:"sum"`
+    Max time.Duration `json:"max"`
+}
+
+func (h Histogram) MarshalJSON() ([]byte, error) {
+    return json.Marshal(histogramJSON{h.counts, h.count, h.sum, h.max})
+}
+
+func (h *Histogram) UnmarshalJSON(data []byte) error {
+    var j histogramJSON
+    if err := json.Unmarshal(data, &j); err != nil {
+        return err
+    }
+    *h = Histogram{j.Counts, j.Count, j.Sum, j.Max}
+    return nil
+}
+
+func (h *Histogram) Count() int64 {
+    return h.count
+}
+
+func (h *Histogram) Max() time.Duration {
+    return h.max
+}
+
+func (h *Histogram) Mean() time.Duration {
+    if h.count == 0 {
+        return 0
+    }
+    return h.sum / time.Duration(h.count)
+}
+
+// Percentile returns the latency below which p percent of values fall
+func (h *Histogram) Percentile(p float64) time.Duration {
+    if h.count == 0 {
+        return 0
+    }
+    rank := int64(p / 100 * float64(h.count) + 0.5)
+    if rank < 1 {
+        rank = 1
+    }
+    var seen int64
+    for i, c := range h.counts {
+        seen += c
+        if seen >= rank {
+            v := bucket_value(i)
+            if v > h.max {
+                return h.max
+            }
+            return v
+        }
+    }
+    return h.max
+}
+
+func (h *Histogram) Summary(elapsed time.Duration) string {
+    return fmt.Sprintf(
+        "%d trans, %0.2f tps, latency p50=%v p95=%v p99=%v max=%v",
+        h.count, float64(h.count)/elapsed.Seconds(),
+        h.Percentile(50), h.Percentile(95), h.Percentile(99), h.max,
+    )
+}
+
+// Latencies of all global transactions performed by the workers
+type Stats struct {
+    sync.Mutex
+    start time.Time
+    total Histogram
+    interval Histogram
+    level Histogram
+    lag Histogram
+    gcFree Histogram
+    gcPauses Histogram
+    gcHit int64
+    snapshots Histogram
+    reads Histogram
+    readSnapshots Histogram
+    writeSnapshots Histogram
+    deadlocks Histogram
+    locks Histogram
+    hotWaits Histogram
+    bursts Histogram
+    burstSerial time.Duration
+    dtm Histogram
+    dtmLatency time.Duration
+    levelDtm, levelLatency time.Duration
+    lockDeadlocks int64
+    coordinators []Histogram
+    nodes []NodeStats
+    phases map[string]*Histogram
+    operations map[string]*Histogram
+    isolation map[string]*IsolationStats
+}
+
+// Share of one node in the run
+type NodeStats struct {
+    Transactions Histogram  // latency of committed transactions the node took part in
+    Statements Histogram    // latency of statements executed on the node
+    Errors int64            // failed statements and commit steps on the node
+}
+
+var stats Stats
+
+// Reset forgets everything recorded so far and starts measuring anew
+func (s *Stats) Reset() {
+    s.Lock()
+    s.start = time.Now()
+    s.total = Histogram{}
+    s.interval = Histogram{}
+    s.level = Histogram{}
+    s.lag = Histogram{}
+    s.gcFree = Histogram{}
+    s.gcPauses = Histogram{}
+    s.gcHit = 0
+    s.snapshots = Histogram{}
+    s.reads = Histogram{}
+    s.readSnapshots = Histogram{}
+    s.writeSnapshots = Histogram{}
+    s.deadlocks = Histogram{}
+    s.locks = Histogram{}
+    s.hotWaits = Histogram{}
+    s.bursts = Histogram{}
+    s.burstSerial = 0
+    s.dtm = Histogram{}
+    s.dtmLatency = 0
+    s.levelDtm, s.levelLatency = 0, 0
+    s.lockDeadlocks = 0
+    s.coordinators = nil
+    s.nodes = nil
+    s.phases = make(map[string]*Histogram)
+    s.operations = make(map[string]*Histogram)
+    s.isolation = make(map[string]*IsolationStats)
+    s.Unlock()
+}
+
+// Everything recorded but the pauses of the collector, which are those
+// of the process, see -checkpoint
+type StatsState struct {
+    Elapsed time.Duration `json:"elapsed"`
+    Total Histogram `json:"total"`
+    Lag Histogram `json:"lag"`
+    Snapshots Histogram `json:"snapshots"`
+    Reads Histogram `json:"reads"`
+    ReadSnapshots Histogram `json:"read_snapshots"`
+    WriteSnapshots Histogram `json:"write_snapshots"`
+    Deadlocks Histogram `json:"deadlocks"`
+    Locks Histogram `json:"locks"`
+    HotWaits Histogram `json:"hot_waits"`
+    Bursts Histogram `json:"bursts"`
+    BurstSerial time.Duration `json:"burst_serial"`
+    Dtm Histogram `json:"dtm"`
+    DtmLatency time.Duration `json:"dtm_latency"`
+    LockDeadlocks int64 `json:"lock_deadlocks"`
+    Coordinators []Histogram `json:"coordinators"`
+    Nodes []NodeStats `json:"nodes"`
+    Phases map[string]Histogram `json:"phases"`
+    Operations map[string]Histogram `json:"operations"`
+    Isolation map[string]IsolationStats `json:"isolation"`
+}
+
+func (s *Stats) State() StatsState {
+    s.Lock()
+    defer s.Unlock()
+    // the counts of histograms go on changing once unlocked
+    dup := func(h *Histogram) Histogram {
+        c := Histogram{}
+        c.Merge(h)
+        return c
+    }
+    st := StatsState{
+        Elapsed: time.Since(s.start),
+        Total: dup(&s.total),
+        Lag: dup(&s.lag),
+        Snapshots: dup(&s.snapshots),
+        Reads: dup(&s.reads),
+        ReadSnapshots: dup(&s.readSnapshots),
+        WriteSnapshots: dup(&s.writeSnapshots),
+        Deadlocks: dup(&s.deadlocks),
+        Locks: dup(&s.locks),
+        HotWaits: dup(&s.hotWaits),
+        Bursts: dup(&s.bursts),
+        BurstSerial: s.burstSerial,
+        Dtm: dup(&s.dtm),
+        DtmLatency: s.dtmLatency,
+        LockDeadlocks: s.lockDeadlocks,
+        Phases: make(map[string]Histogram),
+        Operations: make(map[string]Histogram),
+        Isolation: make(map[string]IsolationStats),
+    }
+    for i := range s.coordinators {
+        st.Coordinators = append(st.Coordinators, dup(&s.coordinators[i]))
+    }
+    for i := range s.nodes {
+        n := &s.nodes[i]
+        st.Nodes = append(st.Nodes, NodeStats{dup(&n.Transactions), dup(&n.Statements), n.Errors})
+    }
+    for phase, h := range s.phases {
+        st.Phases[phase] = dup(h)
+    }
+    for op, h := range s.operations {
+        st.Operations[op] = dup(h)
+    }
+    for level, is := range s.isolation {
+        st.Isolation[level] = *is
+    }
+    return st
+}
+
+// Go on from the state saved by another process as if the time since
+// had not passed
+func (s *Stats) Restore(st StatsState) {
+    s.Lock()
+    defer s.Unlock()
+    s.start = time.Now().Add(-st.Elapsed)
+    s.total = st.Total
+    s.lag = st.Lag
+    s.snapshots = st.Snapshots
+    s.reads = st.Reads
+    s.readSnapshots = st.ReadSnapshots
+    s.writeSnapshots = st.WriteSnapshots
+    s.deadlocks = st.Deadlocks
+    s.locks = st.Locks
+    s.hotWaits = st.HotWaits
+    s.bursts = st.Bursts
+    s.burstSerial = st.BurstSerial
+    s.dtm = st.Dtm
+    s.dtmLatency = st.DtmLatency
+    s.lockDeadlocks = st.LockDeadlocks
+    s.coordinators = st.Coordinators
+    s.nodes = st.Nodes
+    for phase, h := range st.Phases {
+        copy := h
+        s.phases[phase] = &copy
+    }
+    for op, h := range st.Operations {
+        copy := h
+        s.operations[op] = &copy
+    }
+    for level, is := range st.Isolation {
+        copy := is
+        s.isolation[level] = &copy
+    }
+}
+
+// Start returns the moment of the last Reset
+func (s *Stats) Start() time.Time {
+    s.Lock()
+    defer s.Unlock()
+    return s.start
+}
+
+func (s *Stats) Record(d time.Duration) {
+    s.Lock()
+    s.total.Record(d)
+    s.interval.Record(d)
+    s.level.Record(d)
+    s.Unlock()
+}
+
+// How late a transaction has started after its slot of the -rate schedule
+func (s *Stats) RecordLag(d time.Duration) {
+    s.Lock()
+    s.lag.Record(d)
+    s.Unlock()
+}
+
+func (s *Stats) Lag() Histogram {
+    s.Lock()
+    defer s.Unlock()
+    h := Histogram{}
+    h.Merge(&s.lag)
+    return h
+}
+
+// Latency of a committed transaction less the time the Go collector has
+// stopped the process for meanwhile
+func (s *Stats) RecordGc(d time.Duration, paused time.Duration) {
+    s.Lock()
+    s.gcFree.Record(d - paused)
+    if paused > 0 {
+        s.gcHit++
+    }
+    s.Unlock()
+}
+
+// Pause of a cycle of the Go collector
+func (s *Stats) RecordGcPause(d time.Duration) {
+    s.Lock()
+    s.gcPauses.Record(d)
+    s.Unlock()
+}
+
+// Gc returns latencies without GC pauses, the pauses and the number of
+// transactions they have hit
+func (s *Stats) Gc() (gcFree Histogram, pauses Histogram, hit int64) {
+    s.Lock()
+    defer s.Unlock()
+    gcFree.Merge(&s.gcFree)
+    pauses.Merge(&s.gcPauses)
+    return gcFree, pauses, s.gcHit
+}
+
+// Time spent in obtaining global snapshots
+func (s *Stats) RecordSnapshot(d time.Duration) {
+    s.Lock()
+    s.snapshots.Record(d)
+    s.Unlock()
+}
+
+func (s *Stats) Snapshots() Histogram {
+    s.Lock()
+    defer s.Unlock()
+    h := Histogram{}
+    h.Merge(&s.snapshots)
+    return h
+}
+
+// Latency of a committed read-only transaction of -read-pct and the time
+// it spent on its global snapshot
+func (s *Stats) RecordRead(d time.Duration, snapshot time.Duration) {
+    s.Lock()
+    s.reads.Record(d)
+    s.readSnapshots.Record(snapshot)
+    s.Unlock()
+}
+
+// Time committed writing transactions spent on their global snapshots
+func (s *Stats) RecordWriteSnapshot(d time.Duration) {
+    s.Lock()
+    s.writeSnapshots.Record(d)
+    s.Unlock()
+}
+
+// Reads returns latencies of read-only transactions, of their snapshots
+// and of snapshots of writing transactions
+func (s *Stats) Reads() (reads Histogram, readSnapshots Histogram, writeSnapshots Histogram) {
+    s.Lock()
+    defer s.Unlock()
+    reads.Merge(&s.reads)
+    readSnapshots.Merge(&s.readSnapshots)
+    writeSnapshots.Merge(&s.writeSnapshots)
+    return
+}
+
+// Time from the beginning of a transaction until it was aborted because
+// of deadlock or lock timeout
+func (s *Stats) RecordDeadlock(d time.Duration) {
+    s.Lock()
+    s.deadlocks.Record(d)
+    s.Unlock()
+}
+
+func (s *Stats) Deadlocks() Histogram {
+    s.Lock()
+    defer s.Unlock()
+    h := Histogram{}
+    h.Merge(&s.deadlocks)
+    return h
+}
+
+// Time spent in locking all accounts of a transaction, see -for-update
+func (s *Stats) RecordLocks(d time.Duration) {
+    s.Lock()
+    s.locks.Record(d)
+    s.Unlock()
+}
+
+func (s *Stats) Locks() Histogram {
+    s.Lock()
+    defer s.Unlock()
+    h := Histogram{}
+    h.Merge(&s.locks)
+    return h
+}
+
+// Time an update of the hotrow workload took, mostly waiting for the lock
+func (s *Stats) RecordHotWait(d time.Duration) {
+    s.Lock()
+    s.hotWaits.Record(d)
+    s.Unlock()
+}
+
+func (s *Stats) HotWaits() Histogram {
+    s.Lock()
+    defer s.Unlock()
+    h := Histogram{}
+    h.Merge(&s.hotWaits)
+    return h
+}
+
+// Commit of a burst of the group workload: how long it took and how long
+// its transactions took together
+func (s *Stats) RecordBurst(d time.Duration, serial time.Duration) {
+    s.Lock()
+    s.bursts.Record(d)
+    s.burstSerial += serial
+    s.Unlock()
+}
+
+func (s *Stats) Bursts() (Histogram, time.Duration) {
+    s.Lock()
+    defer s.Unlock()
+    h := Histogram{}
+    h.Merge(&s.bursts)
+    return h, s.burstSerial
+}
+
+// Time a committed transaction spent in pg_dtm calls, retries included,
+// and its whole latency, see -dtm-profile
+func (s *Stats) RecordDtm(d time.Duration, latency time.Duration) {
+    s.Lock()
+    s.dtm.Record(d)
+    s.dtmLatency += latency
+    s.levelDtm += d
+    s.levelLatency += latency
+    s.Unlock()
+}
+
+func (s *Stats) Dtm() (Histogram, time.Duration) {
+    s.Lock()
+    defer s.Unlock()
+    h := Histogram{}
+    h.Merge(&s.dtm)
+    return h, s.dtmLatency
+}
+
+// Share of pg_dtm calls in the latency since the previous call
+func (s *Stats) LevelDtm() float64 {
+    s.Lock()
+    defer s.Unlock()
+    share := dtm_share(s.levelDtm, s.levelLatency)
+    s.levelDtm, s.levelLatency = 0, 0
+    return share
+}
+
+// Deadlocks hit while locking the accounts rather than updating them
+func (s *Stats) RecordLockDeadlock() {
+    s.Lock()
+    s.lockDeadlocks++
+    s.Unlock()
+}
+
+func (s *Stats) LockDeadlocks() int64 {
+    s.Lock()
+    defer s.Unlock()
+    return s.lockDeadlocks
+}
+
+// Latency of committed attempts by the node which coordinated them
+func (s *Stats) RecordCoordinator(node int, d time.Duration) {
+    s.Lock()
+    for len(s.coordinators) <= node {
+        s.coordinators = append(s.coordinators, Histogram{})
+    }
+    s.coordinators[node].Record(d)
+    s.Unlock()
+}
+
+func (s *Stats) Coordinators() []Histogram {
+    s.Lock()
+    defer s.Unlock()
+    hs := make([]Histogram, len(s.coordinators))
+    for i := range s.coordinators {
+        hs[i].Merge(&s.coordinators[i])
+    }
+    return hs
+}
+
+// Called with the lock held
+func (s *Stats) node(node int) *NodeStats {
+    for len(s.nodes) <= node {
+        s.nodes = append(s.nodes, NodeStats{})
+    }
+    return &s.nodes[node]
+}
+
+func (s *Stats) RecordNodeTransaction(node int, d time.Duration) {
+    s.Lock()
+    s.node(node).Transactions.Record(d)
+    s.Unlock()
+}
+
+func (s *Stats) RecordNodeStatement(node int, d time.Duration) {
+    s.Lock()
+    s.node(node).Statements.Record(d)
+    s.Unlock()
+}
+
+func (s *Stats) RecordNodeError(node int) {
+    s.Lock()
+    s.node(node).Errors++
+    s.Unlock()
+}
+
+// Nodes returns a copy of per-node statistics indexed by node number
+func (s *Stats) Nodes() []NodeStats {
+    s.Lock()
+    defer s.Unlock()
+    ns := make([]NodeStats, len(nodes))
+    for i := range s.nodes {
+        ns[i].Transactions.Merge(&s.nodes[i].Transactions)
+        ns[i].Statements.Merge(&s.nodes[i].Statements)
+        ns[i].Errors = s.nodes[i].Errors
+    }
+    return ns
+}
+
+// Time of every step of the transaction on every participant, by phase
+func (s *Stats) RecordPhases(spans []dtmclient.Span) {
+    s.Lock()
+    for _, span := range spans {
+        h := s.phases[span.Phase]
+        if h == nil {
+            h = &Histogram{}
+            s.phases[span.Phase] = h
+        }
+        h.Record(span.Duration)
+    }
+    s.Unlock()
+}
+
+func (s *Stats) Phases() map[string]Histogram {
+    s.Lock()
+    defer s.Unlock()
+    phases := make(map[string]Histogram)
+    for phase, h := range s.phases {
+        var copy Histogram
+        copy.Merge(h)
+        phases[phase] = copy
+    }
+    return phases
+}
+
+// Latency of a committed operation of the ycsb workload, retries included
+func (s *Stats) RecordOperation(op string, d time.Duration) {
+    s.Lock()
+    h := s.operations[op]
+    if h == nil {
+        h = &Histogram{}
+        s.operations[op] = h
+    }
+    h.Record(d)
+    s.Unlock()
+}
+
+func (s *Stats) Operations() map[string]Histogram {
+    s.Lock()
+    defer s.Unlock()
+    operations := make(map[string]Histogram)
+    for op, h := range s.operations {
+        var copy Histogram
+        copy.Merge(h)
+        operations[op] = copy
+    }
+    return operations
+}
+
+// Outcome of an attempt of transaction with the isolation level, class is
+// that of classify()
+func (s *Stats) RecordIsolation(level string, class int) {
+    s.Lock()
+    is := s.isolation[level]
+    if is == nil {
+        is = &IsolationStats{}
+        s.isolation[level] = is
+    }
+    switch class {
+    case errNone:
+        is.Commits++
+    case errRetry:
+        is.Retries++
+    default:
+        is.Aborts++
+    }
+    s.Unlock()
+}
+
+func (s *Stats) Isolation() map[string]IsolationStats {
+    s.Lock()
+    defer s.Unlock()
+    levels := make(map[string]IsolationStats)
+    for level, is := range s.isolation {
+        levels[level] = *is
+    }
+    return levels
+}
+
+// Interval returns the latencies recorded since the previous call
+func (s *Stats) Interval() Histogram {
+    s.Lock()
+    h := s.interval
+    s.interval = Histogram{}
+    s.Unlock()
+    return h
+}
+
+// Level returns the latencies recorded since the previous call, like
+// Interval but for the steps of -ramp-step
+func (s *Stats) Level() Histogram {
+    s.Lock()
+    h := s.level
+    s.level = Histogram{}
+    s.Unlock()
+    return h
+}
+
+func (s *Stats) Total() Histogram {
+    s.Lock()
+    defer s.Unlock()
+    h := Histogram{}
+    h.Merge(&s.total)
+    return h
+}
+
+// Called when -warmup is over: throughput, latencies and error counters
+// are measured from now on. Invariant violations are kept, they are not
+// less wrong during the warm-up.
+func end_warmup() {
+    stats.Reset()
+    atomic.StoreInt64(&nAborts, 0)
+    atomic.StoreInt64(&nRetries, 0)
+    atomic.StoreInt64(&nRollbacks, 0)
+    atomic.StoreInt64(&nBulkRows, 0)
+    atomic.StoreInt64(&nCopyRows, 0)
+    atomic.StoreInt64(&nGroupTimeouts, 0)
+    atomic.StoreInt64(&nTpccNewOrders, 0)
+    atomic.StoreInt64(&nTpccPayments, 0)
+    atomic.StoreInt64(&nTpccOrderStatus, 0)
+    atomic.StoreInt64(&nTpccRemote, 0)
+    atomic.StoreInt64(&nStatementTimeouts, 0)
+    atomic.StoreInt64(&nLockTimeouts, 0)
+    atomic.StoreInt64(&nIdleTimeouts, 0)
+    atomic.StoreInt64(&nGlobalDeadlocks, 0)
+    atomic.StoreInt64(&nDeadlockVictims, 0)
+    reset_worker_attempts()
+    fmt.Println("Warm-up is over, measuring")
+}
+
@@ -0,0 +1,230 @@
+package dtmtest
+
+import (
+    "encoding/json"
+    "fmt"
+    "os"
+    "strings"
+    "github.com/jackc/pgx"
+    "github.com/digoal/postgres_cluster/contrib/pg_tsdtm/tests/dtmclient"
+)
+
+// Transfers described by a template, see -template and
+// transfers/template.json for an example. Every transfer runs the
+// statements of the "src" role on the node money is taken from and those
+// of the "dst" role on the node it goes to, so that a transaction may
+// touch many tables on every participant.
+//
+// Arguments of statements are named:
+//  account - account chosen for the role
+//  delta   - amount for the role, negative for "src"
+//  gtid    - global transaction id
+//  worker  - id of the worker
+// Setup and check statements get the number of accounts per node as $1 and
+// the initial amount as $2, if they refer to parameters at all.
+type Template struct {
+    // Run on every node before the workers start
+    Setup []string `json:"setup"`
+    Statements []TemplateStatement `json:"statements"`
+    // Amount of money on the node, the sum over all nodes should not
+    // change during the run
+    Total string `json:"total"`
+    // Every check should return 0 on every node after the run
+    Checks []string `json:"checks"`
+    Teardown []string `json:"teardown"`
+}
+
+type TemplateStatement struct {
+    Role string `json:"role"`
+    SQL string `json:"sql"`
+    Args []string `json:"args"`
+}
+
+// Used when -template is not given: accounts with audit log and history
+// of balances
+var bankTemplate = Template{
+    Setup: []string{
+        "drop table if exists accounts, audit, history",
+        "create table accounts(id int primary key, balance bigint)",
+        "insert into accounts (select generate_series(0, $1 - 1), $2)",
+        "create table audit(gtid text, worker int, account int, delta int, at timestamptz default now())",
+        "create table history(account int, balance bigint, at timestamptz default now())",
+    },
+    Statements: []TemplateStatement{
+        {"src", "update accounts set balance = balance + $1 where id = $2", []string{"delta", "account"}},
+        {"src", "insert into audit(gtid, worker, account, delta) values ($1, $2, $3, $4)",
+            []string{"gtid", "worker", "account", "delta"}},
+        {"src", "insert into history(account, balance) select id, balance from accounts where id = $1",
+            []string{"account"}},
+        {"dst", "update accounts set balance = balance + $1 where id = $2", []string{"delta", "account"}},
+        {"dst", "insert into audit(gtid, worker, account, delta) values ($1, $2, $3, $4)",
+            []string{"gtid", "worker", "account", "delta"}},
+        {"dst", "insert into history(account, balance) select id, balance from accounts where id = $1",
+            []string{"account"}},
+    },
+    Total: "select sum(balance) from accounts",
+    Checks: []string{
+        // the audit log explains every balance
+        "select count(*) from accounts a where balance <> $2 + " +
+        "coalesce((select sum(delta) from audit where account = a.id), 0)",
+        // every committed update left its trace in the history
+        "select (select count(*) from audit) - (select count(*) from history)",
+    },
+    Teardown: []string{"drop table if exists accounts, audit, history"},
+}
+
+type TemplateWorkload struct {
+    tmpl Template
+    expected int64
+}
+
+func init() {
+    register_workload("template", func() Workload {
+        return &TemplateWorkload{tmpl: load_template(cfg.TemplatePath)}
+    })
+}
+
+func load_template(path string) Template {
+    if path == "" {
+        return bankTemplate
+    }
+    f, err := os.Open(path)
+    checkErr(err)
+    defer f.Close()
+
+    var tmpl Template
+    checkErr(json.NewDecoder(f).Decode(&tmpl))
+    if tmpl.Total == "" {
+        fmt.Printf("ERROR: template %s has no total query\n", path)
+        os.Exit(1)
+    }
+    for _, st := range tmpl.Statements {
+        if st.Role != "src" && st.Role != "dst" {
+            fmt.Printf("ERROR: unknown role '%s' in template %s\n", st.Role, path)
+            os.Exit(1)
+        }
+        for _, arg := range st.Args {
+            switch arg {
+            case "account", "delta", "gtid", "worker":
+            default:
+                fmt.Printf("ERROR: unknown argument '%s' in template %s\n", arg, path)
+                os.Exit(1)
+            }
+        }
+    }
+    return tmpl
+}
+
+// Parameters are only passed to statements referring to them, otherwise
+// the server complains about their number
+func exec_template(conn *pgx.Conn, sql string) {
+    if strings.Contains(sql, "$") {
+        exec(conn, sql, cfg.Accounts, cfg.InitAmount)
+    } else {
+        exec(conn, sql)
+    }
+}
+
+// The total is what the setup has created, whatever it is
+func (t *TemplateWorkload) ExpectedTotal() int64 {
+    return t.expected
+}
+
+func (t *TemplateWorkload) TotalQuery() string {
+    return t.tmpl.Total
+}
+
+func (t *TemplateWorkload) Setup(conns []*pgx.Conn) {
+    create_extension(conns)
+    for _, conn := range conns {
+        for _, sql := range t.tmpl.Setup {
+            exec_template(conn, sql)
+        }
+    }
+    t.Attach(conns)
+}
+
+// Transfers keep the total as it is, whatever it is now
+func (t *TemplateWorkload) Attach(conns []*pgx.Conn) {
+    sums, _, err := node_sums(conns)
+    checkErr(err)
+    t.expected = 0
+    for _, sum := range sums {
+        t.expected += sum
+    }
+}
+
+func (t *TemplateWorkload) Iteration(w *Worker) error {
+    amount := 2*w.Rand.Intn(2) - 1
+    src := w.Rand.Intn(len(w.Conns))
+    dst := w.Rand.Intn(len(w.Conns) - 1)
+    if dst >= src {
+        dst++
+    }
+    roles := map[string]struct{ node, account, delta int }{
+        "src": {src, w.Keys.Next(), -amount},
+        "dst": {dst, w.Keys.Next(), amount},
+    }
+
+    return w.Transaction(func(gtid string) (*dtmclient.GlobalTx, error) {
+        tx, err := begin_global([]*pgx.Conn{w.Conns[src], w.Conns[dst]}, gtid, w.Isolation)
+        if err != nil {
+            return nil, err
+        }
+        for _, st := range t.tmpl.Statements {
+            role := roles[st.Role]
+            args := make([]interface{}, len(st.Args))
+            for i, arg := range st.Args {
+                switch arg {
+                case "account":
+                    args[i] = role.account
+                case "delta":
+                    args[i] = role.delta
+                case "gtid":
+                    args[i] = gtid
+                case "worker":
+                    args[i] = w.Id
+                }
+            }
+            participant := 0
+            if st.Role == "dst" {
+                participant = 1
+            }
+            if _, err = tx.Exec(participant, st.SQL, args...); err != nil {
+                tx.Rollback()
+                return nil, err
+            }
+        }
+        if !cfg.Use2PC {
+            return tx, tx.CommitLocal()
+        }
+        return tx, tx.Commit()
+    })
+}
+
+func (t *TemplateWorkload) Verify(conns []*pgx.Conn) int {
+    anomalies := 0
+    for i, conn := range conns {
+        for _, sql := range t.tmpl.Checks {
+            var n int64
+            if strings.Contains(sql, "$") {
+                n = execQuery(conn, sql, cfg.Accounts, cfg.InitAmount)
+            } else {
+                n = execQuery(conn, sql)
+            }
+            if n != 0 {
+                fmt.Printf("Template check failed on node %d: '%s' returned %d\n", i, sql, n)
+                anomalies++
+            }
+        }
+    }
+    return anomalies
+}
+
+func (t *TemplateWorkload) Teardown(conns []*pgx.Conn) {
+    for _, conn := range conns {
+        for _, sql := range t.tmpl.Teardown {
+            exec_template(conn, sql)
+        }
+    }
+}
@@ -0,0 +1,28 @@
+package dtmtest
+
+import (
+    "math/rand"
+    "time"
+)
+
+// Think time emulates interactive sessions, whose user reads the screen
+// between transactions, see -think-time, and between statements of one,
+// see -statement-think-time. With the latter global transactions stay
+// open and idle most of the time, holding their snapshots and locks, so
+// that DTM is tested with many of them in progress at once. Every pause
+// is drawn uniformly from (1 - jitter) to (1 + jitter) of its mean, see
+// -think-jitter. Latency of transactions includes the pauses between
+// their statements.
+
+// Pause for about mean, returns false if interrupted meanwhile
+func think(mean time.Duration) bool {
+    if mean <= 0 {
+        return true
+    }
+    d := mean
+    if cfg.ThinkJitter > 0 {
+        // workers do not share their own generators
+        d = time.Duration(float64(mean) * (1 + cfg.ThinkJitter * (2*rand.Float64() - 1)))
+    }
+    return sleep_interruptible(d)
+}
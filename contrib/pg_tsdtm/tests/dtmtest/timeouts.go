@@ -0,0 +1,64 @@
+package dtmtest
+
+import (
+    "fmt"
+    "strings"
+    "sync/atomic"
+    "time"
+    "github.com/jackc/pgx"
+)
+
+// Timeouts of the sessions of the harness, see -statement-timeout,
+// -lock-timeout and -idle-in-transaction-timeout: a transaction that would
+// hang fails instead and is counted by the timeout it has hit. Statement
+// timeouts abort the transaction, lock timeouts are retried as distributed
+// deadlocks are, and idle ones end the session, which the worker replaces.
+var nStatementTimeouts int64
+var nLockTimeouts int64
+var nIdleTimeouts int64
+
+// Settings of every session for the timeouts configured
+func timeout_settings() []string {
+    var settings []string
+    for _, t := range []struct {
+        name string
+        d time.Duration
+    }{
+        {"statement_timeout", cfg.StatementTimeout},
+        {"lock_timeout", cfg.LockTimeout},
+        {"idle_in_transaction_session_timeout", cfg.IdleTimeout},
+    } {
+        if t.d > 0 {
+            settings = append(settings, fmt.Sprintf("set %s = %d", t.name, t.d / time.Millisecond))
+        }
+    }
+    return settings
+}
+
+func is_idle_timeout(err error) bool {
+    pgerr, ok := err.(pgx.PgError)
+    return ok && pgerr.Code == "25P03"
+}
+
+// Count the attempt failed by a timeout; query_canceled and
+// lock_not_available are told from cancels and nowait by their message
+func record_timeout(err error) {
+    pgerr, ok := err.(pgx.PgError)
+    if !ok {
+        return
+    }
+    switch {
+    case pgerr.Code == "57014" && strings.Contains(pgerr.Message, "statement timeout"):
+        atomic.AddInt64(&nStatementTimeouts, 1)
+    case pgerr.Code == "55P03" && strings.Contains(pgerr.Message, "lock timeout"):
+        atomic.AddInt64(&nLockTimeouts, 1)
+    case pgerr.Code == "25P03":
+        atomic.AddInt64(&nIdleTimeouts, 1)
+    }
+}
+
+func print_timeouts(r Report) {
+    fmt.Printf("Timeouts: %d statement (%v), %d lock (%v), %d idle in transaction (%v)\n",
+        r.StatementTimeouts, cfg.StatementTimeout, r.LockTimeouts, cfg.LockTimeout,
+        r.IdleTimeouts, cfg.IdleTimeout)
+}
@@ -0,0 +1,224 @@
+package dtmtest
+
+import (
+    "fmt"
+    "sync/atomic"
+    "github.com/jackc/pgx"
+    "github.com/digoal/postgres_cluster/contrib/pg_tsdtm/tests/dtmclient"
+)
+
+// Bank of TPC-B: branches with their tellers and -accounts accounts each,
+// branch b and everything of it on node b % nodes, see -branches. Every
+// transaction adds a random delta to an account, to a teller and to the
+// branch of the teller and writes it to the history on the node of the
+// teller. In -remote-pct of transactions the account belongs to another
+// branch, usually of another node, so the transaction is a global one. The
+// balance of every branch is the sum of its tellers and of the deltas in
+// its history, and the accounts of every branch sum up to the deltas of
+// the histories of all nodes for them. Workers check the latter for a
+// branch now and then under the global snapshot, so the history must be
+// in step with the accounts of other nodes.
+type TpcbWorkload struct {}
+
+const tellersPerBranch = 10
+
+// Branches found out of step with the histories by checks of the workers
+var nTpcbViolations int64
+
+func init() {
+    register_workload("tpcb", func() Workload { return new(TpcbWorkload) })
+}
+
+func tpcb_branches() int {
+    if cfg.Branches == 0 {
+        return len(nodes)
+    }
+    return cfg.Branches
+}
+
+func branch_node(branch int) int {
+    return branch % len(nodes)
+}
+
+func (b *TpcbWorkload) Setup(conns []*pgx.Conn) {
+    create_extension(conns)
+    b.Teardown(conns)
+    branches, n := tpcb_branches(), len(conns)
+    for i, conn := range conns {
+        exec(conn, "create table tpcb_branches(bid int, bbalance int)")
+        exec(conn, "create table tpcb_tellers(tid int, bid int, tbalance int)")
+        exec(conn, "create table tpcb_accounts(aid int, bid int, abalance int)")
+        // abid is the branch of the account
+        exec(conn, "create table tpcb_history(tid int, bid int, aid int, abid int, delta int, mtime timestamp)")
+        exec(conn, "insert into tpcb_branches select bid, 0 from generate_series(0, $1 - 1) bid where bid % $2 = $3",
+            branches, n, i)
+        exec(conn, "insert into tpcb_tellers select tid, tid / $1, 0 from generate_series(0, $2 - 1) tid " +
+            "where tid / $1 % $3 = $4", tellersPerBranch, branches * tellersPerBranch, n, i)
+        exec(conn, "insert into tpcb_accounts select aid, aid / $1, 0 from generate_series(0, $2 - 1) aid " +
+            "where aid / $1 % $3 = $4", cfg.Accounts, branches * cfg.Accounts, n, i)
+        exec(conn, "alter table tpcb_branches add primary key (bid)")
+        exec(conn, "alter table tpcb_tellers add primary key (tid)")
+        exec(conn, "alter table tpcb_accounts add primary key (aid)")
+        exec(conn, "create index on tpcb_history(abid)")
+        exec(conn, "analyze")
+    }
+    b.Attach(conns)
+}
+
+func (b *TpcbWorkload) Attach(conns []*pgx.Conn) {
+    atomic.StoreInt64(&nTpcbViolations, 0)
+}
+
+func (b *TpcbWorkload) Iteration(w *Worker) error {
+    branches := tpcb_branches()
+    branch := w.Rand.Intn(branches)
+    if w.Rand.Intn(100) == 0 {
+        return tpcb_check(w, branch)
+    }
+    teller := branch * tellersPerBranch + w.Rand.Intn(tellersPerBranch)
+    abranch := branch
+    if branches > 1 && w.Rand.Intn(100) < cfg.RemotePct {
+        abranch = (branch + 1 + w.Rand.Intn(branches - 1)) % branches
+    }
+    account := abranch * cfg.Accounts + w.Rand.Intn(cfg.Accounts)
+    delta := w.Rand.Intn(10001) - 5000
+
+    order := []int{branch_node(branch)}
+    a := 0
+    if branch_node(abranch) != order[0] {
+        order = append(order, branch_node(abranch))
+        a = 1
+    }
+    return run_global(w, order, false, func(tx *dtmclient.GlobalTx) error {
+        if _, err := tx.Exec(a, "update tpcb_accounts set abalance = abalance + $1 where aid = $2",
+            delta, account); err != nil {
+            return err
+        }
+        if _, err := tx.Exec(0, "update tpcb_tellers set tbalance = tbalance + $1 where tid = $2",
+            delta, teller); err != nil {
+            return err
+        }
+        if _, err := tx.Exec(0, "update tpcb_branches set bbalance = bbalance + $1 where bid = $2",
+            delta, branch); err != nil {
+            return err
+        }
+        _, err := tx.Exec(0, "insert into tpcb_history values ($1, $2, $3, $4, $5, now())",
+            teller, branch, account, abranch, delta)
+        return err
+    })
+}
+
+// Run body in a global transaction over the nodes, the first one is the
+// coordinator; gid is empty for read-only ones, which see a snapshot
+func run_global(w *Worker, order []int, readOnly bool,
+        body func(tx *dtmclient.GlobalTx) error) error {
+    var participants []*pgx.Conn
+    for _, node := range order {
+        participants = append(participants, w.Conns[node])
+    }
+    return w.Transaction(func(gtid string) (*dtmclient.GlobalTx, error) {
+        isolation := w.Isolation
+        if readOnly {
+            gtid, isolation = "", refs_isolation(w.Isolation)
+        }
+        tx, err := begin_global(participants, gtid, isolation)
+        if err != nil {
+            return nil, err
+        }
+        if err = body(tx); err != nil {
+            tx.Rollback()
+            return tx, err
+        }
+        if !cfg.Use2PC {
+            err = tx.CommitLocal()
+        } else {
+            err = tx.Commit()
+        }
+        if tx.Failed >= 0 {
+            stats.RecordNodeError(order[tx.Failed])
+        }
+        if err != nil {
+            record_in_doubt(tx)
+        }
+        return tx, err
+    })
+}
+
+// The accounts of the branch against the deltas for them in the histories
+// of all nodes, under one snapshot
+func tpcb_check(w *Worker, branch int) error {
+    order := []int{branch_node(branch)}
+    for node := range nodes {
+        if node != order[0] {
+            order = append(order, node)
+        }
+    }
+    return run_global(w, order, true, func(tx *dtmclient.GlobalTx) error {
+        var accounts, deltas int64
+        if err := tx.QueryRow(0, "select coalesce(sum(abalance), 0) from tpcb_accounts where aid between $1 and $2",
+            branch * cfg.Accounts, (branch + 1) * cfg.Accounts - 1).Scan(&accounts); err != nil {
+            return err
+        }
+        for i := range order {
+            var d int64
+            if err := tx.QueryRow(i, "select coalesce(sum(delta), 0) from tpcb_history where abid = $1",
+                branch).Scan(&d); err != nil {
+                return err
+            }
+            deltas += d
+        }
+        if accounts != deltas {
+            fmt.Printf("[tpcb] snapshot %d: accounts of branch %d have %d, their history %d\n",
+                tx.Snapshot, branch, accounts, deltas)
+            atomic.AddInt64(&nTpcbViolations, 1)
+        }
+        return nil
+    })
+}
+
+// Add up the sums of the query by the key in its first column over the nodes
+func sum_by_key(conns []*pgx.Conn, query string) map[int]int64 {
+    sums := make(map[int]int64)
+    for _, conn := range conns {
+        rows, err := conn.Query(query)
+        checkErr(err)
+        for rows.Next() {
+            var key int
+            var sum int64
+            checkErr(rows.Scan(&key, &sum))
+            sums[key] += sum
+        }
+        checkErr(rows.Err())
+    }
+    return sums
+}
+
+func (b *TpcbWorkload) Verify(conns []*pgx.Conn) int {
+    anomalies := int(atomic.LoadInt64(&nTpcbViolations))
+    balances := sum_by_key(conns, "select bid, bbalance::bigint from tpcb_branches")
+    tellers := sum_by_key(conns, "select bid, sum(tbalance) from tpcb_tellers group by bid")
+    accounts := sum_by_key(conns, "select bid, sum(abalance) from tpcb_accounts group by bid")
+    history := sum_by_key(conns, "select bid, sum(delta) from tpcb_history group by bid")
+    accountHistory := sum_by_key(conns, "select abid, sum(delta) from tpcb_history group by abid")
+    for branch := 0; branch < tpcb_branches(); branch++ {
+        if balances[branch] != tellers[branch] || balances[branch] != history[branch] {
+            fmt.Printf("[tpcb] branch %d has %d, its tellers %d, its history %d\n",
+                branch, balances[branch], tellers[branch], history[branch])
+            anomalies++
+        }
+        if accounts[branch] != accountHistory[branch] {
+            fmt.Printf("[tpcb] accounts of branch %d have %d, their history %d\n",
+                branch, accounts[branch], accountHistory[branch])
+            anomalies++
+        }
+    }
+    return anomalies
+}
+
+func (b *TpcbWorkload) Teardown(conns []*pgx.Conn) {
+    for _, conn := range conns {
+        for _, table := range []string{"tpcb_branches", "tpcb_tellers", "tpcb_accounts", "tpcb_history"} {
+            exec(conn, "drop table if exists " + table)
+        }
+    }
+}
@@ -0,0 +1,325 @@
+package dtmtest
+
+import (
+    "fmt"
+    "sort"
+    "sync/atomic"
+    "time"
+    "github.com/jackc/pgx"
+    "github.com/digoal/postgres_cluster/contrib/pg_tsdtm/tests/dtmclient"
+)
+
+// Simplified TPC-C: warehouses with their districts, customers, stock,
+// orders and history, warehouse w and everything of it on node w % nodes,
+// see -warehouses; the items are the same on every node. The mix is 45%
+// new orders, 43% payments and 12% order status. In -remote-pct of new
+// orders some lines are supplied by the stock of another warehouse and in
+// -remote-pct of payments the customer is of another warehouse, these are
+// global transactions over both nodes when the warehouses are on different
+// ones. Order status reads the last order of a customer with its lines.
+// Verify checks the consistency conditions of TPC-C: on every warehouse the
+// year to date of the warehouse, of its districts and of its history
+// agree, the districts have the order ids they have given and the lines of
+// their orders, and across the nodes the payments of the customers of a
+// warehouse are in the histories and the orders of its stock in the lines.
+// Stock is updated in the order of warehouses and items, districts before
+// it, so new orders do not deadlock each other across the nodes.
+type TpccWorkload struct {}
+
+const (
+    districtsPerWarehouse = 10
+    customersPerDistrict = 300
+    tpccItems = 1000
+)
+
+// Committed transactions of the mix and those of them on two warehouses
+var nTpccNewOrders int64
+var nTpccPayments int64
+var nTpccOrderStatus int64
+var nTpccRemote int64
+
+// Orders found with another number of lines than they have by the workers
+var nTpccViolations int64
+
+func init() {
+    register_workload("tpcc", func() Workload { return new(TpccWorkload) })
+}
+
+func tpcc_warehouses() int {
+    if cfg.Warehouses == 0 {
+        return len(nodes)
+    }
+    return cfg.Warehouses
+}
+
+func warehouse_node(warehouse int) int {
+    return warehouse % len(nodes)
+}
+
+func (c *TpccWorkload) Setup(conns []*pgx.Conn) {
+    create_extension(conns)
+    c.Teardown(conns)
+    warehouses, n := tpcc_warehouses(), len(conns)
+    for i, conn := range conns {
+        exec(conn, "create table tpcc_item(i_id int primary key, i_price int)")
+        exec(conn, "create table tpcc_warehouse(w_id int, w_ytd bigint)")
+        exec(conn, "create table tpcc_district(d_w_id int, d_id int, d_next_o_id int, d_ytd bigint)")
+        exec(conn, "create table tpcc_customer(c_w_id int, c_d_id int, c_id int, " +
+            "c_balance bigint, c_ytd_payment bigint, c_payment_cnt int)")
+        exec(conn, "create table tpcc_stock(s_w_id int, s_i_id int, s_quantity int, s_order_cnt int, s_remote_cnt int)")
+        exec(conn, "create table tpcc_orders(o_w_id int, o_d_id int, o_id int, o_c_id int, " +
+            "o_ol_cnt int, o_all_local boolean, o_entry_d timestamp)")
+        exec(conn, "create table tpcc_order_line(ol_w_id int, ol_d_id int, ol_o_id int, ol_number int, " +
+            "ol_i_id int, ol_supply_w_id int, ol_quantity int, ol_amount bigint)")
+        exec(conn, "create table tpcc_history(h_c_w_id int, h_c_d_id int, h_c_id int, " +
+            "h_w_id int, h_d_id int, h_amount bigint, h_date timestamp)")
+
+        exec(conn, "insert into tpcc_item select i, 1 + i % 100 from generate_series(0, $1 - 1) i", tpccItems)
+        exec(conn, "insert into tpcc_warehouse select w, 0 from generate_series(0, $1 - 1) w where w % $2 = $3",
+            warehouses, n, i)
+        exec(conn, "insert into tpcc_district select w_id, d, 1, 0 from tpcc_warehouse, generate_series(0, $1 - 1) d",
+            districtsPerWarehouse)
+        exec(conn, "insert into tpcc_customer select d_w_id, d_id, c, 0, 0, 0 " +
+            "from tpcc_district, generate_series(0, $1 - 1) c", customersPerDistrict)
+        exec(conn, "insert into tpcc_stock select w_id, i_id, 100, 0, 0 from tpcc_warehouse, tpcc_item")
+        exec(conn, "alter table tpcc_warehouse add primary key (w_id)")
+        exec(conn, "alter table tpcc_district add primary key (d_w_id, d_id)")
+        exec(conn, "alter table tpcc_customer add primary key (c_w_id, c_d_id, c_id)")
+        exec(conn, "alter table tpcc_stock add primary key (s_w_id, s_i_id)")
+        exec(conn, "alter table tpcc_orders add primary key (o_w_id, o_d_id, o_id)")
+        exec(conn, "create index on tpcc_orders(o_w_id, o_d_id, o_c_id, o_id)")
+        exec(conn, "alter table tpcc_order_line add primary key (ol_w_id, ol_d_id, ol_o_id, ol_number)")
+        exec(conn, "analyze")
+    }
+    c.Attach(conns)
+}
+
+func (c *TpccWorkload) Attach(conns []*pgx.Conn) {
+    atomic.StoreInt64(&nTpccViolations, 0)
+}
+
+func (c *TpccWorkload) Iteration(w *Worker) error {
+    warehouses := tpcc_warehouses()
+    home := w.Rand.Intn(warehouses)
+    district := w.Rand.Intn(districtsPerWarehouse)
+    other := home
+    if warehouses > 1 && w.Rand.Intn(100) < cfg.RemotePct {
+        other = (home + 1 + w.Rand.Intn(warehouses - 1)) % warehouses
+    }
+    var counter *int64
+    var err error
+    switch op := w.Rand.Intn(100); {
+    case op < 45:
+        counter, err = &nTpccNewOrders, new_order(w, home, district, other)
+    case op < 88:
+        counter, err = &nTpccPayments, payment(w, home, district, other)
+    default:
+        counter, err = &nTpccOrderStatus, order_status(w, home, district)
+    }
+    if err == nil {
+        atomic.AddInt64(counter, 1)
+        if other != home && counter != &nTpccOrderStatus {
+            atomic.AddInt64(&nTpccRemote, 1)
+        }
+    }
+    return err
+}
+
+// Nodes of the warehouses, the one of home first and coordinating, and the
+// participant of the other warehouse
+func tpcc_order(home int, other int) (order []int, o int) {
+    order = []int{warehouse_node(home)}
+    if warehouse_node(other) != order[0] {
+        order = append(order, warehouse_node(other))
+        o = 1
+    }
+    return order, o
+}
+
+type orderLine struct {
+    item, supply, quantity int
+}
+
+func new_order(w *Worker, home int, district int, other int) error {
+    customer := w.Rand.Intn(customersPerDistrict)
+    lines := make([]orderLine, 5 + w.Rand.Intn(11))
+    taken := make(map[int]bool)
+    for i := range lines {
+        item := w.Rand.Intn(tpccItems)
+        for taken[item] {
+            item = w.Rand.Intn(tpccItems)
+        }
+        taken[item] = true
+        supply := home
+        if other != home && (i == 0 || w.Rand.Intn(2) == 0) {
+            supply = other
+        }
+        lines[i] = orderLine{item, supply, 1 + w.Rand.Intn(10)}
+    }
+    sort.Slice(lines, func(i, j int) bool {
+        if lines[i].supply != lines[j].supply {
+            return lines[i].supply < lines[j].supply
+        }
+        return lines[i].item < lines[j].item
+    })
+
+    order, o := tpcc_order(home, other)
+    return run_global(w, order, false, func(tx *dtmclient.GlobalTx) error {
+        var id int
+        if err := tx.QueryRow(0, "update tpcc_district set d_next_o_id = d_next_o_id + 1 " +
+            "where d_w_id = $1 and d_id = $2 returning d_next_o_id - 1", home, district).Scan(&id); err != nil {
+            return err
+        }
+        if _, err := tx.Exec(0, "insert into tpcc_orders values ($1, $2, $3, $4, $5, $6, now())",
+            home, district, id, customer, len(lines), other == home); err != nil {
+            return err
+        }
+        for n, l := range lines {
+            var price int
+            if err := tx.QueryRow(0, "select i_price from tpcc_item where i_id = $1", l.item).Scan(&price); err != nil {
+                return err
+            }
+            p, remote := 0, 0
+            if l.supply != home {
+                p, remote = o, 1
+            }
+            if _, err := tx.Exec(p, "update tpcc_stock set s_quantity = case when s_quantity >= $1 + 10 " +
+                "then s_quantity - $1 else s_quantity - $1 + 91 end, s_order_cnt = s_order_cnt + 1, " +
+                "s_remote_cnt = s_remote_cnt + $2 where s_w_id = $3 and s_i_id = $4",
+                l.quantity, remote, l.supply, l.item); err != nil {
+                return err
+            }
+            if _, err := tx.Exec(0, "insert into tpcc_order_line values ($1, $2, $3, $4, $5, $6, $7, $8)",
+                home, district, id, n + 1, l.item, l.supply, l.quantity, l.quantity * price); err != nil {
+                return err
+            }
+        }
+        return nil
+    })
+}
+
+// Payment of a customer of the other warehouse to the district of home
+func payment(w *Worker, home int, district int, other int) error {
+    customerDistrict := district
+    if other != home {
+        customerDistrict = w.Rand.Intn(districtsPerWarehouse)
+    }
+    customer := w.Rand.Intn(customersPerDistrict)
+    amount := 1 + w.Rand.Intn(5000)
+
+    order, o := tpcc_order(home, other)
+    return run_global(w, order, false, func(tx *dtmclient.GlobalTx) error {
+        if _, err := tx.Exec(0, "update tpcc_warehouse set w_ytd = w_ytd + $1 where w_id = $2",
+            amount, home); err != nil {
+            return err
+        }
+        if _, err := tx.Exec(0, "update tpcc_district set d_ytd = d_ytd + $1 where d_w_id = $2 and d_id = $3",
+            amount, home, district); err != nil {
+            return err
+        }
+        if _, err := tx.Exec(o, "update tpcc_customer set c_balance = c_balance - $1, " +
+            "c_ytd_payment = c_ytd_payment + $1, c_payment_cnt = c_payment_cnt + 1 " +
+            "where c_w_id = $2 and c_d_id = $3 and c_id = $4",
+            amount, other, customerDistrict, customer); err != nil {
+            return err
+        }
+        _, err := tx.Exec(0, "insert into tpcc_history values ($1, $2, $3, $4, $5, $6, now())",
+            other, customerDistrict, customer, home, district, amount)
+        return err
+    })
+}
+
+// The last order of a customer and its lines under one snapshot, the
+// order should have all of them
+func order_status(w *Worker, home int, district int) error {
+    customer := w.Rand.Intn(customersPerDistrict)
+    return run_global(w, []int{warehouse_node(home)}, true, func(tx *dtmclient.GlobalTx) error {
+        var id, count int
+        var lines int64
+        err := tx.QueryRow(0, "select o_id, o_ol_cnt from tpcc_orders where o_w_id = $1 and o_d_id = $2 " +
+            "and o_c_id = $3 order by o_id desc limit 1", home, district, customer).Scan(&id, &count)
+        if err == pgx.ErrNoRows {
+            return nil
+        }
+        if err != nil {
+            return err
+        }
+        if err = tx.QueryRow(0, "select count(*) from tpcc_order_line where ol_w_id = $1 and ol_d_id = $2 " +
+            "and ol_o_id = $3", home, district, id).Scan(&lines); err != nil {
+            return err
+        }
+        if lines != int64(count) {
+            fmt.Printf("[tpcc] snapshot %d: order %d of warehouse %d district %d has %d lines of %d\n",
+                tx.Snapshot, id, home, district, lines, count)
+            atomic.AddInt64(&nTpccViolations, 1)
+        }
+        return nil
+    })
+}
+
+func (c *TpccWorkload) Verify(conns []*pgx.Conn) int {
+    anomalies := int(atomic.LoadInt64(&nTpccViolations))
+    report := func(format string, args ...interface{}) {
+        fmt.Printf("[tpcc] " + format + "\n", args...)
+        anomalies++
+    }
+
+    // districts are keyed by w * districtsPerWarehouse + d
+    ytd := sum_by_key(conns, "select w_id, w_ytd from tpcc_warehouse")
+    districtYtd := sum_by_key(conns, "select d_w_id, sum(d_ytd)::bigint from tpcc_district group by d_w_id")
+    historyYtd := sum_by_key(conns, "select h_w_id, sum(h_amount)::bigint from tpcc_history group by h_w_id")
+    payments := sum_by_key(conns, "select c_w_id, sum(c_ytd_payment)::bigint from tpcc_customer group by c_w_id")
+    paid := sum_by_key(conns, "select h_c_w_id, sum(h_amount)::bigint from tpcc_history group by h_c_w_id")
+    stockOrders := sum_by_key(conns, "select s_w_id, sum(s_order_cnt) from tpcc_stock group by s_w_id")
+    supplied := sum_by_key(conns, "select ol_supply_w_id, count(*) from tpcc_order_line group by ol_supply_w_id")
+    nextIds := sum_by_key(conns, fmt.Sprintf("select d_w_id * %d + d_id, (d_next_o_id - 1)::bigint from tpcc_district",
+        districtsPerWarehouse))
+    maxIds := sum_by_key(conns, fmt.Sprintf("select o_w_id * %d + o_d_id, max(o_id)::bigint from tpcc_orders " +
+        "group by o_w_id, o_d_id", districtsPerWarehouse))
+    orderLines := sum_by_key(conns, fmt.Sprintf("select o_w_id * %d + o_d_id, sum(o_ol_cnt) from tpcc_orders " +
+        "group by o_w_id, o_d_id", districtsPerWarehouse))
+    lines := sum_by_key(conns, fmt.Sprintf("select ol_w_id * %d + ol_d_id, count(*) from tpcc_order_line " +
+        "group by ol_w_id, ol_d_id", districtsPerWarehouse))
+
+    for wh := 0; wh < tpcc_warehouses(); wh++ {
+        if ytd[wh] != districtYtd[wh] || ytd[wh] != historyYtd[wh] {
+            report("warehouse %d has ytd %d, its districts %d, its history %d",
+                wh, ytd[wh], districtYtd[wh], historyYtd[wh])
+        }
+        if payments[wh] != paid[wh] {
+            report("customers of warehouse %d have paid %d, the histories have %d", wh, payments[wh], paid[wh])
+        }
+        if stockOrders[wh] != supplied[wh] {
+            report("stock of warehouse %d is ordered %d times, %d order lines supplied by it",
+                wh, stockOrders[wh], supplied[wh])
+        }
+        for d := 0; d < districtsPerWarehouse; d++ {
+            key := wh * districtsPerWarehouse + d
+            if nextIds[key] != maxIds[key] || orderLines[key] != lines[key] {
+                report("district %d of warehouse %d has given %d order ids, has %d orders, %d lines of %d",
+                    d, wh, nextIds[key], maxIds[key], lines[key], orderLines[key])
+            }
+        }
+    }
+    return anomalies
+}
+
+func (c *TpccWorkload) Teardown(conns []*pgx.Conn) {
+    for _, conn := range conns {
+        for _, table := range []string{"tpcc_item", "tpcc_warehouse", "tpcc_district", "tpcc_customer",
+            "tpcc_stock", "tpcc_orders", "tpcc_order_line", "tpcc_history"} {
+            exec(conn, "drop table if exists " + table)
+        }
+    }
+}
+
+// New orders per minute of the run
+func tpmc(elapsed time.Duration) float64 {
+    return float64(atomic.LoadInt64(&nTpccNewOrders)) / elapsed.Minutes()
+}
+
+func print_tpcc(r Report) {
+    fmt.Printf("TPC-C: %d new orders (%0.0f tpmC), %d payments, %d order status, %d on two warehouses, " +
+        "%d warehouses\n", r.TpccNewOrders, r.TpmC, r.TpccPayments, r.TpccOrderStatus, r.TpccRemote,
+        tpcc_warehouses())
+}
@@ -0,0 +1,180 @@
+package dtmtest
+
+import (
+    "bufio"
+    "encoding/hex"
+    "encoding/json"
+    "math/rand"
+    "os"
+    "strconv"
+    "sync"
+    "time"
+    "github.com/digoal/postgres_cluster/contrib/pg_tsdtm/tests/dtmclient"
+)
+
+// Order in which phases are reported
+var phaseNames = []string{
+    "begin", "extend", "access", "statement",
+    "prepare", "begin_prepare", "vote", "end_prepare", "commit_prepared",
+    "commit", "rollback",
+}
+
+// Traces of every attempt of every transaction, see -trace. In "json"
+// format every line is
+//
+//  {"gid": "3.17", "error": "", "spans": [{"phase": "begin", "participant": 0,
+//   "start_us": 1469094603123456, "duration_us": 120}, ...]}
+//
+// In "otlp" format every line is OTLP/JSON ResourceSpans message with a
+// span per transaction and its phases as children, ready for the file
+// receiver of OpenTelemetry collector.
+type Tracer struct {
+    sync.Mutex
+    file *os.File
+    w *bufio.Writer
+    otlp bool
+}
+
+var tracer *Tracer
+
+func open_tracer(path string, format string) *Tracer {
+    f, err := os.Create(path)
+    checkErr(err)
+    return &Tracer{file: f, w: bufio.NewWriter(f), otlp: format == "otlp"}
+}
+
+func (t *Tracer) Close() {
+    t.Lock()
+    defer t.Unlock()
+    checkErr(t.w.Flush())
+    checkErr(t.file.Close())
+}
+
+type traceSpan struct {
+    Phase string `json:"phase"`
+    Participant int `json:"participant"`
+    Start int64 `json:"start_us"`
+    Duration int64 `json:"duration_us"`
+}
+
+type traceEntry struct {
+    Gid string `json:"gid"`
+    Error string `json:"error"`
+    Spans []traceSpan `json:"spans"`
+}
+
+func (t *Tracer) Write(tx *dtmclient.GlobalTx, txErr error) {
+    if len(tx.Spans) == 0 {
+        return
+    }
+    var line interface{}
+    if t.otlp {
+        line = otlp_trace(tx, txErr)
+    } else {
+        entry := traceEntry{Gid: tx.Gid}
+        if txErr != nil {
+            entry.Error = txErr.Error()
+        }
+        for _, s := range tx.Spans {
+            entry.Spans = append(entry.Spans, traceSpan{
+                s.Phase, s.Participant,
+                s.Start.UnixNano() / int64(time.Microsecond), int64(s.Duration / time.Microsecond),
+            })
+        }
+        line = entry
+    }
+    data, err := json.Marshal(line)
+    checkErr(err)
+
+    t.Lock()
+    defer t.Unlock()
+    t.w.Write(data)
+    t.w.WriteByte('\n')
+}
+
+// The subset of OTLP/JSON we produce
+type otlpValue struct {
+    StringValue string `json:"stringValue,omitempty"`
+    IntValue string `json:"intValue,omitempty"`
+}
+
+type otlpAttribute struct {
+    Key string `json:"key"`
+    Value otlpValue `json:"value"`
+}
+
+type otlpStatus struct {
+    Code int `json:"code"` // 1 - ok, 2 - error
+    Message string `json:"message,omitempty"`
+}
+
+type otlpSpan struct {
+    TraceId string `json:"traceId"`
+    SpanId string `json:"spanId"`
+    ParentSpanId string `json:"parentSpanId,omitempty"`
+    Name string `json:"name"`
+    Kind int `json:"kind"`
+    Start string `json:"startTimeUnixNano"`
+    End string `json:"endTimeUnixNano"`
+    Attributes []otlpAttribute `json:"attributes"`
+    Status *otlpStatus `json:"status,omitempty"`
+}
+
+func random_id(n int) string {
+    id := make([]byte, n)
+    rand.Read(id)
+    return hex.EncodeToString(id)
+}
+
+func unix_nano(t time.Time) string {
+    return strconv.FormatInt(t.UnixNano(), 10)
+}
+
+func otlp_trace(tx *dtmclient.GlobalTx, txErr error) interface{} {
+    traceId := random_id(16)
+    root := otlpSpan{
+        TraceId: traceId,
+        SpanId: random_id(8),
+        Name: "transaction",
+        Kind: 3, // client
+        Start: unix_nano(tx.Spans[0].Start),
+        Attributes: []otlpAttribute{{"dtm.gid", otlpValue{StringValue: tx.Gid}}},
+        Status: &otlpStatus{Code: 1},
+    }
+    if txErr != nil {
+        root.Status = &otlpStatus{Code: 2, Message: txErr.Error()}
+    }
+    end := tx.Spans[0].Start
+    spans := []otlpSpan{root}
+    for _, s := range tx.Spans {
+        finish := s.Start.Add(s.Duration)
+        if finish.After(end) {
+            end = finish
+        }
+        spans = append(spans, otlpSpan{
+            TraceId: traceId,
+            SpanId: random_id(8),
+            ParentSpanId: root.SpanId,
+            Name: s.Phase,
+            Kind: 3,
+            Start: unix_nano(s.Start),
+            End: unix_nano(finish),
+            Attributes: []otlpAttribute{
+                {"dtm.participant", otlpValue{IntValue: strconv.Itoa(s.Participant)}},
+            },
+        })
+    }
+    spans[0].End = unix_nano(end)
+
+    return map[string]interface{}{
+        "resourceSpans": []interface{}{map[string]interface{}{
+            "resource": map[string]interface{}{
+                "attributes": []otlpAttribute{{"service.name", otlpValue{StringValue: "transfers"}}},
+            },
+            "scopeSpans": []interface{}{map[string]interface{}{
+                "scope": map[string]string{"name": "dtmclient"},
+                "spans": spans,
+            }},
+        }},
+    }
+}
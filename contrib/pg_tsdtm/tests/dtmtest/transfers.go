@@ -0,0 +1,318 @@
+package dtmtest
+
+import (
+    "math/rand"
+    "sort"
+    "time"
+    "github.com/jackc/pgx"
+    "github.com/digoal/postgres_cluster/contrib/pg_tsdtm/tests/dtmclient"
+)
+
+// Bank transfers between accounts on different nodes: money is moved
+// around but the total amount stays the same
+type TransferWorkload struct {}
+
+func init() {
+    register_workload("transfers", func() Workload { return new(TransferWorkload) })
+}
+
+// Every node holds 'accounts' accounts, in sharded mode on average
+func (t *TransferWorkload) ExpectedTotal() int64 {
+    return int64(cfg.Accounts) * int64(len(nodes)) * int64(cfg.InitAmount)
+}
+
+func (t *TransferWorkload) TotalQuery() string {
+    return "select sum(v) from t"
+}
+
+func (t *TransferWorkload) Setup(conns []*pgx.Conn) {
+    create_extension(conns)
+    for _, conn := range conns {
+        exec(conn, "drop table if exists t")
+        exec(conn, "create table t(u int, v int)" + table_options())
+    }
+
+    load_accounts()
+
+    // cheaper to build the index once than to maintain it while loading
+    for _, conn := range conns {
+        exec(conn, "alter table t add primary key (u)")
+        exec(conn, "analyze t")
+    }
+    create_indexes(conns)
+
+    if cfg.Audit {
+        create_audit(conns)
+    }
+    if cfg.Backend == "fdw" {
+        create_fdw(conns)
+    }
+    t.Attach(conns)
+}
+
+func (t *TransferWorkload) Attach(conns []*pgx.Conn) {
+    start_table_updates(conns)
+    if cfg.HistoryPath != "" {
+        history = open_history(cfg.HistoryPath)
+    }
+}
+
+func (t *TransferWorkload) Verify(conns []*pgx.Conn) int {
+    anomalies := 0
+    if tableUpdates.updates != nil {
+        finish_table_updates(conns)
+    }
+    if history != nil {
+        history.Close()
+        anomalies += verify_history(cfg.HistoryPath)
+    }
+    if cfg.Sharded {
+        anomalies += check_shards()
+    }
+    if cfg.Audit {
+        anomalies += check_audit(conns)
+    }
+    return anomalies
+}
+
+func (t *TransferWorkload) Teardown(conns []*pgx.Conn) {
+    for _, conn := range conns {
+        exec(conn, "drop table if exists t")
+    }
+    if cfg.Audit {
+        drop_audit(conns)
+    }
+    if cfg.Backend == "fdw" {
+        drop_fdw(conns)
+    }
+}
+
+func max(a, b int64) int64 {
+    if a >= b {
+        return a
+    } 
+    return b
+}
+
+// Single update of a global transaction
+type Update struct {
+    Node int        // index of the node in the cluster
+    Account int
+    Delta int
+    Balance int64   // value of the account after the update
+}
+
+// How the transaction should end, see -abort-pct
+const (
+    endCommit = iota
+    endRollback          // rollback on all participants before prepare
+    endRollbackPrepared  // prepare all participants but the last, then rollback
+)
+
+func choose_end(r *rand.Rand) int {
+    if r.Intn(100) >= cfg.AbortPct {
+        return endCommit
+    }
+    if cfg.AbortMode == "one" {
+        return endRollbackPrepared
+    }
+    return endRollback
+}
+
+// Nodes touched by the updates in order of first appearance
+func participant_nodes(updates []Update) []int {
+    var nodes []int
+    seen := make(map[int]bool)
+    for _, u := range updates {
+        if !seen[u.Node] {
+            seen[u.Node] = true
+            nodes = append(nodes, u.Node)
+        }
+    }
+    return nodes
+}
+
+// Applies the update on the participant within the transaction, sets
+// u.Balance
+type applyUpdate func(tx *dtmclient.GlobalTx, participant int, conn *pgx.Conn, u *Update) error
+
+func update_account(tx *dtmclient.GlobalTx, participant int, conn *pgx.Conn, u *Update) error {
+    stmt, err := prepared(conn, "transfer", "update t set v = v + $1 where u=$2 returning v")
+    if err != nil {
+        return err
+    }
+    return tx.QueryRow(participant, stmt, u.Delta, u.Account).Scan(&u.Balance)
+}
+
+// Perform the updates in one global transaction. The coordinator node
+// goes first, the rest of participants follow in order of first
+// appearance in the updates
+func do_transfer(conns []*pgx.Conn, gtid string, isolation string, updates []Update, coordinator int, end int, apply applyUpdate) (*dtmclient.GlobalTx, error) {
+    if cfg.Backend == "fdw" {
+        return fdw_transfer(conns, gtid, isolation, updates, coordinator, end)
+    }
+    var participants []*pgx.Conn
+    index := make(map[int]int)
+
+    order := []int{coordinator}
+    for _, node := range participant_nodes(updates) {
+        if node != coordinator {
+            order = append(order, node)
+        }
+    }
+    for _, node := range order {
+        index[node] = len(participants)
+        participants = append(participants, conns[node])
+    }
+
+    tx, err := begin_global(participants, gtid, isolation)
+    if err != nil {
+        return nil, err
+    }
+
+    if cfg.ForUpdate {
+        if err = lock_accounts(tx, conns, index, updates); err != nil {
+            tx.Rollback()
+            return nil, err
+        }
+    }
+
+    for i := range updates {
+        u := &updates[i]
+        if i > 0 {
+            think(cfg.StatementThinkTime)
+        }
+        start := time.Now()
+        err = apply(tx, index[u.Node], conns[u.Node], u)
+        if err == nil && cfg.Audit {
+            err = audit_update(tx, index[u.Node], conns[u.Node], u, participants_list(order))
+        }
+        stats.RecordNodeStatement(u.Node, time.Since(start))
+        if err != nil {
+            stats.RecordNodeError(u.Node)
+            tx.Rollback()
+            return nil, err
+        }
+    }
+
+    think(cfg.StatementThinkTime)
+
+    var xids []int32
+    if cfg.CheckSnapshots {
+        check_snapshots(tx, order)
+        if xids, err = local_xids(tx); err != nil {
+            tx.Rollback()
+            return nil, err
+        }
+    }
+
+    switch end {
+    case endRollback:
+        if err = tx.Rollback(); err != nil {
+            return tx, err
+        }
+        return tx, errRolledBack
+    case endRollbackPrepared:
+        if err = tx.RollbackAfterPrepare(len(participants) - 1); err != nil {
+            record_in_doubt(tx)
+            return tx, err
+        }
+        return tx, errRolledBack
+    }
+
+    if !cfg.Use2PC {
+        err = tx.CommitLocal()
+    } else {
+        err = tx.Commit()
+    }
+    if tx.Failed >= 0 {
+        stats.RecordNodeError(order[tx.Failed])
+    }
+    if err != nil {
+        record_in_doubt(tx)
+    } else if cfg.CheckSnapshots && cfg.Use2PC && hasGetCsn {
+        check_csns(tx, order, xids)
+    }
+    return tx, err
+}
+
+func (t *TransferWorkload) Iteration(w *Worker) error {
+    if cfg.ReadPct > 0 && w.Rand.Intn(100) < cfg.ReadPct {
+        return read_balances(w, transfer_updates(w))
+    }
+    return run_transfer(w, transfer_updates(w), update_account)
+}
+
+// Money moved by a transfer: accounts and nodes chosen according to
+// -sharded, -deadlocks and -fanout. The first account pays the others,
+// one unit to each.
+func transfer_updates(w *Worker) []Update {
+    amount := 2*w.Rand.Intn(2) - 1
+    var accounts, owners []int
+    if cfg.Deadlocks {
+        account1, account2, src, dst := deadlock_pair(w.Id)
+        accounts, owners = []int{account1, account2}, []int{src, dst}
+    } else if cfg.Sharded {
+        accounts = pick_sharded(w.Keys, cfg.Fanout)
+        for _, account := range accounts {
+            owners = append(owners, shard_of(account))
+        }
+    } else {
+        for i := 0; i < cfg.Fanout; i++ {
+            accounts = append(accounts, w.Keys.Next())
+        }
+        owners = pick_nodes(w.Rand, len(w.Conns), cfg.Fanout)
+    }
+    updates := make([]Update, len(accounts))
+    for i := range updates {
+        updates[i] = Update{Node: owners[i], Account: accounts[i], Delta: amount}
+    }
+    updates[0].Delta = -amount * (len(updates) - 1)
+    if cfg.Deadlocks && w.Id % 2 == 1 {
+        updates[0], updates[1] = updates[1], updates[0]
+    }
+    return updates
+}
+
+// Pick n different participants out of a cluster of size nodes
+func pick_nodes(r *rand.Rand, size int, n int) []int {
+    var picked, sorted []int
+    for len(picked) < n {
+        // the chosen one among the nodes not picked yet
+        node := r.Intn(size - len(picked))
+        for _, p := range sorted {
+            if node >= p {
+                node++
+            }
+        }
+        picked = append(picked, node)
+        sorted = append(sorted, node)
+        sort.Ints(sorted)
+    }
+    return picked
+}
+
+func run_transfer(w *Worker, updates []Update, apply applyUpdate) error {
+    end := choose_end(w.Rand)
+    participants := participant_nodes(updates)
+    coordinator := participants[choose_coordinator(w, len(participants))]
+
+    return w.Transaction(func(gtid string) (*dtmclient.GlobalTx, error) {
+        start := time.Now()
+        tx, err := do_transfer(w.Conns, gtid, w.Isolation, updates, coordinator, end, apply)
+        if err == nil {
+            stats.RecordWriteSnapshot(tx.SnapshotTime)
+            stats.RecordCoordinator(coordinator, time.Since(start))
+            for _, node := range participants {
+                stats.RecordNodeTransaction(node, time.Since(start))
+            }
+            if history != nil {
+                history.Record(tx, updates)
+            }
+        } else if committed_in_doubt(tx) && history != nil {
+            // will be committed once the failed participant is back
+            history.Record(tx, updates)
+        }
+        return tx, err
+    })
+}
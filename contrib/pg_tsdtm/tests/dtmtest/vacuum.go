@@ -0,0 +1,213 @@
+package dtmtest
+
+import (
+    "fmt"
+    "sync"
+    "sync/atomic"
+    "time"
+    "github.com/jackc/pgx"
+    "github.com/digoal/postgres_cluster/contrib/pg_tsdtm/tests/dtmclient"
+)
+
+// With -vacuum-interval every node is vacuumed and analyzed over and over
+// while the workers run, every fourth time with freeze. Besides the dead
+// versions left by the workers, a mover keeps deleting rows of the probe
+// table on one node and inserting them on another in global transactions,
+// so there are deleted rows for vacuum to remove. A checker reads the
+// probe under global snapshots: all vacuumProbeRows rows should be seen,
+// no one missing because vacuum has removed a version still visible to
+// the snapshot and no one twice because a deleted version is still seen.
+// The same snapshot is read again after the next round of vacuum and
+// should see exactly the same.
+const vacuumProbeRows = 100
+
+var nVacuums int64
+
+// Every row starts on the node k % len(nodes)
+func create_probe(conns []*pgx.Conn) {
+    for i, conn := range conns {
+        exec(conn, "drop table if exists vacuum_probe")
+        exec(conn, "create table vacuum_probe(k int primary key, v bigint)")
+        exec(conn, "insert into vacuum_probe select k, 0 from generate_series(0, $1) k " +
+            "where k % $2 = $3", vacuumProbeRows - 1, len(conns), i)
+    }
+}
+
+func drop_probe(conns []*pgx.Conn) {
+    for _, conn := range conns {
+        exec(conn, "drop table if exists vacuum_probe")
+    }
+}
+
+func start_vacuum(stop chan struct{}, wg *sync.WaitGroup) {
+    wg.Add(len(nodes) + 2)
+    for i := range nodes {
+        go vacuumer(i, stop, wg)
+    }
+    go probe_mover(stop, wg)
+    go probe_checker(stop, wg)
+}
+
+func vacuumer(node int, stop chan struct{}, wg *sync.WaitGroup) {
+    defer wg.Done()
+
+    conn, err := pgx.Connect(nodes[node])
+    if err != nil {
+        fmt.Printf("[vacuum] node %d is unreachable: %v\n", node, err)
+        return
+    }
+    defer conn.Close()
+    // as aggressive as it gets
+    conn.Exec("set vacuum_cost_delay = 0")
+
+    for i := 0; ; i++ {
+        stmt := "vacuum analyze"
+        if i % 4 == 3 {
+            stmt = "vacuum freeze analyze"
+        }
+        if _, err := conn.Exec(stmt); err != nil {
+            fmt.Printf("[vacuum] '%s' on node %d failed: %v\n", stmt, node, err)
+            if !conn.IsAlive() {
+                return
+            }
+        } else {
+            atomic.AddInt64(&nVacuums, 1)
+        }
+        select {
+        case <-stop:
+            return
+        case <-time.After(cfg.VacuumInterval):
+        }
+    }
+}
+
+// Move random rows of the probe to random other nodes
+func probe_mover(stop chan struct{}, wg *sync.WaitGroup) {
+    defer wg.Done()
+
+    conns, err := connect_direct()
+    if err != nil {
+        fmt.Printf("[vacuum] mover failed to connect: %v\n", err)
+        return
+    }
+    defer close_direct(conns)
+
+    location := make([]int, vacuumProbeRows)
+    for k := range location {
+        location[k] = k % len(nodes)
+    }
+    r := new_rand("vacuum", 0)
+    for i := 0; ; i++ {
+        select {
+        case <-stop:
+            return
+        default:
+        }
+        k := r.Intn(vacuumProbeRows)
+        src := location[k]
+        dst := (src + 1 + r.Intn(len(nodes) - 1)) % len(nodes)
+        err := with_retries(func(attempt int) error {
+            gid := fmt.Sprintf("vacuum.%d.%d", i, attempt)
+            tx, err := begin_global([]*pgx.Conn{conns[src], conns[dst]}, gid, "default")
+            if err != nil {
+                return err
+            }
+            tag, err := tx.Exec(0, "delete from vacuum_probe where k = $1", k)
+            if err == nil && tag.RowsAffected() != 1 {
+                err = fmt.Errorf("row %d is not on node %d", k, src)
+            }
+            if err == nil {
+                _, err = tx.Exec(1, "insert into vacuum_probe values ($1, $2)", k, i)
+            }
+            if err != nil {
+                tx.Rollback()
+                return err
+            }
+            return tx.Commit()
+        })
+        if err != nil {
+            fmt.Printf("[vacuum] failed to move row %d from node %d to node %d: %v\n", k, src, dst, err)
+            return
+        }
+        location[k] = dst
+    }
+}
+
+// Rows of the probe on every node under the snapshot of the transaction
+func read_probe(tx *dtmclient.GlobalTx) (counts []int64, sums []int64, err error) {
+    n := len(tx.Participants())
+    counts = make([]int64, n)
+    sums = make([]int64, n)
+    for i := 0; i < n; i++ {
+        err = tx.QueryRow(i, "select count(*), coalesce(sum(k), 0) from vacuum_probe").Scan(&counts[i], &sums[i])
+        if err != nil {
+            return nil, nil, err
+        }
+    }
+    return counts, sums, nil
+}
+
+func probe_checker(stop chan struct{}, wg *sync.WaitGroup) {
+    defer wg.Done()
+
+    conns, err := connect_direct()
+    if err != nil {
+        fmt.Printf("[vacuum] checker failed to connect: %v\n", err)
+        return
+    }
+    defer close_direct(conns)
+
+    const expectedSum = vacuumProbeRows * (vacuumProbeRows - 1) / 2
+    for i := 0; ; i++ {
+        select {
+        case <-stop:
+            return
+        default:
+        }
+        tx, err := begin_global(conns, fmt.Sprintf("vacuum.check.%d", i), "repeatable-read")
+        if err != nil {
+            fmt.Printf("[vacuum] checker failed to begin: %v\n", err)
+            return
+        }
+        counts, sums, err := read_probe(tx)
+        if err == nil {
+            var count, sum int64
+            for n := range counts {
+                count += counts[n]
+                sum += sums[n]
+            }
+            atomic.AddInt64(&nChecks, 1)
+            if count != vacuumProbeRows || sum != expectedSum {
+                atomic.AddInt64(&nViolations, 1)
+                fmt.Printf("[vacuum] violation: snapshot %d sees %d rows of the probe (sum of keys %d) " +
+                    "instead of %d (%d), by node %v\n",
+                    tx.Snapshot, count, sum, vacuumProbeRows, expectedSum, counts)
+            }
+
+            // let every node be vacuumed meanwhile
+            before := atomic.LoadInt64(&nVacuums)
+            for atomic.LoadInt64(&nVacuums) < before + int64(len(nodes)) && running {
+                time.Sleep(10 * time.Millisecond)
+            }
+
+            var again, againSums []int64
+            again, againSums, err = read_probe(tx)
+            if err == nil {
+                atomic.AddInt64(&nChecks, 1)
+                for n := range again {
+                    if again[n] != counts[n] || againSums[n] != sums[n] {
+                        atomic.AddInt64(&nViolations, 1)
+                        fmt.Printf("[vacuum] violation: snapshot %d saw %d rows on node %d, " +
+                            "%d after vacuum\n", tx.Snapshot, counts[n], n, again[n])
+                    }
+                }
+            }
+        }
+        // nothing is written, there is nothing to commit
+        tx.Rollback()
+        if err != nil {
+            fmt.Printf("[vacuum] checker failed to read the probe: %v\n", err)
+            return
+        }
+    }
+}
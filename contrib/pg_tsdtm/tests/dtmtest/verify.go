@@ -0,0 +1,146 @@
+package dtmtest
+
+import (
+    "fmt"
+    "sync"
+    "sync/atomic"
+    "github.com/jackc/pgx"
+)
+
+var nChecks int64
+var nViolations int64
+
+// Violations by what reading the sums again in the same snapshot has
+// shown: the same sums every time mean the snapshot is not global, a part
+// of some transaction is visible in it for good; sums changing from read
+// to read mean the snapshot is not even pinned and the reads race with
+// commits
+var nStableViolations int64
+var nUnstableReads int64
+
+// How many times sums breaking the invariant are read again
+const sumRereads = 2
+
+// Only called for Balanced workloads
+func expected_total() int64 {
+    return workload.(Balanced).ExpectedTotal()
+}
+
+func sum_of(sums []int64) (sum int64) {
+    for _, s := range sums {
+        sum += s
+    }
+    return
+}
+
+// Read per-node sums under one global snapshot
+func node_sums(conns []*pgx.Conn) (sums []int64, snapshot int64, err error) {
+    reads, snapshot, err := snapshot_sums(conns, nil)
+    if err == nil {
+        sums = reads[0]
+    }
+    return
+}
+
+// Read per-node sums under one global snapshot, and while reread says so
+// of the last sums read them again in the same snapshot, up to sumRereads
+// times. The transaction is repeatable read, so that only DTM can make
+// the sums change.
+func snapshot_sums(conns []*pgx.Conn, reread func(sums []int64) bool) (reads [][]int64, snapshot int64, err error) {
+    err = with_retries(func(attempt int) error {
+        reads = nil
+        tx, err := begin_global(conns, "", "repeatable-read")
+        if err != nil {
+            return err
+        }
+        for len(reads) == 0 || reread != nil && len(reads) <= sumRereads && reread(reads[len(reads) - 1]) {
+            sums, err := read_sums(conns)
+            if err != nil {
+                tx.Rollback()
+                return err
+            }
+            reads = append(reads, sums)
+        }
+        snapshot = tx.Snapshot
+        return tx.Commit()
+    })
+    return
+}
+
+// Sums of all nodes at once, queried by the connections rather than the
+// transaction begun on them as it records its steps unsynchronized
+func read_sums(conns []*pgx.Conn) ([]int64, error) {
+    sums := make([]int64, len(conns))
+    errs := make([]error, len(conns))
+    var wg sync.WaitGroup
+    for i := range conns {
+        wg.Add(1)
+        go func(i int) {
+            defer wg.Done()
+            stmt, err := prepared(conns[i], "node_sum", workload.(Balanced).TotalQuery())
+            if err == nil {
+                err = conns[i].QueryRow(stmt).Scan(&sums[i])
+            }
+            errs[i] = err
+        }(i)
+    }
+    wg.Wait()
+    for _, err := range errs {
+        if err != nil {
+            return nil, err
+        }
+    }
+    return sums, nil
+}
+
+func same_sums(a []int64, b []int64) bool {
+    for i := range a {
+        if a[i] != b[i] {
+            return false
+        }
+    }
+    return true
+}
+
+// Check the invariant on every read until the workers are done
+func verifier(id int, wg *sync.WaitGroup) {
+    defer wg.Done()
+
+    conns := connect_all()
+    defer close_all(conns)
+
+    expected := expected_total()
+    wrong := func(sums []int64) bool {
+        return sum_of(sums) != expected
+    }
+    for running {
+        reads, snapshot, err := snapshot_sums(conns, wrong)
+        if err != nil {
+            if classify(err) == errFatal {
+                handle_fatal(err, conns)
+            }
+            continue
+        }
+
+        sums := reads[0]
+        atomic.AddInt64(&nChecks, 1)
+        if sum := sum_of(sums); sum != expected {
+            atomic.AddInt64(&nViolations, 1)
+            stable := true
+            for _, again := range reads[1:] {
+                stable = stable && same_sums(again, sums)
+            }
+            kind := "same on every read, snapshot is not global"
+            if stable {
+                atomic.AddInt64(&nStableViolations, 1)
+            } else {
+                atomic.AddInt64(&nUnstableReads, 1)
+                kind = "changing within the snapshot"
+            }
+            why := fmt.Sprintf("violation: total=%d expected=%d snapshot=%d node sums=%v, %s: %v",
+                sum, expected, snapshot, sums, kind, reads[1:])
+            fmt.Printf("[verifier %d] %s\n", id, why)
+            capture_diagnostics("violation", why)
+        }
+    }
+}
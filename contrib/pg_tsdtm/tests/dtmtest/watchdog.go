@@ -0,0 +1,95 @@
+package dtmtest
+
+import (
+    "fmt"
+    "strings"
+    "sync"
+    "sync/atomic"
+    "time"
+    "github.com/jackc/pgx"
+)
+
+// Transactions which did not finish within -tx-timeout
+var nStuck int64
+
+type watchdog struct {
+    sync.Mutex
+    timer *time.Timer
+    done bool
+}
+
+// Start watching one attempt of the transaction over conns. When it takes
+// longer than -tx-timeout, the state of every node is dumped and backends
+// of the transaction are cancelled, so that the worker rolls it back.
+// The returned function stops watching.
+func watch(gtid string, conns []*pgx.Conn) func() {
+    if cfg.TxTimeout <= 0 {
+        return func() {}
+    }
+
+    // connections may be replaced by reconnect() meanwhile
+    pids := make([]int32, len(conns))
+    for i, conn := range conns {
+        pids[i] = conn.Pid
+    }
+    wd := &watchdog{}
+    wd.timer = time.AfterFunc(cfg.TxTimeout, func() { wd.fire(gtid, pids) })
+    return func() {
+        wd.Lock()
+        wd.done = true
+        wd.timer.Stop()
+        wd.Unlock()
+    }
+}
+
+func (wd *watchdog) fire(gtid string, pids []int32) {
+    atomic.AddInt64(&nStuck, 1)
+    why := fmt.Sprintf("transaction '%s' is stuck for %v, backends %v", gtid, cfg.TxTimeout, pids)
+    fmt.Printf("[watchdog] %s\n", why)
+    capture_diagnostics("stuck", why)
+
+    for i := range nodes {
+        conn, err := pgx.Connect(nodes[i])
+        if err != nil {
+            fmt.Printf("[watchdog] node %d is unreachable: %v\n", i, err)
+            continue
+        }
+        dump(conn, i, "activity",
+            "select pid, state, (now() - xact_start)::text, query from pg_stat_activity " +
+            "where datname = current_database() and pid <> pg_backend_pid()")
+        dump(conn, i, "locks",
+            "select pid, locktype, mode, granted, relation::regclass::text, transactionid::text, virtualxid " +
+            "from pg_locks where pid <> pg_backend_pid()")
+
+        wd.Lock()
+        if !wd.done {
+            if _, err = conn.Exec("select pg_cancel_backend($1)", pids[i]); err != nil {
+                fmt.Printf("[watchdog] failed to cancel backend %d on node %d: %v\n", pids[i], i, err)
+            }
+        }
+        wd.Unlock()
+        conn.Close()
+    }
+}
+
+// Print result of the query, every column as text
+func dump(conn *pgx.Conn, node int, what string, query string) {
+    rows, err := conn.Query(query)
+    if err != nil {
+        fmt.Printf("[watchdog] node %d %s: %v\n", node, what, err)
+        return
+    }
+    defer rows.Close()
+    for rows.Next() {
+        values, err := rows.Values()
+        if err != nil {
+            fmt.Printf("[watchdog] node %d %s: %v\n", node, what, err)
+            return
+        }
+        columns := make([]string, len(values))
+        for i, v := range values {
+            columns[i] = fmt.Sprint(v)
+        }
+        fmt.Printf("[watchdog] node %d %s: %s\n", node, what, strings.Join(columns, " | "))
+    }
+}
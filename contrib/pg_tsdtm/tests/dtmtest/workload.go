@@ -0,0 +1,306 @@
+package dtmtest
+
+import (
+    "fmt"
+    "math/rand"
+    "os"
+    "sort"
+    "strconv"
+    "sync"
+    "sync/atomic"
+    "time"
+    "github.com/jackc/pgx"
+    "github.com/digoal/postgres_cluster/contrib/pg_tsdtm/tests/dtmclient"
+)
+
+// Kind of global transactions performed by the workers, see -workload.
+// Every workload lives in its own file and registers itself in init().
+type Workload interface {
+    // Create schema and initial data on all nodes
+    Setup(conns []*pgx.Conn)
+    // Perform one global transaction, normally through w.Transaction()
+    Iteration(w *Worker) error
+    // Check the database after the workers are done, returns the number
+    // of anomalies found
+    Verify(conns []*pgx.Conn) int
+    // Drop whatever Setup has created, see -teardown
+    Teardown(conns []*pgx.Conn)
+}
+
+// Workloads keeping the total amount of money constant. Only they are
+// watched by totalrep, verifiers and the chaos convergence check.
+type Balanced interface {
+    ExpectedTotal() int64
+    // Query returning the amount of money on a node
+    TotalQuery() string
+}
+
+// Workloads which can run on the data set up by another process, see the
+// init command and -no-setup. Attach prepares whatever Setup keeps in
+// memory besides the data.
+type Reusable interface {
+    Attach(conns []*pgx.Conn)
+}
+
+// Every workload starts with fresh pg_dtm on all nodes
+func create_extension(conns []*pgx.Conn) {
+    for _, conn := range conns {
+        exec(conn, "drop extension if exists pg_dtm")
+        exec(conn, "create extension pg_dtm")
+    }
+    check_capabilities(conns)
+}
+
+var workloads = make(map[string]func() Workload)
+
+var workload Workload
+
+func register_workload(name string, create func() Workload) {
+    workloads[name] = create
+}
+
+func workload_names() []string {
+    var names []string
+    for name := range workloads {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+    return names
+}
+
+// The workload of the Runner or the one of -workload
+func choose_workload() Workload {
+    if customWorkload != nil {
+        return customWorkload
+    }
+    return select_workload(cfg.Workload)
+}
+
+// Use the data and pg_dtm left by the init command instead of Setup
+func attach_workload(conns []*pgx.Conn) {
+    reusable, ok := workload.(Reusable)
+    if !ok {
+        panic(fmt.Sprintf("workload '%s' can not run on the data of another process", cfg.Workload))
+    }
+    check_capabilities(conns)
+    reusable.Attach(conns)
+}
+
+func select_workload(name string) Workload {
+    create, ok := workloads[name]
+    if !ok {
+        fmt.Printf("ERROR: unknown workload '%s', available: %v\n", name, workload_names())
+        os.Exit(1)
+    }
+    return create()
+}
+
+// Global transaction over the connections, or with -no-dtm just local
+// transactions on the same participants, see also -backend. Isolation is one of the names
+// of -isolation.
+func begin_global(conns []*pgx.Conn, gid string, isolation string) (*dtmclient.GlobalTx, error) {
+    var tx *dtmclient.GlobalTx
+    var err error
+    if cfg.Backend == "2pc" {
+        p := dtmclient.TwoPhase
+        if cfg.ConcurrentAccess {
+            p = dtmclient.Concurrent(p)
+        }
+        tx, err = dtmclient.BeginWith(p, conns, gid, isolationNames[isolation])
+    } else if cfg.NoDTM {
+        tx, err = dtmclient.BeginLocalIsolated(conns, gid, isolationNames[isolation])
+    } else {
+        tx, err = dtmclient.BeginWith(protocol(), conns, gid, isolationNames[isolation])
+        if err == nil && cfg.CrashInterval > 0 {
+            tx.Hook = crash_hook(tx)
+        }
+    }
+    if err == nil {
+        log_transaction(tx)
+    }
+    if err == nil && cfg.JournalPath != "" && gid != "" {
+        if err = journal_intent(tx); err != nil {
+            tx.Rollback()
+            return nil, err
+        }
+    }
+    if err == nil && cfg.SessionChecks {
+        if err = session_begin(tx, gid); err != nil {
+            tx.Rollback()
+            return nil, err
+        }
+    }
+    return tx, err
+}
+
+// Protocol of -protocol, -pipeline and -concurrent-access
+func protocol() dtmclient.Protocol {
+    if cfg.Pipeline {
+        return dtmclient.PipelinedCSN
+    }
+    if cfg.ConcurrentAccess {
+        return dtmclient.Concurrent(dtmclient.Protocols[cfg.Protocol])
+    }
+    return dtmclient.Protocols[cfg.Protocol]
+}
+
+// State of a worker passed to the workload on every iteration
+type Worker struct {
+    Id int
+    Iteration int
+    Conns []*pgx.Conn
+    Rand *rand.Rand
+    Keys KeyChooser
+    Isolation string    // level of the current transaction, see -isolation
+    dtmTime time.Duration  // in pg_dtm calls during the iteration, see -dtm-profile
+    session *Session       // see -session-checks
+}
+
+// Transaction runs fn until it succeeds or fails with non-retryable error.
+// Every attempt gets its own gtid as aborted attempt may still be known to
+// DTM under its gtid.
+func (w *Worker) Transaction(fn func(gtid string) (*dtmclient.GlobalTx, error)) error {
+    base := strconv.Itoa(w.Id) + "." + strconv.Itoa(w.Iteration)
+    w.Isolation = choose_isolation(w.Rand)
+    return with_retries(func(attempt int) error {
+        gtid := base
+        if attempt > 0 {
+            gtid += "." + strconv.Itoa(attempt)
+        }
+        atomic.AddInt64(&nInFlight, 1)
+        attemptStart := time.Now()
+        disarm := watch(gtid, w.Conns)
+        forget := register_backends(gtid, w.Conns)
+        detach := attach_session(w.session, w.Conns)
+        tx, err := fn(gtid)
+        detach()
+        forget()
+        disarm()
+        if cfg.DeadlockDetect != "" && deadlock_victim(gtid) && err != nil {
+            err = errGlobalDeadlock
+        }
+        if err != nil {
+            record_timeout(err)
+        }
+        if cfg.CrashInterval > 0 {
+            crash_finished(tx)
+        }
+        if cfg.JournalPath != "" && tx != nil {
+            journal_outcome(tx, err)
+        }
+        if cfg.Arbiters != "" {
+            outage.Decided(tx, err)
+        }
+        session_outcome(w.session, tx, err)
+        atomic.AddInt64(&nInFlight, -1)
+        record_attempt(w.Id, err)
+        if is_deadlock(err) {
+            stats.RecordDeadlock(time.Since(attemptStart))
+        }
+        if err != errRolledBack {
+            stats.RecordIsolation(w.Isolation, classify(err))
+        }
+        if err != nil && err != errRolledBack && tx != nil && tx.Failed >= 0 {
+            log_failed_step(tx, err)
+        }
+        if tx != nil {
+            stats.RecordSnapshot(tx.SnapshotTime)
+            stats.RecordPhases(tx.Spans)
+            if cfg.DtmProfile {
+                w.dtmTime += dtm_time(tx.Spans)
+            }
+            if tracer != nil {
+                tracer.Write(tx, err)
+            }
+        }
+        return err
+    })
+}
+
+// Beginning of the run, in -duration mode all workers stop at
+// runStart + cfg.Warmup + cfg.Duration
+var runStart time.Time
+
+// Commits done until the first worker finished: the throughput measured up
+// to this moment is the steady-state one, with all workers busy
+var steady struct {
+    sync.Once
+    commits int64
+    elapsed time.Duration
+}
+
+func worker(id int, wg *sync.WaitGroup) {
+    nGlobalTrans := 0
+
+    conns := connect_all()
+    defer close_all(conns)
+
+    w := &Worker{
+        Id: id,
+        Conns: conns,
+        Rand: new_rand("worker", id),
+        Keys: worker_keys(new_rand("keys", id), id),
+    }
+    if cfg.SessionChecks {
+        w.session = new_session(id, conns)
+    }
+
+    for i := first_iteration(id); cfg.RampStep > 0 || cfg.Duration > 0 || i < cfg.Iterations; i++ {
+        if i > 0 && !think(cfg.ThinkTime) {
+            break
+        }
+        if !wait_resumed() {
+            break
+        }
+        var slot time.Time
+        if cfg.Rate > 0 {
+            var ok bool
+            if slot, ok = wait_slot(); !ok {
+                break
+            }
+        }
+        if interrupted() || cfg.RampStep > 0 && !ramp_keeps(id) {
+            break
+        }
+        if cfg.RampStep == 0 && cfg.Duration > 0 && time.Since(runStart) > cfg.Warmup + cfg.Duration {
+            break
+        }
+        w.Iteration = i
+        started_iteration(id, i)
+        w.dtmTime = 0
+
+        txStart := time.Now()
+        if cfg.Rate > 0 {
+            txStart = slot
+        }
+        err := workload.Iteration(w)
+        if err == errRolledBack {
+            atomic.AddInt64(&nRollbacks, 1)
+            continue
+        }
+        if err != nil {
+            atomic.AddInt64(&nAborts, 1)
+            outage.Error()
+            if classify(err) == errFatal {
+                handle_fatal(err, conns)
+            }
+            continue
+        }
+        outage.Commit()
+        latency := time.Since(txStart)
+        stats.Record(latency)
+        if cfg.DtmProfile {
+            stats.RecordDtm(w.dtmTime, latency)
+        }
+        stats.RecordGc(latency, gc_paused_since(txStart))
+        nGlobalTrans++
+    }
+
+    steady.Do(func() {
+        total := stats.Total()
+        steady.commits = total.Count()
+        steady.elapsed = time.Since(stats.Start())
+    })
+    fmt.Printf("Test completed, performed %d global transactions\n", nGlobalTrans)
+    wg.Done()
+}
@@ -0,0 +1,127 @@
+package dtmtest
+
+import (
+    "fmt"
+    "sync"
+    "sync/atomic"
+    "time"
+    "github.com/jackc/pgx"
+)
+
+// XID burners, see -xid-burners: connections to every node consuming xids
+// as fast as they can while the workload runs, so that the cluster gets
+// close to wraparound and autovacuum has to freeze under DTM. Every
+// statement aborts -xid-burn-batch subtransactions, each with an xid of
+// its own, leaving nothing behind. To actually reach the wraparound limits
+// in a reasonable time start the nodes with xids moved forward by
+// 'pg_resetwal -x'.
+//
+// Every xidReportInterval the age of datfrozenxid and the autovacuum
+// workers of every node are reported.
+const xidReportInterval = 10 * time.Second
+
+var nXidsBurned int64
+
+func burn_xids(node int, stop chan struct{}, wg *sync.WaitGroup) {
+    defer wg.Done()
+
+    conn, err := pgx.Connect(nodes[node])
+    if err != nil {
+        fmt.Printf("[xids] node %d is unreachable: %v\n", node, err)
+        return
+    }
+    defer conn.Close()
+
+    burn := fmt.Sprintf("do $$ begin for i in 1..%d loop " +
+        "begin insert into xid_burner values (i); raise exception 'burn'; " +
+        "exception when others then null; end; end loop; end $$", cfg.XidBurnBatch)
+    for {
+        select {
+        case <-stop:
+            return
+        default:
+        }
+        if _, err := conn.Exec(burn); err != nil {
+            fmt.Printf("[xids] burning on node %d failed: %v\n", node, err)
+            if !conn.IsAlive() {
+                return
+            }
+            time.Sleep(time.Second)
+            continue
+        }
+        atomic.AddInt64(&nXidsBurned, int64(cfg.XidBurnBatch))
+    }
+}
+
+// Largest age of datfrozenxid seen on every node
+var xidAges struct {
+    sync.Mutex
+    max []int64
+}
+
+func report_xids(stop chan struct{}, wg *sync.WaitGroup) {
+    defer wg.Done()
+
+    conns, err := connect_direct()
+    if err != nil {
+        fmt.Printf("[xids] can not watch the nodes: %v\n", err)
+        return
+    }
+    defer close_direct(conns)
+
+    ticker := time.NewTicker(xidReportInterval)
+    defer ticker.Stop()
+    for {
+        select {
+        case <-stop:
+            return
+        case <-ticker.C:
+        }
+        for i, conn := range conns {
+            var xid, age, workers, wraparound int64
+            err := conn.QueryRow(
+                "select txid_current(), " +
+                "(select age(datfrozenxid) from pg_database where datname = current_database()), " +
+                "(select count(*) from pg_stat_activity where query like 'autovacuum:%'), " +
+                "(select count(*) from pg_stat_activity where query like 'autovacuum:%to prevent wraparound%')").
+                Scan(&xid, &age, &workers, &wraparound)
+            if err != nil {
+                fmt.Printf("[xids] node %d: %v\n", i, err)
+                continue
+            }
+            xidAges.Lock()
+            if age > xidAges.max[i] {
+                xidAges.max[i] = age
+            }
+            xidAges.Unlock()
+            fmt.Printf("[xids] node %d: xid=%d datfrozenxid age=%d autovacuum workers=%d (%d to prevent wraparound)\n",
+                i, xid, age, workers, wraparound)
+        }
+    }
+}
+
+// Start burners and the reporter, the table used by burners is created on
+// every node
+func start_burners(stop chan struct{}, wg *sync.WaitGroup) {
+    conns := connect_all()
+    for _, conn := range conns {
+        exec(conn, "create table if not exists xid_burner(i int)")
+    }
+    close_all(conns)
+
+    xidAges.max = make([]int64, len(nodes))
+    for node := range nodes {
+        for i := 0; i < cfg.XidBurners; i++ {
+            wg.Add(1)
+            go burn_xids(node, stop, wg)
+        }
+    }
+    wg.Add(1)
+    go report_xids(stop, wg)
+}
+
+func max_xid_ages() []int64 {
+    xidAges.Lock()
+    defer xidAges.Unlock()
+    return append([]int64(nil), xidAges.max...)
+}
@@ -0,0 +1,370 @@
+package dtmtest
+
+import (
+    "fmt"
+    "math/rand"
+    "sort"
+    "strings"
+    "sync"
+    "sync/atomic"
+    "time"
+    "github.com/jackc/pgx"
+    "github.com/digoal/postgres_cluster/contrib/pg_tsdtm/tests/dtmclient"
+)
+
+// Key-value operations of YCSB on usertable: -accounts records per node,
+// every one with ycsbFields fields of ycsbFieldLength characters, key k on
+// the shard of k as in -sharded. The mix is one of the core workloads A-F
+// of YCSB, see -ycsb-mix, keys are chosen by -distribution. Reads, updates,
+// read-modify-writes and inserts take -ycsb-keys keys at once, so they are
+// global transactions when the keys are on different nodes, reads and
+// scans read-only ones under the global snapshot. Mix D reads the latest
+// records, offsets from the newest one are what -distribution chooses.
+// Records of the initial load are never deleted: a read or scan missing
+// any of them is an anomaly.
+type YcsbWorkload struct {
+    mu sync.Mutex
+    keys map[int]KeyChooser  // of every worker over the records
+}
+
+const (
+    ycsbFields = 10
+    ycsbFieldLength = 100
+    ycsbMaxScan = 100
+)
+
+// Percents of the operations in a mix
+type ycsbMix struct {
+    read, update, rmw, scan, insert int
+}
+
+var ycsbMixes = map[string]ycsbMix{
+    "a": {read: 50, update: 50},
+    "b": {read: 95, update: 5},
+    "c": {read: 100},
+    "d": {read: 95, insert: 5},
+    "e": {scan: 95, insert: 5},
+    "f": {read: 50, rmw: 50},
+}
+
+// Next key to insert and the inserts committed
+var ycsbNext int64
+var nYcsbInserts int64
+
+// Records of the load found missing by reads and scans
+var nYcsbMissing int64
+
+func init() {
+    register_workload("ycsb", func() Workload { return new(YcsbWorkload) })
+}
+
+func ycsb_records() int {
+    return cfg.Accounts * len(nodes)
+}
+
+func ycsb_columns() string {
+    var fields []string
+    for i := 0; i < ycsbFields; i++ {
+        fields = append(fields, fmt.Sprintf("field%d", i))
+    }
+    return strings.Join(fields, ", ")
+}
+
+func (y *YcsbWorkload) Setup(conns []*pgx.Conn) {
+    create_extension(conns)
+    y.Teardown(conns)
+    var fields, values []string
+    for i := 0; i < ycsbFields; i++ {
+        fields = append(fields, fmt.Sprintf("field%d varchar(%d)", i, ycsbFieldLength))
+        values = append(values, fmt.Sprintf("substr(repeat(md5(k::text || '%d'), 4), 1, %d)", i, ycsbFieldLength))
+    }
+    for i, conn := range conns {
+        exec(conn, "create table usertable(ycsb_key bigint, " + strings.Join(fields, ", ") + ")")
+        exec(conn, "insert into usertable select k, " + strings.Join(values, ", ") +
+            " from generate_series(0, $1 - 1) k where " + column_shard_predicate("k", i), ycsb_records())
+        exec(conn, "alter table usertable add primary key (ycsb_key)")
+        exec(conn, "analyze usertable")
+    }
+    y.Attach(conns)
+}
+
+// Inserts go on after the greatest key
+func (y *YcsbWorkload) Attach(conns []*pgx.Conn) {
+    y.keys = make(map[int]KeyChooser)
+    next, rows := int64(ycsb_records()), int64(0)
+    for _, conn := range conns {
+        if max := execQuery(conn, "select coalesce(max(ycsb_key), -1) + 1 from usertable"); max > next {
+            next = max
+        }
+        rows += execQuery(conn, "select count(*) from usertable")
+    }
+    atomic.StoreInt64(&ycsbNext, next)
+    atomic.StoreInt64(&nYcsbInserts, rows - int64(ycsb_records()))
+    atomic.StoreInt64(&nYcsbMissing, 0)
+}
+
+func (y *YcsbWorkload) chooser(w *Worker) KeyChooser {
+    y.mu.Lock()
+    defer y.mu.Unlock()
+    keys := y.keys[w.Id]
+    if keys == nil {
+        keys = new_key_chooser(w.Rand, ycsb_records())
+        y.keys[w.Id] = keys
+    }
+    return keys
+}
+
+// Distinct keys of the records in their order, the latest ones in mix D
+func (y *YcsbWorkload) pick_keys(w *Worker, n int) []int64 {
+    keys := y.chooser(w)
+    picked := make(map[int64]bool)
+    var result []int64
+    for len(result) < n {
+        key := int64(keys.Next())
+        if cfg.YcsbMix == "d" {
+            last := int64(ycsb_records()) + atomic.LoadInt64(&nYcsbInserts)
+            key = last - 1 - key % last
+        }
+        if !picked[key] {
+            picked[key] = true
+            result = append(result, key)
+        }
+    }
+    sort.Slice(result, func(i, j int) bool { return result[i] < result[j] })
+    return result
+}
+
+// Nodes of the keys in their order and the participant of every key
+func ycsb_order(keys []int64) (order []int, participants []int) {
+    index := make(map[int]int)
+    for _, key := range keys {
+        node := shard_of(int(key))
+        if _, ok := index[node]; !ok {
+            index[node] = len(order)
+            order = append(order, node)
+        }
+        participants = append(participants, index[node])
+    }
+    return order, participants
+}
+
+func random_field(r *rand.Rand) string {
+    const letters = "abcdefghijklmnopqrstuvwxyz0123456789"
+    b := make([]byte, ycsbFieldLength)
+    for i := range b {
+        b[i] = letters[r.Intn(len(letters))]
+    }
+    return string(b)
+}
+
+func (y *YcsbWorkload) Iteration(w *Worker) error {
+    mix := ycsbMixes[cfg.YcsbMix]
+    start := time.Now()
+    var op string
+    var err error
+    switch p := w.Rand.Intn(100); {
+    case p < mix.read:
+        op, err = "read", y.read(w, y.pick_keys(w, cfg.YcsbKeys))
+    case p < mix.read + mix.update:
+        op, err = "update", y.write(w, y.pick_keys(w, cfg.YcsbKeys), false)
+    case p < mix.read + mix.update + mix.rmw:
+        op, err = "read-modify-write", y.write(w, y.pick_keys(w, cfg.YcsbKeys), true)
+    case p < mix.read + mix.update + mix.rmw + mix.scan:
+        op, err = "scan", y.scan(w)
+    default:
+        op, err = "insert", y.insert(w)
+    }
+    if err == nil {
+        stats.RecordOperation(op, time.Since(start))
+    }
+    return err
+}
+
+// Missing records of the load are anomalies, inserted ones may be in flight
+func missing(key int64) {
+    if key < int64(ycsb_records()) {
+        fmt.Printf("[ycsb] record %d is missing\n", key)
+        atomic.AddInt64(&nYcsbMissing, 1)
+    }
+}
+
+func (y *YcsbWorkload) read(w *Worker, keys []int64) error {
+    order, participants := ycsb_order(keys)
+    return run_global(w, order, true, func(tx *dtmclient.GlobalTx) error {
+        fields := make([]interface{}, ycsbFields)
+        for i := range fields {
+            fields[i] = new(string)
+        }
+        for i, key := range keys {
+            err := tx.QueryRow(participants[i], "select " + ycsb_columns() + " from usertable where ycsb_key = $1",
+                key).Scan(fields...)
+            if err == pgx.ErrNoRows {
+                missing(key)
+                continue
+            }
+            if err != nil {
+                return err
+            }
+        }
+        return nil
+    })
+}
+
+// Update a random field of every record, after reading it with rmw
+func (y *YcsbWorkload) write(w *Worker, keys []int64, rmw bool) error {
+    field := fmt.Sprintf("field%d", w.Rand.Intn(ycsbFields))
+    var values []string
+    for range keys {
+        values = append(values, random_field(w.Rand))
+    }
+    order, participants := ycsb_order(keys)
+    return run_global(w, order, false, func(tx *dtmclient.GlobalTx) error {
+        for i, key := range keys {
+            if rmw {
+                var value string
+                err := tx.QueryRow(participants[i], "select " + field + " from usertable where ycsb_key = $1",
+                    key).Scan(&value)
+                if err == pgx.ErrNoRows {
+                    missing(key)
+                    continue
+                }
+                if err != nil {
+                    return err
+                }
+            }
+            if _, err := tx.Exec(participants[i], "update usertable set " + field + " = $1 where ycsb_key = $2",
+                values[i], key); err != nil {
+                return err
+            }
+        }
+        return nil
+    })
+}
+
+// Records of a range of keys, spread over all nodes by their shards
+func (y *YcsbWorkload) scan(w *Worker) error {
+    first := int64(y.chooser(w).Next())
+    last := first + int64(w.Rand.Intn(ycsbMaxScan))
+    loaded := last
+    if loaded >= int64(ycsb_records()) {
+        loaded = int64(ycsb_records()) - 1
+    }
+    order := make([]int, len(nodes))
+    for i := range order {
+        order[i] = (shard_of(int(first)) + i) % len(nodes)
+    }
+    return run_global(w, order, true, func(tx *dtmclient.GlobalTx) error {
+        var found int64
+        for i := range order {
+            rows, err := tx.Query(i, "select ycsb_key, " + ycsb_columns() + " from usertable " +
+                "where ycsb_key between $1 and $2 order by ycsb_key", first, last)
+            if err != nil {
+                return err
+            }
+            for rows.Next() {
+                var key int64
+                if key, err = scan_record(rows); err != nil {
+                    rows.Close()
+                    return err
+                }
+                if key <= loaded {
+                    found++
+                }
+            }
+            rows.Close()
+            if err = rows.Err(); err != nil {
+                return err
+            }
+        }
+        if found != loaded - first + 1 {
+            fmt.Printf("[ycsb] snapshot %d: %d of records %d..%d found\n", tx.Snapshot, found, first, loaded)
+            atomic.AddInt64(&nYcsbMissing, 1)
+        }
+        return nil
+    })
+}
+
+func scan_record(rows *pgx.Rows) (int64, error) {
+    var key int64
+    values := []interface{}{&key}
+    for i := 0; i < ycsbFields; i++ {
+        values = append(values, new(string))
+    }
+    err := rows.Scan(values...)
+    return key, err
+}
+
+// New records after the greatest key, which the failed inserts skip
+func (y *YcsbWorkload) insert(w *Worker) error {
+    n := int64(cfg.YcsbKeys)
+    first := atomic.AddInt64(&ycsbNext, n) - n
+    var keys []int64
+    for key := first; key < first + n; key++ {
+        keys = append(keys, key)
+    }
+    placeholders := make([]string, ycsbFields)
+    for i := range placeholders {
+        placeholders[i] = fmt.Sprintf("$%d", i + 2)
+    }
+    order, participants := ycsb_order(keys)
+    err := run_global(w, order, false, func(tx *dtmclient.GlobalTx) error {
+        for i, key := range keys {
+            args := []interface{}{key}
+            for f := 0; f < ycsbFields; f++ {
+                args = append(args, random_field(w.Rand))
+            }
+            if _, err := tx.Exec(participants[i], "insert into usertable values ($1, " +
+                strings.Join(placeholders, ", ") + ")", args...); err != nil {
+                return err
+            }
+        }
+        return nil
+    })
+    if err == nil {
+        atomic.AddInt64(&nYcsbInserts, n)
+    }
+    return err
+}
+
+func (y *YcsbWorkload) Verify(conns []*pgx.Conn) int {
+    anomalies := int(atomic.LoadInt64(&nYcsbMissing))
+    loaded, inserted := int64(0), int64(0)
+    for i, conn := range conns {
+        if strays := execQuery(conn, "select count(*) from usertable where not (" +
+            column_shard_predicate("ycsb_key", i) + ")"); strays != 0 {
+            fmt.Printf("[ycsb] node %d holds %d records of other shards\n", i, strays)
+            anomalies++
+        }
+        loaded += execQuery(conn, "select count(*) from usertable where ycsb_key < $1", ycsb_records())
+        inserted += execQuery(conn, "select count(*) from usertable where ycsb_key >= $1", ycsb_records())
+    }
+    if loaded != int64(ycsb_records()) {
+        fmt.Printf("[ycsb] %d of %d records of the load are there\n", loaded, ycsb_records())
+        anomalies++
+    }
+    // in-doubt inserts may have committed since
+    if committed := atomic.LoadInt64(&nYcsbInserts); inserted < committed {
+        fmt.Printf("[ycsb] %d records inserted, %d inserts committed\n", inserted, committed)
+        anomalies++
+    }
+    return anomalies
+}
+
+func (y *YcsbWorkload) Teardown(conns []*pgx.Conn) {
+    for _, conn := range conns {
+        exec(conn, "drop table if exists usertable")
+    }
+}
+
+func print_ycsb(r Report) {
+    var ops []string
+    for op := range r.YcsbOperations {
+        ops = append(ops, op)
+    }
+    sort.Strings(ops)
+    for _, op := range ops {
+        l := r.YcsbOperations[op]
+        fmt.Printf("YCSB %s: %d operations, %0.2f ops/sec, latency p50=%0.3fms p95=%0.3fms p99=%0.3fms\n",
+            op, r.YcsbCounts[op], float64(r.YcsbCounts[op]) / r.Elapsed, l.P50, l.P95, l.P99)
+    }
+}
@@ -0,0 +1,17 @@
+#!/bin/sh
+# Entry point of a node: fresh data directory every time the container is
+# created, settings pg_dtm needs, then postgres in foreground
+set -e
+
+if [ ! -f /data/PG_VERSION ]; then
+    initdb -D /data -A trust
+    cat >> /data/postgresql.conf <<CONF
+listen_addresses = '*'
+shared_preload_libraries = 'pg_dtm'
+max_prepared_transactions = 1000
+max_connections = 500
+fsync = off
+CONF
+    echo "host all all 0.0.0.0/0 trust" >> /data/pg_hba.conf
+fi
+exec postgres -D /data "$@"
@@ -0,0 +1,14 @@
+-- pgbench-like transfer between accounts of two nodes, run with
+--  transfers -workload script -script example.sql
+-- on table t created by the 'transfers' workload
+\set src random(0, :nodes - 1)
+\set dst (:src + random(1, :nodes - 1)) % :nodes
+\set from random(0, :accounts - 1)
+\set to random(0, :accounts - 1)
+\set delta random(1, 100)
+begin;
+\node :src
+update t set v = v - :delta where u = :from;
+\node :dst
+update t set v = v + :delta where u = :to;
+end;
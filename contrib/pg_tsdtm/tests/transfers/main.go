@@ -0,0 +1,12 @@
+// Command transfers moves money between accounts on several nodes in
+// global transactions and checks that the total never changes, see the
+// dtmtest package for the workloads, checks and faults it can run
+package main
+
+import (
+    "github.com/digoal/postgres_cluster/contrib/pg_tsdtm/tests/dtmtest"
+)
+
+func main() {
+    dtmtest.Main()
+}